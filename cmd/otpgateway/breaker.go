@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/knadh/otpgateway/v3/internal/store"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breakerStore wraps a store.Store with a circuit breaker. After maxFailures
+// consecutive failures, the circuit opens and all operations fail fast with
+// store.ErrUnavailable for the cooldown duration. After that, a single
+// operation is let through as a probe. If it succeeds, the circuit closes,
+// and if it fails, the circuit opens again.
+type breakerStore struct {
+	store       store.Store
+	maxFailures int
+	cooldown    time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreakerStore(s store.Store, maxFailures int, cooldown time.Duration) *breakerStore {
+	return &breakerStore{store: s, maxFailures: maxFailures, cooldown: cooldown}
+}
+
+// State returns the current state of the circuit.
+func (b *breakerStore) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow returns store.ErrUnavailable if an operation should not be attempted.
+func (b *breakerStore) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return store.ErrUnavailable
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+	case breakerHalfOpen:
+		// Only one probe at a time.
+		if b.probing {
+			return store.ErrUnavailable
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+// record records the result of an operation and opens or closes the circuit.
+func (b *breakerStore) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !isStoreFailure(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.maxFailures {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *breakerStore) call(fn func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := fn()
+	b.record(err)
+	return err
+}
+
+// isStoreFailure checks whether an error returned by the store indicates
+// that it's unhealthy (as opposed to, for instance, an OTP not existing).
+func isStoreFailure(err error) bool {
+	switch err {
+	case nil, store.ErrNotExist, store.ErrMismatch, store.ErrLocked, store.ErrThrottled, store.ErrAlreadyVerified, store.ErrRefExists, store.ErrSendClaimed, store.ErrQuotaExceeded:
+		return false
+	}
+
+	// The request was cancelled by the client.
+	return !errors.Is(err, context.Canceled)
+}
+
+func (b *breakerStore) Set(ctx context.Context, namespace, id string, otp models.OTP) (models.OTP, error) {
+	var out models.OTP
+	err := b.call(func() (err error) {
+		out, err = b.store.Set(ctx, namespace, id, otp)
+		return err
+	})
+	return out, err
+}
+
+func (b *breakerStore) SetBatch(ctx context.Context, namespace string, otps []models.OTP) ([]models.OTP, error) {
+	var out []models.OTP
+	err := b.call(func() (err error) {
+		out, err = b.store.SetBatch(ctx, namespace, otps)
+		return err
+	})
+	return out, err
+}
+
+func (b *breakerStore) SetAddress(ctx context.Context, namespace, id, address string) error {
+	return b.call(func() error {
+		return b.store.SetAddress(ctx, namespace, id, address)
+	})
+}
+
+func (b *breakerStore) Check(ctx context.Context, namespace, id string, counterKey string) (models.OTP, error) {
+	var out models.OTP
+	err := b.call(func() (err error) {
+		out, err = b.store.Check(ctx, namespace, id, counterKey)
+		return err
+	})
+	return out, err
+}
+
+func (b *breakerStore) Peek(ctx context.Context, namespace, id string) (models.OTP, error) {
+	var out models.OTP
+	err := b.call(func() (err error) {
+		out, err = b.store.Peek(ctx, namespace, id)
+		return err
+	})
+	return out, err
+}
+
+func (b *breakerStore) Verify(ctx context.Context, namespace, id, otp string, lastSet int64, minInterval, grace time.Duration) (models.OTP, error) {
+	var out models.OTP
+	err := b.call(func() (err error) {
+		out, err = b.store.Verify(ctx, namespace, id, otp, lastSet, minInterval, grace)
+		return err
+	})
+	return out, err
+}
+
+func (b *breakerStore) SetNonce(ctx context.Context, namespace, id, nonce string) error {
+	return b.call(func() error {
+		return b.store.SetNonce(ctx, namespace, id, nonce)
+	})
+}
+
+func (b *breakerStore) ConsumeNonce(ctx context.Context, namespace, id, nonce string) error {
+	return b.call(func() error {
+		return b.store.ConsumeNonce(ctx, namespace, id, nonce)
+	})
+}
+
+func (b *breakerStore) SetDelivered(ctx context.Context, namespace, id string) error {
+	return b.call(func() error {
+		return b.store.SetDelivered(ctx, namespace, id)
+	})
+}
+
+func (b *breakerStore) SetSent(ctx context.Context, namespace, id string) error {
+	return b.call(func() error {
+		return b.store.SetSent(ctx, namespace, id)
+	})
+}
+
+func (b *breakerStore) ClaimSend(ctx context.Context, namespace, id, key string, ttl time.Duration) error {
+	return b.call(func() error {
+		return b.store.ClaimSend(ctx, namespace, id, key, ttl)
+	})
+}
+
+func (b *breakerStore) ReleaseSend(ctx context.Context, namespace, id, key string) error {
+	return b.call(func() error {
+		return b.store.ReleaseSend(ctx, namespace, id, key)
+	})
+}
+
+func (b *breakerStore) Touch(ctx context.Context, namespace, id string, extend time.Duration) error {
+	return b.call(func() error {
+		return b.store.Touch(ctx, namespace, id, extend)
+	})
+}
+
+func (b *breakerStore) ResetAttempts(ctx context.Context, namespace, id string) error {
+	return b.call(func() error {
+		return b.store.ResetAttempts(ctx, namespace, id)
+	})
+}
+
+func (b *breakerStore) Close(ctx context.Context, namespace, id string) error {
+	return b.call(func() error {
+		return b.store.Close(ctx, namespace, id)
+	})
+}
+
+func (b *breakerStore) Delete(ctx context.Context, namespace, id string) error {
+	return b.call(func() error {
+		return b.store.Delete(ctx, namespace, id)
+	})
+}
+
+func (b *breakerStore) Expire(ctx context.Context, namespace, id string, ttl time.Duration) error {
+	return b.call(func() error {
+		return b.store.Expire(ctx, namespace, id, ttl)
+	})
+}
+
+func (b *breakerStore) SetRef(ctx context.Context, namespace, ref, id string, ttl time.Duration) error {
+	return b.call(func() error {
+		return b.store.SetRef(ctx, namespace, ref, id, ttl)
+	})
+}
+
+func (b *breakerStore) GetRef(ctx context.Context, namespace, ref string) (string, error) {
+	var id string
+	err := b.call(func() (err error) {
+		id, err = b.store.GetRef(ctx, namespace, ref)
+		return err
+	})
+	return id, err
+}
+
+func (b *breakerStore) DeleteRef(ctx context.Context, namespace, ref, id string) error {
+	return b.call(func() error {
+		return b.store.DeleteRef(ctx, namespace, ref, id)
+	})
+}
+
+func (b *breakerStore) LockAddress(ctx context.Context, namespace, address string, ttl time.Duration) error {
+	return b.call(func() error {
+		return b.store.LockAddress(ctx, namespace, address, ttl)
+	})
+}
+
+func (b *breakerStore) GetAddressLock(ctx context.Context, namespace, address string) (time.Duration, error) {
+	var ttl time.Duration
+	err := b.call(func() (err error) {
+		ttl, err = b.store.GetAddressLock(ctx, namespace, address)
+		return err
+	})
+	return ttl, err
+}
+
+func (b *breakerStore) ConsumeQuota(ctx context.Context, key, period string, limit int, ttl time.Duration) (int, error) {
+	var n int
+	err := b.call(func() (err error) {
+		n, err = b.store.ConsumeQuota(ctx, key, period, limit, ttl)
+		return err
+	})
+	return n, err
+}
+
+func (b *breakerStore) RefundQuota(ctx context.Context, key, period string) error {
+	return b.call(func() error {
+		return b.store.RefundQuota(ctx, key, period)
+	})
+}
+
+func (b *breakerStore) GetQuota(ctx context.Context, key, period string) (int, error) {
+	var n int
+	err := b.call(func() (err error) {
+		n, err = b.store.GetQuota(ctx, key, period)
+		return err
+	})
+	return n, err
+}
+
+func (b *breakerStore) IncrStat(ctx context.Context, namespace, stat, day string) error {
+	return b.call(func() error {
+		return b.store.IncrStat(ctx, namespace, stat, day)
+	})
+}
+
+func (b *breakerStore) GetStats(ctx context.Context, namespace, day string) (store.Stats, error) {
+	var out store.Stats
+	err := b.call(func() (err error) {
+		out, err = b.store.GetStats(ctx, namespace, day)
+		return err
+	})
+	return out, err
+}
+
+func (b *breakerStore) CountActive(ctx context.Context, namespace string) (int, error) {
+	var out int
+	err := b.call(func() (err error) {
+		out, err = b.store.CountActive(ctx, namespace)
+		return err
+	})
+	return out, err
+}
+
+func (b *breakerStore) Ping(ctx context.Context) error {
+	return b.call(func() error {
+		return b.store.Ping(ctx)
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// withCompression is a middleware that gzip (or deflate) compresses
+// responses if the client accepts it. Responses smaller than minSize
+// are sent uncompressed as compressing them isn't worth the overhead.
+func withCompression(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			enc := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+			if enc == "" || r.Method == http.MethodHead || isEventStream(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Accept-Encoding")
+			cw := &compressWriter{ResponseWriter: w, enc: enc, minSize: minSize, status: http.StatusOK}
+			defer cw.Close()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// acceptedEncoding returns the preferred supported encoding from an
+// Accept-Encoding header.
+func acceptedEncoding(h string) string {
+	var deflate bool
+	for _, e := range strings.Split(h, ",") {
+		// Ignore q-values other than an explicit q=0.
+		e, params, _ := strings.Cut(strings.TrimSpace(e), ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+
+		switch strings.ToLower(e) {
+		case "gzip":
+			return "gzip"
+		case "deflate":
+			deflate = true
+		}
+	}
+
+	if deflate {
+		return "deflate"
+	}
+	return ""
+}
+
+// compressWriter buffers the response until minSize bytes have been written
+// and then switches to compressing it. If the response is smaller, it is
+// written as is on Close().
+type compressWriter struct {
+	http.ResponseWriter
+
+	enc     string
+	minSize int
+	status  int
+	buf     []byte
+
+	cw          compressor
+	wroteHeader bool
+}
+
+// compressor is a gzip or flate writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	c.status = status
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.cw != nil {
+		return c.cw.Write(b)
+	}
+	if c.wroteHeader {
+		return c.ResponseWriter.Write(b)
+	}
+
+	c.buf = append(c.buf, b...)
+	if len(c.buf) < c.minSize {
+		return len(b), nil
+	}
+
+	// The response is already encoded (or has no body). Pass it through.
+	h := c.Header()
+	if h.Get("Content-Encoding") != "" || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		if err := c.flushRaw(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	h.Set("Content-Encoding", c.enc)
+	h.Del("Content-Length")
+	c.ResponseWriter.WriteHeader(c.status)
+	c.wroteHeader = true
+
+	if c.enc == "gzip" {
+		c.cw = gzip.NewWriter(c.ResponseWriter)
+	} else {
+		c.cw, _ = flate.NewWriter(c.ResponseWriter, flate.DefaultCompression)
+	}
+
+	buf := c.buf
+	c.buf = nil
+	if _, err := c.cw.Write(buf); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Flush writes out what's been compressed so far, or the uncompressed buffer
+// if the response hasn't reached minSize yet, and flushes the underlying
+// ResponseWriter.
+func (c *compressWriter) Flush() {
+	if c.cw != nil {
+		c.cw.Flush()
+	} else if !c.wroteHeader {
+		c.flushRaw()
+	}
+
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Close flushes the compressor or writes out the uncompressed buffer.
+func (c *compressWriter) Close() error {
+	if c.cw != nil {
+		return c.cw.Close()
+	}
+	if !c.wroteHeader {
+		return c.flushRaw()
+	}
+	return nil
+}
+
+// flushRaw writes the header and the buffered response uncompressed.
+func (c *compressWriter) flushRaw() error {
+	c.ResponseWriter.WriteHeader(c.status)
+	c.wroteHeader = true
+
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	_, err := c.ResponseWriter.Write(c.buf)
+	c.buf = nil
+	return err
+}
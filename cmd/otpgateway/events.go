@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/knadh/otpgateway/v3/internal/store"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/zerodha/logf"
+)
+
+// OTP lifecycle events posted to the namespaces' events webhooks.
+const (
+	eventSet      = "set"
+	eventVerified = "verified"
+	eventFailed   = "failed"
+	eventExpired  = "expired"
+)
+
+const (
+	eventQueueSize = 1000
+	eventWorkers   = 4
+	eventTimeout   = time.Second * 5
+)
+
+// eventHook is the events webhook of a namespace.
+type eventHook struct {
+	url    string
+	secret []byte
+}
+
+type hookJob struct {
+	hook eventHook
+	body []byte
+}
+
+// eventHooks posts the OTP lifecycle events of namespaces to their events
+// webhooks (auth.*.events_webhook_url) in the background. Every namespace
+// only gets its own events. Requests are signed with an HMAC-SHA256 of
+// the timestamp and the body so that receivers can verify them.
+type eventHooks struct {
+	hooks map[string]eventHook
+	queue chan hookJob
+	h     *http.Client
+	lo    logf.Logger
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// newEventHooks returns an eventHooks for the namespaces that have an events
+// webhook and starts its workers. It returns nil if there are none.
+func newEventHooks(namespaces map[string]nsConf, lo logf.Logger) *eventHooks {
+	hooks := make(map[string]eventHook)
+	for name, ns := range namespaces {
+		if ns.EventsWebhookURL != "" {
+			hooks[name] = eventHook{url: ns.EventsWebhookURL, secret: []byte(ns.EventsWebhookSecret)}
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	e := &eventHooks{
+		hooks: hooks,
+		queue: make(chan hookJob, eventQueueSize),
+		h:     &http.Client{Timeout: eventTimeout},
+		lo:    lo,
+	}
+	for i := 0; i < eventWorkers; i++ {
+		e.wg.Add(1)
+		go e.run()
+	}
+
+	return e
+}
+
+// push queues an event of an OTP for its namespace's webhook, if it has
+// one. The OTP value isn't sent. Events are dropped when the queue is full
+// so that a slow receiver doesn't hold up requests.
+func (e *eventHooks) push(typ, namespace, id string, otp *models.OTP) {
+	if e == nil {
+		return
+	}
+	hook, ok := e.hooks[namespace]
+	if !ok {
+		return
+	}
+
+	var data []byte
+	if otp != nil {
+		o := *otp
+		o.OTP = ""
+		data, _ = json.Marshal(o)
+	} else {
+		data = []byte("null")
+	}
+
+	body, _ := json.Marshal(store.Event{
+		Type:      typ,
+		Namespace: namespace,
+		ID:        id,
+		Data:      json.RawMessage(data),
+	})
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+
+	select {
+	case e.queue <- hookJob{hook: hook, body: body}:
+	default:
+		e.lo.Error("events webhook queue is full. Dropping event", "namespace", namespace, "id", id, "type", typ)
+	}
+}
+
+// close stops accepting events and waits for the queued ones to be posted
+// until ctx is done. It returns the number of events that weren't posted.
+func (e *eventHooks) close(ctx context.Context) int {
+	if e == nil {
+		return 0
+	}
+
+	e.mu.Lock()
+	e.closed = true
+	close(e.queue)
+	e.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return len(e.queue)
+	}
+}
+
+func (e *eventHooks) run() {
+	defer e.wg.Done()
+
+	for j := range e.queue {
+		if err := e.post(j); err != nil {
+			e.lo.Error("error posting to events webhook", "url", j.hook.url, "error", err)
+		}
+	}
+}
+
+// post posts an event to a webhook. Any 2xx response is a success.
+func (e *eventHooks) post(j hookJob) error {
+	req, err := http.NewRequest(http.MethodPost, j.hook.url, bytes.NewReader(j.body))
+	if err != nil {
+		return err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-OTPGateway-Timestamp", ts)
+	req.Header.Set("X-OTPGateway-Signature", signEvent(j.hook.secret, ts, j.body))
+
+	resp, err := e.h.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signEvent returns the hex encoded HMAC-SHA256 of "timestamp.body".
+func signEvent(secret []byte, ts string, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(ts + "."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -4,19 +4,40 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"math"
+	mrand "math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/knadh/otpgateway/v3/internal/providers/httplog"
 	"github.com/knadh/otpgateway/v3/internal/store"
 	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/skip2/go-qrcode"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -24,29 +45,272 @@ const (
 	numChars      = "0123456789"
 	alphaNumChars = alphaChars + numChars
 
+	// Auto-generated IDs are UUIDs if this is the configured ID charset.
+	idCharsetUUID = "uuid"
+	defaultIDLen  = 32
+	minIDLen      = 6
+
+	// Letters of reference codes without the ones that are easily
+	// confused with digits (I, O).
+	refChars    = "ABCDEFGHJKLMNPQRSTUVWXYZ"
+	maxRefTries = 5
+
 	actCheck  = "check"
 	actResend = "resend"
 
 	uriViewOTP     = "/otp/%s/%s"
 	uriViewAddress = "/otp/%s/%s/address"
-	uriCheck       = "/otp/%s/%s?otp=%s&action=check"
+	uriEvents      = "/otp/*/*/events"
+	uriStatus      = "/otp/*/*/status"
+	uriCheck       = "/otp/%s/%s?otp=%s&nonce=%s&action=check"
+
+	maxChannelLen = 64
+
+	// Defaults of app.batch_max_size and app.batch_concurrency.
+	defaultBatchMaxSize     = 100
+	defaultBatchConcurrency = 10
+
+	// Interval of the keep-alive comments sent on idle status event
+	// streams so that proxies don't time them out.
+	sseKeepAlive = time.Second * 15
+
+	// Size (px) of the QR code image of the web view URL.
+	qrSize = 256
+
+	// Quota counters are kept for longer than a day so that they
+	// outlive their period regardless of the reset time.
+	quotaTTL = time.Hour * 48
+
+	// apiVersion is the version of the API's response shape that's sent
+	// in the X-OTPGateway-API-Version header on API responses.
+	apiVersion    = "3"
+	hdrAPIVersion = "X-OTPGateway-API-Version"
 )
 
+// Machine readable error codes sent as error_code in error responses.
+const (
+	errCodeNotFound         = "not_found"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeForbidden        = "forbidden"
+	errCodeInvalidParam     = "invalid_param"
+	errCodeValidation       = "validation_failed"
+	errCodeInvalidProvider  = "invalid_provider"
+	errCodeProviderDisabled = "provider_disabled"
+	errCodeInvalidAddress   = "invalid_address"
+	errCodeOTPNotFound      = "otp_not_found"
+	errCodeOTPNotVerified   = "otp_not_verified"
+	errCodeOTPNotDelivered  = "otp_not_delivered"
+	errCodeOTPMismatch      = "otp_mismatch"
+	errCodeOTPLocked        = "otp_locked"
+	errCodeRateLimited      = "rate_limited"
+	errCodeQuotaExceeded    = "quota_exceeded"
+	errCodeMaxActiveOTPs    = "max_active_otps"
+	errCodeSendInProgress   = "send_in_progress"
+	errCodeProviderError    = "provider_error"
+	errCodeStoreUnavailable = "store_unavailable"
+	errCodeOverloaded       = "overloaded"
+	errCodeInternal         = "internal_error"
+)
+
+// randRead is the source of randomness for generating IDs and OTPs.
+// It can be overridden in tests to generate deterministic values.
+var randRead = rand.Read
+
+// errVerifyThrottled is returned by verifyOTP when an attempt is made too
+// soon after the previous one.
+var errVerifyThrottled = errors.New("Too many attempts. Please wait a moment and retry.")
+
+// codedError is an error with a machine readable error code.
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// errorCode returns the error code of a codedError, or def.
+func errorCode(err error, def string) string {
+	if err == store.ErrNotExist {
+		return errCodeOTPNotFound
+	}
+
+	var e *codedError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return def
+}
+
+// errStoreUnavailable is returned when the store is unavailable, for
+// instance, when the circuit breaker on it is open.
+var errStoreUnavailable = &codedError{code: errCodeStoreUnavailable, msg: "Store unavailable. Please retry later."}
+
+// errNotDelivered is returned by verifyOTP when the namespace requires
+// delivery confirmation and the OTP hasn't been marked delivered yet.
+var errNotDelivered = &codedError{code: errCodeOTPNotDelivered, msg: "The code has not been delivered yet. Please wait."}
+
+// errEmptyBody is returned by push when the message body renders empty
+// on a provider that requires a body.
+var errEmptyBody = errors.New("message body rendered empty")
+
+// errBodyTooLong is returned by push when the message body is longer than
+// the provider's MaxBodyLen() and app.strict_body_len is set.
+var errBodyTooLong = errors.New("message body exceeds the provider's max length")
+
+// errQuotaExceeded is returned by push when the daily quota of the provider
+// (and its fallbacks) is exhausted.
+var errQuotaExceeded = errors.New("Sending quota exceeded. Please try again later.")
+
 type httpResp struct {
-	Status  string      `json:"status"`
-	Message string      `json:"message,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
+	Status    string      `json:"status"`
+	Message   string      `json:"message,omitempty"`
+	ErrorCode string      `json:"error_code,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
 }
 
 type otpResp struct {
 	models.OTP
 	URL string `json:"url"`
+
+	// DeliveredVia is the provider that delivered the OTP, which can be
+	// a fallback provider if the OTP's provider failed.
+	DeliveredVia string `json:"delivered_via,omitempty"`
+
+	// Duplicate is set when an identical send within the dup_send_window
+	// was suppressed and the existing OTP was returned.
+	Duplicate bool `json:"duplicate,omitempty"`
+
+	// Reused is set when an existing open OTP was returned (reuse_existing)
+	// instead of setting and sending a new one.
+	Reused bool `json:"reused,omitempty"`
+
+	// Queued is set when the OTP couldn't be sent right away and has been
+	// queued by its provider to be retried in the background.
+	Queued bool `json:"queued,omitempty"`
+
+	// created is set when the OTP didn't exist before.
+	created bool
+}
+
+type verifyResp struct {
+	models.OTP
+
+	// Token is a signed JWT attesting to the verification, if enabled.
+	Token string `json:"token,omitempty"`
+
+	// Next is the result of setting the next step's OTP with chain_next.
+	Next *httpResp `json:"next,omitempty"`
+}
+
+type providerResp struct {
+	ID            string `json:"id"`
+	ChannelName   string `json:"channel_name"`
+	ChannelDesc   string `json:"channel_description"`
+	AddressName   string `json:"address_name"`
+	AddressDesc   string `json:"address_description"`
+	MaxOTPLen     int    `json:"max_otp_len"`
+	MaxAddressLen int    `json:"max_address_len"`
+
+	// Daily sending quota and today's usage. 0 = no quota.
+	DailyQuota int `json:"daily_quota"`
+	QuotaUsed  int `json:"quota_used"`
 }
 
 type otpErrResp struct {
-	TTL         float64 `json:"ttl_seconds"`
-	Attempts    int     `json:"attempts"`
-	MaxAttempts int     `json:"max_attempts"`
+	TTL            float64 `json:"ttl_seconds"`
+	VerifyAttempts int     `json:"attempts"`
+	MaxAttempts    int     `json:"max_attempts"`
+}
+
+// otpReq represents a request to set an OTP. Numeric fields that are
+// 0 take the defaults from the config.
+type otpReq struct {
+	ID              string          `json:"id"`
+	Provider        string          `json:"provider"`
+	To              string          `json:"to"`
+	OTP             string          `json:"otp"`
+	Channel         string          `json:"channel"`
+	ChannelDesc     string          `json:"channel_description"`
+	AddressDesc     string          `json:"address_description"`
+	TTL             int             `json:"ttl"`
+	MaxAttempts     int             `json:"max_attempts"`
+	MaxGenerate     int             `json:"max_generate"`
+	CaseInsensitive bool            `json:"case_insensitive"`
+	ReuseExisting   bool            `json:"reuse_existing"`
+	Extra           json.RawMessage `json:"extra"`
+}
+
+// verifyReq represents a request to verify an OTP. In JSON requests,
+// the next step's OTP (chain_next) is the `next` object instead of the
+// next_* form values.
+type verifyReq struct {
+	OTP        string `json:"otp"`
+	OTPHash    string `json:"otp_hash"`
+	HashAlgo   string `json:"hash_algo"`
+	VerifyData string `json:"verify_data"`
+	SkipDelete bool   `json:"skip_delete"`
+	ChainNext  bool   `json:"chain_next"`
+	Next       otpReq `json:"next"`
+}
+
+// setError is an error in setting an OTP along with the HTTP status,
+// error code, and data it's responded with.
+type setError struct {
+	status int
+	code   string
+	msg    string
+	data   interface{}
+}
+
+// fieldError is a validation error in a field of an OTP request.
+type fieldError struct {
+	field string
+	code  string
+	msg   string
+}
+
+type fieldErrorsResp struct {
+	Errors map[string]string `json:"errors"`
+}
+
+// validationError returns the error for the failed validations of an OTP
+// request. With app.field_errors, it's a validation_failed error with all
+// the field errors in data.errors. Otherwise, it's the first error.
+func validationError(errs []fieldError, app *App) *setError {
+	if !app.constants.FieldErrors {
+		return &setError{http.StatusBadRequest, errs[0].code, errs[0].msg, nil}
+	}
+
+	out := make(map[string]string, len(errs))
+	for _, e := range errs {
+		if _, ok := out[e.field]; !ok {
+			out[e.field] = e.msg
+		}
+	}
+	return &setError{http.StatusBadRequest, errCodeValidation, errs[0].msg, fieldErrorsResp{Errors: out}}
+}
+
+type lockErrResp struct {
+	TTL float64 `json:"ttl_seconds"`
+}
+
+type infoResp struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Status  string `json:"status"`
+}
+
+type statsResp struct {
+	Date string `json:"date"`
+	store.Stats
+}
+
+type healthResp struct {
+	// State of the store's circuit breaker: closed, open, or half-open.
+	StoreCircuit string `json:"store_circuit"`
 }
 
 type webviewTpl struct {
@@ -64,6 +328,20 @@ type webviewTpl struct {
 	Closed        bool
 	Message       string
 
+	// Embed renders the chromeless variant of the view (?embed=1) for
+	// iframes.
+	Embed bool
+
+	// Input is the OTP filled in the form and Nonce is the nonce of the
+	// verification link that's being confirmed.
+	Input string
+	Nonce string
+
+	// TTL is the remaining validity of the OTP in seconds and AttemptsLeft
+	// is the number of verification attempts left before it gets locked.
+	TTL          int
+	AttemptsLeft int
+
 	App constants
 }
 
@@ -74,6 +352,9 @@ type pushTpl struct {
 	OTP       string
 	OTPURL    string
 	OTPTTL    time.Duration
+
+	// The OTP's extra JSON object for custom fields, eg: {{ .Extra.name }}.
+	Extra map[string]interface{}
 }
 
 // handleGetProviders returns the list of available message providers.
@@ -90,539 +371,2599 @@ func handleGetProviders(w http.ResponseWriter, r *http.Request) {
 	sendResponse(w, out)
 }
 
-func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+// handleGetProvider returns the metadata of a message provider.
+func handleGetProvider(w http.ResponseWriter, r *http.Request) {
 	var (
 		app = r.Context().Value("app").(*App)
+		id  = chi.URLParam(r, "id")
 	)
 
-	if err := app.store.Ping(); err != nil {
-		sendErrorResponse(w, "Unable to reach store.", http.StatusServiceUnavailable, nil)
+	if app.disabledProviders[id] {
+		sendErrorResponse(w, "Provider temporarily disabled.", http.StatusServiceUnavailable, errCodeProviderDisabled, nil)
 		return
 	}
-
-	sendResponse(w, "OK")
-}
-
-// handleSetOTP creates a new OTP while respecting maximum attempts
-// and TTL values.
-func handleSetOTP(w http.ResponseWriter, r *http.Request) {
-	var (
-		app = r.Context().Value("app").(*App)
-
-		namespace      = r.Context().Value("namespace").(string)
-		id             = chi.URLParam(r, "id")
-		provider       = r.FormValue("provider")
-		channelDesc    = r.FormValue("channel_description")
-		addressDesc    = r.FormValue("address_description")
-		rawTTL         = r.FormValue("ttl")
-		rawMaxAttempts = r.FormValue("max_attempts")
-		rawMaxGenerate = r.FormValue("max_generate")
-		extra          = []byte(r.FormValue("extra"))
-		to             = r.FormValue("to")
-		otpVal         = r.FormValue("otp")
-	)
-
-	// Get the provider.
-	p, ok := app.providers[provider]
+	p, ok := app.providers[id]
 	if !ok {
-		sendErrorResponse(w, "Unknown provider.", http.StatusBadRequest, nil)
+		sendErrorResponse(w, "Unknown provider.", http.StatusNotFound, errCodeInvalidProvider, nil)
 		return
 	}
 
-	// Validate the 'to' address with the provider if one is given.
-	// If an address is not set, the gateway will render the address
-	// collection UI.
-	if to != "" {
-		if err := p.provider.ValidateAddress(to); err != nil {
-			sendErrorResponse(w, fmt.Sprintf("Invalid `to` address: %v", err),
-				http.StatusBadRequest, nil)
-			return
-		}
+	out := providerResp{
+		ID:            id,
+		ChannelName:   p.provider.ChannelName(),
+		ChannelDesc:   strings.TrimSpace(p.provider.ChannelDesc()),
+		AddressName:   p.provider.AddressName(),
+		AddressDesc:   p.provider.AddressDesc(),
+		MaxOTPLen:     p.provider.MaxOTPLen(),
+		MaxAddressLen: p.provider.MaxAddressLen(),
+		DailyQuota:    p.dailyQuota,
 	}
 
-	// Validate optional TTL in seconds.
-	ttl := app.constants.OtpTTL
-	if rawTTL != "" {
-		v, err := strconv.Atoi(rawTTL)
-		if err != nil || v < 1 {
-			sendErrorResponse(w, "Invalid `ttl` value.", http.StatusBadRequest, nil)
+	if p.dailyQuota > 0 {
+		n, err := app.store.GetQuota(r.Context(), p.name, quotaPeriod(time.Now(), app.constants.QuotaResetTime))
+		if err != nil {
+			app.lo.Error("error getting provider quota", "error", err, "provider", id)
+			sendStoreErrorResponse(w, "Error getting provider quota.", http.StatusInternalServerError, err)
 			return
 		}
-		ttl = time.Second * time.Duration(v)
+		out.QuotaUsed = n
 	}
 
-	maxAttempts := app.constants.OtpMaxAttempts
-	if rawMaxAttempts != "" {
-		v, err := strconv.Atoi(rawMaxAttempts)
-		if err != nil || v < 1 {
-			sendErrorResponse(w, "Invalid `max_attempts` value.", http.StatusBadRequest, nil)
-			return
-		}
-		maxAttempts = v
-	}
+	sendResponse(w, out)
+}
 
-	maxGenerate := app.constants.OtpMaxGenerate
-	if rawMaxGenerate != "" {
-		v, err := strconv.Atoi(rawMaxGenerate)
-		if err != nil || v < 1 {
-			sendErrorResponse(w, "Invalid `max_generate` value.", http.StatusBadRequest, nil)
-			return
-		}
-		maxGenerate = v
-	}
+// handleGetStats returns the number of active OTPs and today's verification
+// stats of the authenticated namespace.
+func handleGetStats(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = r.Context().Value("namespace").(string)
+		day       = statsDay(time.Now())
+	)
 
-	// If there's extra data, make sure it's JSON.
-	if len(extra) > 0 {
-		var tmp interface{}
-		if err := json.Unmarshal(extra, &tmp); err != nil {
-			sendErrorResponse(w, fmt.Sprintf("Invalid JSON in `extra`: %v", err), http.StatusBadRequest, nil)
-			return
-		}
-	} else {
-		extra = []byte("{}")
+	s, err := app.store.GetStats(r.Context(), namespace, day)
+	if err != nil {
+		app.lo.Error("error getting stats", "error", err)
+		sendStoreErrorResponse(w, "Error getting stats.", http.StatusInternalServerError, err)
+		return
 	}
 
-	// If there is no incoming ID, generate a random ID.
-	if id == "" {
-		if i, err := generateRandomString(32, alphaNumChars); err != nil {
-			app.lo.Error("error generating ID", "error", err)
-			sendErrorResponse(w, "Error generating ID.", http.StatusInternalServerError, nil)
-			return
-		} else {
-			id = i
-		}
-	}
+	sendResponse(w, statsResp{Date: day, Stats: s})
+}
 
-	// If there's no incoming OTP, generate a random one.
-	if otpVal == "" {
-		o, err := generateRandomString(p.provider.MaxOTPLen(), numChars)
-		if err != nil {
-			app.lo.Error("error generating OTP", "error", err)
-			sendErrorResponse(w, "Error generating OTP.", http.StatusInternalServerError, nil)
-			return
-		}
-		otpVal = o
-	}
+// handleRoot responds to / with basic information about the service or
+// redirects to the configured URL.
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	var (
+		app = r.Context().Value("app").(*App)
+	)
 
-	// Check if the OTP attempts have exceeded the quota.
-	otp, err := app.store.Check(namespace, id, store.CounterNil)
-	if err != nil && err != store.ErrNotExist {
-		app.lo.Error("error checking OTP status", "error", err)
-		sendErrorResponse(w, "Error checking OTP status.", http.StatusBadRequest, nil)
+	if u := app.constants.RootRedirect; u != "" {
+		http.Redirect(w, r, u, http.StatusFound)
 		return
 	}
 
-	// There's an existing OTP that's locked.
-	if err != store.ErrNotExist && isLocked(otp) {
-		sendErrorResponse(w,
-			fmt.Sprintf("OTP attempts exceeded. Retry after %0.f seconds.",
-				otp.TTL.Seconds()),
-			http.StatusTooManyRequests, otpErrResp{
-				Attempts:    otp.Attempts,
-				MaxAttempts: otp.MaxAttempts,
-				TTL:         otp.TTL.Seconds(),
-			})
-		return
-	}
+	sendResponse(w, infoResp{Name: "otpgateway", Version: buildString, Status: "ok"})
+}
 
-	// Create the OTP.
-	newOTP, err := app.store.Set(namespace, id, models.OTP{
-		OTP:         otpVal,
-		To:          to,
-		ChannelDesc: channelDesc,
-		AddressDesc: addressDesc,
-		Extra:       []byte(extra),
-		Provider:    provider,
-		TTL:         ttl,
-		MaxAttempts: maxAttempts,
-		MaxGenerate: maxGenerate,
-	})
-	if err != nil {
-		app.lo.Error("error setting OTP", "error", err)
-		sendErrorResponse(w, "Error setting OTP.", http.StatusInternalServerError, nil)
+// handleLiveCheck is the liveness check. It always succeeds as long as the
+// process is up and doesn't depend on the store.
+func handleLiveCheck(w http.ResponseWriter, r *http.Request) {
+	sendResponse(w, "OK")
+}
+
+// handleHealthCheck is the readiness check. It checks that the store is
+// reachable and that there are providers to send OTPs.
+func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	var (
+		app = r.Context().Value("app").(*App)
+	)
+
+	if len(app.providers) == 0 {
+		sendErrorResponse(w, "No providers available.", http.StatusServiceUnavailable, errCodeInternal, nil)
 		return
 	}
 
-	// Push the OTP out.
-	if to != "" {
-		if err := push(newOTP, p, app.constants.RootURL, app); err != nil {
-			app.lo.Error("error sending OTP", "error", err, "provider", p.provider.ID())
-			sendErrorResponse(w, "Error sending OTP.", http.StatusInternalServerError, nil)
-			return
+	if err := app.store.Ping(r.Context()); err != nil {
+		var data interface{}
+		if app.breaker != nil {
+			data = healthResp{StoreCircuit: app.breaker.State().String()}
 		}
+		sendErrorResponse(w, "Unable to reach store.", http.StatusServiceUnavailable, errCodeStoreUnavailable, data)
+		return
 	}
 
-	out := otpResp{newOTP, getURL(app.constants.RootURL, newOTP, false)}
-	sendResponse(w, out)
+	sendResponse(w, "OK")
 }
 
-// handleCheckOTPStatus checks the user input against a stored OTP.
-func handleCheckOTPStatus(w http.ResponseWriter, r *http.Request) {
+// handleNotFound returns a JSON error envelope for unknown paths.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	sendErrorResponse(w, "Not found.", http.StatusNotFound, errCodeNotFound, nil)
+}
+
+// handleMethodNotAllowed returns a JSON error envelope for requests
+// made with a method that isn't registered on a path.
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	sendErrorResponse(w, "Method not allowed.", http.StatusMethodNotAllowed, errCodeMethodNotAllowed, nil)
+}
+
+// handleSetOTP creates a new OTP while respecting maximum attempts
+// and TTL values.
+func handleSetOTP(w http.ResponseWriter, r *http.Request) {
 	var (
 		app       = r.Context().Value("app").(*App)
 		namespace = r.Context().Value("namespace").(string)
-		id        = chi.URLParam(r, "id")
+
+		req = otpReq{
+			ID:          chi.URLParam(r, "id"),
+			Provider:    r.FormValue("provider"),
+			To:          r.FormValue("to"),
+			OTP:         r.FormValue("otp"),
+			Channel:     r.FormValue("channel"),
+			ChannelDesc: r.FormValue("channel_description"),
+			AddressDesc: r.FormValue("address_description"),
+			Extra:       []byte(r.FormValue("extra")),
+		}
 	)
+	req.CaseInsensitive, _ = strconv.ParseBool(r.FormValue("case_insensitive"))
+	req.ReuseExisting, _ = strconv.ParseBool(r.FormValue("reuse_existing"))
+
+	// Validate the optional numeric params. If all the field errors are to
+	// be returned, validate the rest of the request too.
+	if errs := parseNumParams(r, "", &req); len(errs) > 0 {
+		if app.constants.FieldErrors {
+			_, more := validateOTPReq(namespace, &req, app)
+			errs = append(errs, more...)
+		}
 
-	if len(id) < 6 {
-		sendErrorResponse(w, "ID should be min 6 chars.", http.StatusBadRequest, nil)
+		err := validationError(errs, app)
+		sendErrorResponse(w, err.msg, err.status, err.code, err.data)
 		return
 	}
 
-	// Check the OTP status.
-	out, err := app.store.Check(namespace, id, store.CounterNil)
+	out, err := setOTP(r.Context(), namespace, req, app)
 	if err != nil {
-		if err == store.ErrNotExist {
-			sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
-			return
+		sendErrorResponse(w, err.msg, err.status, err.code, err.data)
+		return
+	}
+
+	// Point to the OTP resource, and optionally, respond to new OTPs
+	// with 201 Created.
+	w.Header().Set("Location", app.constants.RootURL+"/api/otp/"+url.PathEscape(out.ID))
+	code := http.StatusOK
+	if out.created && app.constants.StatusCreated {
+		code = http.StatusCreated
+	}
+
+	sendResponseCode(w, code, out)
+}
+
+// parseNumParams parses the optional numeric params of an OTP request
+// (ttl, max_attempts, max_generate) whose names are prefixed with prefix.
+// An error is returned for every invalid param.
+func parseNumParams(r *http.Request, prefix string, req *otpReq) []fieldError {
+	var errs []fieldError
+	for _, f := range []struct {
+		name string
+		val  *int
+	}{
+		{"ttl", &req.TTL},
+		{"max_attempts", &req.MaxAttempts},
+		{"max_generate", &req.MaxGenerate},
+	} {
+		raw := r.FormValue(prefix + f.name)
+		if raw == "" {
+			continue
 		}
 
-		app.lo.Error("error checking OTP", "error", err)
-		sendErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
-		return
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 {
+			errs = append(errs, fieldError{prefix + f.name, errCodeInvalidParam,
+				fmt.Sprintf("Invalid `%s%s` value.", prefix, f.name)})
+			continue
+		}
+		*f.val = v
 	}
 
-	if out.Closed {
-		// Delete otp
-		if r.Method == http.MethodDelete {
-			app.store.Delete(namespace, id)
+	return errs
+}
+
+// parseVerifyReq parses a verification request from a JSON body
+// (Content-Type: application/json) or from the form values.
+func parseVerifyReq(r *http.Request) (verifyReq, error) {
+	var req verifyReq
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, fmt.Errorf("Invalid JSON in the request: %v", err)
+		}
+		if req.Next.TTL < 0 || req.Next.MaxAttempts < 0 || req.Next.MaxGenerate < 0 {
+			return req, errors.New("Invalid `next.ttl`, `next.max_attempts`, or `next.max_generate` value.")
 		}
+		return req, nil
+	}
 
-		sendResponse(w, out)
-		return
+	req.OTP = r.FormValue("otp")
+	req.OTPHash = r.FormValue("otp_hash")
+	req.HashAlgo = r.FormValue("hash_algo")
+	req.VerifyData = r.FormValue("verify_data")
+	req.SkipDelete, _ = strconv.ParseBool(r.FormValue("skip_delete"))
+	req.ChainNext, _ = strconv.ParseBool(r.FormValue("chain_next"))
+
+	if req.ChainNext {
+		req.Next = otpReq{
+			ID:       r.FormValue("next_id"),
+			Provider: r.FormValue("next_provider"),
+			To:       r.FormValue("next_to"),
+			Extra:    []byte(r.FormValue("next_extra")),
+		}
+		if errs := parseNumParams(r, "next_", &req.Next); len(errs) > 0 {
+			return req, errors.New(errs[0].msg)
+		}
 	}
 
-	sendErrorResponse(w, "OTP not verified.", http.StatusBadRequest, nil)
+	return req, nil
 }
 
-// handleVerifyOTP checks the user input against a stored OTP.
-func handleVerifyOTP(w http.ResponseWriter, r *http.Request) {
+// handleSetOTPBatch creates OTPs for a JSON array of requests in one go. The
+// OTPs are set in a single store pipeline and are pushed concurrently. Every
+// item gets its own result, so failed items don't fail the whole batch.
+func handleSetOTPBatch(w http.ResponseWriter, r *http.Request) {
 	var (
-		app           = r.Context().Value("app").(*App)
-		namespace     = r.Context().Value("namespace").(string)
-		id            = chi.URLParam(r, "id")
-		otpVal        = r.FormValue("otp")
-		skipDelete, _ = strconv.ParseBool(r.FormValue("skip_delete"))
+		app       = r.Context().Value("app").(*App)
+		namespace = r.Context().Value("namespace").(string)
 	)
 
-	if len(id) < 6 {
-		sendErrorResponse(w, "ID should be min 6 chars", http.StatusBadRequest, nil)
+	var reqs []otpReq
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		sendErrorResponse(w, fmt.Sprintf("Invalid JSON in the batch: %v", err), http.StatusBadRequest, errCodeInvalidParam, nil)
 		return
 	}
-	if otpVal == "" {
-		sendErrorResponse(w, "`otp` is empty.", http.StatusBadRequest, nil)
+	if len(reqs) == 0 || len(reqs) > app.constants.BatchMaxSize {
+		sendErrorResponse(w, fmt.Sprintf("The batch should have 1 to %d items.", app.constants.BatchMaxSize),
+			http.StatusBadRequest, errCodeInvalidParam, nil)
 		return
 	}
 
-	out, err := verifyOTP(namespace, id, otpVal, !skipDelete, app)
-	if err != nil {
-		code := http.StatusBadRequest
-		if err == store.ErrNotExist {
-			sendErrorResponse(w, err.Error(), code, nil)
-			return
+	var (
+		out = make([]httpResp, len(reqs))
+
+		// Items that are to be set and pushed, and their indexes in the batch.
+		items   []models.OTP
+		provs   []*provider
+		indexes []int
+		isNew   []bool
+		claims  []string
+		numNew  int
+		ids     = make(map[string]bool, len(reqs))
+	)
+	for i, req := range reqs {
+		if req.TTL < 0 || req.MaxAttempts < 0 || req.MaxGenerate < 0 {
+			out[i] = batchError(&setError{http.StatusBadRequest, errCodeInvalidParam,
+				"Invalid `ttl`, `max_attempts`, or `max_generate` value.", nil})
+			continue
 		}
 
-		if out.Closed {
-			code = http.StatusTooManyRequests
+		otp, p, err := prepareOTP(r.Context(), namespace, req, app)
+		if err != nil {
+			out[i] = batchError(err)
+			continue
 		}
-		sendErrorResponse(w, err.Error(), code, out)
-		return
-	}
 
-	sendResponse(w, out)
-}
+		if ids[otp.ID] {
+			out[i] = batchError(&setError{http.StatusBadRequest, errCodeInvalidParam, "Duplicate `id` in the batch.", nil})
+			continue
+		}
+		ids[otp.ID] = true
 
-// handleOTPView renders the HTTP view.
-func handleOTPView(w http.ResponseWriter, r *http.Request) {
-	var (
-		app       = r.Context().Value("app").(*App)
-		namespace = chi.URLParam(r, "namespace")
-		action    = r.FormValue("action")
-		id        = chi.URLParam(r, "id")
-		otp       = r.FormValue("otp")
+		dup, ok, err := checkOTP(r.Context(), &otp, req, app)
+		if err != nil {
+			out[i] = batchError(err)
+			continue
+		}
+		if dup != nil {
+			out[i] = httpResp{Status: "success", Data: dup}
+			continue
+		}
 
-		out    models.OTP
-		otpErr error
-	)
+		claim, dup, err := claimSend(r.Context(), otp, req, app)
+		if err != nil {
+			out[i] = batchError(err)
+			continue
+		}
+		if dup != nil {
+			out[i] = httpResp{Status: "success", Data: dup}
+			continue
+		}
 
-	if action == "" {
-		// Render the view without incrementing attempts.
-		out, otpErr = app.store.Check(namespace, id, store.CounterNil)
-	} else if action == actResend {
-		// Fetch the OTP for resending.
-		out, otpErr = app.store.Check(namespace, id, store.CounterGenerate)
-	} else {
-		// Validate the attempt.
-		out, otpErr = verifyOTP(namespace, id, otp, false, app)
-	}
-	if otpErr == store.ErrNotExist {
-		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants,
-			Title: "Session expired",
-			Description: `Your session has expired.
-					Please re-initiate the verification.`,
-		})
-		return
+		items = append(items, otp)
+		provs = append(provs, p)
+		indexes = append(indexes, i)
+		isNew = append(isNew, ok)
+		claims = append(claims, claim)
+		if ok {
+			numNew++
+		}
 	}
 
-	// Attempts are maxed out and locked.
-	if isLocked(out) {
-		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants,
-			Title:       "Too many attempts",
-			Description: fmt.Sprintf("Please retry after %d seconds.", int64(out.TTLSeconds)),
-		})
-		return
+	// The new IDs in the batch are checked against the max active OTPs all
+	// at once as the active count doesn't change until they're set. If they
+	// don't fit, none of them are set.
+	var maxErr *setError
+	if numNew > 0 {
+		maxErr = checkMaxActive(r.Context(), namespace, numNew, app)
 	}
 
-	// Get the provider.
-	pro, ok := app.providers[out.Provider]
-	if !ok {
-		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants,
+	// Filter the items in place.
+	var (
+		setItems   = items[:0]
+		setProvs   = provs[:0]
+		setIndexes = indexes[:0]
+		setClaims  = claims[:0]
+		prevRefs   []string
+	)
+	for k, otp := range items {
+		if maxErr != nil && isNew[k] {
+			out[indexes[k]] = batchError(maxErr)
+			releaseSend(r.Context(), otp, claims[k], app)
+			continue
+		}
+		prevRef := otp.Ref
+		if err := setRef(r.Context(), &otp, app); err != nil {
+			out[indexes[k]] = batchError(err)
+			releaseSend(r.Context(), otp, claims[k], app)
+			continue
+		}
+
+		prevRefs = append(prevRefs, prevRef)
+		setItems = append(setItems, otp)
+		setProvs = append(setProvs, provs[k])
+		setIndexes = append(setIndexes, indexes[k])
+		setClaims = append(setClaims, claims[k])
+	}
+	items, provs, indexes, claims = setItems, setProvs, setIndexes, setClaims
+
+	// Set all the OTPs in a single pipeline.
+	if len(items) > 0 {
+		set, err := app.store.SetBatch(r.Context(), namespace, items)
+		if err != nil {
+			app.lo.Error("error setting OTP batch", "error", err)
+			e := storeSetError("Error setting OTP.", http.StatusInternalServerError, err)
+			for n, i := range indexes {
+				out[i] = batchError(e)
+				deleteRef(r.Context(), items[n], prevRefs[n], app)
+				releaseSend(r.Context(), items[n], claims[n], app)
+			}
+			sendResponse(w, out)
+			return
+		}
+		for n := range set {
+			app.events.push(eventSet, namespace, set[n].ID, &set[n])
+		}
+
+		// Push them out with bounded concurrency. OTPs of providers that
+		// support bulk pushes are pushed in one call per provider.
+		var (
+			wg  sync.WaitGroup
+			sem = make(chan struct{}, app.constants.BatchConcurrency)
+
+			bulk      = make(map[*provider][]int)
+			bulkProvs []*provider
+		)
+		for n, otp := range set {
+			if _, ok := provs[n].provider.(models.BulkPusher); ok && otp.To != "" {
+				if _, ok := bulk[provs[n]]; !ok {
+					bulkProvs = append(bulkProvs, provs[n])
+				}
+				bulk[provs[n]] = append(bulk[provs[n]], n)
+				continue
+			}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, otp models.OTP, p *provider, claim string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				res, err := sendOTP(r.Context(), otp, p, app)
+				releaseSend(r.Context(), otp, claim, app)
+				if err != nil {
+					out[i] = batchError(err)
+					return
+				}
+				out[i] = httpResp{Status: "success", Data: res}
+			}(indexes[n], otp, provs[n], claims[n])
+		}
+
+		for _, p := range bulkProvs {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(p *provider, items []int) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				otps := make([]models.OTP, len(items))
+				for k, n := range items {
+					otps[k] = set[n]
+				}
+
+				res, errs := bulkSendOTP(r.Context(), otps, p, app)
+				for k, n := range items {
+					releaseSend(r.Context(), set[n], claims[n], app)
+					if errs[k] != nil {
+						out[indexes[n]] = batchError(errs[k])
+						continue
+					}
+					out[indexes[n]] = httpResp{Status: "success", Data: res[k]}
+				}
+			}(p, bulk[p])
+		}
+		wg.Wait()
+	}
+
+	sendResponse(w, out)
+}
+
+// setOTP validates an OTP request, and sets and pushes the OTP.
+func setOTP(ctx context.Context, namespace string, req otpReq, app *App) (otpResp, *setError) {
+	otp, p, err := prepareOTP(ctx, namespace, req, app)
+	if err != nil {
+		return otpResp{}, err
+	}
+
+	// There's an existing OTP that's locked, or an identical one was just sent.
+	dup, isNew, err := checkOTP(ctx, &otp, req, app)
+	if err != nil {
+		return otpResp{}, err
+	}
+	if dup != nil {
+		return *dup, nil
+	}
+
+	claim, dup, err := claimSend(ctx, otp, req, app)
+	if err != nil {
+		return otpResp{}, err
+	}
+	if dup != nil {
+		return *dup, nil
+	}
+	defer releaseSend(ctx, otp, claim, app)
+
+	if isNew {
+		if err := checkMaxActive(ctx, namespace, 1, app); err != nil {
+			return otpResp{}, err
+		}
+	}
+	prevRef := otp.Ref
+	if err := setRef(ctx, &otp, app); err != nil {
+		return otpResp{}, err
+	}
+
+	// Create the OTP.
+	newOTP, sErr := app.store.Set(ctx, namespace, otp.ID, otp)
+	if sErr != nil {
+		app.lo.Error("error setting OTP", "error", sErr)
+		deleteRef(ctx, otp, prevRef, app)
+		return otpResp{}, storeSetError("Error setting OTP.", http.StatusInternalServerError, sErr)
+	}
+	app.events.push(eventSet, namespace, newOTP.ID, &newOTP)
+
+	out, err := sendOTP(ctx, newOTP, p, app)
+	if err != nil {
+		return out, err
+	}
+
+	// The deliveries counter starts with the first Set().
+	out.created = newOTP.Deliveries == 1
+	return out, nil
+}
+
+// prepareOTP validates an OTP request and returns the OTP to be set along
+// with its provider. Missing IDs and OTPs are generated.
+func prepareOTP(ctx context.Context, namespace string, req otpReq, app *App) (models.OTP, *provider, *setError) {
+	p, errs := validateOTPReq(namespace, &req, app)
+	if app.disabledProviders[req.Provider] {
+		return models.OTP{}, nil, &setError{http.StatusServiceUnavailable, errCodeProviderDisabled, "Provider temporarily disabled.", nil}
+	}
+	if len(errs) > 0 {
+		return models.OTP{}, nil, validationError(errs, app)
+	}
+	setSpanAttrs(ctx, attribute.String("otp.provider", req.Provider))
+
+	// Optional TTL in seconds, max attempts and resends.
+	ttl := app.constants.OtpTTL
+	if req.TTL > 0 {
+		ttl = time.Second * time.Duration(req.TTL)
+	}
+
+	maxAttempts := app.constants.OtpMaxAttempts
+	if req.MaxAttempts > 0 {
+		maxAttempts = req.MaxAttempts
+	}
+
+	maxGenerate := app.constants.OtpMaxGenerate
+	if req.MaxGenerate > 0 {
+		maxGenerate = req.MaxGenerate
+	}
+
+	extra := req.Extra
+	if len(extra) == 0 {
+		extra = []byte("{}")
+	}
+
+	// If there is no incoming ID, generate a random ID.
+	id := req.ID
+	if id == "" {
+		i, err := generateID(app.constants.IDLength, app.constants.IDCharset)
+		if err != nil {
+			app.lo.Error("error generating ID", "error", err)
+			return models.OTP{}, nil, &setError{http.StatusInternalServerError, errCodeInternal, "Error generating ID.", nil}
+		}
+		id = i
+	}
+
+	// If there's no incoming OTP, generate a random one.
+	otpVal := req.OTP
+	if otpVal == "" {
+		o, err := generateOTP(ctx, p.provider.MaxOTPLen(), app)
+		if err != nil {
+			app.lo.Error("error generating OTP", "error", err)
+			return models.OTP{}, nil, &setError{http.StatusInternalServerError, errCodeInternal, "Error generating OTP.", nil}
+		}
+		otpVal = o
+	}
+
+	otp := models.OTP{
+		Namespace:   namespace,
+		ID:          id,
+		OTP:         otpVal,
+		To:          req.To,
+		ChannelDesc: req.ChannelDesc,
+		AddressDesc: req.AddressDesc,
+		Extra:       extra,
+		Provider:    req.Provider,
+		Channel:     req.Channel,
+		TTL:         ttl,
+		CaseInsens:  req.CaseInsensitive,
+		MaxAttempts: maxAttempts,
+		MaxGenerate: maxGenerate,
+	}
+
+	// Store the web view URL for support workflows. It's the URL without
+	// the OTP and the nonce so that it doesn't verify the OTP by itself.
+	if app.namespaces[namespace].StoreURL {
+		otp.ViewURL = getURL(app.constants.RootURL, otp, false)
+	}
+
+	return otp, p, nil
+}
+
+// validateOTPReq validates the fields of an OTP request and returns its
+// provider along with an error for every invalid field. If the namespace
+// has auto routing and there's no provider, the provider is picked by
+// the address.
+func validateOTPReq(namespace string, req *otpReq, app *App) (*provider, []fieldError) {
+	var errs []fieldError
+
+	if req.Provider == "" && req.To != "" && len(app.namespaces[namespace].AutoProviders) > 0 {
+		req.Provider = autoProvider(req.To, app.namespaces[namespace].AutoProviders, app)
+		if req.Provider == "" {
+			errs = append(errs, fieldError{"to", errCodeInvalidAddress,
+				"Invalid `to` address: no provider accepts the address."})
+		}
+	}
+
+	p, ok := app.providers[req.Provider]
+	if !ok && len(errs) == 0 {
+		errs = append(errs, fieldError{"provider", errCodeInvalidProvider, "Unknown provider."})
+	}
+
+	// Validate the 'to' address with the provider if one is given.
+	// If an address is not set, the gateway will render the address
+	// collection UI.
+	if ok && req.To != "" {
+		if err := p.provider.ValidateAddress(req.To); err != nil {
+			errs = append(errs, fieldError{"to", errCodeInvalidAddress,
+				fmt.Sprintf("Invalid `to` address: %v", err)})
+		}
+	}
+
+	if len(req.Channel) > maxChannelLen {
+		errs = append(errs, fieldError{"channel", errCodeInvalidParam,
+			fmt.Sprintf("`channel` should be less than %d characters.", maxChannelLen)})
+	}
+
+	// If there's extra data, make sure it's JSON.
+	extra := req.Extra
+	if len(extra) > 0 {
+		var tmp interface{}
+		if err := json.Unmarshal(extra, &tmp); err != nil {
+			return p, append(errs, fieldError{"extra", errCodeInvalidParam,
+				fmt.Sprintf("Invalid JSON in `extra`: %v", err)})
+		}
+
+		// The optional secondary factor should be a SHA256 hash.
+		if m, ok := tmp.(map[string]interface{}); ok {
+			if v, ok := m["verify_data"]; ok {
+				s, _ := v.(string)
+				if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+					errs = append(errs, fieldError{"extra", errCodeInvalidParam,
+						"`extra.verify_data` should be a hex encoded SHA256 hash."})
+				}
+			}
+		}
+	} else {
+		extra = []byte("{}")
+	}
+
+	// If the namespace has a schema for extra, it has to match.
+	if sc := app.namespaces[namespace].ExtraSchema; sc != nil {
+		if err := validateExtra(sc, extra); err != nil {
+			errs = append(errs, fieldError{"extra", errCodeInvalidParam, err.Error()})
+		}
+	}
+
+	return p, errs
+}
+
+// checkOTP checks an existing OTP against an ID before it's set again. An
+// error is returned if it's locked. If an identical OTP was just sent (eg: a
+// double click), or the existing OTP is open and is to be reused, it's
+// returned so that another message isn't sent. An existing OTP's reference
+// code is carried over to otp. The bool is true if the ID doesn't exist.
+func checkOTP(ctx context.Context, otp *models.OTP, req otpReq, app *App) (*otpResp, bool, *setError) {
+	// The address is locked after too many failed attempts on an earlier OTP.
+	ttl, err := getAddressLock(ctx, *otp, app)
+	if err != nil {
+		app.lo.Error("error checking address lock", "error", err)
+		return nil, false, storeSetError("Error checking OTP status.", http.StatusBadRequest, err)
+	}
+	if ttl > 0 {
+		return nil, false, &setError{http.StatusTooManyRequests, errCodeOTPLocked,
+			fmt.Sprintf("Too many failed attempts. Retry after %0.f seconds.", math.Ceil(ttl.Seconds())),
+			lockErrResp{TTL: math.Ceil(ttl.Seconds())}}
+	}
+
+	old, err := app.store.Check(ctx, otp.Namespace, otp.ID, store.CounterNil)
+	if err == store.ErrNotExist {
+		return nil, true, nil
+	}
+	if err != nil {
+		app.lo.Error("error checking OTP status", "error", err)
+		return nil, false, storeSetError("Error checking OTP status.", http.StatusBadRequest, err)
+	}
+
+	if isLocked(old) {
+		return nil, false, &setError{http.StatusTooManyRequests, errCodeOTPLocked,
+			fmt.Sprintf("OTP attempts exceeded. Retry after %0.f seconds.", old.TTL.Seconds()),
+			otpErrResp{
+				VerifyAttempts: old.VerifyAttempts,
+				MaxAttempts:    old.MaxAttempts,
+				TTL:            old.TTL.Seconds(),
+			}}
+	}
+
+	if isDuplicateSend(old, otp.Provider, otp.To, req.OTP, app.constants.DupSendWindow) {
+		app.lo.Debug("suppressing duplicate send", "namespace", otp.Namespace, "id", otp.ID)
+		return &otpResp{OTP: old, URL: getURL(app.constants.RootURL, old, false), Duplicate: true}, false, nil
+	}
+
+	if (req.ReuseExisting || app.namespaces[otp.Namespace].ReuseExisting) && isReusable(old, otp.Provider, otp.To, req.OTP) {
+		return &otpResp{OTP: old, URL: getURL(app.constants.RootURL, old, false), Reused: true}, false, nil
+	}
+	otp.Ref = old.Ref
+
+	return nil, false, nil
+}
+
+// claimSend claims the send of an OTP in the store if duplicate sends are
+// suppressed. Concurrent identical requests all pass checkOTP before any of
+// them is sent, so only the one that claims the send pushes it, and the rest
+// fail while it's being sent. As the claim is released once the OTP is sent,
+// it's checked again for a duplicate after it's claimed. It returns the key
+// of the claim, or "" if there's nothing to claim.
+func claimSend(ctx context.Context, otp models.OTP, req otpReq, app *App) (string, *otpResp, *setError) {
+	if app.constants.DupSendWindow <= 0 || otp.To == "" {
+		return "", nil, nil
+	}
+
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(otp.Provider+"\x00"+otp.To+"\x00"+req.OTP)))
+	if err := app.store.ClaimSend(ctx, otp.Namespace, otp.ID, key, app.constants.DupSendWindow); err != nil {
+		if err == store.ErrSendClaimed {
+			return "", nil, &setError{http.StatusConflict, errCodeSendInProgress, "An identical OTP is being sent.", nil}
+		}
+
+		app.lo.Error("error claiming OTP send", "error", err)
+		return "", nil, storeSetError("Error checking OTP status.", http.StatusBadRequest, err)
+	}
+
+	// The OTP may have been sent by a concurrent request that released its
+	// claim after checkOTP.
+	old, err := app.store.Check(ctx, otp.Namespace, otp.ID, store.CounterNil)
+	if err != nil && err != store.ErrNotExist {
+		releaseSend(ctx, otp, key, app)
+		app.lo.Error("error checking OTP status", "error", err)
+		return "", nil, storeSetError("Error checking OTP status.", http.StatusBadRequest, err)
+	}
+	if err == nil && isDuplicateSend(old, otp.Provider, otp.To, req.OTP, app.constants.DupSendWindow) {
+		releaseSend(ctx, otp, key, app)
+		return "", &otpResp{OTP: old, URL: getURL(app.constants.RootURL, old, false), Duplicate: true}, nil
+	}
+
+	return key, nil, nil
+}
+
+// releaseSend releases the send claim of an OTP once it's been pushed (or
+// has failed to be). Errors are only logged.
+func releaseSend(ctx context.Context, otp models.OTP, key string, app *App) {
+	if key == "" {
+		return
+	}
+	if err := app.store.ReleaseSend(ctx, otp.Namespace, otp.ID, key); err != nil {
+		app.lo.Error("error releasing OTP send", "error", err)
+	}
+}
+
+// setRef maps the OTP's reference code (generating one if it doesn't have
+// one) to its ID in the store for the OTP's TTL, if reference codes are
+// enabled.
+func setRef(ctx context.Context, otp *models.OTP, app *App) *setError {
+	if !app.constants.RefCodes {
+		return nil
+	}
+
+	for i := 0; i < maxRefTries; i++ {
+		if otp.Ref == "" {
+			ref, err := generateRef()
+			if err != nil {
+				app.lo.Error("error generating reference code", "error", err)
+				return &setError{http.StatusInternalServerError, errCodeInternal, "Error generating reference code.", nil}
+			}
+			otp.Ref = ref
+		}
+
+		err := app.store.SetRef(ctx, otp.Namespace, otp.Ref, otp.ID, otp.TTL)
+		if err == nil {
+			return nil
+		}
+
+		// The code is taken by another OTP. Try a new one.
+		if err == store.ErrRefExists {
+			otp.Ref = ""
+			continue
+		}
+
+		app.lo.Error("error setting reference code", "error", err)
+		return storeSetError("Error setting OTP.", http.StatusInternalServerError, err)
+	}
+
+	app.lo.Error("error generating a unique reference code", "namespace", otp.Namespace)
+	return &setError{http.StatusInternalServerError, errCodeInternal, "Error generating reference code.", nil}
+}
+
+// deleteRef removes the reference code of an OTP that couldn't be set, if it
+// was generated for it (and not carried over from the existing OTP), so that
+// it isn't left mapped to an ID that doesn't exist.
+func deleteRef(ctx context.Context, otp models.OTP, prevRef string, app *App) {
+	if otp.Ref == "" || otp.Ref == prevRef {
+		return
+	}
+	if err := app.store.DeleteRef(ctx, otp.Namespace, otp.Ref, otp.ID); err != nil {
+		app.lo.Error("error deleting reference code", "error", err)
+	}
+}
+
+// checkMaxActive returns an error if n new IDs would take a namespace over
+// the max number of active OTPs, in which case they can't be set. It's a
+// soft limit as concurrent requests may exceed it slightly.
+func checkMaxActive(ctx context.Context, namespace string, n int, app *App) *setError {
+	if app.constants.MaxActiveOTPs < 1 {
+		return nil
+	}
+
+	count, err := app.store.CountActive(ctx, namespace)
+	if err != nil {
+		app.lo.Error("error counting active OTPs", "error", err)
+		return storeSetError("Error checking OTP status.", http.StatusBadRequest, err)
+	}
+	if count+n > app.constants.MaxActiveOTPs {
+		return &setError{http.StatusTooManyRequests, errCodeMaxActiveOTPs,
+			"Too many active OTPs. Please retry in a while.", nil}
+	}
+
+	return nil
+}
+
+// sendOTP pushes an OTP that has been set out via its provider, if it has
+// an address, and returns the response.
+func sendOTP(ctx context.Context, otp models.OTP, p *provider, app *App) (otpResp, *setError) {
+	out := otpResp{OTP: otp, URL: getURL(app.constants.RootURL, otp, false)}
+	if otp.To != "" {
+		v, err := push(ctx, otp, p, app.constants.RootURL, app)
+		if errors.Is(err, models.ErrQueued) {
+			out.Queued = true
+			return out, nil
+		}
+		if err != nil {
+			return otpResp{}, pushSetError(err, p, app)
+		}
+		out.DeliveredVia = v
+		markSent(ctx, otp, app)
+	}
+
+	return out, nil
+}
+
+// bulkSendOTP pushes OTPs that have been set out via their provider that
+// supports bulk pushes (models.BulkPusher) in one call and returns the
+// response or error of each OTP. All the OTPs should have addresses.
+func bulkSendOTP(ctx context.Context, otps []models.OTP, p *provider, app *App) ([]otpResp, []*setError) {
+	var (
+		out  = make([]otpResp, len(otps))
+		errs = make([]*setError, len(otps))
+
+		pushOTPs []models.OTP
+		indexes  []int
+	)
+	for i, otp := range otps {
+		o, err := preparePush(ctx, otp, app)
+		if err != nil {
+			errs[i] = pushSetError(err, p, app)
+			continue
+		}
+		pushOTPs = append(pushOTPs, o)
+		indexes = append(indexes, i)
+	}
+
+	via, pushErrs := bulkPush(ctx, pushOTPs, p, app.constants.RootURL, app)
+	for n, i := range indexes {
+		out[i] = otpResp{OTP: otps[i], URL: getURL(app.constants.RootURL, otps[i], false)}
+		if errors.Is(pushErrs[n], models.ErrQueued) {
+			out[i].Queued = true
+			continue
+		}
+		if pushErrs[n] != nil {
+			out[i] = otpResp{}
+			errs[i] = pushSetError(pushErrs[n], p, app)
+			continue
+		}
+		markSent(ctx, otps[i], app)
+		out[i].DeliveredVia = via[n]
+	}
+
+	return out, errs
+}
+
+// markSent records a successful push of an OTP so that only OTPs that were
+// actually sent are deduplicated. Errors are only logged.
+func markSent(ctx context.Context, otp models.OTP, app *App) {
+	if err := app.store.SetSent(ctx, otp.Namespace, otp.ID); err != nil && err != store.ErrNotExist {
+		app.lo.Error("error recording OTP send", "error", err)
+	}
+}
+
+// pushSetError returns the setError for a failed push.
+func pushSetError(err error, p *provider, app *App) *setError {
+	if err == errQuotaExceeded {
+		return &setError{http.StatusTooManyRequests, errCodeQuotaExceeded, err.Error(), nil}
+	}
+
+	app.lo.Error("error sending OTP", "error", err, "provider", p.provider.ID())
+	return &setError{http.StatusInternalServerError, errCodeProviderError, "Error sending OTP.", nil}
+}
+
+// storeSetError returns the setError for a failed store operation.
+func storeSetError(msg string, status int, err error) *setError {
+	if err == store.ErrUnavailable {
+		return &setError{http.StatusServiceUnavailable, errCodeStoreUnavailable, errStoreUnavailable.msg, nil}
+	}
+	return &setError{status, errCodeInternal, msg, nil}
+}
+
+// batchError returns the result of a failed item in a batch.
+func batchError(e *setError) httpResp {
+	return httpResp{Status: "error", Message: e.msg, ErrorCode: e.code, Data: e.data}
+}
+
+// handleCheckOTPStatus checks the user input against a stored OTP.
+func handleCheckOTPStatus(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = r.Context().Value("namespace").(string)
+		id        = chi.URLParam(r, "id")
+	)
+
+	if len(id) < minIDLen {
+		sendErrorResponse(w, "ID should be min 6 chars.", http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+
+	// Check the OTP status.
+	out, err := app.store.Check(r.Context(), namespace, id, store.CounterNil)
+	if err != nil {
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest, errCodeOTPNotFound, nil)
+			return
+		}
+
+		app.lo.Error("error checking OTP", "error", err)
+		sendStoreErrorResponse(w, err.Error(), http.StatusBadRequest, err)
+		return
+	}
+
+	if out.Closed {
+		// Delete otp, unless verified OTPs are to be retained.
+		if r.Method == http.MethodDelete && !app.constants.RetainVerified {
+			app.store.Delete(r.Context(), namespace, id)
+		} else {
+			touchOTP(r.Context(), namespace, id, true, app)
+		}
+
+		sendResponse(w, out)
+		return
+	}
+
+	touchOTP(r.Context(), namespace, id, true, app)
+	sendErrorResponse(w, "OTP not verified.", http.StatusBadRequest, errCodeOTPNotVerified, nil)
+}
+
+// handleGetOTP returns an OTP's details without the OTP value, for
+// instance, for support agents to re-share its stored view_url.
+func handleGetOTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = r.Context().Value("namespace").(string)
+		id        = chi.URLParam(r, "id")
+	)
+
+	if len(id) < minIDLen {
+		sendErrorResponse(w, "ID should be min 6 chars.", http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+
+	out, err := app.store.Peek(r.Context(), namespace, id)
+	if err != nil {
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest, errCodeOTPNotFound, nil)
+			return
+		}
+
+		app.lo.Error("error checking OTP", "error", err)
+		sendStoreErrorResponse(w, "Error checking OTP.", http.StatusInternalServerError, err)
+		return
+	}
+	out.OTP = ""
+
+	sendResponse(w, out)
+}
+
+// handleGetOTPByRef returns an OTP's details by its reference code (eg: for
+// support lookups) without the OTP value.
+func handleGetOTPByRef(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = r.Context().Value("namespace").(string)
+		ref       = strings.ToUpper(strings.TrimSpace(chi.URLParam(r, "ref")))
+	)
+
+	if ref == "" {
+		sendErrorResponse(w, "Invalid `ref`.", http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+
+	id, err := app.store.GetRef(r.Context(), namespace, ref)
+	if err != nil && err != store.ErrNotExist {
+		app.lo.Error("error looking up reference code", "error", err)
+		sendStoreErrorResponse(w, "Error checking OTP.", http.StatusInternalServerError, err)
+		return
+	}
+
+	var out models.OTP
+	if err == nil {
+		out, err = app.store.Peek(r.Context(), namespace, id)
+
+		// A lagging replica may still have the OTP that was set before the
+		// code was mapped.
+		if err == nil && out.Ref != ref {
+			out, err = app.store.Check(r.Context(), namespace, id, store.CounterNil)
+		}
+	}
+
+	// The code may outlive its OTP or be reused by a newer one.
+	if err == store.ErrNotExist || (err == nil && out.Ref != ref) {
+		sendErrorResponse(w, store.ErrNotExist.Error(), http.StatusBadRequest, errCodeOTPNotFound, nil)
+		return
+	}
+	if err != nil {
+		app.lo.Error("error checking OTP", "error", err)
+		sendStoreErrorResponse(w, "Error checking OTP.", http.StatusInternalServerError, err)
+		return
+	}
+	out.OTP = ""
+
+	sendResponse(w, out)
+}
+
+// handleCloseOTP closes (marks as verified) an OTP without verification.
+// It is only allowed on namespaces with allow_admin_close enabled.
+func handleCloseOTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = r.Context().Value("namespace").(string)
+		id        = chi.URLParam(r, "id")
+	)
+
+	if !app.namespaces[namespace].AllowAdminClose {
+		sendErrorResponse(w, "Closing OTPs is not allowed for this namespace.", http.StatusForbidden, errCodeForbidden, nil)
+		return
+	}
+
+	if len(id) < minIDLen {
+		sendErrorResponse(w, "ID should be min 6 chars.", http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+
+	out, err := app.store.Check(r.Context(), namespace, id, store.CounterNil)
+	if err != nil {
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest, errCodeOTPNotFound, nil)
+			return
+		}
+
+		app.lo.Error("error checking OTP", "error", err)
+		sendStoreErrorResponse(w, "Error checking OTP.", http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := app.store.Close(r.Context(), namespace, id); err != nil {
+		app.lo.Error("error closing OTP", "error", err)
+		sendStoreErrorResponse(w, "Error closing OTP.", http.StatusInternalServerError, err)
+		return
+	}
+	out.Closed = true
+	out.VerifiedAt = time.Now().UnixMilli()
+	incrStat(r.Context(), namespace, store.StatVerified, app)
+	app.events.push(eventVerified, namespace, id, &out)
+
+	sendResponse(w, out)
+}
+
+// handleResetOTPAttempts resets the verification attempts and deliveries on
+// an OTP, for instance, to unlock a user. It is only allowed on namespaces
+// with allow_admin_reset enabled.
+func handleResetOTPAttempts(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = r.Context().Value("namespace").(string)
+		id        = chi.URLParam(r, "id")
+	)
+
+	if !app.namespaces[namespace].AllowAdminReset {
+		sendErrorResponse(w, "Resetting OTPs is not allowed for this namespace.", http.StatusForbidden, errCodeForbidden, nil)
+		return
+	}
+
+	if len(id) < minIDLen {
+		sendErrorResponse(w, "ID should be min 6 chars.", http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+
+	if err := app.store.ResetAttempts(r.Context(), namespace, id); err != nil {
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest, errCodeOTPNotFound, nil)
+			return
+		}
+
+		app.lo.Error("error resetting OTP attempts", "error", err)
+		sendStoreErrorResponse(w, "Error resetting OTP attempts.", http.StatusInternalServerError, err)
+		return
+	}
+
+	out, err := app.store.Check(r.Context(), namespace, id, store.CounterNil)
+	if err != nil {
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest, errCodeOTPNotFound, nil)
+			return
+		}
+
+		app.lo.Error("error checking OTP", "error", err)
+		sendStoreErrorResponse(w, "Error checking OTP.", http.StatusInternalServerError, err)
+		return
+	}
+
+	// Unlock the address too.
+	if out.To != "" {
+		if err := app.store.LockAddress(r.Context(), namespace, lockAddressKey(out, app), 0); err != nil {
+			app.lo.Error("error unlocking address", "error", err)
+		}
+	}
+
+	sendResponse(w, out)
+}
+
+// handleSetOTPDelivered marks an OTP as delivered. It's meant to be called
+// by the application on receiving a delivery report from the provider.
+func handleSetOTPDelivered(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = r.Context().Value("namespace").(string)
+		id        = chi.URLParam(r, "id")
+	)
+
+	if len(id) < minIDLen {
+		sendErrorResponse(w, "ID should be min 6 chars.", http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+
+	if err := app.store.SetDelivered(r.Context(), namespace, id); err != nil {
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest, errCodeOTPNotFound, nil)
+			return
+		}
+
+		app.lo.Error("error marking OTP delivered", "error", err)
+		sendStoreErrorResponse(w, "Error marking OTP delivered.", http.StatusInternalServerError, err)
+		return
+	}
+
+	sendResponse(w, true)
+}
+
+// handleVerifyOTP checks the user input against a stored OTP.
+func handleVerifyOTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = r.Context().Value("namespace").(string)
+		id        = chi.URLParam(r, "id")
+	)
+
+	req, err := parseVerifyReq(r)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+	var (
+		otpVal     = req.OTP
+		otpHash    = req.OTPHash
+		hashAlgo   = req.HashAlgo
+		verifyData = req.VerifyData
+		skipDelete = req.SkipDelete
+		chainNext  = req.ChainNext
+		next       = req.Next
+	)
+
+	// Clients may send the OTP in a header to keep it out of the body and query.
+	if otpVal == "" {
+		otpVal = r.Header.Get("X-OTP")
+	}
+	otpVal = cleanOTPInput(otpVal, namespace, app)
+
+	if len(id) < minIDLen {
+		sendErrorResponse(w, "ID should be min 6 chars", http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+	if otpVal == "" && otpHash == "" {
+		sendErrorResponse(w, "`otp` is empty.", http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+
+	// The OTP for the next step that's set on a successful verification.
+	if chainNext && next.ID == id {
+		sendErrorResponse(w, "`next_id` should be different from the verified OTP's ID.", http.StatusBadRequest, errCodeInvalidParam, nil)
+		return
+	}
+
+	// Verified OTPs are never deleted if they're to be retained.
+	if app.constants.RetainVerified {
+		skipDelete = true
+	}
+
+	// The client has sent a hash of the OTP instead of the OTP.
+	if otpVal == "" {
+		v, err := resolveOTPHash(r.Context(), namespace, id, otpHash, hashAlgo, app)
+		if err == store.ErrNotExist && app.constants.ObscureNotFound {
+			// Let verifyOTP respond with the obscured error.
+			err = nil
+		}
+		if err != nil {
+			code := http.StatusBadRequest
+			if err == errStoreUnavailable {
+				code = http.StatusServiceUnavailable
+			}
+			sendErrorResponse(w, err.Error(), code, errorCode(err, errCodeInvalidParam), nil)
+			return
+		}
+		otpVal = v
+	}
+
+	out, err := verifyOTP(r.Context(), namespace, id, otpVal, verifyData, !skipDelete, app)
+	if err != nil {
+		code := http.StatusBadRequest
+
+		// Respond to unknown IDs and incorrect OTPs identically so that
+		// IDs with active OTPs can't be enumerated.
+		if app.constants.ObscureNotFound && (err == store.ErrNotExist || errorCode(err, "") == errCodeOTPMismatch) {
+			sendErrorResponse(w, "Incorrect OTP", code, errCodeOTPMismatch, nil)
+			return
+		}
+
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, err.Error(), code, errCodeOTPNotFound, nil)
+			return
+		}
+
+		if err == errNotDelivered {
+			sendErrorResponse(w, err.Error(), http.StatusTooEarly, errCodeOTPNotDelivered, nil)
+			return
+		}
+
+		// The attempt was made too soon after the last one. Retry-After is
+		// the time left until the next attempt, rounded up to a second.
+		if err == errVerifyThrottled {
+			w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(out.RetryAfter.Seconds())), 1)))
+			sendErrorResponse(w, err.Error(), http.StatusTooManyRequests, errCodeRateLimited, nil)
+			return
+		}
+
+		if out.Closed {
+			code = http.StatusTooManyRequests
+		} else if err == errStoreUnavailable {
+			code = http.StatusServiceUnavailable
+		}
+		sendErrorResponse(w, err.Error(), code, errorCode(err, errCodeInternal), out)
+		return
+	}
+
+	resp := verifyResp{OTP: out}
+	if app.verifyToken != nil {
+		tk, err := makeVerifyToken(out, time.Now(), app.verifyToken)
+		if err != nil {
+			app.lo.Error("error signing verification token", "error", err)
+			sendErrorResponse(w, "Error signing verification token.", http.StatusInternalServerError, errCodeInternal, nil)
+			return
+		}
+		resp.Token = tk
+	}
+
+	// Set the next step's OTP. It's an independent OTP with its own attempts.
+	// The verification stands even if it fails, so the error is returned
+	// in the response for the client to retry setting it.
+	if chainNext {
+		if next.Provider == "" {
+			next.Provider = out.Provider
+		}
+		if next.To == "" && next.Provider == out.Provider {
+			next.To = out.To
+		}
+
+		res, err := setOTP(r.Context(), namespace, next, app)
+		if err != nil {
+			e := batchError(err)
+			resp.Next = &e
+		} else {
+			resp.Next = &httpResp{Status: "success", Data: res}
+		}
+	}
+
+	sendResponse(w, resp)
+}
+
+// handleOTPView renders the HTTP view.
+func handleOTPView(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = chi.URLParam(r, "namespace")
+		action    = r.FormValue("action")
+		id        = chi.URLParam(r, "id")
+		otp       = r.FormValue("otp")
+		embed     = r.FormValue("embed") == "1"
+
+		out    models.OTP
+		otpErr error
+	)
+	setFrameHeaders(w, app.namespaces[namespace], embed)
+
+	// Verification links sent to users carry a one-time nonce.
+	nonce := ""
+	if action == actCheck {
+		nonce = r.FormValue("nonce")
+	}
+
+	// Only POSTed forms act on the OTP. Any action on a GET request, for
+	// instance, one left over in the URL of a refreshed page, only renders the
+	// view so that it doesn't consume attempts or trigger resends. Opening a
+	// verification link renders the view with the OTP filled in for the user
+	// to confirm so that link prefetchers and scanners don't consume it.
+	confirm := false
+	if r.Method == http.MethodGet {
+		confirm = nonce != ""
+		action = ""
+	}
+
+	// Throttle verification attempts from the same client IP.
+	if action != "" && action != actResend && !allowWebVerify(r.Context(), clientIP(r, app.constants.TrustedProxies), app) {
+		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants, Embed: embed,
+			Title:       "Too many attempts",
+			Description: "There have been too many verification attempts. Please retry in a while.",
+		})
+		return
+	}
+
+	// OTPs with a verify_data factor can only be verified with the API, which
+	// takes it, and not here, where every attempt would be a mismatch.
+	if action == actCheck {
+		if o, err := app.store.Check(r.Context(), namespace, id, store.CounterNil); err == nil && hasVerifyData(o.Extra) {
+			app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants, Embed: embed,
+				Title:       "Verification unavailable",
+				Description: "This verification has to be completed in the application that requested it.",
+			})
+			return
+		}
+	}
+
+	// If the nonce of a confirmed verification link is invalid or has
+	// already been used, the link is being replayed.
+	if action == actCheck && nonce != "" {
+		if err := app.store.ConsumeNonce(r.Context(), namespace, id, nonce); err != nil {
+			if err != store.ErrNotExist {
+				app.lo.Error("error consuming nonce", "error", err)
+			}
+			app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants, Embed: embed,
+				Title: "Session expired",
+				Description: `Your session has expired.
+					Please re-initiate the verification.`,
+			})
+			return
+		}
+	}
+
+	if action == "" {
+		// Render the view without incrementing attempts.
+		out, otpErr = app.store.Check(r.Context(), namespace, id, store.CounterNil)
+	} else if action == actResend {
+		// Fetch the OTP for resending. Resends are counted as deliveries
+		// and don't consume verification attempts.
+		out, otpErr = app.store.Check(r.Context(), namespace, id, store.CounterGenerate)
+	} else {
+		// Validate the attempt.
+		out, otpErr = verifyOTP(r.Context(), namespace, id, cleanOTPInput(otp, namespace, app), "", false, app)
+	}
+	// A verification link is only confirmed while its nonce is unused.
+	if otpErr == store.ErrNotExist || (confirm && !out.Closed &&
+		subtle.ConstantTimeCompare([]byte(out.Nonce), []byte(nonce)) != 1) {
+		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants, Embed: embed,
+			Title: "Session expired",
+			Description: `Your session has expired.
+					Please re-initiate the verification.`,
+		})
+		return
+	}
+
+	// Attempts are maxed out and locked.
+	if isLocked(out) {
+		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants, Embed: embed,
+			Title:       "Too many attempts",
+			Description: fmt.Sprintf("Please retry after %d seconds.", int64(out.TTLSeconds)),
+		})
+		return
+	}
+
+	// Get the provider. Verification doesn't depend on the provider, so if
+	// it's been removed since the OTP was created, fall back to generic labels
+	// and only fail provider dependent operations such as resending.
+	pro, hasPro := app.providers[out.Provider]
+	var (
+		channelName = "OTP"
+		channelDesc = "Please enter the code sent to you to complete the verification."
+		addressDesc = ""
+		maxOTPLen   = len(out.OTP)
+	)
+	if hasPro {
+		channelName = pro.provider.ChannelName()
+		channelDesc = pro.provider.ChannelDesc()
+		addressDesc = pro.provider.AddressDesc()
+		maxOTPLen = pro.provider.MaxOTPLen()
+	}
+
+	// The code may be entered as it appears in the message.
+	ns := app.namespaces[namespace]
+	maxOTPLen += len(ns.OTPPrefix) + len(ns.OTPSuffix)
+
+	// OTP's already verified and closed.
+	if out.Closed {
+		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants, Embed: embed,
+			OTP:    out,
+			Closed: true,
+			Title:  fmt.Sprintf("%s verified", channelName),
+			Description: fmt.Sprintf(
+				`Your %s is verified. This page can be closed now.`,
+				channelName),
+		})
+		return
+	}
+
+	// There is no 'to' address set.
+	if out.To == "" {
+		http.Redirect(w, r, embedURI(fmt.Sprintf(uriViewAddress, out.Namespace, out.ID), embed),
+			http.StatusFound)
+		return
+	}
+
+	msg := ""
+	// It's a resend request.
+	if action == actResend {
+		msg = "OTP resent"
+		if !hasPro {
+			app.lo.Error("provider not found for resending OTP", "provider", out.Provider)
+			otpErr = errors.New("error resending OTP.")
+		} else if _, err := push(r.Context(), out, pro, app.constants.RootURL, app); err != nil {
+			// A queued resend is sent in the background, but isn't marked
+			// as sent until it is.
+			if errors.Is(err, models.ErrQueued) {
+				msg = "OTP queued for resending"
+			} else if err == errQuotaExceeded {
+				otpErr = err
+			} else {
+				app.lo.Error("error sending OTP", "error", err, "provider", pro.provider.ID())
+				otpErr = errors.New("error resending OTP.")
+			}
+		} else {
+			markSent(r.Context(), out, app)
+		}
+	}
+
+	if otpErr != nil {
+		msg = otpErr.Error()
+	}
+
+	data := webviewTpl{App: app.constants, Embed: embed,
+		ChannelName: channelName,
+		MaxOTPLen:   maxOTPLen,
+		Message:     msg,
+		Title:       fmt.Sprintf("Verify %s", channelName),
+		ChannelDesc: channelDesc,
+		AddressDesc: addressDesc,
+		OTP:         out,
+
+		TTL:          int(out.TTLSeconds),
+		AttemptsLeft: attemptsLeft(out),
+	}
+	if confirm {
+		data.Input = otp
+		data.Nonce = nonce
+	}
+	app.tpl.ExecuteTemplate(w, "otp", data)
+}
+
+// handleGetOTPClosed returns a true/false denoting whether an OTP is closed or not.
+// It is used by the OTP UI to poll for the OTP status and then self-close.
+func handleGetOTPClosed(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = chi.URLParam(r, "namespace")
+		id        = chi.URLParam(r, "id")
+	)
+
+	// In long-polling mode, start waiting before checking the OTP so that
+	// a close in between isn't missed. The OTP is then read from the primary
+	// as a close that hasn't been replicated yet would hold the request.
+	// Otherwise, the next poll catches up with a lagging replica.
+	var closed <-chan struct{}
+	if app.closeWaiters != nil {
+		ch, done := app.closeWaiters.wait(namespace, id)
+		defer done()
+		closed = ch
+	}
+
+	var (
+		out models.OTP
+		err error
+	)
+	if closed != nil {
+		out, err = app.store.Check(r.Context(), namespace, id, store.CounterNil)
+	} else {
+		out, err = app.store.Peek(r.Context(), namespace, id)
+	}
+	if err != nil {
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, "Session expired.", http.StatusBadRequest, errCodeOTPNotFound, nil)
+			return
+		}
+
+		sendStoreErrorResponse(w, "Error checking status.", http.StatusInternalServerError, err)
+		return
+	}
+
+	// Hold the request until the OTP is closed or the poll times out.
+	if !out.Closed && closed != nil {
+		t := time.NewTimer(app.constants.LongPollTimeout)
+		defer t.Stop()
+
+		select {
+		case <-closed:
+			out.Closed = true
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	touchOTP(r.Context(), namespace, id, false, app)
+	sendResponse(w, struct {
+		Closed bool `json:"closed"`
+	}{out.Closed})
+}
+
+// handleOTPEvents streams the status of an OTP to the web view as Server-Sent
+// Events. A "closed" event is sent as soon as the OTP is closed (including if
+// it's already closed), after which the stream ends. Open streams are ended
+// after app.status_events_max_lifetime, or when the server shuts down, and
+// the clients reconnect.
+func handleOTPEvents(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = chi.URLParam(r, "namespace")
+		id        = chi.URLParam(r, "id")
+	)
+
+	if !app.constants.StatusEvents || app.closeWaiters == nil {
+		sendErrorResponse(w, "Not found.", http.StatusNotFound, errCodeNotFound, nil)
+		return
+	}
+
+	// Start waiting before checking the OTP so that a close in between
+	// isn't missed.
+	closed, done := app.closeWaiters.wait(namespace, id)
+	defer done()
+
+	out, err := app.store.Check(r.Context(), namespace, id, store.CounterNil)
+	if err != nil {
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, "Session expired.", http.StatusBadRequest, errCodeOTPNotFound, nil)
+			return
+		}
+
+		sendStoreErrorResponse(w, "Error checking status.", http.StatusInternalServerError, err)
+		return
+	}
+	touchOTP(r.Context(), namespace, id, false, app)
+
+	// The stream outlives the server's write timeout.
+	var (
+		lifetime = app.constants.StatusEventsLifetime
+		rc       = http.NewResponseController(w)
+	)
+	if err := rc.SetWriteDeadline(time.Now().Add(lifetime + sseKeepAlive)); err != nil {
+		app.lo.Error("error setting status events write deadline", "error", err)
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if out.Closed {
+		io.WriteString(w, "event: closed\ndata: {}\n\n")
+		rc.Flush()
+		return
+	}
+	io.WriteString(w, ": ok\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	var (
+		end  = time.NewTimer(lifetime)
+		ping = time.NewTicker(sseKeepAlive)
+	)
+	defer end.Stop()
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-closed:
+			io.WriteString(w, "event: closed\ndata: {}\n\n")
+			rc.Flush()
+			return
+
+		case <-ping.C:
+			io.WriteString(w, ": ping\n\n")
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+		case <-end.C:
+			return
+
+		// The server is shutting down and doesn't wait for streams to end.
+		case <-app.stopping:
+			return
+
+		// The client has disconnected.
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleOTPQR renders a PNG QR code of the OTP's web view URL so that the
+// verification can be continued on another device.
+func handleOTPQR(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = chi.URLParam(r, "namespace")
+		id        = chi.URLParam(r, "id")
+	)
+
+	out, err := app.store.Check(r.Context(), namespace, id, store.CounterNil)
+	if err != nil {
+		if err == store.ErrNotExist {
+			sendErrorResponse(w, "Session expired.", http.StatusNotFound, errCodeOTPNotFound, nil)
+			return
+		}
+
+		sendStoreErrorResponse(w, "Error checking status.", http.StatusInternalServerError, err)
+		return
+	}
+
+	b, err := qrcode.Encode(getURL(app.constants.RootURL, out, false), qrcode.Medium, qrSize)
+	if err != nil {
+		app.lo.Error("error generating QR code", "error", err)
+		sendErrorResponse(w, "Error generating QR code.", http.StatusInternalServerError, errCodeInternal, nil)
+		return
+	}
+
+	// The URL doesn't change for the lifetime of the OTP.
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(out.TTL.Seconds())))
+	w.Write(b)
+}
+
+// handleAddressView renders the UI for collecting the provider address for
+// verification from the user.
+func handleAddressView(w http.ResponseWriter, r *http.Request) {
+	var (
+		app       = r.Context().Value("app").(*App)
+		namespace = chi.URLParam(r, "namespace")
+		id        = chi.URLParam(r, "id")
+		to        = r.FormValue("to")
+		embed     = r.FormValue("embed") == "1"
+	)
+	setFrameHeaders(w, app.namespaces[namespace], embed)
+
+	out, err := app.store.Check(r.Context(), namespace, id, store.CounterNil)
+	if err != nil {
+		if err == store.ErrNotExist {
+			app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants, Embed: embed,
+				Title: "Session expired",
+				Description: `Your session has expired.
+					Please re-initiate the verification.`,
+			})
+		} else {
+			app.lo.Error("error checking OTP", "error", err)
+			app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants, Embed: embed,
+				Title:       "Internal error",
+				Description: `Please try later.`,
+			})
+		}
+		return
+	}
+
+	// Address is already set.
+	if out.To != "" {
+		http.Redirect(w, r, embedURI(fmt.Sprintf(uriViewOTP, out.Namespace, out.ID), embed),
+			http.StatusFound)
+		return
+	}
+
+	// Get the provider.
+	pro, ok := app.providers[out.Provider]
+	if !ok {
+		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants, Embed: embed,
 			Title:       "Internal error",
 			Description: "The provider for this OTP was not found.",
 		})
 		return
 	}
 
-	// OTP's already verified and closed.
-	if out.Closed {
-		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants,
-			OTP:    out,
-			Closed: true,
-			Title:  fmt.Sprintf("%s verified", pro.provider.ChannelName()),
-			Description: fmt.Sprintf(
-				`Your %s is verified. This page can be closed now.`,
-				pro.provider.ChannelName()),
-		})
-		return
+	// Validate the address. Like new OTPs, it's rejected if it's locked.
+	msg := ""
+	if to != "" {
+		addr := out
+		addr.To = to
+
+		if err := pro.provider.ValidateAddress(to); err != nil {
+			msg = err.Error()
+		} else if ttl, err := getAddressLock(r.Context(), addr, app); err != nil {
+			app.lo.Error("error checking address lock", "error", err)
+			msg = "error checking address"
+		} else if ttl > 0 {
+			msg = fmt.Sprintf("Too many failed attempts. Retry after %0.f seconds.", math.Ceil(ttl.Seconds()))
+		} else if err := app.store.SetAddress(r.Context(), namespace, id, to); err != nil {
+			msg = err.Error()
+		} else {
+			out.To = to
+			_, err := push(r.Context(), out, pro, app.constants.RootURL, app)
+			if err != nil && !errors.Is(err, models.ErrQueued) {
+				app.lo.Error("error sending OTP", "error", err, "provider", pro.provider.ID())
+				msg = "error sending OTP"
+			} else {
+				// A queued OTP is sent in the background, but isn't marked
+				// as sent until it is.
+				if err == nil {
+					markSent(r.Context(), out, app)
+				}
+				http.Redirect(w, r, embedURI(fmt.Sprintf(uriViewOTP, out.Namespace, out.ID), embed),
+					http.StatusFound)
+			}
+		}
+	}
+
+	app.tpl.ExecuteTemplate(w, "index", webviewTpl{App: app.constants, Embed: embed,
+		ChannelName:   pro.provider.ChannelName(),
+		AddressName:   pro.provider.AddressName(),
+		MaxAddressLen: pro.provider.MaxAddressLen(),
+		Message:       msg,
+		Title:         fmt.Sprintf("Verify %s", pro.provider.ChannelName()),
+		ChannelDesc:   pro.provider.ChannelDesc(),
+		AddressDesc:   pro.provider.AddressDesc(),
+		OTP:           out,
+	})
+}
+
+// setFrameHeaders sets the headers that control which sites can frame the
+// web views. Web views can only be framed by the gateway's own pages, except
+// for embedded views, which the namespace's embed_origins can frame.
+func setFrameHeaders(w http.ResponseWriter, ns nsConf, embed bool) {
+	if !embed || len(ns.EmbedOrigins) == 0 {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Set("Content-Security-Policy", "frame-ancestors 'self'")
+		return
+	}
+
+	// X-Frame-Options can't allow multiple origins and browsers that support
+	// frame-ancestors ignore it.
+	w.Header().Set("Content-Security-Policy", "frame-ancestors "+strings.Join(ns.EmbedOrigins, " "))
+}
+
+// embedURI carries the embed param over to the web view URIs that embedded
+// views redirect to.
+func embedURI(uri string, embed bool) string {
+	if !embed {
+		return uri
+	}
+	return uri + "?embed=1"
+}
+
+// verifyOTP validates an OTP against user input.
+func verifyOTP(ctx context.Context, namespace, id, otp, verifyData string, deleteOnVerify bool, app *App) (models.OTP, error) {
+	// Checks against the stored OTP before the atomic verification. Verify()
+	// only matches the OTP if it hasn't been replaced since these checks.
+	// If the OTP couldn't be read, an empty OTP that never matches is
+	// verified so that Verify() returns the error or counts the attempt.
+	var lastSet int64
+	if o, err := app.store.Check(ctx, namespace, id, store.CounterNil); err != nil {
+		otp = ""
+	} else {
+		lastSet = o.LastSet
+
+		// Reject the attempt without counting it until the delivery is
+		// confirmed or the wait for the confirmation runs out.
+		if ns := app.namespaces[namespace]; ns.RequireDelivery && !o.Delivered &&
+			time.Since(time.UnixMilli(o.LastSet)) < ns.DeliveryWait {
+			return o, errNotDelivered
+		}
+
+		// If the OTP or the namespace is case-insensitive, resolve the input
+		// to the stored OTP so that the store's comparison matches.
+		if (o.CaseInsens || app.namespaces[namespace].CaseInsensitive) && strings.EqualFold(o.OTP, otp) {
+			otp = o.OTP
+		}
+
+		// If the OTP has a secondary verify_data factor, it has to match too.
+		// Otherwise, an empty OTP that never matches is verified so that
+		// the attempt is counted.
+		if !matchVerifyData(o.Extra, verifyData) {
+			otp = ""
+		}
+	}
+
+	// Verify and close the OTP atomically.
+	out, err := app.store.Verify(ctx, namespace, id, otp, lastSet, app.constants.VerifyMinInterval, app.constants.VerifyGrace)
+
+	// A repeat verification (eg: a retry after a dropped response) of an
+	// OTP that was verified within the grace period succeeds again.
+	repeat := err == store.ErrAlreadyVerified
+	if repeat {
+		err = nil
+	}
+	if err != nil {
+		// The OTP's attempts are exhausted. Lock its address too so that
+		// the lockout can't be bypassed by setting a new OTP.
+		if (err == store.ErrLocked || err == store.ErrMismatch) && out.VerifyAttempts >= out.MaxAttempts {
+			lockAddress(ctx, out, app)
+		}
+
+		if err == store.ErrMismatch {
+			incrStat(ctx, namespace, store.StatFailed, app)
+			app.events.push(eventFailed, namespace, id, &out)
+
+			// This attempt exhausted the OTP's attempts.
+			if out.VerifyAttempts >= out.MaxAttempts {
+				incrStat(ctx, namespace, store.StatLocked, app)
+			}
+		}
+
+		// Slow down incorrect attempts (and not-found ones that are
+		// indistinguishable from them).
+		if err == store.ErrMismatch || (err == store.ErrNotExist && app.constants.ObscureNotFound) {
+			verifyFailDelay(ctx, app)
+		}
+
+		switch err {
+		case store.ErrNotExist:
+			return out, err
+		case store.ErrThrottled:
+			return out, errVerifyThrottled
+		case store.ErrLocked:
+			return out, &codedError{code: errCodeOTPLocked,
+				msg: fmt.Sprintf("Too many attempts. Please retry after %0.f seconds.", out.TTL.Seconds())}
+		case store.ErrMismatch:
+			return out, &codedError{code: errCodeOTPMismatch, msg: "Incorrect OTP"}
+		}
+
+		if err == store.ErrUnavailable {
+			return out, errStoreUnavailable
+		}
+
+		app.lo.Error("error checking OTP", "error", err)
+		return out, &codedError{code: errCodeInternal, msg: "error checking OTP."}
+	}
+
+	if !repeat {
+		incrStat(ctx, namespace, store.StatVerified, app)
+		app.events.push(eventVerified, namespace, id, &out)
+	}
+
+	// Delete the OTP? If there's a grace period, it's kept (closed) until
+	// then so that repeat verifications succeed.
+	if deleteOnVerify {
+		if app.constants.VerifyGrace > 0 {
+			app.store.Expire(ctx, namespace, id, app.constants.VerifyGrace)
+		} else {
+			app.store.Delete(ctx, namespace, id)
+		}
+	}
+
+	return out, nil
+}
+
+// verifyFailDelay waits for app.verify_fail_delay plus a random jitter of
+// up to app.verify_fail_jitter, or until the context is cancelled.
+func verifyFailDelay(ctx context.Context, app *App) {
+	d := app.constants.VerifyFailDelay
+	if j := app.constants.VerifyFailJitter; j > 0 {
+		d += time.Duration(mrand.Int63n(int64(j)))
+	}
+	if d <= 0 {
+		return
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// makeVerifyToken returns a short-lived HS256 JWT attesting that an OTP
+// was verified at the given time. The address is included as a hex encoded
+// SHA256 hash so that it isn't exposed.
+func makeVerifyToken(otp models.OTP, now time.Time, c *verifyTokenConf) (string, error) {
+	to := sha256.Sum256([]byte(otp.To))
+
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":         "otpgateway",
+		"namespace":   otp.Namespace,
+		"id":          otp.ID,
+		"to_hash":     hex.EncodeToString(to[:]),
+		"verified_at": now.Unix(),
+		"iat":         now.Unix(),
+		"exp":         now.Add(c.ttl).Unix(),
+	})
+
+	return t.SignedString(c.secret)
+}
+
+// validateExtra validates an extra payload against a JSON schema. The
+// error describes the first violation without exposing the schema's location.
+func validateExtra(sc *jsonschema.Schema, extra []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(extra, &v); err != nil {
+		return fmt.Errorf("Invalid JSON in `extra`: %v", err)
+	}
+
+	err := sc.Validate(v)
+	if err == nil {
+		return nil
+	}
+
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	for len(ve.Causes) > 0 {
+		ve = ve.Causes[0]
+	}
+	return fmt.Errorf("`extra%s` doesn't match the schema: %s", strings.ReplaceAll(ve.InstanceLocation, "/", "."), ve.Message)
+}
+
+// hasVerifyData tells if an OTP's extra has a verify_data factor.
+func hasVerifyData(extra json.RawMessage) bool {
+	var e struct {
+		VerifyData string `json:"verify_data"`
+	}
+	return json.Unmarshal(extra, &e) == nil && e.VerifyData != ""
+}
+
+// matchVerifyData checks the given verify_data against the hex encoded
+// SHA256 hash in the OTP's extra.verify_data, if there's one.
+func matchVerifyData(extra json.RawMessage, data string) bool {
+	var e struct {
+		VerifyData string `json:"verify_data"`
+	}
+	if err := json.Unmarshal(extra, &e); err != nil || e.VerifyData == "" {
+		return true
+	}
+
+	b, err := hex.DecodeString(e.VerifyData)
+	if err != nil {
+		return false
+	}
+
+	h := sha256.Sum256([]byte(data))
+	return subtle.ConstantTimeCompare(h[:], b) == 1
+}
+
+// autoProvider returns the first of the given providers that accepts
+// the address, or an empty string if none does.
+func autoProvider(to string, providers []string, app *App) string {
+	for _, name := range providers {
+		if p, ok := app.providers[name]; ok && p.provider.ValidateAddress(to) == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// lockAddress locks the address of an OTP if address lockout is enabled.
+func lockAddress(ctx context.Context, otp models.OTP, app *App) {
+	if app.constants.AddressLockout <= 0 || otp.To == "" {
+		return
+	}
+
+	if err := app.store.LockAddress(ctx, otp.Namespace, lockAddressKey(otp, app), app.constants.AddressLockout); err != nil {
+		app.lo.Error("error locking address", "error", err)
+	}
+}
+
+// getAddressLock returns the remaining duration of the lock on an OTP's
+// address, or 0 if it's not locked or the lockout isn't enabled.
+func getAddressLock(ctx context.Context, otp models.OTP, app *App) (time.Duration, error) {
+	if app.constants.AddressLockout == 0 || otp.To == "" {
+		return 0, nil
+	}
+	return app.store.GetAddressLock(ctx, otp.Namespace, lockAddressKey(otp, app))
+}
+
+// lockAddressKey returns the address of an OTP that address locks are set
+// on, in its provider's canonical form (models.AddressNormalizer) so that
+// a lock can't be bypassed by spelling the address differently.
+func lockAddressKey(otp models.OTP, app *App) string {
+	to := strings.TrimSpace(otp.To)
+	if p, ok := app.providers[otp.Provider]; ok {
+		if n, ok := p.provider.(models.AddressNormalizer); ok {
+			return n.NormalizeAddress(to, app.namespaces[otp.Namespace].DefaultPhoneCode)
+		}
+	}
+
+	return to
+}
+
+// affixOTP returns the OTP with the namespace's prefix and suffix as it's
+// displayed in messages.
+func affixOTP(otp string, ns nsConf) string {
+	return ns.OTPPrefix + otp + ns.OTPSuffix
+}
+
+// cleanOTPInput normalizes a user entered OTP for comparison. Surrounding
+// whitespace (app.trim_otp_input), whitespace within grouped codes (eg:
+// "123 456" with app.strip_otp_spaces), and the namespace's affixes are
+// removed. The stored OTP is never altered.
+func cleanOTPInput(otp, namespace string, app *App) string {
+	if app.constants.TrimOTPInput {
+		otp = strings.TrimSpace(otp)
+	}
+	if app.constants.StripOTPSpaces {
+		otp = strings.Join(strings.Fields(otp), "")
+	}
+	return trimOTPAffixes(otp, app.namespaces[namespace])
+}
+
+// trimOTPAffixes strips the namespace's prefix and suffix (compared
+// case-insensitively) from an OTP entered as it was displayed. OTPs
+// entered without them are returned as is.
+func trimOTPAffixes(otp string, ns nsConf) string {
+	if p := ns.OTPPrefix; p != "" && len(otp) > len(p) && strings.EqualFold(otp[:len(p)], p) {
+		otp = otp[len(p):]
+	}
+	if s := ns.OTPSuffix; s != "" && len(otp) > len(s) && strings.EqualFold(otp[len(otp)-len(s):], s) {
+		otp = otp[:len(otp)-len(s)]
+	}
+	return otp
+}
+
+// incrStat increments a namespace's stat counter for the current (UTC) day.
+// Errors are only logged as the stats are informational.
+func incrStat(ctx context.Context, namespace, stat string, app *App) {
+	if err := app.store.IncrStat(ctx, namespace, stat, statsDay(time.Now())); err != nil {
+		app.lo.Error("error incrementing stat", "error", err, "stat", stat)
+	}
+}
+
+// statsDay returns the day (UTC) that stats are counted against.
+func statsDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// touchOTP records an access on an OTP and, if extend is set, extends its
+// expiry if sliding expiry is enabled. Only authenticated accesses should
+// extend OTPs so that anyone with the (unauthenticated) web view URL can't
+// keep them alive. Errors are only logged as the access is incidental.
+func touchOTP(ctx context.Context, namespace, id string, extend bool, app *App) {
+	var ttl time.Duration
+	if extend {
+		ttl = app.constants.SlidingExpiry
+	}
+
+	err := app.store.Touch(ctx, namespace, id, ttl)
+	if err != nil && err != store.ErrNotExist {
+		app.lo.Error("error touching OTP", "error", err)
+	}
+}
+
+// resolveOTPHash compares a hex encoded hash of an OTP against the hash of
+// the stored OTP and returns the stored OTP if they match so that it can be
+// verified. An empty string (that never matches) is returned otherwise.
+func resolveOTPHash(ctx context.Context, namespace, id, otpHash, algo string, app *App) (string, error) {
+	var h hash.Hash
+	switch algo {
+	case "", "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", errors.New("Unknown `hash_algo`. Should be sha256 or sha512.")
+	}
+
+	b, err := hex.DecodeString(otpHash)
+	if err != nil || len(b) != h.Size() {
+		return "", errors.New("Invalid `otp_hash` value.")
+	}
+
+	out, err := app.store.Check(ctx, namespace, id, store.CounterNil)
+	if err != nil {
+		if err == store.ErrNotExist {
+			return "", err
+		}
+		if err == store.ErrUnavailable {
+			return "", errStoreUnavailable
+		}
+
+		app.lo.Error("error checking OTP", "error", err)
+		return "", &codedError{code: errCodeInternal, msg: "error checking OTP."}
+	}
+
+	h.Write([]byte(out.OTP))
+	if subtle.ConstantTimeCompare(h.Sum(nil), b) != 1 {
+		return "", nil
+	}
+
+	return out.OTP, nil
+}
+
+// withTimeout is a middleware that sets a deadline on the request context
+// so that slow provider and store calls made by handlers are cancelled.
+// Event streams have their own lifetime and are exempt.
+func withTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isEventStream(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// withAPIAllowList is a middleware that rejects /api/* requests from client
+// IPs (resolved through the trusted proxies) outside the allowed ranges. The
+// liveness and readiness probes are exempt so that orchestrators can reach
+// them.
+func withAPIAllowList(allowed, trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHealthCheck(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if strings.HasPrefix(r.URL.Path, "/api/") && !inCIDRs(clientIP(r, trusted), allowed) {
+				sendErrorResponse(w, "Access denied.", http.StatusForbidden, errCodeForbidden, nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withConcurrencyLimit is a middleware that sheds load by rejecting requests
+// with a 503 when max requests are already in flight, instead of letting
+// them pile up and exhaust memory and the store. Health checks are exempt so
+// that probes work under load, and so are event streams and, if longPoll is
+// set, status polls, which are long lived, mostly idle, and have their own
+// lifetime.
+func withConcurrencyLimit(max int, longPoll bool) func(http.Handler) http.Handler {
+	sem := make(chan struct{}, max)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHealthCheck(r) || isEventStream(r) || (longPoll && isStatusPoll(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				next.ServeHTTP(w, r)
+			default:
+				w.Header().Set("Retry-After", "1")
+				sendErrorResponse(w, "Server is busy. Please retry.", http.StatusServiceUnavailable, errCodeOverloaded, nil)
+			}
+		})
+	}
+}
+
+// isHealthCheck returns true if the request is for one of the liveness and
+// readiness probes.
+func isHealthCheck(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/live", "/api/ready", "/api/health":
+		return true
+	}
+	return false
+}
+
+// isEventStream returns true if the request is for the Server-Sent Events
+// status stream of an OTP. It's matched by the route and not by the Accept
+// header so that other requests can't opt out of the middleware limits.
+func isEventStream(r *http.Request) bool {
+	ok, _ := path.Match(uriEvents, r.URL.Path)
+	return ok
+}
+
+// isStatusPoll returns true if the request is for the web view's OTP status
+// poll.
+func isStatusPoll(r *http.Request) bool {
+	ok, _ := path.Match(uriStatus, r.URL.Path)
+	return ok
+}
+
+// wrap is a middleware that wraps HTTP handlers and injects the "app" context.
+func wrap(app *App, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), "app", app)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// sendResponse sends an envelope in the negotiated format (JSON by
+// default) to the HTTP response.
+func sendResponse(w http.ResponseWriter, data interface{}) {
+	sendResponseCode(w, http.StatusOK, data)
+}
+
+// sendResponseCode sends a success response with the given status code.
+func sendResponseCode(w http.ResponseWriter, code int, data interface{}) {
+	if err := writeResponse(w, code, httpResp{Status: "success", Data: data}); err != nil {
+		sendErrorResponse(w, "Internal Server Error.", http.StatusInternalServerError, errCodeInternal, nil)
+	}
+}
+
+// sendStoreErrorResponse sends an error response for a failed store
+// operation. If the store is unavailable, a 503 is sent instead.
+func sendStoreErrorResponse(w http.ResponseWriter, message string, code int, err error) {
+	if err == store.ErrUnavailable {
+		sendErrorResponse(w, errStoreUnavailable.msg, http.StatusServiceUnavailable, errCodeStoreUnavailable, nil)
+		return
+	}
+
+	sendErrorResponse(w, message, code, errCodeInternal, nil)
+}
+
+// sendErrorResponse sends an error envelope in the negotiated format
+// (JSON by default) to the HTTP response.
+func sendErrorResponse(w http.ResponseWriter, message string, code int, errCode string, data interface{}) {
+	resp := httpResp{Status: "error",
+		Message:   message,
+		ErrorCode: errCode,
+		Data:      data}
+	if err := writeResponse(w, code, resp); err != nil {
+		// Fall back to the message without the data.
+		resp.Data = nil
+		writeResponse(w, code, resp)
+	}
+}
+
+// generateRandomString generates a cryptographically random,
+// alphanumeric string of length n.
+func generateRandomString(totalLen int, chars string) (string, error) {
+	bytes := make([]byte, totalLen)
+	if _, err := randRead(bytes); err != nil {
+		return "", err
+	}
+	for k, v := range bytes {
+		bytes[k] = chars[v%byte(len(chars))]
+	}
+	return string(bytes), nil
+}
+
+// randomOTPGenerator is the default OTP generator that picks random
+// characters with crypto/rand.
+type randomOTPGenerator struct{}
+
+func (randomOTPGenerator) Generate(_ context.Context, length int, charset string) (string, error) {
+	return generateRandomString(length, charset)
+}
+
+// generateOTP generates a numeric OTP of the given length with the
+// configured generator. OTPs of other lengths are rejected as the provider
+// may not be able to send them.
+func generateOTP(ctx context.Context, length int, app *App) (string, error) {
+	o, err := app.otpGen.Generate(ctx, length, numChars)
+	if err != nil {
+		return "", err
+	}
+	if utf8.RuneCountInString(o) != length {
+		return "", fmt.Errorf("generator returned an OTP of length %d instead of %d", utf8.RuneCountInString(o), length)
+	}
+	return o, nil
+}
+
+// generateID generates a random OTP ID of the given length from the charset,
+// or a UUID (v4) if the charset is idCharsetUUID.
+func generateID(totalLen int, charset string) (string, error) {
+	if charset == idCharsetUUID {
+		u, err := uuid.NewRandom()
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+
+	if totalLen == 0 {
+		totalLen = defaultIDLen
+	}
+	if charset == "" {
+		charset = alphaNumChars
+	}
+	return generateRandomString(totalLen, charset)
+}
+
+// generateRef generates a random reference code of the form ABC-123.
+func generateRef() (string, error) {
+	a, err := generateRandomString(3, refChars)
+	if err != nil {
+		return "", err
+	}
+	n, err := generateRandomString(3, numChars)
+	if err != nil {
+		return "", err
+	}
+	return a + "-" + n, nil
+}
+
+// isLocked tells if an OTP is locked after exceeding attempts.
+func isLocked(otp models.OTP) bool {
+	if otp.VerifyAttempts >= otp.MaxAttempts {
+		return true
 	}
 
-	// There is no 'to' address set.
-	if out.To == "" {
-		http.Redirect(w, r, fmt.Sprintf(uriViewAddress, out.Namespace, out.ID),
-			http.StatusFound)
-		return
+	if otp.Deliveries > otp.MaxGenerate {
+		return true
 	}
+	return false
+}
 
-	msg := ""
-	// It's a resend request.
-	if action == actResend {
-		msg = "OTP resent"
-		if err := push(out, pro, app.constants.RootURL, app); err != nil {
-			app.lo.Error("error sending OTP", "error", err, "provider", pro.provider.ID())
-			otpErr = errors.New("error resending OTP.")
-		}
+// isDuplicateSend tells if an OTP with the same provider, address and
+// OTP value (if one was given) was sent within the window. OTPs whose last
+// push failed aren't duplicates so that the send can be retried.
+func isDuplicateSend(otp models.OTP, provider, to, otpVal string, window time.Duration) bool {
+	if window <= 0 || otp.Closed || otp.LastSent == 0 || to == "" || otp.To != to || otp.Provider != provider {
+		return false
 	}
-
-	if otpErr != nil {
-		msg = otpErr.Error()
+	if otpVal != "" && otpVal != otp.OTP {
+		return false
 	}
 
-	app.tpl.ExecuteTemplate(w, "otp", webviewTpl{App: app.constants,
-		ChannelName: pro.provider.ChannelName(),
-		MaxOTPLen:   pro.provider.MaxOTPLen(),
-		Message:     msg,
-		Title:       fmt.Sprintf("Verify %s", pro.provider.ChannelName()),
-		ChannelDesc: pro.provider.ChannelDesc(),
-		AddressDesc: pro.provider.AddressDesc(),
-		OTP:         out,
-	})
+	return time.Since(time.UnixMilli(otp.LastSent)) < window
 }
 
-// handleGetOTPClosed returns a true/false denoting whether an OTP is closed or not.
-// It is used by the OTP UI to poll for the OTP status and then self-close.
-func handleGetOTPClosed(w http.ResponseWriter, r *http.Request) {
-	var (
-		app       = r.Context().Value("app").(*App)
-		namespace = chi.URLParam(r, "namespace")
-		id        = chi.URLParam(r, "id")
-	)
+// isReusable tells if an existing OTP is open, was sent (or confirmed as
+// delivered), and was set for the same provider, address, and OTP value (if
+// one is given) as a new request. An OTP whose push failed isn't reused so
+// that the new request sends it.
+func isReusable(otp models.OTP, provider, to, otpVal string) bool {
+	if otp.Closed || otp.To != to || otp.Provider != provider {
+		return false
+	}
+	if !otp.Delivered && otp.LastSent == 0 {
+		return false
+	}
+	return otpVal == "" || otpVal == otp.OTP
+}
 
-	out, err := app.store.Check(namespace, id, store.CounterNil)
+// attemptsLeft returns the number of verification attempts remaining on an OTP.
+func attemptsLeft(otp models.OTP) int {
+	if n := otp.MaxAttempts - otp.VerifyAttempts; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// push pushes an OTP to its provider, and if that fails, to each of the
+// provider's fallback providers in order. It returns the name of the provider
+// that delivered the OTP.
+func push(ctx context.Context, otp models.OTP, p *provider, rootURL string, app *App) (string, error) {
+	otp, err := preparePush(ctx, otp, app)
 	if err != nil {
-		if err == store.ErrNotExist {
-			sendErrorResponse(w, "Session expired.", http.StatusBadRequest, nil)
-			return
-		}
+		return "", err
+	}
 
-		sendErrorResponse(w, "Error checking status.", http.StatusInternalServerError, nil)
-		return
+	err = pushProvider(ctx, otp, p, rootURL, app)
+	if err == nil {
+		return otp.Provider, nil
 	}
 
-	sendResponse(w, struct {
-		Closed bool `json:"closed"`
-	}{out.Closed})
+	return pushFallbacks(ctx, otp, p, rootURL, err, app)
 }
 
-// handleAddressView renders the UI for collecting the provider address for
-// verification from the user.
-func handleAddressView(w http.ResponseWriter, r *http.Request) {
-	var (
-		app       = r.Context().Value("app").(*App)
-		namespace = chi.URLParam(r, "namespace")
-		id        = chi.URLParam(r, "id")
-		to        = r.FormValue("to")
-	)
-
-	out, err := app.store.Check(namespace, id, store.CounterNil)
+// preparePush sets a one-time nonce for the verification URL on an OTP so
+// that it can't be replayed, and the namespace's default phone code.
+func preparePush(ctx context.Context, otp models.OTP, app *App) (models.OTP, error) {
+	nonce, err := generateRandomString(16, alphaNumChars)
 	if err != nil {
-		if err == store.ErrNotExist {
-			app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants,
-				Title: "Session expired",
-				Description: `Your session has expired.
-					Please re-initiate the verification.`,
-			})
-		} else {
-			app.lo.Error("error checking OTP", "error", err)
-			app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants,
-				Title:       "Internal error",
-				Description: `Please try later.`,
-			})
-		}
-		return
+		return otp, err
 	}
-
-	// Address is already set.
-	if out.To != "" {
-		http.Redirect(w, r, fmt.Sprintf(uriViewOTP, out.Namespace, out.ID),
-			http.StatusFound)
-		return
+	if err := app.store.SetNonce(ctx, otp.Namespace, otp.ID, nonce); err != nil {
+		return otp, err
 	}
+	otp.Nonce = nonce
+	otp.PhoneCode = app.namespaces[otp.Namespace].DefaultPhoneCode
 
-	// Get the provider.
-	pro, ok := app.providers[out.Provider]
-	if !ok {
-		app.tpl.ExecuteTemplate(w, "message", webviewTpl{App: app.constants,
-			Title:       "Internal error",
-			Description: "The provider for this OTP was not found.",
-		})
-		return
+	return otp, nil
+}
+
+// pushFallbacks pushes an OTP (prepared with preparePush) that failed to be
+// pushed to p with err, to each of p's fallback providers in order. It
+// returns the name of the provider that delivered the OTP, or if none did,
+// the error of a provider that queued it to be retried (models.ErrQueued),
+// or the last error.
+func pushFallbacks(ctx context.Context, otp models.OTP, p *provider, rootURL string, err error, app *App) (string, error) {
+	var queued error
+	if errors.Is(err, models.ErrQueued) {
+		queued = err
 	}
 
-	// Validate the address.
-	msg := ""
-	if to != "" {
-		if err := pro.provider.ValidateAddress(to); err != nil {
-			msg = err.Error()
-		} else if err := app.store.SetAddress(namespace, id, to); err != nil {
-			msg = err.Error()
-		} else {
-			out.To = to
-			if err := push(out, pro, app.constants.RootURL, app); err != nil {
-				app.lo.Error("error sending OTP", "error", err, "provider", pro.provider.ID())
-				msg = "error sending OTP"
-			} else {
-				http.Redirect(w, r, fmt.Sprintf(uriViewOTP, out.Namespace, out.ID),
-					http.StatusFound)
-			}
+	for _, name := range p.fallbacks {
+		f, ok := app.providers[name]
+		if !ok {
+			continue
 		}
+
+		app.lo.Error("error sending OTP, trying fallback", "error", err,
+			"provider", p.provider.ID(), "fallback", name)
+
+		// The address may not be valid for the fallback provider.
+		if e := f.provider.ValidateAddress(otp.To); e != nil {
+			continue
+		}
+
+		if err = pushProvider(ctx, otp, f, rootURL, app); err == nil {
+			return name, nil
+		}
+		if queued == nil && errors.Is(err, models.ErrQueued) {
+			queued = err
+		}
+		p = f
 	}
 
-	app.tpl.ExecuteTemplate(w, "index", webviewTpl{App: app.constants,
-		ChannelName:   pro.provider.ChannelName(),
-		AddressName:   pro.provider.AddressName(),
-		MaxAddressLen: pro.provider.MaxAddressLen(),
-		Message:       msg,
-		Title:         fmt.Sprintf("Verify %s", pro.provider.ChannelName()),
-		ChannelDesc:   pro.provider.ChannelDesc(),
-		AddressDesc:   pro.provider.AddressDesc(),
-		OTP:           out,
-	})
+	if queued != nil {
+		return "", queued
+	}
+	return "", err
 }
 
-// verifyOTP validates an OTP against user input.
-func verifyOTP(namespace, id, otp string, deleteOnVerify bool, app *App) (models.OTP, error) {
-	// Check the OTP.
-	out, err := app.store.Check(namespace, id, store.CounterAttempts)
+// pushProvider compiles a message template and pushes it to the provider.
+func pushProvider(ctx context.Context, otp models.OTP, p *provider, rootURL string, app *App) error {
+	subject, body, err := compileMessage(otp, p, rootURL, app)
 	if err != nil {
-		if err != store.ErrNotExist {
-			app.lo.Error("error checking OTP", "error", err)
-			return out, err
-		}
-		return out, errors.New("error checking OTP.")
+		return err
 	}
 
-	errMsg := ""
-	if isLocked(out) {
-		errMsg = fmt.Sprintf("Too many attempts. Please retry after %0.f seconds.",
-			out.TTL.Seconds())
-	} else if out.OTP != otp {
-		errMsg = "Incorrect OTP"
+	period, err := consumeQuota(ctx, p, app)
+	if err != nil {
+		return err
 	}
 
-	// There was an error.
-	if errMsg != "" {
-		return out, errors.New(errMsg)
+	app.lo.Debug("sending otp", "to", otp.To, "provider", p.provider.ID(), "namespace", otp.Namespace)
+
+	ctx, span := tracer.Start(ctx, "provider.Push", trace.WithAttributes(
+		attribute.String("otp.namespace", otp.Namespace),
+		attribute.String("otp.provider", p.provider.ID()),
+	))
+	err = redactErr(p.provider.Push(ctx, otp, subject, body), otp)
+	endSpan(span, err)
+
+	// A failed push doesn't count against the quota.
+	if err != nil {
+		refundQuota(ctx, p, period, app)
 	}
+	return err
+}
 
-	// Delete the OTP?
-	if deleteOnVerify {
-		app.store.Delete(namespace, id)
+// bulkPush pushes OTPs (prepared with preparePush) of a provider that
+// implements models.BulkPusher in one call. OTPs that fail are pushed to
+// the provider's fallbacks individually. It returns the name of the provider
+// that delivered each OTP or its error.
+func bulkPush(ctx context.Context, otps []models.OTP, p *provider, rootURL string, app *App) ([]string, []error) {
+	var (
+		via  = make([]string, len(otps))
+		errs = make([]error, len(otps))
+
+		msgs    []models.Message
+		indexes []int
+		periods []string
+	)
+	for i, otp := range otps {
+		subject, body, err := compileMessage(otp, p, rootURL, app)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		period, err := consumeQuota(ctx, p, app)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		msgs = append(msgs, models.Message{OTP: otp, Subject: subject, Body: body})
+		indexes = append(indexes, i)
+		periods = append(periods, period)
 	}
 
-	app.store.Close(namespace, id)
-	out.Closed = true
-	return out, err
-}
+	if len(msgs) > 0 {
+		app.lo.Debug("sending otps in bulk", "count", len(msgs), "provider", p.provider.ID())
 
-// wrap is a middleware that wraps HTTP handlers and injects the "app" context.
-func wrap(app *App, next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := context.WithValue(r.Context(), "app", app)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
+		bctx, span := tracer.Start(ctx, "provider.BulkPush", trace.WithAttributes(
+			attribute.String("otp.provider", p.provider.ID()),
+			attribute.Int("otp.count", len(msgs)),
+		))
+		res := p.provider.(models.BulkPusher).BulkPush(bctx, msgs)
 
-// sendResponse sends a JSON envelope to the HTTP response.
-func sendResponse(w http.ResponseWriter, data interface{}) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	out, err := json.Marshal(httpResp{Status: "success", Data: data})
-	if err != nil {
-		sendErrorResponse(w, "Internal Server Error.", http.StatusInternalServerError, nil)
-		return
+		failed := 0
+		for n, i := range indexes {
+			var err error
+			if n < len(res) {
+				err = redactErr(res[n], otps[i])
+			} else {
+				err = errors.New("no result from bulk push")
+			}
+			errs[i] = err
+
+			// A failed push doesn't count against the quota.
+			if err != nil {
+				failed++
+				refundQuota(ctx, p, periods[n], app)
+			}
+		}
+
+		var err error
+		if failed > 0 {
+			err = fmt.Errorf("%d of %d messages failed", failed, len(msgs))
+		}
+		endSpan(span, err)
+	}
+
+	for i, otp := range otps {
+		if errs[i] == nil {
+			via[i] = otp.Provider
+			continue
+		}
+		via[i], errs[i] = pushFallbacks(ctx, otp, p, rootURL, errs[i], app)
 	}
 
-	w.Write(out)
+	return via, errs
 }
 
-// sendErrorResponse sends a JSON error envelope to the HTTP response.
-func sendErrorResponse(w http.ResponseWriter, message string, code int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(code)
+// redactErr returns a provider's error with the OTP's secrets (the code
+// and the nonce of the verification URL) redacted so that they're never
+// logged or traced, for instance, when a provider's error echoes the
+// message it was sent.
+func redactErr(err error, otp models.OTP) error {
+	if err == nil {
+		return nil
+	}
 
-	resp := httpResp{Status: "error",
-		Message: message,
-		Data:    data}
-	out, _ := json.Marshal(resp)
-	w.Write(out)
+	msg := httplog.Redact(err.Error(), otp.OTP, otp.Nonce)
+	if msg == err.Error() {
+		return err
+	}
+	return errors.New(msg)
 }
 
-// generateRandomString generates a cryptographically random,
-// alphanumeric string of length n.
-func generateRandomString(totalLen int, chars string) (string, error) {
-	bytes := make([]byte, totalLen)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
+// consumeQuota counts a message against the provider's daily quota. It
+// returns the quota period that was consumed, or an empty string if the
+// provider has no quota.
+func consumeQuota(ctx context.Context, p *provider, app *App) (string, error) {
+	if p.dailyQuota < 1 {
+		return "", nil
 	}
-	for k, v := range bytes {
-		bytes[k] = chars[v%byte(len(chars))]
+
+	period := quotaPeriod(time.Now(), app.constants.QuotaResetTime)
+	if _, err := app.store.ConsumeQuota(ctx, p.name, period, p.dailyQuota, quotaTTL); err != nil {
+		if err == store.ErrQuotaExceeded {
+			return "", errQuotaExceeded
+		}
+		return "", err
 	}
-	return string(bytes), nil
+
+	return period, nil
 }
 
-// isLocked tells if an OTP is locked after exceeding attempts.
-func isLocked(otp models.OTP) bool {
-	if otp.Attempts > otp.MaxAttempts {
-		return true
+// refundQuota gives back a message consumed with consumeQuota in period to
+// the provider's daily quota.
+func refundQuota(ctx context.Context, p *provider, period string, app *App) {
+	if period == "" {
+		return
 	}
 
-	if otp.Generate > otp.MaxGenerate {
-		return true
+	if err := app.store.RefundQuota(ctx, p.name, period); err != nil {
+		app.lo.Error("error refunding provider quota", "error", err, "provider", p.provider.ID())
 	}
-	return false
 }
 
-// push compiles a message template and pushes it to the provider.
-func push(otp models.OTP, p *provider, rootURL string, app *App) error {
+// compileMessage compiles the subject and body templates of a provider
+// for an OTP.
+func compileMessage(otp models.OTP, p *provider, rootURL string, app *App) (string, []byte, error) {
+	// OTPs can be set with their own TTL.
+	ttl := otp.TTL
+	if ttl == 0 {
+		ttl = app.constants.OtpTTL
+	}
+
 	var (
 		subj = &bytes.Buffer{}
 		out  = &bytes.Buffer{}
@@ -631,41 +2972,166 @@ func push(otp models.OTP, p *provider, rootURL string, app *App) error {
 			Channel:   p.provider.ChannelName(),
 			Namespace: otp.Namespace,
 			To:        otp.To,
-			OTP:       otp.OTP,
+			OTP:       affixOTP(otp.OTP, app.namespaces[otp.Namespace]),
 			OTPURL:    getURL(rootURL, otp, true),
-			OTPTTL:    app.constants.OtpTTL,
+			OTPTTL:    ttl,
+			Extra:     tplExtra(otp.Extra),
 		}
 	)
 
+	// Only compile the subject for providers that send it.
+	usesSubject := p.provider.UsesSubject()
+
 	if p.tpl != nil {
-		if p.tpl.subject != nil {
+		if p.tpl.subject != nil && usesSubject {
 			if err := p.tpl.subject.Execute(subj, data); err != nil {
-				return err
+				return "", nil, err
 			}
 		}
 
 		if p.tpl.body != nil {
 			if err := p.tpl.body.Execute(out, data); err != nil {
-				return err
+				return "", nil, err
 			}
 		}
 	}
 
-	app.lo.Debug("sending otp", "to", otp.To, "provider", p.provider.ID(), "namespace", otp.Namespace)
-	return p.provider.Push(otp, subj.String(), out.Bytes())
+	// A body template that renders empty is likely misconfigured.
+	if p.tpl != nil && p.tpl.body != nil && len(bytes.TrimSpace(out.Bytes())) == 0 {
+		if p.requireBody {
+			return "", nil, errEmptyBody
+		}
+		app.lo.Warn("message body rendered empty", "provider", p.provider.ID(), "namespace", otp.Namespace)
+	}
+
+	// Over-length bodies may be split into multiple (billed) SMS segments
+	// or be truncated.
+	max := p.provider.MaxBodyLen()
+	if bl, ok := p.provider.(models.BodyLimiter); ok {
+		max = bl.MaxBodyLenFor(out.Bytes())
+	}
+	if max > 0 {
+		if n := utf8.RuneCount(out.Bytes()); n > max {
+			if app.constants.StrictBodyLen {
+				return "", nil, errBodyTooLong
+			}
+			app.lo.Warn("message body exceeds the provider's max length", "provider", p.provider.ID(),
+				"namespace", otp.Namespace, "length", n, "max", max)
+		}
+	}
+
+	// Fall back to a default subject if required, and enforce the max length.
+	subject := subj.String()
+	if usesSubject && p.requireSubject && strings.TrimSpace(subject) == "" {
+		subject = fmt.Sprintf("%s: %s verification", otp.Namespace, data.Channel)
+	}
+	if p.maxSubjectLen > 0 && utf8.RuneCountInString(subject) > p.maxSubjectLen {
+		subject = string([]rune(subject)[:p.maxSubjectLen])
+	}
+
+	return subject, out.Bytes(), nil
+}
+
+// tplExtra decodes an OTP's extra JSON for message templates. Extra that
+// isn't a JSON object is ignored so that it doesn't break rendering.
+func tplExtra(b []byte) map[string]interface{} {
+	out := make(map[string]interface{})
+	if len(b) == 0 {
+		return out
+	}
+	if err := json.Unmarshal(b, &out); err != nil || out == nil {
+		return make(map[string]interface{})
+	}
+	return out
+}
+
+// allowWebVerify counts a web view verification attempt from a client IP
+// and returns false if the IP has exceeded the rate limit for the current
+// window. Store errors are logged and the attempt is allowed.
+func allowWebVerify(ctx context.Context, ip string, app *App) bool {
+	var (
+		limit  = app.constants.WebVerifyRateLimit
+		window = app.constants.WebVerifyRateWindow
+	)
+	if limit <= 0 || window <= 0 {
+		return true
+	}
+
+	period := strconv.FormatInt(time.Now().Truncate(window).Unix(), 10)
+	if _, err := app.store.ConsumeQuota(ctx, "webverify:"+ip, period, limit, window); err != nil {
+		if err == store.ErrQuotaExceeded {
+			return false
+		}
+		app.lo.Error("error checking web verify rate limit", "error", err, "ip", ip)
+	}
+
+	return true
+}
+
+// clientIP returns the IP address of the client that made a request. If the
+// request came through trusted proxies, it's the rightmost address in the
+// X-Forwarded-For header that isn't one of them.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !inCIDRs(ip, trusted) {
+		return ip
+	}
+
+	fwd := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(fwd) - 1; i >= 0; i-- {
+		f := strings.TrimSpace(fwd[i])
+		if f == "" {
+			continue
+		}
+
+		ip = f
+		if !inCIDRs(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// inCIDRs returns true if the IP is in one of the ranges.
+func inCIDRs(ip string, cidrs []netip.Prefix) bool {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+
+	for _, c := range cidrs {
+		if c.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaPeriod returns the daily quota period (date) that t falls in, where
+// days start at resetTime after midnight UTC.
+func quotaPeriod(t time.Time, resetTime time.Duration) string {
+	return t.UTC().Add(-resetTime).Format("2006-01-02")
 }
 
 func getURL(rootURL string, otp models.OTP, check bool) string {
 	if check {
-		return rootURL + fmt.Sprintf(uriCheck, otp.Namespace, otp.ID, otp.OTP)
+		return rootURL + fmt.Sprintf(uriCheck, otp.Namespace, otp.ID, otp.OTP, otp.Nonce)
 	}
 	return rootURL + fmt.Sprintf(uriViewOTP, otp.Namespace, otp.ID)
 }
 
-// auth is a simple authentication middleware.
-func auth(authMap map[string]string, next http.HandlerFunc) http.HandlerFunc {
+// auth is a simple authentication middleware. It supports BasicAuth
+// (namespace:secret) and optionally, JWT Bearer tokens.
+func auth(a *authConf, next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		const authBasic = "Basic"
+		const (
+			authBasic  = "Basic"
+			authBearer = "Bearer"
+		)
 		var (
 			pair  [][]byte
 			delim = []byte(":")
@@ -673,26 +3139,47 @@ func auth(authMap map[string]string, next http.HandlerFunc) http.HandlerFunc {
 			h = r.Header.Get("Authorization")
 		)
 
+		// Bearer (JWT) auth scheme.
+		if a.jwt != nil && strings.HasPrefix(h, authBearer) {
+			namespace, err := a.jwt.validate(strings.TrimSpace(h[len(authBearer):]))
+			if err != nil {
+				sendErrorResponse(w, "Invalid token in Bearer Authorization header.",
+					http.StatusUnauthorized, errCodeUnauthorized, nil)
+				return
+			}
+
+			if _, ok := a.creds[namespace]; !ok {
+				sendErrorResponse(w, "Invalid API credentials.",
+					http.StatusUnauthorized, errCodeUnauthorized, nil)
+				return
+			}
+
+			setSpanAttrs(r.Context(), attribute.String("otp.namespace", namespace))
+			ctx := context.WithValue(r.Context(), "namespace", namespace)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		// Basic auth scheme.
 		if strings.HasPrefix(h, authBasic) {
 			payload, err := base64.StdEncoding.DecodeString(string(strings.Trim(h[len(authBasic):], " ")))
 			if err != nil {
 				sendErrorResponse(w, "Invalid Base64 value in Basic Authorization header.",
-					http.StatusUnauthorized, nil)
+					http.StatusUnauthorized, errCodeUnauthorized, nil)
 				return
 			}
 
 			pair = bytes.SplitN(payload, delim, 2)
 		} else {
 			sendErrorResponse(w, "Missing Basic Authorization header.",
-				http.StatusUnauthorized, nil)
+				http.StatusUnauthorized, errCodeUnauthorized, nil)
 			return
 
 		}
 
 		if len(pair) != 2 {
 			sendErrorResponse(w, "Invalid value in Basic Authorization header.",
-				http.StatusUnauthorized, nil)
+				http.StatusUnauthorized, errCodeUnauthorized, nil)
 			return
 		}
 
@@ -700,14 +3187,39 @@ func auth(authMap map[string]string, next http.HandlerFunc) http.HandlerFunc {
 			namespace = string(pair[0])
 			secret    = pair[1]
 		)
-		s, ok := authMap[namespace]
+		s, ok := a.creds[namespace]
 		if !ok || subtle.ConstantTimeCompare([]byte(s), secret) != 1 {
 			sendErrorResponse(w, "Invalid API credentials.",
-				http.StatusUnauthorized, nil)
+				http.StatusUnauthorized, errCodeUnauthorized, nil)
 			return
 		}
 
+		setSpanAttrs(r.Context(), attribute.String("otp.namespace", namespace))
 		ctx := context.WithValue(r.Context(), "namespace", namespace)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// validate validates a JWT's signature and returns the namespace in its claims.
+// Tokens have to expire (exp) and can't be issued (iat) in the future, with
+// the configured leeway for clock skew.
+func (j *jwtAuth) validate(token string) (string, error) {
+	t, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		return j.key, nil
+	}, jwt.WithValidMethods([]string{j.algo}), jwt.WithExpirationRequired(), jwt.WithIssuedAt(), jwt.WithLeeway(j.leeway))
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := t.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", errors.New("invalid claims")
+	}
+
+	namespace, _ := claims[j.claim].(string)
+	if namespace == "" {
+		return "", fmt.Errorf("claim '%s' not found", j.claim)
+	}
+
+	return namespace, nil
+}
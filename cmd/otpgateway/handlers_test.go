@@ -1,24 +1,51 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/alicebob/miniredis"
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	kjson "github.com/knadh/koanf/parsers/json"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+	"github.com/knadh/otpgateway/v3/internal/store"
 	"github.com/knadh/otpgateway/v3/internal/store/redis"
 	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/zerodha/logf"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type dummyProv struct{}
@@ -57,7 +84,7 @@ func (d *dummyProv) ValidateAddress(to string) error {
 }
 
 // Push pushes an e-mail to the SMTP server.
-func (d *dummyProv) Push(to models.OTP, subject string, m []byte) error {
+func (d *dummyProv) Push(ctx context.Context, to models.OTP, subject string, m []byte) error {
 	return nil
 }
 
@@ -76,6 +103,184 @@ func (d *dummyProv) MaxBodyLen() int {
 	return 100 * 1024
 }
 
+// UsesSubject returns whether the provider sends a message subject.
+func (d *dummyProv) UsesSubject() bool {
+	return true
+}
+
+// dummyFailProv is a provider that always fails to push.
+type dummyFailProv struct {
+	dummyProv
+}
+
+// Push fails.
+func (d *dummyFailProv) Push(ctx context.Context, to models.OTP, subject string, m []byte) error {
+	return errors.New("push failed")
+}
+
+// dummyBlockProv is a provider whose pushes block until release is closed.
+type dummyBlockProv struct {
+	dummyProv
+
+	mu      sync.Mutex
+	pushes  int
+	pushed  chan struct{}
+	release chan struct{}
+}
+
+// Push blocks.
+func (d *dummyBlockProv) Push(ctx context.Context, to models.OTP, subject string, m []byte) error {
+	d.mu.Lock()
+	d.pushes++
+	d.mu.Unlock()
+
+	select {
+	case d.pushed <- struct{}{}:
+	default:
+	}
+	<-d.release
+	return nil
+}
+
+// dummyQueueProv is a provider that queues every push to be retried.
+type dummyQueueProv struct {
+	dummyProv
+}
+
+// Push queues.
+func (d *dummyQueueProv) Push(ctx context.Context, to models.OTP, subject string, m []byte) error {
+	return fmt.Errorf("%w: push failed", models.ErrQueued)
+}
+
+// dummyEchoProv is a provider that fails with an error that echoes the
+// message it was sent.
+type dummyEchoProv struct {
+	dummyProv
+}
+
+// Push fails.
+func (d *dummyEchoProv) Push(ctx context.Context, to models.OTP, subject string, m []byte) error {
+	return fmt.Errorf("rejected message to %s: %s (otp=%s)", to.To, m, to.OTP)
+}
+
+// dummyBulkProv is a provider that supports bulk pushes. It rejects
+// messages of failOTP.
+type dummyBulkProv struct {
+	dummyProv
+	mu     sync.Mutex
+	pushes int
+	bulk   [][]models.Message
+}
+
+const failOTP = "999999"
+
+// Push records the push.
+func (d *dummyBulkProv) Push(ctx context.Context, to models.OTP, subject string, m []byte) error {
+	d.mu.Lock()
+	d.pushes++
+	d.mu.Unlock()
+	return nil
+}
+
+// BulkPush records the messages.
+func (d *dummyBulkProv) BulkPush(ctx context.Context, msgs []models.Message) []error {
+	d.mu.Lock()
+	d.bulk = append(d.bulk, msgs)
+	d.mu.Unlock()
+
+	out := make([]error, len(msgs))
+	for i, m := range msgs {
+		if m.OTP.OTP == failOTP {
+			out[i] = errors.New("push failed")
+		}
+	}
+	return out
+}
+
+// dummyChanProv is a provider that records the OTP channel and phone code it was pushed.
+type dummyChanProv struct {
+	dummyProv
+	channel   string
+	phoneCode string
+}
+
+// Push records the channel and the phone code.
+func (d *dummyChanProv) Push(ctx context.Context, to models.OTP, subject string, m []byte) error {
+	d.channel = to.Channel
+	d.phoneCode = to.PhoneCode
+	return nil
+}
+
+// dummyCheckProv is a provider with a connectivity check.
+type dummyCheckProv struct {
+	dummyProv
+	err error
+}
+
+func (d *dummyCheckProv) Check(ctx context.Context) error {
+	if d.err == errCheckTimeout {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return d.err
+}
+
+var errCheckTimeout = errors.New("timeout")
+
+// dummyPhoneProv is a provider that only accepts numeric addresses.
+type dummyPhoneProv struct {
+	dummyProv
+}
+
+// ValidateAddress accepts numbers.
+func (d *dummyPhoneProv) ValidateAddress(to string) error {
+	if _, err := strconv.Atoi(to); err != nil {
+		return errors.New("invalid phone number")
+	}
+	return nil
+}
+
+// NormalizeAddress prefixes numbers without one with the phone code.
+func (d *dummyPhoneProv) NormalizeAddress(to, phoneCode string) string {
+	if strings.HasPrefix(to, "+") {
+		return to
+	}
+	return phoneCode + to
+}
+
+// dummySMSProv is a provider whose max body length depends on the body.
+type dummySMSProv struct {
+	dummySubjProv
+}
+
+// MaxBodyLenFor limits bodies with non-ASCII characters to 10 chars.
+func (d *dummySMSProv) MaxBodyLenFor(body []byte) int {
+	if utf8.RuneCount(body) != len(body) {
+		return 10
+	}
+	return d.MaxBodyLen()
+}
+
+// dummySubjProv is a provider that records the subject it was pushed.
+type dummySubjProv struct {
+	dummyProv
+	usesSubject bool
+	subject     string
+	body        string
+}
+
+// Push records the subject and the body.
+func (d *dummySubjProv) Push(ctx context.Context, to models.OTP, subject string, m []byte) error {
+	d.subject = subject
+	d.body = string(m)
+	return nil
+}
+
+// UsesSubject returns the configured subject hint.
+func (d *dummySubjProv) UsesSubject() bool {
+	return d.usesSubject
+}
+
 const (
 	dummyNamespace = "myapp"
 	dummySecret    = "mysecret"
@@ -86,8 +291,9 @@ const (
 )
 
 var (
-	srv  *httptest.Server
-	rdis *miniredis.Miniredis
+	srv     *httptest.Server
+	rdis    *miniredis.Miniredis
+	testApp *App
 )
 
 func init() {
@@ -105,8 +311,10 @@ func init() {
 
 	// Dummy app.
 	app := &App{
-		lo:        initLogger(true),
-		providers: map[string]*provider{dummyProvider: &provider{provider: &dummyProv{}}},
+		lo:         initLogger(true),
+		providers:  map[string]*provider{dummyProvider: &provider{name: dummyProvider, provider: &dummyProv{}}},
+		namespaces: map[string]nsConf{dummyNamespace: {}},
+		otpGen:     randomOTPGenerator{},
 		providerTpls: map[string]*providerTpl{
 			dummyProvider: &providerTpl{
 				subject: tpl,
@@ -117,21 +325,54 @@ func init() {
 			OtpTTL:         10 * time.Second,
 			OtpMaxAttempts: 10,
 			OtpMaxGenerate: 10,
+			TrimOTPInput:   true,
 		},
-		store: redis.New(redis.Conf{
-			Host: rd.Host(),
-			Port: port,
-		}),
 	}
+	testApp = app
+
+	rs, err := redis.New(redis.Conf{
+		Host: rd.Host(),
+		Port: port,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.store = rs
 
-	authCreds := map[string]string{dummyNamespace: dummySecret}
+	authCfg := &authConf{
+		creds: map[string]string{dummyNamespace: dummySecret},
+		jwt: &jwtAuth{
+			key:   []byte(dummySecret),
+			algo:  "HS256",
+			claim: "namespace",
+		},
+	}
 	r := chi.NewRouter()
-	r.Get("/api/providers", auth(authCreds, wrap(app, handleGetProviders)))
-	r.Get("/api/health", auth(authCreds, wrap(app, handleHealthCheck)))
-	r.Put("/api/otp/{id}", auth(authCreds, wrap(app, handleSetOTP)))
-	r.Post("/api/otp/{id}", auth(authCreds, wrap(app, handleVerifyOTP)))
-	r.Delete("/api/otp/{id}/status", auth(authCreds, wrap(app, handleCheckOTPStatus)))
+	r.Use(withNegotiation(true))
+	r.NotFound(handleNotFound)
+	r.MethodNotAllowed(handleMethodNotAllowed)
+	r.Get("/api/providers", auth(authCfg, wrap(app, handleGetProviders)))
+	r.Get("/api/providers/{id}", auth(authCfg, wrap(app, handleGetProvider)))
+	r.Get("/api/stats", auth(authCfg, wrap(app, handleGetStats)))
+	r.Get("/", wrap(app, handleRoot))
+	r.Get("/api/live", handleLiveCheck)
+	r.Get("/api/ready", wrap(app, handleHealthCheck))
+	r.Get("/api/health", auth(authCfg, wrap(app, handleHealthCheck)))
+	r.Put("/api/otp/batch", auth(authCfg, wrap(app, handleSetOTPBatch)))
+	r.Put("/api/otp/{id}", auth(authCfg, wrap(app, handleSetOTP)))
+	r.Get("/api/otp/ref/{ref}", auth(authCfg, wrap(app, handleGetOTPByRef)))
+	r.Get("/api/otp/{id}", auth(authCfg, wrap(app, handleGetOTP)))
+	r.Post("/api/otp/{id}", auth(authCfg, wrap(app, handleVerifyOTP)))
+	r.Delete("/api/otp/{id}/status", auth(authCfg, wrap(app, handleCheckOTPStatus)))
+	r.Post("/api/otp/{id}/close", auth(authCfg, wrap(app, handleCloseOTP)))
+	r.Post("/api/otp/{id}/reset", auth(authCfg, wrap(app, handleResetOTPAttempts)))
+	r.Post("/api/otp/{id}/delivered", auth(authCfg, wrap(app, handleSetOTPDelivered)))
 	r.Get("/otp/{namespace}/{id}", wrap(app, handleOTPView))
+	r.Get("/otp/{namespace}/{id}/status", wrap(app, handleGetOTPClosed))
+	r.Get("/otp/{namespace}/{id}/events", wrap(app, handleOTPEvents))
+	r.Get("/otp/{namespace}/{id}/qr", wrap(app, handleOTPQR))
+	r.Get("/otp/{namespace}/{id}/address", wrap(app, handleAddressView))
+	r.Post("/otp/{namespace}/{id}/address", wrap(app, handleAddressView))
 	r.Post("/otp/{namespace}/{id}", wrap(app, handleOTPView))
 	srv = httptest.NewServer(r)
 }
@@ -145,6 +386,55 @@ func TestGetProviders(t *testing.T) {
 	r := testRequest(t, http.MethodGet, "/api/providers", nil, &out)
 	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
 	assert.Equal(t, out.Data, []interface{}{dummyProvider}, "providers don't match")
+	assert.Equal(t, apiVersion, r.Header.Get(hdrAPIVersion), "API version header mismatch")
+}
+
+func TestGetProvider(t *testing.T) {
+	var (
+		data = &providerResp{}
+		out  = httpResp{Data: data}
+	)
+	r := testRequest(t, http.MethodGet, "/api/providers/"+dummyProvider, nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.Equal(t, providerResp{
+		ID:            dummyProvider,
+		ChannelName:   "dummychannel",
+		ChannelDesc:   "dummy channel description",
+		AddressName:   "dummyaddress",
+		AddressDesc:   "dummy address description",
+		MaxOTPLen:     6,
+		MaxAddressLen: 6,
+	}, *data, "provider doesn't match")
+
+	r = testRequest(t, http.MethodGet, "/api/providers/unknown", nil, &out)
+	assert.Equal(t, http.StatusNotFound, r.StatusCode, "non 404 response for unknown provider")
+}
+
+func TestInitProviders(t *testing.T) {
+	// A third-party provider registered from outside the package is loaded
+	// alongside the built-in ones.
+	var gotCfg json.RawMessage
+	models.RegisterProvider("test_thirdparty", func(b json.RawMessage) (models.Provider, error) {
+		gotCfg = b
+		return &dummyProv{}, nil
+	})
+
+	k := koanf.New(".")
+	if err := k.Load(rawConf(`{"providers": {"test_thirdparty": {"enabled": true, "foo": "bar"}}}`), kjson.Parser()); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logf.New(logf.Opts{})
+	out := initProviders(k, nil, &log)
+	assert.Contains(t, out, "test_thirdparty", "third-party provider not loaded")
+	assert.Len(t, out, 1, "disabled built-in providers loaded")
+	assert.Contains(t, string(gotCfg), `"foo":"bar"`, "provider config not passed to the factory")
+
+	// Built-in providers are registered at init.
+	f := models.ProviderFactories()
+	for _, id := range []string{"smtp", "sns", "pinpoint_sms", "kaleyra_sms", "whatsapp_cloud", "infobip", "smpp"} {
+		assert.Contains(t, f, id, "built-in provider not registered")
+	}
 }
 
 func TestHealthCheck(t *testing.T) {
@@ -153,198 +443,3658 @@ func TestHealthCheck(t *testing.T) {
 	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
 }
 
-func TestSetOTP(t *testing.T) {
-	rdis.FlushDB()
-	var (
-		data = &otpResp{}
-		out  = httpResp{
-			Data: data,
+func TestJWTAuth(t *testing.T) {
+	now := time.Now()
+	signClaims := func(c jwt.MapClaims, key string) string {
+		tk, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
 		}
-		p = url.Values{}
-	)
-	p.Set("to", dummyToAddress)
-	p.Set("provider", "badprovider")
+		return tk
+	}
+	sign := func(namespace, key string) string {
+		return signClaims(jwt.MapClaims{"namespace": namespace, "exp": now.Add(time.Minute).Unix()}, key)
+	}
 
-	// Register an OTP with a bad provider.
-	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
-	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for bad provider")
+	for _, c := range []struct {
+		token string
+		code  int
+	}{
+		{sign(dummyNamespace, dummySecret), http.StatusOK},
+		{sign(dummyNamespace, "badsecret"), http.StatusUnauthorized},
+		{sign("unknown", dummySecret), http.StatusUnauthorized},
+		{"junk", http.StatusUnauthorized},
 
-	// Register an OTP with a bad to address.
-	p.Set("to", "xxxx")
-	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
-	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for bad to address")
+		// Tokens without an expiry, expired tokens, and tokens from the future.
+		{signClaims(jwt.MapClaims{"namespace": dummyNamespace}, dummySecret), http.StatusUnauthorized},
+		{signClaims(jwt.MapClaims{"namespace": dummyNamespace, "exp": now.Add(-time.Minute).Unix()}, dummySecret), http.StatusUnauthorized},
+		{signClaims(jwt.MapClaims{"namespace": dummyNamespace, "exp": now.Add(time.Hour).Unix(),
+			"iat": now.Add(time.Minute * 10).Unix()}, dummySecret), http.StatusUnauthorized},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/providers", nil)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, c.code, resp.StatusCode, "unexpected status for token %s", c.token)
+	}
+}
 
-	// Register without ID and OTP.
-	p.Set("provider", dummyProvider)
-	p.Set("to", dummyToAddress)
-	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
-	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
-	assert.Equal(t, dummyToAddress, data.OTP.To, "to doesn't match")
-	assert.Equal(t, 1, data.OTP.Attempts, "attempts doesn't match")
-	assert.NotEqual(t, "", data.OTP.ID, "id wasn't auto generated")
-	assert.NotEqual(t, "", data.OTP.ID, "otp wasn't auto generated")
+func TestWithTimeout(t *testing.T) {
+	var ok bool
+	h := withTimeout(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok = r.Context().Deadline()
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, ok, "request context has no deadline")
 
-	// Register with known data.
-	p.Set("id", dummyOTPID)
-	p.Set("otp", dummyOTP)
-	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
-	assert.Equal(t, dummyOTPID, data.OTP.ID, "id doesn't match")
-	assert.Equal(t, dummyOTP, data.OTP.OTP, "otp doesn't match")
-}
+	// Only the event stream route is exempt, not requests that ask for a
+	// stream.
+	req := httptest.NewRequest(http.MethodGet, "/api/otp/myotp123", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, ok, "request context has no deadline")
 
-func TestCheckOTP(t *testing.T) {
-	rdis.FlushDB()
-	var (
-		data = &otpResp{}
-		out  = httpResp{
-			Data: data,
-		}
-		p = url.Values{}
-	)
-	p.Set("id", dummyOTPID)
-	p.Set("otp", dummyOTP)
-	p.Set("to", dummyToAddress)
-	p.Set("provider", dummyProvider)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/otp/myapp/myotp123/events", nil))
+	assert.False(t, ok, "event stream context has a deadline")
+}
 
-	// Register OTP.
-	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
-	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
 
-	// Check OTP.
-	cp := url.Values{}
-	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
-	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for empty otp check")
+	for _, c := range []struct {
+		remote string
+		fwd    []string
+		exp    string
+	}{
+		{"1.2.3.4:1234", nil, "1.2.3.4"},
+		{"1.2.3.4:1234", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"9.9.9.9, 5.6.7.8, 10.0.0.2"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"9.9.9.9", "5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"[::1]:1234", []string{"5.6.7.8"}, "5.6.7.8"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = c.remote
+		for _, f := range c.fwd {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		assert.Equal(t, c.exp, clientIP(r, trusted), "%s %v", c.remote, c.fwd)
+	}
 
-	// Bad OTP.
-	cp.Set("otp", "123")
-	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
-	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for bad otp check")
-	assert.Equal(t, 2, data.Attempts, "attempts didn't increase")
+	// Without trusted proxies, X-Forwarded-For is ignored.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "5.6.7.8")
+	assert.Equal(t, "10.0.0.1", clientIP(r, nil))
+}
 
-	// Good OTP. skip_delete so that it's not deleted.
-	cp.Set("otp", dummyOTP)
-	cp.Set("skip_delete", "true")
-	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
-	assert.Equal(t, http.StatusOK, r.StatusCode, "good OTP failed")
+func TestAPIAllowList(t *testing.T) {
+	var (
+		allowed = []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}
+		trusted = []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}
+	)
+	h := withAPIAllowList(allowed, trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
 
-	// Check it again. Shouldn't been deleted.
-	cp.Set("skip_delete", "false")
-	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
-	assert.Equal(t, http.StatusOK, r.StatusCode, "good OTP failed")
+	for _, c := range []struct {
+		path   string
+		remote string
+		fwd    string
+		exp    int
+	}{
+		{"/api/otp/myotp123", "192.168.1.5:1234", "", http.StatusOK},
+		{"/api/otp/myotp123", "1.2.3.4:1234", "", http.StatusForbidden},
+		{"/api/otp/myotp123", "1.2.3.4:1234", "192.168.1.5", http.StatusForbidden},
+		{"/api/otp/myotp123", "10.0.0.1:1234", "192.168.1.5", http.StatusOK},
+		{"/api/otp/myotp123", "10.0.0.1:1234", "1.2.3.4", http.StatusForbidden},
+		{"/api/ready", "1.2.3.4:1234", "", http.StatusOK},
+		{"/otp/myapp/myotp123", "1.2.3.4:1234", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		r.RemoteAddr = c.remote
+		if c.fwd != "" {
+			r.Header.Set("X-Forwarded-For", c.fwd)
+		}
 
-	// Check it again. Should be deleted.
-	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
-	assert.NotEqual(t, http.StatusOK, r.StatusCode, "OTP didn't get deleted on verification")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, c.exp, w.Code, "%s %s %s", c.path, c.remote, c.fwd)
+	}
 }
 
-func TestCheckOTPAttempts(t *testing.T) {
-	rdis.FlushDB()
+func TestConcurrencyLimit(t *testing.T) {
 	var (
-		data = &otpResp{}
-		out  = httpResp{
-			Data: data,
-		}
-		p = url.Values{}
+		block = make(chan struct{})
+		busy  = make(chan struct{})
 	)
-	p.Set("id", dummyOTPID)
-	p.Set("otp", dummyOTP)
-	p.Set("max_attempts", "5")
-	p.Set("max_generate", "5")
-	p.Set("to", dummyToAddress)
-	p.Set("provider", dummyProvider)
+	h := withConcurrencyLimit(1, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/otp/slow" {
+			busy <- struct{}{}
+			<-block
+		}
+	}))
 
-	// Register OTP.
-	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
-	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	req := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
 
-	cp := url.Values{}
-	cp.Set("otp", dummyOTP)
-	cp.Set("skip_delete", "true")
+	// Hold the only slot.
+	done := make(chan struct{})
+	go func() {
+		req("/api/otp/slow")
+		close(done)
+	}()
+	<-busy
 
-	// Good otp check.
-	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
-	assert.Equal(t, http.StatusOK, r.StatusCode, "good OTP failed")
+	w := req("/api/otp/myotp123")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "request over the limit not rejected")
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), errCodeOverloaded)
 
-	// Exceed bad attempts.
-	cp.Set("otp", "123999")
-	for i := 0; i < 10; i++ {
-		r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
-		assert.NotEqual(t, http.StatusOK, r.StatusCode, "bad OTP passed")
+	// Health checks, event streams, and long-polls aren't limited.
+	for _, p := range []string{"/api/live", "/api/ready", "/api/health",
+		"/otp/myapp/myotp123/events", "/otp/myapp/myotp123/status"} {
+		assert.Equal(t, http.StatusOK, req(p).Code, p)
 	}
 
-	// Rate limited.
-	cp.Set("skip_delete", "true")
-	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode, "bad OTPs didn't get rate limited")
+	// Neither are requests that only ask for an event stream.
+	r := httptest.NewRequest(http.MethodGet, "/api/otp/myotp123", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "Accept header exempted a request from the limit")
+
+	// The slot is released.
+	close(block)
+	<-done
+	assert.Equal(t, http.StatusOK, req("/api/otp/myotp123").Code, "slot not released")
 }
 
-func TestDeleteOnOTPCheck(t *testing.T) {
-	rdis.FlushDB()
+func TestConcurrencyLimitNoLongPoll(t *testing.T) {
 	var (
-		data = &otpResp{}
-		out  = httpResp{
-			Data: data,
-		}
-		p = url.Values{}
+		block = make(chan struct{})
+		busy  = make(chan struct{})
 	)
-	p.Set("id", dummyOTPID)
-	p.Set("otp", dummyOTP)
-	p.Set("max_attempts", "5")
-	p.Set("max_generate", "5")
-	p.Set("to", dummyToAddress)
-	p.Set("provider", dummyProvider)
+	h := withConcurrencyLimit(1, false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/otp/slow" {
+			busy <- struct{}{}
+			<-block
+		}
+	}))
 
-	// Register OTP.
-	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
-	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/otp/slow", nil))
+		close(done)
+	}()
+	<-busy
 
-	// Verification pending before otp status check.
-	r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &data)
-	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "verification pending")
+	// Status polls that respond right away are limited.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/otp/myapp/myotp123/status", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "status poll not limited")
 
-	cp := url.Values{}
-	cp.Set("otp", dummyOTP)
-	cp.Set("skip_delete", "true")
+	close(block)
+	<-done
+}
 
-	// Verify (done by the otpgateway module).
-	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
-	assert.Equal(t, http.StatusOK, r.StatusCode, "verification failed")
+func TestTracing(t *testing.T) {
+	rdis.FlushDB()
 
-	// Delete on status check
-	r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &data)
-	assert.Equal(t, http.StatusOK, r.StatusCode, "verification pending")
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
 
-	// Reattempt status check
-	r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &data)
-	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "otp not found")
-}
+	app := *testApp
+	app.store = newTracedStore(testApp.store)
 
-func testRequest(t *testing.T, method, path string, p url.Values, out interface{}) *http.Response {
-	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(p.Encode()))
-	if err != nil {
-		t.Fatal(err)
-		return nil
-	}
+	authCfg := &authConf{creds: map[string]string{dummyNamespace: dummySecret}}
+	rt := chi.NewRouter()
+	rt.Use(withTracing)
+	rt.Put("/api/otp/{id}", auth(authCfg, wrap(&app, handleSetOTP)))
+
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	req := httptest.NewRequest(http.MethodPut, "/api/otp/"+dummyOTPID, strings.NewReader(p.Encode()))
 	req.SetBasicAuth(dummyNamespace, dummySecret)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	// HTTP client.
-	c := &http.Client{}
-	resp, err := c.Do(req)
-	if err != nil {
-		t.Fatal(err)
-		return nil
-	}
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "non 200 response")
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatal(err)
-		return nil
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
 	}
-	defer resp.Body.Close()
 
-	if err := json.Unmarshal(respBody, out); err != nil {
-		t.Fatal(err)
+	root, ok := spans["PUT /api/otp/{id}"]
+	if !ok {
+		t.Fatal("request span not recorded")
 	}
+	assert.Contains(t, root.Attributes(), attribute.String("otp.namespace", dummyNamespace), "namespace attribute missing")
+	assert.Contains(t, root.Attributes(), attribute.String("otp.provider", dummyProvider), "provider attribute missing")
 
-	return resp
+	for _, name := range []string{"store.Set", "store.SetNonce", "provider.Push"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Fatalf("%s span not recorded", name)
+		}
+		assert.Equal(t, root.SpanContext().SpanID(), s.Parent().SpanID(), "%s span not nested under request span", name)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat("otpgateway ", 200)
+	h := withCompression(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			w.Write([]byte(large))
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+
+	// Large responses are compressed.
+	req := httptest.NewRequest(http.MethodGet, "/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, large, string(b))
+
+	// Small responses are not.
+	req = httptest.NewRequest(http.MethodGet, "/small", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "OK", w.Body.String())
+
+	// Neither are responses to clients that don't accept it.
+	req = httptest.NewRequest(http.MethodGet, "/large", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, large, w.Body.String())
+
+	// Neither are event streams, which are matched by their route.
+	req = httptest.NewRequest(http.MethodGet, "/otp/myapp/myotp123/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+
+	req = httptest.NewRequest(http.MethodGet, "/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Accept", "text/event-stream")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"), "Accept header exempted a request from compression")
+
+	// Flushes write out what's been compressed, or the small response as is.
+	h = withCompression(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			w.Write([]byte(large))
+		} else {
+			w.Write([]byte("OK"))
+		}
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Error(err)
+		}
+		assert.NotZero(t, w.(*compressWriter).ResponseWriter.(*httptest.ResponseRecorder).Body.Len(), "flush didn't write the response")
+	}))
+	for _, path := range []string{"/large", "/small"} {
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.True(t, w.Flushed, "%s wasn't flushed", path)
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	for h, exp := range map[string]string{
+		"":                                   formatJSON,
+		"*/*":                                formatJSON,
+		"text/html":                          formatJSON,
+		"text/plain":                         formatText,
+		"text/plain;q=0.5, application/json": formatJSON,
+		"application/json;q=0.5, text/plain": formatText,
+		"application/xml":                    formatXML,
+		"text/plain;q=0, */*":                formatJSON,
+	} {
+		assert.Equal(t, exp, acceptedFormat(h, true), "acceptedFormat(%s) mismatch", h)
+	}
+	assert.Equal(t, formatJSON, acceptedFormat("application/xml", false), "xml accepted when disabled")
+
+	h := withNegotiation(true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			sendErrorResponse(w, "Incorrect OTP", http.StatusBadRequest, errCodeOTPMismatch, nil)
+			return
+		}
+		sendResponse(w, map[string]interface{}{"id": "myotp123", "list": []int{1, 2}, "bad key": true})
+	}))
+
+	serve := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// JSON by default.
+	w := serve("/", "")
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"status": "success", "data": {"id": "myotp123", "list": [1, 2], "bad key": true}}`, w.Body.String())
+
+	w = serve("/", "text/plain")
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+
+	w = serve("/error", "text/plain")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "Incorrect OTP", w.Body.String())
+
+	w = serve("/", "application/xml")
+	assert.Equal(t, "application/xml; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, xml.Header+`<response><data><field name="bad key">true</field><id>myotp123</id>`+
+		`<list><item>1</item><item>2</item></list></data><status>success</status></response>`, w.Body.String())
+
+	w = serve("/error", "application/xml")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, xml.Header+`<response><error_code>otp_mismatch</error_code><message>Incorrect OTP</message>`+
+		`<status>error</status></response>`, w.Body.String())
+}
+
+// failingStore is a store whose operations fail with err.
+type failingStore struct {
+	store.Store
+	err   error
+	calls int
+}
+
+func (f *failingStore) Check(ctx context.Context, namespace, id string, counterKey string) (models.OTP, error) {
+	f.calls++
+	return models.OTP{}, f.err
+}
+
+func (f *failingStore) Ping(ctx context.Context) error {
+	f.calls++
+	return f.err
+}
+
+func TestRoot(t *testing.T) {
+	var out struct {
+		Data infoResp `json:"data"`
+	}
+	r := testRequest(t, http.MethodGet, "/", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "otpgateway", out.Data.Name)
+	assert.Equal(t, buildString, out.Data.Version)
+	assert.Equal(t, "ok", out.Data.Status)
+
+	// Redirect to the configured URL.
+	old := testApp.constants.RootRedirect
+	testApp.constants.RootRedirect = "/api/live"
+	t.Cleanup(func() { testApp.constants.RootRedirect = old })
+
+	var live httpResp
+	r = testRequest(t, http.MethodGet, "/", nil, &live)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "/api/live", r.Request.URL.Path)
+	assert.Equal(t, "OK", live.Data)
+}
+
+func TestStats(t *testing.T) {
+	rdis.FlushDB()
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	p.Set("max_attempts", "2")
+
+	var out httpResp
+	for _, id := range []string{"statsotp1", "statsotp2", "statsotp3"} {
+		r := testRequest(t, http.MethodPut, "/api/otp/"+id, p, &out)
+		assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	}
+
+	// One verified, one failed and then locked, one left active.
+	testRequest(t, http.MethodPost, "/api/otp/statsotp1", url.Values{"otp": {dummyOTP}}, &out)
+	testRequest(t, http.MethodPost, "/api/otp/statsotp2", url.Values{"otp": {"000000"}}, &out)
+	testRequest(t, http.MethodPost, "/api/otp/statsotp2", url.Values{"otp": {"000000"}}, &out)
+
+	var (
+		data = &statsResp{}
+		sout = httpResp{Data: data}
+	)
+	r := testRequest(t, http.MethodGet, "/api/stats", nil, &sout)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, time.Now().UTC().Format("2006-01-02"), data.Date)
+	assert.Equal(t, store.Stats{Active: 2, Verified: 1, Failed: 2, Locked: 1}, data.Stats)
+}
+
+func TestLiveReady(t *testing.T) {
+	var out httpResp
+	r := testRequest(t, http.MethodGet, "/api/live", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	r = testRequest(t, http.MethodGet, "/api/ready", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	// The store is down. Liveness is unaffected.
+	old := testApp.store
+	testApp.store = &failingStore{err: errors.New("connection refused")}
+	t.Cleanup(func() { testApp.store = old })
+
+	out = httpResp{}
+	r = testRequest(t, http.MethodGet, "/api/ready", nil, &out)
+	assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode)
+	assert.Equal(t, errCodeStoreUnavailable, out.ErrorCode)
+
+	out = httpResp{}
+	r = testRequest(t, http.MethodGet, "/api/live", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+}
+
+func TestStoreBreaker(t *testing.T) {
+	fs := &failingStore{err: errors.New("connection refused")}
+	b := newBreakerStore(fs, 2, 50*time.Millisecond)
+
+	// Business errors don't trip the circuit.
+	fs.err = store.ErrNotExist
+	for i := 0; i < 3; i++ {
+		b.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	}
+	assert.Equal(t, breakerClosed, b.State())
+
+	// Consecutive failures do.
+	fs.err = errors.New("connection refused")
+	b.Ping(context.Background())
+	assert.Equal(t, breakerClosed, b.State())
+	b.Ping(context.Background())
+	assert.Equal(t, breakerOpen, b.State())
+
+	// The open circuit fails fast without hitting the store.
+	fs.calls = 0
+	assert.Equal(t, store.ErrUnavailable, b.Ping(context.Background()))
+	assert.Equal(t, 0, fs.calls)
+
+	old, oldBreaker := testApp.store, testApp.breaker
+	testApp.store, testApp.breaker = b, b
+	t.Cleanup(func() { testApp.store, testApp.breaker = old, oldBreaker })
+
+	var (
+		health = &healthResp{}
+		out    = httpResp{Data: health}
+	)
+	r := testRequest(t, http.MethodGet, "/api/health", nil, &out)
+	assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode)
+	assert.Equal(t, errCodeStoreUnavailable, out.ErrorCode)
+	assert.Equal(t, "open", health.StoreCircuit)
+
+	out = httpResp{}
+	r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &out)
+	assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode)
+	assert.Equal(t, errCodeStoreUnavailable, out.ErrorCode)
+
+	out = httpResp{}
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {dummyOTP}}, &out)
+	assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode)
+	assert.Equal(t, errCodeStoreUnavailable, out.ErrorCode)
+
+	// After the cooldown, a failed probe re-opens the circuit.
+	time.Sleep(60 * time.Millisecond)
+	assert.Error(t, b.Ping(context.Background()))
+	assert.Equal(t, breakerOpen, b.State())
+	assert.Equal(t, 1, fs.calls)
+
+	// And a successful one closes it.
+	time.Sleep(60 * time.Millisecond)
+	fs.err = nil
+	assert.NoError(t, b.Ping(context.Background()))
+	assert.Equal(t, breakerClosed, b.State())
+
+	out = httpResp{}
+	r = testRequest(t, http.MethodGet, "/api/health", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+}
+
+func TestPushSubject(t *testing.T) {
+	rdis.FlushDB()
+
+	subj := template.Must(template.New("subject").Parse("Your {{ .Channel }} code"))
+	body := template.Must(template.New("body").Parse("{{ .OTP }}"))
+	otp := models.OTP{Namespace: dummyNamespace, ID: dummyOTPID, To: dummyToAddress, OTP: dummyOTP}
+
+	for _, uses := range []bool{true, false} {
+		dp := &dummySubjProv{usesSubject: uses}
+		p := &provider{name: "subj", provider: dp, requireSubject: true,
+			tpl: &providerTpl{subject: subj, body: body}}
+
+		assert.NoError(t, pushProvider(context.Background(), otp, p, "", testApp))
+		if uses {
+			assert.Equal(t, "Your dummychannel code", dp.subject)
+		} else {
+			assert.Empty(t, dp.subject, "subject sent to a provider that doesn't use it")
+		}
+	}
+}
+
+func TestOTPAffixes(t *testing.T) {
+	rdis.FlushDB()
+	testApp.namespaces[dummyNamespace] = nsConf{OTPPrefix: "ACME-", OTPSuffix: "."}
+	t.Cleanup(func() {
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	ns := testApp.namespaces[dummyNamespace]
+	for in, exp := range map[string]string{
+		"ACME-123456.": "123456",
+		"acme-123456.": "123456",
+		"ACME-123456":  "123456",
+		"123456.":      "123456",
+		"123456":       "123456",
+		"ACME-":        "ACME-",
+	} {
+		assert.Equal(t, exp, trimOTPAffixes(in, ns), "trimOTPAffixes(%s) mismatch", in)
+	}
+
+	// The message has the affixed OTP.
+	dp := &dummySubjProv{}
+	p := &provider{name: "subj", provider: dp,
+		tpl: &providerTpl{body: template.Must(template.New("body").Parse("{{ .OTP }}"))}}
+	otp := models.OTP{Namespace: dummyNamespace, ID: dummyOTPID, To: dummyToAddress, OTP: dummyOTP}
+	assert.NoError(t, pushProvider(context.Background(), otp, p, "", testApp))
+	assert.Equal(t, "ACME-"+dummyOTP+".", dp.body)
+
+	// The OTP is stored without the affixes and verifies as displayed.
+	v := url.Values{}
+	v.Set("otp", dummyOTP)
+	v.Set("to", dummyToAddress)
+	v.Set("provider", dummyProvider)
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{Data: data}
+	)
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, v, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	assert.Equal(t, dummyOTP, data.OTP.OTP)
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"ACME-" + dummyOTP + "."}}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "affixed otp didn't verify")
+}
+
+func TestPushExtra(t *testing.T) {
+	body := template.Must(template.New("body").Funcs(tplFuncs()).Parse(`Hi {{ .Extra.name | default "there" }}, {{ .OTP }}`))
+	otp := models.OTP{Namespace: dummyNamespace, ID: dummyOTPID, To: dummyToAddress, OTP: dummyOTP}
+
+	for extra, exp := range map[string]string{
+		`{"name": "John"}`: "Hi John, " + dummyOTP,
+		`{}`:               "Hi there, " + dummyOTP,
+		`null`:             "Hi there, " + dummyOTP,
+		`[1, 2]`:           "Hi there, " + dummyOTP,
+		`{"name": `:        "Hi there, " + dummyOTP,
+		``:                 "Hi there, " + dummyOTP,
+	} {
+		dp := &dummySubjProv{}
+		p := &provider{name: "subj", provider: dp, tpl: &providerTpl{body: body}}
+
+		otp.Extra = []byte(extra)
+		assert.NoError(t, pushProvider(context.Background(), otp, p, "", testApp), "extra: %s", extra)
+		assert.Equal(t, exp, dp.body, "extra: %s", extra)
+	}
+}
+
+func TestPushEmptyBody(t *testing.T) {
+	body := template.Must(template.New("body").Parse(`{{ with .Extra.message }}{{ . }}{{ end }}`))
+	otp := models.OTP{Namespace: dummyNamespace, ID: dummyOTPID, To: dummyToAddress, OTP: dummyOTP}
+
+	// Empty bodies are sent unless a body is required.
+	dp := &dummySubjProv{body: "unsent"}
+	p := &provider{name: "hook", provider: dp, tpl: &providerTpl{body: body}}
+	assert.NoError(t, pushProvider(context.Background(), otp, p, "", testApp))
+	assert.Empty(t, dp.body)
+
+	dp.body = "unsent"
+	p.requireBody = true
+	assert.Equal(t, errEmptyBody, pushProvider(context.Background(), otp, p, "", testApp))
+	assert.Equal(t, "unsent", dp.body, "empty body was sent")
+
+	otp.Extra = []byte(`{"message": "hello"}`)
+	assert.NoError(t, pushProvider(context.Background(), otp, p, "", testApp))
+	assert.Equal(t, "hello", dp.body)
+}
+
+func TestPushBodyLen(t *testing.T) {
+	t.Cleanup(func() { testApp.constants.StrictBodyLen = false })
+
+	var (
+		body = template.Must(template.New("body").Parse(`{{ .Extra.message }}`))
+		msg  = strings.Repeat("x", (&dummyProv{}).MaxBodyLen()+1)
+		otp  = models.OTP{Namespace: dummyNamespace, ID: dummyOTPID, To: dummyToAddress, OTP: dummyOTP,
+			Extra: []byte(`{"message": "` + msg + `"}`)}
+
+		dp = &dummySubjProv{body: "unsent"}
+		p  = &provider{name: "hook", provider: dp, tpl: &providerTpl{body: body}}
+	)
+
+	// Over-length bodies are sent by default.
+	assert.NoError(t, pushProvider(context.Background(), otp, p, "", testApp))
+	assert.Equal(t, msg, dp.body)
+
+	dp.body = "unsent"
+	testApp.constants.StrictBodyLen = true
+	assert.Equal(t, errBodyTooLong, pushProvider(context.Background(), otp, p, "", testApp))
+	assert.Equal(t, "unsent", dp.body, "over-length body was sent")
+
+	otp.Extra = []byte(`{"message": "hello"}`)
+	assert.NoError(t, pushProvider(context.Background(), otp, p, "", testApp))
+	assert.Equal(t, "hello", dp.body)
+
+	// Providers can limit bodies by their content.
+	sp := &dummySMSProv{}
+	p = &provider{name: "sms", provider: sp, tpl: &providerTpl{body: body}}
+	otp.Extra = []byte(`{"message": "hello world"}`)
+	assert.NoError(t, pushProvider(context.Background(), otp, p, "", testApp))
+	assert.Equal(t, "hello world", sp.body)
+
+	otp.Extra = []byte(`{"message": "héllo world"}`)
+	assert.Equal(t, errBodyTooLong, pushProvider(context.Background(), otp, p, "", testApp))
+}
+
+func TestLogRedaction(t *testing.T) {
+	rdis.FlushDB()
+
+	var (
+		buf  = &bytes.Buffer{}
+		lo   = testApp.lo
+		body = template.Must(template.New("body").Parse(`Your code is {{ .OTP }}. Verify at {{ .OTPURL }}`))
+	)
+	testApp.lo = logf.New(logf.Opts{Writer: buf, Level: logf.DebugLevel})
+	testApp.providers["echo1"] = &provider{name: "echo1", provider: &dummyEchoProv{},
+		tpl: &providerTpl{body: body}, fallbacks: []string{"echo2"}}
+	testApp.providers["echo2"] = &provider{name: "echo2", provider: &dummyEchoProv{},
+		tpl: &providerTpl{body: body}}
+	t.Cleanup(func() {
+		testApp.lo = lo
+		delete(testApp.providers, "echo1")
+		delete(testApp.providers, "echo2")
+	})
+
+	const code = "918273"
+	p := url.Values{}
+	p.Set("otp", code)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "echo1")
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusInternalServerError, r.StatusCode)
+
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+
+	logs := buf.String()
+	assert.Contains(t, logs, "error sending OTP", "error not logged")
+	assert.Contains(t, logs, "rejected message to "+dummyToAddress, "error not logged")
+	assert.NotContains(t, logs, code, "otp logged")
+	assert.NotContains(t, logs, o.Nonce, "nonce logged")
+	assert.NotContains(t, logs, dummySecret, "auth secret logged")
+}
+
+func TestTplFuncs(t *testing.T) {
+	for d, exp := range map[time.Duration]string{
+		0:                                   "0 seconds",
+		45 * time.Second:                    "45 seconds",
+		time.Minute:                         "1 minute",
+		5 * time.Minute:                     "5 minutes",
+		90 * time.Second:                    "1 minute 30 seconds",
+		time.Hour + 30*time.Minute:          "1 hour 30 minutes",
+		2*time.Hour + 1500*time.Millisecond: "2 hours 2 seconds",
+	} {
+		assert.Equal(t, exp, ttlHuman(d), "ttlHuman(%v) mismatch", d)
+	}
+
+	tpl, err := template.New("test").Funcs(tplFuncs()).Parse(
+		"{{ ttlMinutes .OTPTTL }}|{{ ttlSeconds .OTPTTL }}|{{ ttlHuman .OTPTTL }}")
+	assert.NoError(t, err)
+
+	var b strings.Builder
+	assert.NoError(t, tpl.Execute(&b, pushTpl{OTPTTL: 90 * time.Second}))
+	assert.Equal(t, "2|90|1 minute 30 seconds", b.String())
+
+	// Messages have the OTP's own TTL, or the global TTL.
+	p := &provider{name: "subj", provider: &dummySubjProv{},
+		tpl: &providerTpl{body: template.Must(template.New("body").Funcs(tplFuncs()).Parse("{{ ttlHuman .OTPTTL }}"))}}
+	otp := models.OTP{Namespace: dummyNamespace, ID: dummyOTPID, To: dummyToAddress, OTP: dummyOTP, TTL: 90 * time.Second}
+	_, body, err := compileMessage(otp, p, "", testApp)
+	assert.NoError(t, err)
+	assert.Equal(t, "1 minute 30 seconds", string(body))
+
+	otp.TTL = 0
+	_, body, err = compileMessage(otp, p, "", testApp)
+	assert.NoError(t, err)
+	assert.Equal(t, ttlHuman(testApp.constants.OtpTTL), string(body))
+}
+
+func TestNotFoundAndMethodNotAllowed(t *testing.T) {
+	var out httpResp
+	r := testRequest(t, http.MethodGet, "/api/unknown", nil, &out)
+	assert.Equal(t, http.StatusNotFound, r.StatusCode, "non 404 response")
+	assert.Equal(t, "error", out.Status, "non error envelope for 404")
+	assert.Equal(t, apiVersion, r.Header.Get(hdrAPIVersion), "API version header mismatch")
+
+	r = testRequest(t, http.MethodPatch, "/api/providers", nil, &out)
+	assert.Equal(t, http.StatusMethodNotAllowed, r.StatusCode, "non 405 response")
+	assert.Equal(t, "error", out.Status, "non error envelope for 405")
+}
+
+func TestSetOTP(t *testing.T) {
+	rdis.FlushDB()
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "badprovider")
+
+	// Register an OTP with a bad provider.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for bad provider")
+
+	// Register an OTP with a bad to address.
+	p.Set("to", "xxxx")
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for bad to address")
+
+	// Register without ID and OTP.
+	p.Set("provider", dummyProvider)
+	p.Set("to", dummyToAddress)
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.Equal(t, dummyToAddress, data.OTP.To, "to doesn't match")
+	assert.Equal(t, 0, data.OTP.VerifyAttempts, "attempts doesn't match")
+	assert.NotEqual(t, "", data.OTP.ID, "id wasn't auto generated")
+	assert.NotEqual(t, "", data.OTP.ID, "otp wasn't auto generated")
+
+	// Register with known data.
+	p.Set("id", dummyOTPID)
+	p.Set("otp", dummyOTP)
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, dummyOTPID, data.OTP.ID, "id doesn't match")
+	assert.Equal(t, dummyOTP, data.OTP.OTP, "otp doesn't match")
+}
+
+func TestSetOTPGenerated(t *testing.T) {
+	rdis.FlushDB()
+
+	// Override the random source to generate deterministic values.
+	randRead = func(b []byte) (int, error) {
+		for i := range b {
+			b[i] = byte(i)
+		}
+		return len(b), nil
+	}
+	t.Cleanup(func() {
+		randRead = rand.Read
+	})
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.Equal(t, "012345", data.OTP.OTP, "generated otp doesn't match")
+
+	v, err := generateRandomString(4, alphaChars)
+	assert.NoError(t, err)
+	assert.Equal(t, "ABCD", v, "generated string doesn't match")
+
+	// IDs.
+	v, err = generateID(0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, alphaNumChars[:32], v, "default id doesn't match")
+
+	v, err = generateID(8, "0123456789abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, "01234567", v, "id doesn't match")
+
+	randRead = rand.Read
+	v, err = generateID(8, idCharsetUUID)
+	assert.NoError(t, err)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, v, "id isn't a uuid")
+}
+
+// dummyOTPGen is an OTP generator that returns a fixed OTP.
+type dummyOTPGen struct {
+	otp     string
+	length  int
+	charset string
+}
+
+func (d *dummyOTPGen) Generate(_ context.Context, length int, charset string) (string, error) {
+	d.length, d.charset = length, charset
+	if d.otp == "" {
+		return "", errors.New("generator failed")
+	}
+	return d.otp, nil
+}
+
+func TestSetOTPGenerator(t *testing.T) {
+	rdis.FlushDB()
+	gen := &dummyOTPGen{otp: "424242"}
+	testApp.otpGen = gen
+	t.Cleanup(func() { testApp.otpGen = randomOTPGenerator{} })
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{Data: data}
+		p    = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.Equal(t, "424242", data.OTP.OTP, "otp not from the generator")
+	assert.Equal(t, (&dummyProv{}).MaxOTPLen(), gen.length, "generator got wrong length")
+	assert.Equal(t, numChars, gen.charset, "generator got wrong charset")
+
+	// Given OTPs aren't generated.
+	gen.length = 0
+	p.Set("otp", dummyOTP)
+	r = testRequest(t, http.MethodPut, "/api/otp/anotherotp", p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, dummyOTP, data.OTP.OTP)
+	assert.Zero(t, gen.length, "generator called for a given otp")
+	p.Del("otp")
+
+	// Failures and OTPs of the wrong length are errors.
+	for _, o := range []string{"", "42"} {
+		rdis.FlushDB()
+		gen.otp = o
+		r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+		assert.Equal(t, http.StatusInternalServerError, r.StatusCode, "bad otp %q accepted", o)
+		assert.Equal(t, errCodeInternal, out.ErrorCode)
+	}
+}
+
+func TestSetOTPChannel(t *testing.T) {
+	rdis.FlushDB()
+	prov := &dummyChanProv{}
+	testApp.providers["dummychan"] = &provider{provider: prov}
+	t.Cleanup(func() {
+		delete(testApp.providers, "dummychan")
+	})
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "dummychan")
+
+	// No channel.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.Equal(t, "", prov.channel, "channel pushed without hint")
+
+	// Channel hint.
+	rdis.FlushDB()
+	p.Set("channel", "whatsapp")
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.Equal(t, "whatsapp", data.OTP.Channel, "channel doesn't match")
+	assert.Equal(t, "whatsapp", prov.channel, "channel not pushed to provider")
+
+	otp, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, "whatsapp", otp.Channel, "channel not stored")
+
+	// Invalid channel.
+	p.Set("channel", strings.Repeat("x", maxChannelLen+1))
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for long channel")
+}
+
+func TestNamespacePhoneCode(t *testing.T) {
+	rdis.FlushDB()
+	prov := &dummyChanProv{}
+	testApp.providers["dummychan"] = &provider{provider: prov}
+	t.Cleanup(func() {
+		delete(testApp.providers, "dummychan")
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "dummychan")
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.Equal(t, "", prov.phoneCode, "phone code pushed without namespace default")
+
+	rdis.FlushDB()
+	testApp.namespaces[dummyNamespace] = nsConf{DefaultPhoneCode: "+44"}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.Equal(t, "+44", prov.phoneCode, "namespace phone code not pushed")
+}
+
+func TestSetOTPDuplicate(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.DupSendWindow = time.Minute
+	t.Cleanup(func() {
+		testApp.constants.DupSendWindow = 0
+	})
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	p.Set("otp", dummyOTP)
+
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.False(t, data.Duplicate, "first send marked duplicate")
+
+	// Identical send within the window.
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.True(t, data.Duplicate, "duplicate send not suppressed")
+	assert.Equal(t, 1, data.OTP.Deliveries, "duplicate send regenerated the OTP")
+	assert.Equal(t, dummyOTP, data.OTP.OTP, "otp doesn't match")
+
+	// A different OTP value isn't a duplicate.
+	*data = otpResp{}
+	p.Set("otp", "654321")
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.False(t, data.Duplicate, "different otp marked duplicate")
+	assert.Equal(t, 2, data.OTP.Deliveries, "otp wasn't regenerated")
+
+	// Outside the window.
+	*data = otpResp{}
+	testApp.constants.DupSendWindow = 0
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.False(t, data.Duplicate, "send marked duplicate with no window")
+}
+
+func TestSetOTPDuplicateConcurrent(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.DupSendWindow = time.Minute
+	prov := &dummyBlockProv{pushed: make(chan struct{}, 2), release: make(chan struct{})}
+	testApp.providers["dummyblock"] = &provider{name: "dummyblock", provider: prov}
+	t.Cleanup(func() {
+		testApp.constants.DupSendWindow = 0
+		delete(testApp.providers, "dummyblock")
+	})
+
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "dummyblock")
+	p.Set("otp", dummyOTP)
+
+	// Send an OTP whose push blocks.
+	var first httpResp
+	done := make(chan *http.Response)
+	go func() {
+		done <- testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &first)
+	}()
+	<-prov.pushed
+
+	// An identical request while it's being sent isn't sent again.
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusConflict, r.StatusCode, "non 409 response for a concurrent send")
+	assert.Equal(t, errCodeSendInProgress, out.ErrorCode, "error code mismatch")
+
+	close(prov.release)
+	r = <-done
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+
+	// Once sent, identical sends are duplicates.
+	data := &otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &httpResp{Data: data})
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.True(t, data.Duplicate, "duplicate send not suppressed")
+
+	// Many concurrent identical requests are sent once.
+	rdis.FlushDB()
+	prov.pushes = 0
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &httpResp{})
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, prov.pushes, "concurrent identical sends pushed more than once")
+}
+
+func TestSetOTPDuplicateFailedPush(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.DupSendWindow = time.Minute
+	testApp.providers["dummyfail"] = &provider{provider: &dummyFailProv{}}
+	t.Cleanup(func() {
+		testApp.constants.DupSendWindow = 0
+		delete(testApp.providers, "dummyfail")
+	})
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "dummyfail")
+	p.Set("otp", dummyOTP)
+
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusInternalServerError, r.StatusCode, "non 500 response for failed push")
+
+	// A retry after a failed push isn't a duplicate and is sent.
+	testApp.providers["dummyfail"].provider = &dummyProv{}
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.False(t, data.Duplicate, "retry after failed push marked duplicate")
+	assert.Equal(t, 2, data.OTP.Deliveries, "retry wasn't sent")
+
+	// Once sent, identical sends are duplicates.
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.True(t, data.Duplicate, "duplicate send not suppressed")
+}
+
+func TestSetOTPReuseExisting(t *testing.T) {
+	rdis.FlushDB()
+	t.Cleanup(func() { testApp.namespaces[dummyNamespace] = nsConf{} })
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{Data: data}
+		p    = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// By default, the OTP is regenerated and resent.
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.False(t, data.Reused, "otp reused by default")
+	assert.Equal(t, 2, data.OTP.Deliveries, "otp wasn't resent")
+	otp := data.OTP.OTP
+
+	// The open OTP is returned as is.
+	*data = otpResp{}
+	p.Set("reuse_existing", "true")
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.True(t, data.Reused, "otp wasn't reused")
+	assert.Equal(t, otp, data.OTP.OTP, "reused otp mismatch")
+	assert.Equal(t, 2, data.OTP.Deliveries, "reused otp was resent")
+
+	// A different OTP value isn't reused.
+	*data = otpResp{}
+	p.Set("otp", "654321")
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.False(t, data.Reused, "different otp reused")
+	assert.Equal(t, "654321", data.OTP.OTP)
+
+	// Closed OTPs aren't reused. The namespace can enable reuse by default.
+	testApp.namespaces[dummyNamespace] = nsConf{ReuseExisting: true}
+	p.Del("reuse_existing")
+	p.Del("otp")
+	assert.NoError(t, testApp.store.Close(context.Background(), dummyNamespace, dummyOTPID))
+
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.False(t, data.Reused, "closed otp reused")
+
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.True(t, data.Reused, "namespace default not applied")
+}
+
+func TestSetOTPReuseFailedPush(t *testing.T) {
+	rdis.FlushDB()
+	testApp.providers["dummyfail"] = &provider{provider: &dummyFailProv{}}
+	t.Cleanup(func() { delete(testApp.providers, "dummyfail") })
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{Data: data}
+		p    = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "dummyfail")
+	p.Set("reuse_existing", "true")
+
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusInternalServerError, r.StatusCode, "non 500 response for failed push")
+
+	// An OTP that was never sent isn't reused and is sent again.
+	testApp.providers["dummyfail"].provider = &dummyProv{}
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.False(t, data.Reused, "unsent otp reused")
+	assert.Equal(t, 2, data.OTP.Deliveries, "unsent otp wasn't resent")
+
+	// Once it's sent, it's reused.
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.True(t, data.Reused, "sent otp wasn't reused")
+}
+
+func TestProviderQuota(t *testing.T) {
+	rdis.FlushDB()
+	testApp.providers[dummyProvider].dailyQuota = 1
+	t.Cleanup(func() {
+		testApp.providers[dummyProvider].dailyQuota = 0
+	})
+
+	var (
+		out = httpResp{}
+		p   = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID+"2", p, &out)
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode, "non 429 response for exceeded quota")
+	assert.Equal(t, errCodeQuotaExceeded, out.ErrorCode, "error code mismatch")
+
+	// Usage is reported on the provider info.
+	var (
+		data = &providerResp{}
+		pOut = httpResp{Data: data}
+	)
+	r = testRequest(t, http.MethodGet, "/api/providers/"+dummyProvider, nil, &pOut)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.Equal(t, 1, data.DailyQuota, "daily quota mismatch")
+	assert.Equal(t, 1, data.QuotaUsed, "quota usage mismatch")
+
+	// Failed pushes don't count against the quota.
+	testApp.providers["dummyfail"] = &provider{name: "dummyfail", provider: &dummyFailProv{}, dailyQuota: 1}
+	t.Cleanup(func() {
+		delete(testApp.providers, "dummyfail")
+	})
+	p.Set("provider", "dummyfail")
+	for i := 0; i < 2; i++ {
+		r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID+"3", p, &out)
+		assert.Equal(t, http.StatusInternalServerError, r.StatusCode, "non 500 response for failed push")
+	}
+	n, err := testApp.store.GetQuota(context.Background(), "dummyfail", quotaPeriod(time.Now(), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, n, "failed push counted against the quota")
+
+	// Periods roll over at the reset time.
+	ts := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	assert.Equal(t, "2024-01-02", quotaPeriod(ts, 0))
+	assert.Equal(t, "2024-01-01", quotaPeriod(ts, 4*time.Hour))
+}
+
+func TestAutoProvider(t *testing.T) {
+	rdis.FlushDB()
+	testApp.providers["dummyphone"] = &provider{provider: &dummyPhoneProv{}}
+	t.Cleanup(func() {
+		delete(testApp.providers, "dummyphone")
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	// Auto routing is opt-in.
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, url.Values{"to": {dummyToAddress}}, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "otp set without provider")
+	assert.Equal(t, errCodeInvalidProvider, out.ErrorCode, "error code mismatch")
+
+	testApp.namespaces[dummyNamespace] = nsConf{AutoProviders: []string{"dummyphone", dummyProvider}}
+	for _, c := range []struct {
+		to       string
+		status   int
+		provider string
+	}{
+		{"9876543210", http.StatusOK, "dummyphone"},
+		{dummyToAddress, http.StatusOK, dummyProvider},
+		{"unknown", http.StatusBadRequest, ""},
+	} {
+		rdis.FlushDB()
+		var (
+			data = &otpResp{}
+			out  = httpResp{Data: data}
+		)
+		r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, url.Values{"to": {c.to}}, &out)
+		assert.Equal(t, c.status, r.StatusCode, "%s: status mismatch", c.to)
+		assert.Equal(t, c.provider, data.Provider, "%s: provider mismatch", c.to)
+		if c.status != http.StatusOK {
+			assert.Equal(t, errCodeInvalidAddress, out.ErrorCode, "%s: error code mismatch", c.to)
+		}
+	}
+}
+
+func TestSetOTPBatch(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.BatchMaxSize = 4
+	testApp.constants.BatchConcurrency = 2
+	t.Cleanup(func() {
+		testApp.constants.BatchMaxSize = 0
+		testApp.constants.BatchConcurrency = 0
+	})
+
+	batch := func(body string) (*http.Response, httpResp) {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/otp/batch", strings.NewReader(body))
+		req.SetBasicAuth(dummyNamespace, dummySecret)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		out := httpResp{Data: &[]httpResp{}}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+		return resp, out
+	}
+
+	resp, out := batch(`[
+		{"id": "batchotp1", "provider": "` + dummyProvider + `", "to": "` + dummyToAddress + `", "otp": "123456", "ttl": 60},
+		{"id": "batchotp2", "provider": "unknown", "to": "` + dummyToAddress + `"},
+		{"id": "batchotp1", "provider": "` + dummyProvider + `", "to": "` + dummyToAddress + `"},
+		{"provider": "` + dummyProvider + `", "to": "` + dummyToAddress + `", "extra": {"user_id": 1}}
+	]`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "batch failed")
+
+	res := *out.Data.(*[]httpResp)
+	if !assert.Len(t, res, 4, "result count mismatch") {
+		return
+	}
+	assert.Equal(t, "success", res[0].Status, "valid item failed")
+	assert.Equal(t, errCodeInvalidProvider, res[1].ErrorCode, "invalid provider not rejected")
+	assert.Equal(t, errCodeInvalidParam, res[2].ErrorCode, "duplicate id not rejected")
+	assert.Equal(t, "success", res[3].Status, "item without an id failed")
+
+	// The OTPs are set and can be verified.
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, "batchotp1", store.CounterNil)
+	assert.NoError(t, err, "batch otp not set")
+	assert.Equal(t, "123456", o.OTP, "batch otp mismatch")
+	assert.Equal(t, 1, o.Deliveries, "deliveries mismatch")
+	assert.Equal(t, time.Minute, o.TTL, "ttl mismatch")
+
+	var vout httpResp
+	r := testRequest(t, http.MethodPost, "/api/otp/batchotp1", url.Values{"otp": {"123456"}}, &vout)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "batch otp not verified")
+
+	// Invalid batches.
+	for _, body := range []string{`{}`, `[]`, `[{}, {}, {}, {}, {}]`} {
+		resp, _ := batch(body)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "invalid batch %s accepted", body)
+	}
+}
+
+func TestSetOTPBatchBulkPush(t *testing.T) {
+	rdis.FlushDB()
+
+	// The package tracer only delegates to the first global provider that was
+	// set (by TestTracing), so it's swapped instead.
+	rec := tracetest.NewSpanRecorder()
+	oldTracer := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer("test")
+	t.Cleanup(func() { tracer = oldTracer })
+
+	testApp.constants.BatchMaxSize = 4
+	testApp.constants.BatchConcurrency = 2
+	prov := &dummyBulkProv{}
+	testApp.providers["dummybulk"] = &provider{name: "dummybulk", provider: prov, fallbacks: []string{dummyProvider}, dailyQuota: 10}
+	t.Cleanup(func() {
+		testApp.constants.BatchMaxSize = 0
+		testApp.constants.BatchConcurrency = 0
+		delete(testApp.providers, "dummybulk")
+	})
+
+	body := `[
+		{"id": "bulkotp1", "provider": "dummybulk", "to": "` + dummyToAddress + `"},
+		{"id": "bulkotp2", "provider": "dummybulk", "to": "` + dummyToAddress + `", "otp": "` + failOTP + `"},
+		{"id": "bulkotp3", "provider": "dummybulk"},
+		{"id": "bulkotp4", "provider": "dummybulk", "to": "` + dummyToAddress + `"}
+	]`
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/otp/batch", strings.NewReader(body))
+	req.SetBasicAuth(dummyNamespace, dummySecret)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var res []struct {
+		Status string  `json:"status"`
+		Data   otpResp `json:"data"`
+	}
+	out := httpResp{Data: &res}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	if !assert.Len(t, res, 4, "result count mismatch") {
+		return
+	}
+
+	// OTPs with addresses are pushed in one call and never individually.
+	if assert.Len(t, prov.bulk, 1, "bulk push count mismatch") {
+		assert.Len(t, prov.bulk[0], 3, "bulk message count mismatch")
+		assert.NotEmpty(t, prov.bulk[0][0].OTP.Nonce, "nonce not set")
+	}
+	assert.Equal(t, 0, prov.pushes, "bulk otps pushed individually")
+
+	for i, r := range res {
+		assert.Equal(t, "success", r.Status, "item %d failed", i)
+	}
+
+	assert.Equal(t, "dummybulk", res[0].Data.DeliveredVia)
+	assert.Equal(t, dummyProvider, res[1].Data.DeliveredVia, "failed message not sent to the fallback")
+	assert.Equal(t, "", res[2].Data.DeliveredVia, "otp without an address pushed")
+	assert.Equal(t, "dummybulk", res[3].Data.DeliveredVia)
+
+	// The failed message doesn't count against the quota.
+	n, err := testApp.store.GetQuota(context.Background(), "dummybulk", quotaPeriod(time.Now(), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, n, "quota usage mismatch")
+
+	// Failures in the bulk push are recorded on its span.
+	for _, s := range rec.Ended() {
+		if s.Name() == "provider.BulkPush" {
+			assert.Equal(t, codes.Error, s.Status().Code, "bulk push failure not recorded")
+			return
+		}
+	}
+	t.Fatal("bulk push span not recorded")
+}
+
+func TestAddressLockout(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.AddressLockout = time.Minute
+	testApp.namespaces[dummyNamespace] = nsConf{AllowAdminReset: true}
+	t.Cleanup(func() {
+		testApp.constants.AddressLockout = 0
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	p.Set("max_attempts", "2")
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// A failed attempt doesn't lock the address.
+	testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"000000"}}, &out)
+	r = testRequest(t, http.MethodPut, "/api/otp/otherotpid", p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "address locked before the attempts were exhausted")
+
+	// Exhausting the attempts locks the address for new OTPs with other IDs.
+	testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"000000"}}, &out)
+	var (
+		data = &lockErrResp{}
+		lout = httpResp{Data: data}
+	)
+	r = testRequest(t, http.MethodPut, "/api/otp/newotpid", p, &lout)
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode, "locked address not rejected")
+	assert.Equal(t, errCodeOTPLocked, lout.ErrorCode, "error code mismatch")
+	assert.Equal(t, float64(60), data.TTL, "lockout ttl mismatch")
+
+	// Resetting the attempts unlocks the address.
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID+"/reset", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "reset failed")
+	r = testRequest(t, http.MethodPut, "/api/otp/newotpid", p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "address not unlocked on reset")
+}
+
+func TestAddressLockoutAddressView(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.AddressLockout = time.Minute
+	testApp.tpl = template.Must(template.New("").Parse(
+		`{{ define "message" }}{{ .Title }}{{ end }}{{ define "index" }}{{ .Message }}{{ end }}{{ define "otp" }}otp{{ end }}`))
+	t.Cleanup(func() {
+		testApp.constants.AddressLockout = 0
+		testApp.tpl = nil
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	p.Set("max_attempts", "1")
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"000000"}}, &out)
+
+	// An OTP without an address can't be sent to the locked address from
+	// the web view.
+	p.Del("to")
+	r = testRequest(t, http.MethodPut, "/api/otp/newotpid", p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	resp, err := http.PostForm(srv.URL+"/otp/"+dummyNamespace+"/newotpid/address", url.Values{"to": {dummyToAddress}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(b), "Too many failed attempts", "locked address not rejected")
+
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, "newotpid", store.CounterNil)
+	assert.NoError(t, err)
+	assert.Empty(t, o.To, "locked address set")
+	assert.Zero(t, o.LastSent, "otp sent to a locked address")
+}
+
+func TestAddressLockoutNormalized(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.AddressLockout = time.Minute
+	testApp.providers["dummyphone"] = &provider{provider: &dummyPhoneProv{}}
+	testApp.namespaces[dummyNamespace] = nsConf{DefaultPhoneCode: "+91"}
+	t.Cleanup(func() {
+		testApp.constants.AddressLockout = 0
+		delete(testApp.providers, "dummyphone")
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", "9876543210")
+	p.Set("provider", "dummyphone")
+	p.Set("max_attempts", "1")
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"000000"}}, &out)
+
+	// The lock applies to the address with the phone code too.
+	p.Set("to", "+919876543210")
+	r = testRequest(t, http.MethodPut, "/api/otp/newotpid", p, &out)
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode, "locked address not rejected")
+}
+
+func TestSetOTPFallback(t *testing.T) {
+	rdis.FlushDB()
+	testApp.providers["dummyfail"] = &provider{provider: &dummyFailProv{}}
+	t.Cleanup(func() {
+		delete(testApp.providers, "dummyfail")
+	})
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "dummyfail")
+
+	// No fallbacks.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusInternalServerError, r.StatusCode, "non 500 response for failed push")
+
+	// Fallback.
+	rdis.FlushDB()
+	testApp.providers["dummyfail"].fallbacks = []string{dummyProvider}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "fallback push failed")
+	assert.Equal(t, dummyProvider, data.DeliveredVia, "delivering provider doesn't match")
+	assert.Equal(t, "dummyfail", data.Provider, "provider doesn't match")
+}
+
+func TestSetOTPQueued(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.DupSendWindow = time.Minute
+	testApp.providers["dummyqueue"] = &provider{name: "dummyqueue", provider: &dummyQueueProv{}}
+	t.Cleanup(func() {
+		testApp.constants.DupSendWindow = 0
+		delete(testApp.providers, "dummyqueue")
+	})
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "dummyqueue")
+	p.Set("otp", dummyOTP)
+
+	// A queued push is accepted, but isn't marked sent.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response for queued push")
+	assert.True(t, data.Queued, "queued push not reported")
+	assert.Empty(t, data.DeliveredVia, "queued push reported delivered")
+
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, o.LastSent, "queued push marked sent")
+
+	// So an identical send isn't suppressed as a duplicate.
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "non 200 response")
+	assert.False(t, data.Duplicate, "send after queued push marked duplicate")
+
+	// Fallbacks are tried on queued pushes.
+	rdis.FlushDB()
+	testApp.providers["dummyqueue"].fallbacks = []string{dummyProvider}
+	*data = otpResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "fallback push failed")
+	assert.False(t, data.Queued, "delivered push reported queued")
+	assert.Equal(t, dummyProvider, data.DeliveredVia, "delivering provider doesn't match")
+}
+
+func TestCheckOTP(t *testing.T) {
+	rdis.FlushDB()
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("id", dummyOTPID)
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	// Register OTP.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Check OTP.
+	cp := url.Values{}
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for empty otp check")
+
+	// Bad OTP.
+	cp.Set("otp", "123")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for bad otp check")
+	assert.Equal(t, 1, data.VerifyAttempts, "attempts didn't increase")
+
+	// Good OTP. skip_delete so that it's not deleted.
+	cp.Set("otp", dummyOTP)
+	cp.Set("skip_delete", "true")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "good OTP failed")
+
+	// Check it again. Shouldn't been deleted and should have the time of verification.
+	// Without app.verify_grace, the repeat verification is counted.
+	cp.Set("skip_delete", "false")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "good OTP failed")
+	assert.True(t, data.Closed, "OTP isn't closed")
+	assert.NotZero(t, data.VerifiedAt, "verified_at isn't set")
+	assert.Equal(t, 3, data.VerifyAttempts, "repeat verification without grace wasn't counted")
+
+	// Check it again. Should be deleted.
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
+	assert.NotEqual(t, http.StatusOK, r.StatusCode, "OTP didn't get deleted on verification")
+}
+
+func TestCheckOTPTrim(t *testing.T) {
+	t.Cleanup(func() {
+		testApp.constants.TrimOTPInput = true
+		testApp.constants.StripOTPSpaces = false
+	})
+
+	set := func() {
+		rdis.FlushDB()
+		p := url.Values{"otp": {dummyOTP}, "to": {dummyToAddress}, "provider": {dummyProvider}}
+		r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &httpResp{})
+		assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	}
+	verify := func(otp string) int {
+		r := testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {otp}}, &httpResp{})
+		return r.StatusCode
+	}
+
+	// Surrounding whitespace is trimmed.
+	set()
+	assert.Equal(t, http.StatusOK, verify(" \t"+dummyOTP+" \n"))
+
+	// Whitespace-only input is empty.
+	set()
+	assert.Equal(t, http.StatusBadRequest, verify("   "))
+
+	// Whitespace within codes isn't stripped by default.
+	set()
+	assert.Equal(t, http.StatusBadRequest, verify("123 456"))
+
+	testApp.constants.StripOTPSpaces = true
+	assert.Equal(t, http.StatusOK, verify(" 123 456 "))
+
+	// The stored OTP isn't altered.
+	set()
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, dummyOTP, o.OTP)
+
+	testApp.constants.TrimOTPInput = false
+	testApp.constants.StripOTPSpaces = false
+	assert.Equal(t, http.StatusBadRequest, verify(" "+dummyOTP+" "))
+}
+
+func TestCheckOTPJSON(t *testing.T) {
+	rdis.FlushDB()
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &httpResp{})
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	verify := func(body string) (*http.Response, *otpResp) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/otp/"+dummyOTPID, strings.NewReader(body))
+		req.SetBasicAuth(dummyNamespace, dummySecret)
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		data := &otpResp{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&httpResp{Data: data}))
+		return resp, data
+	}
+
+	r, _ = verify(`{"otp": "000000"}`)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "incorrect otp verified")
+
+	r, _ = verify(`{"otp": "` + dummyOTP + `"`)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "invalid json accepted")
+
+	r, data := verify(`{"otp": "` + dummyOTP + `", "skip_delete": true}`)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "good OTP failed")
+	assert.True(t, data.Closed, "OTP isn't closed")
+
+	// skip_delete was honoured and the OTP can be verified again.
+	r, _ = verify(`{"otp": "` + dummyOTP + `"}`)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "OTP deleted despite skip_delete")
+
+	r, _ = verify(`{"otp": "` + dummyOTP + `"}`)
+	assert.NotEqual(t, http.StatusOK, r.StatusCode, "OTP didn't get deleted on verification")
+}
+
+func TestCheckOTPCaseInsensitive(t *testing.T) {
+	rdis.FlushDB()
+	var (
+		out = httpResp{}
+		p   = url.Values{}
+		cp  = url.Values{}
+	)
+	p.Set("otp", "AbC123")
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	// Case-sensitive by default.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	cp.Set("otp", "abc123")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "case-sensitive otp matched")
+
+	// Per-OTP flag.
+	rdis.FlushDB()
+	p.Set("case_insensitive", "true")
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "case-insensitive otp didn't match")
+
+	// Per-namespace flag.
+	rdis.FlushDB()
+	testApp.namespaces[dummyNamespace] = nsConf{CaseInsensitive: true}
+	t.Cleanup(func() {
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+	p.Del("case_insensitive")
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	cp.Set("otp", "ABC123")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "case-insensitive namespace otp didn't match")
+}
+
+func TestCheckOTPVerifyData(t *testing.T) {
+	rdis.FlushDB()
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p  = url.Values{}
+		cp = url.Values{}
+	)
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	// Invalid hash.
+	p.Set("extra", `{"verify_data": "1234"}`)
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for invalid verify_data")
+
+	h := sha256.Sum256([]byte("1234"))
+	p.Set("extra", `{"verify_data": "`+hex.EncodeToString(h[:])+`"}`)
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Correct OTP, missing and wrong verify_data.
+	cp.Set("otp", dummyOTP)
+	cp.Set("skip_delete", "true")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "otp verified without verify_data")
+	assert.Equal(t, 1, data.VerifyAttempts, "attempt wasn't counted")
+
+	cp.Set("verify_data", "0000")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "otp verified with wrong verify_data")
+
+	cp.Set("verify_data", "1234")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp with correct verify_data failed")
+}
+
+func TestOTPViewVerifyData(t *testing.T) {
+	rdis.FlushDB()
+	testApp.tpl = template.Must(template.New("").Parse(
+		`{{ define "message" }}{{ .Title }}{{ end }}{{ define "otp" }}{{ .Message }}{{ end }}`))
+	t.Cleanup(func() { testApp.tpl = nil })
+
+	h := sha256.Sum256([]byte("1234"))
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, url.Values{
+		"otp":      {dummyOTP},
+		"to":       {dummyToAddress},
+		"provider": {dummyProvider},
+		"extra":    {`{"verify_data": "` + hex.EncodeToString(h[:]) + `"}`},
+	}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither the form nor verification links verify the OTP or consume
+	// attempts and nonces.
+	uri := srv.URL + "/otp/" + dummyNamespace + "/" + dummyOTPID
+	for _, p := range []url.Values{
+		{"action": {actCheck}, "otp": {dummyOTP}},
+		{"action": {actCheck}, "otp": {dummyOTP}, "nonce": {o.Nonce}},
+	} {
+		resp, err := http.PostForm(uri, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "Verification unavailable", string(b))
+	}
+
+	o, err = testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, o.VerifyAttempts, "web view consumed an attempt")
+	assert.False(t, o.Closed, "web view verified the OTP")
+	assert.NotEmpty(t, o.Nonce, "web view consumed the nonce")
+}
+
+func TestCheckOTPHash(t *testing.T) {
+	rdis.FlushDB()
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	// Register OTP.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Bad algorithm.
+	good := sha256.Sum256([]byte(dummyOTP))
+	cp := url.Values{}
+	cp.Set("otp_hash", hex.EncodeToString(good[:]))
+	cp.Set("hash_algo", "md5")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for bad algorithm")
+
+	// Bad hash.
+	bad := sha256.Sum256([]byte("123"))
+	cp.Set("hash_algo", "sha256")
+	cp.Set("otp_hash", hex.EncodeToString(bad[:]))
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for bad otp hash")
+	assert.Equal(t, 1, data.VerifyAttempts, "attempts didn't increase")
+
+	// Good hash.
+	cp.Set("otp_hash", hex.EncodeToString(good[:]))
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "good otp hash failed")
+	assert.True(t, data.Closed, "otp wasn't closed")
+}
+
+func TestCheckOTPAttempts(t *testing.T) {
+	rdis.FlushDB()
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("id", dummyOTPID)
+	p.Set("otp", dummyOTP)
+	p.Set("max_attempts", "5")
+	p.Set("max_generate", "5")
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	// Register OTP.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	cp := url.Values{}
+	cp.Set("otp", dummyOTP)
+	cp.Set("skip_delete", "true")
+
+	// Good otp check.
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "good OTP failed")
+
+	// Exceed bad attempts.
+	cp.Set("otp", "123999")
+	for i := 0; i < 10; i++ {
+		r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
+		assert.NotEqual(t, http.StatusOK, r.StatusCode, "bad OTP passed")
+	}
+
+	// Rate limited.
+	cp.Set("skip_delete", "true")
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode, "bad OTPs didn't get rate limited")
+}
+
+func TestDeleteOnOTPCheck(t *testing.T) {
+	rdis.FlushDB()
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("id", dummyOTPID)
+	p.Set("otp", dummyOTP)
+	p.Set("max_attempts", "5")
+	p.Set("max_generate", "5")
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	// Register OTP.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Verification pending before otp status check.
+	r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &data)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "verification pending")
+
+	cp := url.Values{}
+	cp.Set("otp", dummyOTP)
+	cp.Set("skip_delete", "true")
+
+	// Verify (done by the otpgateway module).
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &data)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "verification failed")
+
+	// Delete on status check
+	r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &data)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "verification pending")
+
+	// Reattempt status check
+	r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &data)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "otp not found")
+}
+
+func TestOTPViewRemovedProvider(t *testing.T) {
+	rdis.FlushDB()
+	testApp.tpl = template.Must(template.New("").Parse(
+		`{{ define "message" }}{{ .Title }}{{ end }}{{ define "otp" }}{{ .Title }}: {{ .Message }}{{ end }}`))
+	p := testApp.providers[dummyProvider]
+	t.Cleanup(func() {
+		testApp.tpl = nil
+		testApp.providers[dummyProvider] = p
+	})
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, url.Values{
+		"otp":      {dummyOTP},
+		"to":       {dummyToAddress},
+		"provider": {dummyProvider},
+	}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// The provider is removed from the config.
+	delete(testApp.providers, dummyProvider)
+
+	uri := srv.URL + "/otp/" + dummyNamespace + "/" + dummyOTPID
+	post := func(p url.Values) string {
+		resp, err := http.PostForm(uri, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	// Resending needs the provider.
+	assert.Equal(t, "Verify OTP: error resending OTP.", post(url.Values{"action": {actResend}}))
+
+	// Verification doesn't.
+	assert.Equal(t, "Verify OTP: Incorrect OTP", post(url.Values{"action": {actCheck}, "otp": {"000000"}}))
+	assert.Equal(t, "OTP verified", post(url.Values{"action": {actCheck}, "otp": {dummyOTP}}))
+}
+
+func TestVerifyMinInterval(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.VerifyMinInterval = time.Minute
+	t.Cleanup(func() {
+		testApp.constants.VerifyMinInterval = 0
+	})
+
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	// Register OTP.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	cp := url.Values{}
+	cp.Set("otp", "123")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for bad otp check")
+	assert.Equal(t, 1, data.VerifyAttempts, "attempts didn't increase")
+
+	// Rapid second attempt.
+	cp.Set("otp", dummyOTP)
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode, "rapid attempt didn't get throttled")
+	assert.Equal(t, errCodeRateLimited, out.ErrorCode, "error code mismatch")
+	assert.Equal(t, "60", r.Header.Get("Retry-After"), "Retry-After header mismatch")
+
+	// Retry-After is the time left since the last attempt, rounded up.
+	for _, k := range rdis.Keys() {
+		if strings.HasSuffix(k, ":"+dummyOTPID) {
+			rdis.HSet(k, "last_verify", strconv.FormatInt(time.Now().Add(-time.Millisecond*44500).UnixMilli(), 10))
+		}
+	}
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode, "rapid attempt didn't get throttled")
+	assert.Equal(t, "16", r.Header.Get("Retry-After"), "Retry-After isn't the time left")
+}
+
+func TestVerifyFailDelay(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.VerifyFailDelay = time.Millisecond * 100
+	testApp.constants.VerifyFailJitter = time.Millisecond * 50
+	t.Cleanup(func() {
+		testApp.constants.VerifyFailDelay = 0
+		testApp.constants.VerifyFailJitter = 0
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Incorrect OTPs are delayed.
+	start := time.Now()
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"000000"}}, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*100, "failure not delayed")
+
+	// Correct OTPs aren't.
+	start = time.Now()
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {dummyOTP}}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Less(t, time.Since(start), time.Millisecond*100, "success delayed")
+
+	// The delay ends with the context.
+	testApp.constants.VerifyFailDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	start = time.Now()
+	verifyFailDelay(ctx, testApp)
+	assert.Less(t, time.Since(start), time.Second, "delay outlived the context")
+}
+
+func TestWebVerifyRateLimit(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.WebVerifyRateLimit = 2
+	testApp.constants.WebVerifyRateWindow = time.Minute
+	testApp.tpl = template.Must(template.New("").Parse(
+		`{{ define "message" }}{{ .Title }}{{ end }}{{ define "otp" }}{{ .Message }}{{ end }}`))
+	t.Cleanup(func() {
+		testApp.constants.WebVerifyRateLimit = 0
+		testApp.tpl = nil
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	verify := func(otp string) string {
+		resp, err := http.PostForm(srv.URL+"/otp/"+dummyNamespace+"/"+dummyOTPID,
+			url.Values{"action": {actCheck}, "otp": {otp}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	assert.Equal(t, "Incorrect OTP", verify("000000"))
+	assert.Equal(t, "Incorrect OTP", verify("000000"))
+
+	// The IP has exhausted its attempts, even with the right OTP.
+	assert.Equal(t, "Too many attempts", verify(dummyOTP))
+
+	// The API isn't affected.
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {dummyOTP}}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "api verification failed")
+}
+
+func TestOTPViewGET(t *testing.T) {
+	rdis.FlushDB()
+	testApp.tpl = template.Must(template.New("").Parse(
+		`{{ define "message" }}{{ .Title }}{{ end }}{{ define "otp" }}{{ .Message }}{{ end }}`))
+	t.Cleanup(func() { testApp.tpl = nil })
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	uri := srv.URL + "/otp/" + dummyNamespace + "/" + dummyOTPID
+	get := func(q url.Values) {
+		resp, err := http.Get(uri + "?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// GETs with a left over action neither consume attempts nor resend.
+	get(url.Values{"action": {actCheck}, "otp": {"000000"}})
+	get(url.Values{"action": {actCheck}, "otp": {dummyOTP}})
+	get(url.Values{"action": {actResend}})
+
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, o.VerifyAttempts, "GET consumed an attempt")
+	assert.Equal(t, 1, o.Deliveries, "GET resent the OTP")
+	assert.False(t, o.Closed, "GET verified the OTP")
+
+	// A POSTed verification is counted.
+	resp, err := http.PostForm(uri, url.Values{"action": {actCheck}, "otp": {"000000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	o, err = testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, o.VerifyAttempts, "POST didn't consume an attempt")
+}
+
+func TestOTPViewNonce(t *testing.T) {
+	rdis.FlushDB()
+	testApp.tpl = template.Must(template.New("").Parse(
+		`{{ define "message" }}{{ .Title }}{{ end }}{{ define "otp" }}{{ .Input }}:{{ .Nonce }}{{ end }}`))
+	t.Cleanup(func() { testApp.tpl = nil })
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, url.Values{
+		"otp":      {dummyOTP},
+		"to":       {dummyToAddress},
+		"provider": {dummyProvider},
+	}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, o.Nonce, "nonce not set")
+
+	uri := srv.URL + "/otp/" + dummyNamespace + "/" + dummyOTPID
+	read := func(resp *http.Response, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	link := url.Values{"action": {actCheck}, "otp": {dummyOTP}, "nonce": {o.Nonce}}
+
+	// Opening the link (eg: by a link scanner) only renders the OTP to be
+	// confirmed, and doesn't consume the nonce.
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, dummyOTP+":"+o.Nonce, read(http.Get(uri+"?"+link.Encode())))
+	}
+	assert.Equal(t, "Session expired", read(http.Get(uri+"?"+url.Values{
+		"action": {actCheck}, "otp": {dummyOTP}, "nonce": {"wrong"}}.Encode())))
+
+	o, err = testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.False(t, o.Closed, "GET verified the OTP")
+	assert.NotEmpty(t, o.Nonce, "GET consumed the nonce")
+
+	// Confirming it verifies the OTP and consumes the nonce.
+	assert.Equal(t, "dummychannel verified", read(http.PostForm(uri, link)))
+	o, err = testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Empty(t, o.Nonce, "nonce not consumed")
+
+	// Replays are rejected.
+	assert.Equal(t, "Session expired", read(http.PostForm(uri, link)))
+}
+
+func TestOTPViewEmbed(t *testing.T) {
+	rdis.FlushDB()
+	testApp.tpl = template.Must(template.New("").Parse(
+		`{{ define "message" }}{{ .Title }}{{ end }}{{ define "otp" }}{{ if .Embed }}embed{{ end }}{{ end }}`))
+	t.Cleanup(func() {
+		testApp.tpl = nil
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, url.Values{
+		"otp": {dummyOTP}, "to": {dummyToAddress}, "provider": {dummyProvider}}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	get := func(uri string) (*http.Response, string) {
+		resp, err := http.Get(srv.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	uri := "/otp/" + dummyNamespace + "/" + dummyOTPID
+
+	// Regular views can only be framed by the same origin.
+	resp, body := get(uri)
+	assert.Empty(t, body)
+	assert.Equal(t, "SAMEORIGIN", resp.Header.Get("X-Frame-Options"))
+	assert.Equal(t, "frame-ancestors 'self'", resp.Header.Get("Content-Security-Policy"))
+
+	// Without embed_origins, embedded views can only be framed by the same origin.
+	resp, body = get(uri + "?embed=1")
+	assert.Equal(t, "embed", body)
+	assert.Equal(t, "SAMEORIGIN", resp.Header.Get("X-Frame-Options"))
+	assert.Equal(t, "frame-ancestors 'self'", resp.Header.Get("Content-Security-Policy"))
+
+	testApp.namespaces[dummyNamespace] = nsConf{EmbedOrigins: []string{"https://a.example.com", "https://b.example.com"}}
+	resp, _ = get(uri + "?embed=1")
+	assert.Empty(t, resp.Header.Get("X-Frame-Options"))
+	assert.Equal(t, "frame-ancestors https://a.example.com https://b.example.com", resp.Header.Get("Content-Security-Policy"))
+
+	// embed_origins only apply to embedded views.
+	resp, _ = get(uri)
+	assert.Equal(t, "SAMEORIGIN", resp.Header.Get("X-Frame-Options"))
+	assert.Equal(t, "frame-ancestors 'self'", resp.Header.Get("Content-Security-Policy"))
+
+	// The address view redirects to the OTP view as the address is set.
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := c.Get(srv.URL + uri + "/address")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "SAMEORIGIN", resp.Header.Get("X-Frame-Options"))
+
+	// Redirects between views stay embedded.
+	assert.Equal(t, "/otp/a/b?embed=1", embedURI("/otp/a/b", true))
+	assert.Equal(t, "/otp/a/b", embedURI("/otp/a/b", false))
+}
+
+func TestParseOrigin(t *testing.T) {
+	for in, exp := range map[string]string{
+		"https://App.example.com":      "https://app.example.com",
+		"https://app.example.com/":     "https://app.example.com",
+		"http://localhost:8080":        "http://localhost:8080",
+		"app.example.com":              "",
+		"ftp://app.example.com":        "",
+		"https://app.example.com/path": "",
+		"https://user@app.example.com": "",
+		"https://app.example.com/?q=1": "",
+		"https://":                     "",
+	} {
+		out, err := parseOrigin(in)
+		if exp == "" {
+			assert.Error(t, err, "origin %q not rejected", in)
+			continue
+		}
+		assert.NoError(t, err, in)
+		assert.Equal(t, exp, out)
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	for in, exp := range map[string]string{
+		"10.0.0.0/8":      "10.0.0.0/8",
+		"10.1.2.3/8":      "10.0.0.0/8",
+		" 192.168.1.10 ":  "192.168.1.10/32",
+		"::ffff:10.0.0.1": "10.0.0.1/32",
+		"2001:db8::/32":   "2001:db8::/32",
+		"::1":             "::1/128",
+		"10.0.0.0/33":     "",
+		"10.0.0":          "",
+		"example.com":     "",
+		"":                "",
+	} {
+		out, err := parseCIDR(in)
+		if exp == "" {
+			assert.Error(t, err, "CIDR %q not rejected", in)
+			continue
+		}
+		assert.NoError(t, err, in)
+		assert.Equal(t, exp, out.String())
+	}
+}
+
+func TestAttemptsAcrossResends(t *testing.T) {
+	rdis.FlushDB()
+	testApp.tpl = template.Must(template.New("").Parse(
+		`{{ define "message" }}{{ .Title }}{{ end }}{{ define "otp" }}{{ .Message }}{{ end }}`))
+	t.Cleanup(func() { testApp.tpl = nil })
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	p.Set("max_attempts", "3")
+	p.Set("max_generate", "10")
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"000000"}}, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+
+	// Resends from the web view and the API don't consume or reset attempts.
+	uri := srv.URL + "/otp/" + dummyNamespace + "/" + dummyOTPID
+	resp, err := http.PostForm(uri, url.Values{"action": {actResend}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp resend failed")
+
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, o.VerifyAttempts, "resend changed the attempts")
+	assert.Equal(t, 3, o.Deliveries)
+
+	// Concurrent attempts can't exceed the cap.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testApp.store.Verify(context.Background(), dummyNamespace, dummyOTPID, "000000", 0, 0, 0)
+		}()
+	}
+	wg.Wait()
+
+	o, err = testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, o.VerifyAttempts, "attempts exceeded the cap")
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {dummyOTP}}, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.Equal(t, errCodeOTPLocked, out.ErrorCode)
+}
+
+func TestVerifyToken(t *testing.T) {
+	rdis.FlushDB()
+	testApp.verifyToken = &verifyTokenConf{secret: []byte("tokensecret"), ttl: time.Minute}
+	t.Cleanup(func() {
+		testApp.verifyToken = nil
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Failed verifications don't get a token.
+	var (
+		data = &verifyResp{}
+		vout = httpResp{Data: data}
+	)
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"000000"}}, &vout)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.Empty(t, data.Token)
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {dummyOTP}}, &vout)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "verification failed")
+	assert.True(t, data.Closed, "otp not closed")
+
+	tk, err := jwt.Parse(data.Token, func(t *jwt.Token) (interface{}, error) {
+		return []byte("tokensecret"), nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toHash := sha256.Sum256([]byte(dummyToAddress))
+	claims := tk.Claims.(jwt.MapClaims)
+	assert.Equal(t, dummyNamespace, claims["namespace"])
+	assert.Equal(t, dummyOTPID, claims["id"])
+	assert.Equal(t, hex.EncodeToString(toHash[:]), claims["to_hash"])
+	assert.NotZero(t, claims["verified_at"])
+
+	// Tokens signed with another key don't validate.
+	_, err = jwt.Parse(data.Token, func(t *jwt.Token) (interface{}, error) {
+		return []byte("wrong"), nil
+	})
+	assert.Error(t, err)
+}
+
+func TestObscureNotFound(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.ObscureNotFound = true
+	t.Cleanup(func() {
+		testApp.constants.ObscureNotFound = false
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	hash := sha256.Sum256([]byte("000000"))
+	for _, c := range []struct {
+		name string
+		id   string
+		p    url.Values
+	}{
+		{"wrong otp", dummyOTPID, url.Values{"otp": {"000000"}}},
+		{"unknown id", "unknownid", url.Values{"otp": {"000000"}}},
+		{"unknown id with hash", "unknownid", url.Values{"otp_hash": {hex.EncodeToString(hash[:])}}},
+	} {
+		out = httpResp{}
+		r := testRequest(t, http.MethodPost, "/api/otp/"+c.id, c.p, &out)
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode, "%s: status mismatch", c.name)
+		assert.Equal(t, "Incorrect OTP", out.Message, "%s: message mismatch", c.name)
+		assert.Equal(t, errCodeOTPMismatch, out.ErrorCode, "%s: error code mismatch", c.name)
+		assert.Nil(t, out.Data, "%s: data leaked", c.name)
+	}
+}
+
+func TestRetainVerified(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.RetainVerified = true
+	t.Cleanup(func() {
+		testApp.constants.RetainVerified = false
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Verify without skip_delete.
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {dummyOTP}}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "verification failed")
+
+	// The verified OTP is retained, even after a status check with DELETE.
+	for i := 0; i < 2; i++ {
+		var (
+			data = &models.OTP{}
+			sout = httpResp{Data: data}
+		)
+		r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &sout)
+		assert.Equal(t, http.StatusOK, r.StatusCode, "verified otp not retained")
+		assert.True(t, data.Closed, "retained otp not closed")
+	}
+}
+
+func TestOTPQR(t *testing.T) {
+	rdis.FlushDB()
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	resp, err := http.Get(srv.URL + "/otp/" + dummyNamespace + "/" + dummyOTPID + "/qr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "private, max-age=10", resp.Header.Get("Cache-Control"))
+	assert.True(t, bytes.HasPrefix(b, []byte("\x89PNG")), "response isn't a PNG")
+
+	resp, err = http.Get(srv.URL + "/otp/" + dummyNamespace + "/unknownid/qr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestSetOTPLocation(t *testing.T) {
+	rdis.FlushDB()
+	t.Cleanup(func() { testApp.constants.StatusCreated = false })
+
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, testApp.constants.RootURL+"/api/otp/"+dummyOTPID, r.Header.Get("Location"))
+
+	// New OTPs get a 201 and existing ones a 200.
+	testApp.constants.StatusCreated = true
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "existing otp not 200")
+
+	r = testRequest(t, http.MethodPut, "/api/otp/newotp123", p, &out)
+	assert.Equal(t, http.StatusCreated, r.StatusCode, "new otp not 201")
+	assert.Equal(t, testApp.constants.RootURL+"/api/otp/newotp123", r.Header.Get("Location"))
+	assert.Equal(t, "success", out.Status)
+}
+
+func TestSetOTPFieldErrors(t *testing.T) {
+	rdis.FlushDB()
+	t.Cleanup(func() { testApp.constants.FieldErrors = false })
+
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "unknown")
+	p.Set("ttl", "abc")
+	p.Set("extra", "{bad")
+
+	// Only the first error by default.
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.Equal(t, errCodeInvalidParam, out.ErrorCode)
+	assert.Equal(t, "Invalid `ttl` value.", out.Message)
+	assert.Nil(t, out.Data)
+
+	testApp.constants.FieldErrors = true
+	var res struct {
+		httpResp
+		Data fieldErrorsResp `json:"data"`
+	}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &res)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.Equal(t, errCodeValidation, res.ErrorCode)
+	assert.Equal(t, "Invalid `ttl` value.", res.Message)
+	assert.Len(t, res.Data.Errors, 3, "not all field errors returned")
+	assert.Contains(t, res.Data.Errors, "ttl")
+	assert.Equal(t, "Unknown provider.", res.Data.Errors["provider"])
+	assert.Contains(t, res.Data.Errors["extra"], "Invalid JSON")
+
+	// Errors past the numeric params.
+	p.Set("ttl", "60")
+	p.Set("provider", dummyProvider)
+	p.Set("channel", strings.Repeat("x", maxChannelLen+1))
+	res.Data = fieldErrorsResp{}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &res)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.Equal(t, errCodeValidation, res.ErrorCode)
+	assert.Len(t, res.Data.Errors, 2)
+	assert.Contains(t, res.Data.Errors, "channel")
+	assert.Contains(t, res.Data.Errors, "extra")
+
+	// Valid requests are unaffected.
+	p.Del("channel")
+	p.Del("extra")
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+}
+
+func TestMaxActiveOTPs(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.MaxActiveOTPs = 2
+	t.Cleanup(func() { testApp.constants.MaxActiveOTPs = 0 })
+
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	for _, id := range []string{"activeotp1", "activeotp2"} {
+		r := testRequest(t, http.MethodPut, "/api/otp/"+id, p, &out)
+		assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	}
+
+	// New IDs are rejected.
+	r := testRequest(t, http.MethodPut, "/api/otp/activeotp3", p, &out)
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode)
+	assert.Equal(t, errCodeMaxActiveOTPs, out.ErrorCode)
+
+	// Existing OTPs can be resent.
+	r = testRequest(t, http.MethodPut, "/api/otp/activeotp1", p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp resend failed")
+
+	// Deleted OTPs free up the limit.
+	assert.NoError(t, testApp.store.Delete(context.Background(), dummyNamespace, "activeotp2"))
+
+	r = testRequest(t, http.MethodPut, "/api/otp/activeotp3", p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// The new IDs in a batch are checked together and none of them are set if
+	// they don't all fit. Existing OTPs in the batch are still resent.
+	testApp.constants.MaxActiveOTPs = 3
+	testApp.constants.BatchMaxSize = 4
+	testApp.constants.BatchConcurrency = 2
+	t.Cleanup(func() {
+		testApp.constants.BatchMaxSize = 0
+		testApp.constants.BatchConcurrency = 0
+	})
+
+	body := `[
+		{"id": "activeotp1", "provider": "` + dummyProvider + `", "to": "` + dummyToAddress + `"},
+		{"id": "activeotp4", "provider": "` + dummyProvider + `", "to": "` + dummyToAddress + `"},
+		{"id": "activeotp5", "provider": "` + dummyProvider + `", "to": "` + dummyToAddress + `"}
+	]`
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/otp/batch", strings.NewReader(body))
+	req.SetBasicAuth(dummyNamespace, dummySecret)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	bOut := httpResp{Data: &[]httpResp{}}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&bOut))
+	res := *bOut.Data.(*[]httpResp)
+	if !assert.Len(t, res, 3, "result count mismatch") {
+		return
+	}
+	assert.Equal(t, "success", res[0].Status, "existing OTP in the batch not resent")
+	assert.Equal(t, errCodeMaxActiveOTPs, res[1].ErrorCode, "batch exceeded max active OTPs")
+	assert.Equal(t, errCodeMaxActiveOTPs, res[2].ErrorCode, "batch exceeded max active OTPs")
+
+	n, err := testApp.store.CountActive(context.Background(), dummyNamespace)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n, "new OTPs in the batch were set")
+}
+
+func TestVerifyGrace(t *testing.T) {
+	rdis.FlushDB()
+	t.Cleanup(func() { testApp.constants.VerifyGrace = 0 })
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	verify := func() *http.Response {
+		return testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {dummyOTP}}, &out)
+	}
+
+	// Without a grace period, verified OTPs are deleted.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	assert.Equal(t, http.StatusOK, verify().StatusCode)
+	assert.Equal(t, http.StatusBadRequest, verify().StatusCode, "deleted otp verified")
+
+	// With a grace period, repeat verifications succeed.
+	testApp.constants.VerifyGrace = time.Second
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	assert.Equal(t, http.StatusOK, verify().StatusCode)
+	assert.Equal(t, http.StatusOK, verify().StatusCode, "repeat verification failed")
+
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.True(t, o.Closed)
+	assert.Equal(t, 1, o.VerifyAttempts, "repeat verification counted")
+	assert.Equal(t, time.Second, rdis.TTL("OTP:"+dummyNamespace+":"+dummyOTPID), "grace period not set")
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"000000"}}, &out)
+	assert.Equal(t, http.StatusTooManyRequests, r.StatusCode, "incorrect otp verified")
+}
+
+func TestStoreURL(t *testing.T) {
+	rdis.FlushDB()
+	t.Cleanup(func() {
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var (
+		data = &models.OTP{}
+		out  = httpResp{Data: data}
+	)
+
+	// URLs aren't stored by default.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	r = testRequest(t, http.MethodGet, "/api/otp/"+dummyOTPID, nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Empty(t, data.ViewURL)
+
+	testApp.namespaces[dummyNamespace] = nsConf{StoreURL: true}
+	rdis.FlushDB()
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	*data = models.OTP{}
+	r = testRequest(t, http.MethodGet, "/api/otp/"+dummyOTPID, nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, getURL(testApp.constants.RootURL, models.OTP{Namespace: dummyNamespace, ID: dummyOTPID}, false), data.ViewURL)
+	assert.Empty(t, data.OTP, "otp value returned")
+	assert.Equal(t, dummyToAddress, data.To)
+
+	r = testRequest(t, http.MethodGet, "/api/otp/unknownid", nil, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.Equal(t, errCodeOTPNotFound, out.ErrorCode)
+}
+
+func TestRefCode(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.RefCodes = true
+	t.Cleanup(func() { testApp.constants.RefCodes = false })
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var (
+		data = &models.OTP{}
+		out  = httpResp{Data: data}
+	)
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	assert.Regexp(t, `^[A-Z]{3}-[0-9]{3}$`, data.Ref, "invalid reference code")
+	ref := data.Ref
+
+	// Resends keep the code.
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp resend failed")
+	assert.Equal(t, ref, data.Ref, "reference code changed on resend")
+
+	// Lookups are case-insensitive and don't return the OTP.
+	*data = models.OTP{}
+	r = testRequest(t, http.MethodGet, "/api/otp/ref/"+strings.ToLower(ref), nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "lookup by ref failed")
+	assert.Equal(t, dummyOTPID, data.ID)
+	assert.Empty(t, data.OTP, "otp returned in lookup")
+
+	r = testRequest(t, http.MethodGet, "/api/otp/ref/XYZ-000", nil, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.Equal(t, errCodeOTPNotFound, out.ErrorCode)
+
+	// Codes of deleted OTPs aren't found.
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {dummyOTP}}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp verification failed")
+	r = testRequest(t, http.MethodGet, "/api/otp/ref/"+ref, nil, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "deleted otp found by ref")
+}
+
+// failSetStore is a store that fails to set OTPs.
+type failSetStore struct {
+	store.Store
+}
+
+func (f *failSetStore) Set(ctx context.Context, namespace, id string, otp models.OTP) (models.OTP, error) {
+	return otp, errors.New("set failed")
+}
+
+func (f *failSetStore) SetBatch(ctx context.Context, namespace string, otps []models.OTP) ([]models.OTP, error) {
+	return nil, errors.New("set failed")
+}
+
+func TestRefCodeFailedSet(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.RefCodes = true
+	testApp.constants.BatchMaxSize = 4
+	testApp.constants.BatchConcurrency = 2
+	st := testApp.store
+	testApp.store = &failSetStore{Store: st}
+	t.Cleanup(func() {
+		testApp.constants.RefCodes = false
+		testApp.constants.BatchMaxSize = 0
+		testApp.constants.BatchConcurrency = 0
+		testApp.store = st
+	})
+
+	refs := func() []string {
+		var out []string
+		for _, k := range rdis.Keys() {
+			if strings.Contains(k, ":ref:") {
+				out = append(out, k)
+			}
+		}
+		return out
+	}
+
+	// The codes generated for OTPs that couldn't be set are removed.
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusInternalServerError, r.StatusCode)
+	assert.Empty(t, refs(), "orphaned reference code")
+
+	body := `[{"id": "refotp1", "provider": "` + dummyProvider + `", "to": "` + dummyToAddress + `"}]`
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/api/otp/batch", strings.NewReader(body))
+	req.SetBasicAuth(dummyNamespace, dummySecret)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Empty(t, refs(), "orphaned reference code in batch")
+}
+
+func TestVerifyChainNext(t *testing.T) {
+	rdis.FlushDB()
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// The next OTP's ID can't be the same.
+	v := url.Values{"otp": {dummyOTP}, "chain_next": {"true"}, "next_id": {dummyOTPID}}
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, v, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.Equal(t, errCodeInvalidParam, out.ErrorCode)
+
+	// On verification, the next step's OTP is set with the same provider and address.
+	var (
+		nextOTP = &otpResp{}
+		data    = &verifyResp{Next: &httpResp{Data: nextOTP}}
+		vout    = httpResp{Data: data}
+	)
+	v.Set("next_id", "steptwo123")
+	v.Set("next_max_attempts", "3")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, v, &vout)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "verification failed")
+	assert.True(t, data.Closed, "otp wasn't closed")
+	assert.Equal(t, "success", data.Next.Status)
+	assert.Equal(t, "steptwo123", nextOTP.ID)
+	assert.Equal(t, dummyProvider, nextOTP.Provider)
+	assert.Equal(t, dummyToAddress, nextOTP.To)
+	assert.Equal(t, 3, nextOTP.MaxAttempts)
+	assert.Equal(t, 0, nextOTP.VerifyAttempts, "attempts carried over to the next otp")
+	assert.NotEmpty(t, nextOTP.URL)
+
+	// The next OTP has its own attempts.
+	r = testRequest(t, http.MethodPost, "/api/otp/steptwo123", url.Values{"otp": {"000000"}}, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	r = testRequest(t, http.MethodPost, "/api/otp/steptwo123", url.Values{"otp": {nextOTP.OTP.OTP}}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "next otp didn't verify")
+
+	// A failure in setting the next OTP doesn't fail the verification.
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	data.Next = &httpResp{}
+	v = url.Values{"otp": {dummyOTP}, "chain_next": {"true"}, "next_provider": {"unknown"}}
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, v, &vout)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "verification failed")
+	assert.Equal(t, "error", data.Next.Status)
+	assert.Equal(t, errCodeInvalidProvider, data.Next.ErrorCode)
+}
+
+func TestVerifyOTPHeader(t *testing.T) {
+	rdis.FlushDB()
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	verify := func(otp string) (*http.Response, httpResp) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/otp/"+dummyOTPID, nil)
+		req.SetBasicAuth(dummyNamespace, dummySecret)
+		req.Header.Set("X-OTP", otp)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var out httpResp
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+		return resp, out
+	}
+
+	// Incorrect OTP in the header.
+	resp, out := verify("000000")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "incorrect otp in header verified")
+	assert.Equal(t, errCodeOTPMismatch, out.ErrorCode, "error code mismatch")
+
+	resp, _ = verify(dummyOTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "otp in header not verified")
+}
+
+func TestCloseOTP(t *testing.T) {
+	rdis.FlushDB()
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	// Register OTP.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Not allowed on the namespace.
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID+"/close", nil, &out)
+	assert.Equal(t, http.StatusForbidden, r.StatusCode, "non 403 response for disallowed close")
+
+	testApp.namespaces[dummyNamespace] = nsConf{AllowAdminClose: true}
+	t.Cleanup(func() {
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID+"/close", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "close failed")
+	assert.True(t, data.Closed, "otp wasn't closed")
+
+	// Status should now be verified.
+	r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp isn't verified after close")
+}
+
+func TestResetOTPAttempts(t *testing.T) {
+	rdis.FlushDB()
+	var (
+		data = &otpResp{}
+		out  = httpResp{
+			Data: data,
+		}
+		p = url.Values{}
+	)
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	p.Set("max_attempts", "2")
+
+	// Register OTP and exhaust the attempts.
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	cp := url.Values{}
+	cp.Set("otp", "000000")
+	for i := 0; i < 2; i++ {
+		testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	}
+	cp.Set("otp", dummyOTP)
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "locked otp verified")
+
+	// Not allowed on the namespace.
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID+"/reset", nil, &out)
+	assert.Equal(t, http.StatusForbidden, r.StatusCode, "non 403 response for disallowed reset")
+
+	testApp.namespaces[dummyNamespace] = nsConf{AllowAdminReset: true}
+	t.Cleanup(func() {
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID+"/reset", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "reset failed")
+	assert.Equal(t, 0, data.VerifyAttempts, "attempts weren't reset")
+	assert.Equal(t, dummyOTP, data.OTP.OTP, "otp changed on reset")
+
+	// The OTP can be verified again.
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp couldn't be verified after reset")
+
+	// An OTP locked by exceeding its deliveries is unlocked too.
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	for i := 0; i <= data.MaxGenerate; i++ {
+		if _, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterGenerate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "locked otp verified")
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID+"/reset", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "reset failed")
+	assert.Equal(t, 0, data.Deliveries, "deliveries weren't reset")
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp couldn't be verified after reset")
+
+	// Unknown OTP.
+	r = testRequest(t, http.MethodPost, "/api/otp/unknownotp/reset", nil, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for unknown otp")
+}
+
+func TestRequireDelivery(t *testing.T) {
+	rdis.FlushDB()
+	testApp.namespaces[dummyNamespace] = nsConf{RequireDelivery: true, DeliveryWait: time.Hour}
+	t.Cleanup(func() {
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Verification is rejected (and not counted) until delivery is confirmed.
+	cp := url.Values{"otp": {dummyOTP}}
+	out = httpResp{}
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusTooEarly, r.StatusCode, "undelivered otp verified")
+	assert.Equal(t, errCodeOTPNotDelivered, out.ErrorCode, "error code mismatch")
+
+	r = testRequest(t, http.MethodPost, "/api/otp/unknownotp/delivered", nil, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "unknown otp marked delivered")
+
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID+"/delivered", nil, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "marking otp delivered failed")
+
+	var (
+		data = &models.OTP{}
+		vout = httpResp{Data: data}
+	)
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &vout)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "delivered otp not verified")
+	assert.Equal(t, 1, data.VerifyAttempts, "rejected attempt was counted")
+
+	// Once the wait for the delivery runs out, verification is allowed.
+	testApp.namespaces[dummyNamespace] = nsConf{RequireDelivery: true, DeliveryWait: time.Nanosecond}
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+	r = testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, cp, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp not verified after the delivery wait")
+}
+
+func TestSlidingExpiry(t *testing.T) {
+	rdis.FlushDB()
+	testApp.constants.SlidingExpiry = time.Minute
+	t.Cleanup(func() {
+		testApp.constants.SlidingExpiry = 0
+	})
+
+	p := url.Values{}
+	p.Set("otp", dummyOTP)
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+	p.Set("ttl", "10")
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	// Polling the status with the web view records the access but doesn't
+	// extend the expiry as it's unauthenticated.
+	resp, err := http.Get(srv.URL + "/otp/" + dummyNamespace + "/" + dummyOTPID + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	o, err := testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, o.TTL, "expiry extended by an unauthenticated poll")
+	assert.NotZero(t, o.LastAccessed, "last access time not recorded")
+
+	// Checking the status with the API extends it.
+	r = testRequest(t, http.MethodDelete, "/api/otp/"+dummyOTPID+"/status", nil, &out)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode, "non 400 response for open otp")
+
+	o, err = testApp.store.Check(context.Background(), dummyNamespace, dummyOTPID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, o.TTL, "expiry wasn't extended")
+	assert.Equal(t, 0, o.VerifyAttempts, "status check counted as an attempt")
+}
+
+func TestGetOTPClosedLongPoll(t *testing.T) {
+	rdis.FlushDB()
+	testApp.closeWaiters = newCloseWaiters()
+	testApp.constants.LongPollTimeout = time.Millisecond * 200
+	t.Cleanup(func() {
+		testApp.closeWaiters = nil
+		testApp.constants.LongPollTimeout = 0
+	})
+
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	var res struct {
+		Data struct {
+			Closed bool `json:"closed"`
+		} `json:"data"`
+	}
+	poll := func() time.Duration {
+		start := time.Now()
+		resp, err := http.Get(srv.URL + "/otp/" + dummyNamespace + "/" + dummyOTPID + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return time.Since(start)
+	}
+
+	// An open OTP is held until the poll times out.
+	d := poll()
+	assert.False(t, res.Data.Closed)
+	assert.GreaterOrEqual(t, d, testApp.constants.LongPollTimeout, "poll wasn't held")
+
+	// A close responds right away.
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		testApp.closeWaiters.notify(dummyNamespace, dummyOTPID)
+	}()
+	d = poll()
+	assert.True(t, res.Data.Closed, "close not responded to")
+	assert.Less(t, d, testApp.constants.LongPollTimeout, "poll held after close")
+
+	// Closed OTPs aren't held.
+	assert.NoError(t, testApp.store.Close(context.Background(), dummyNamespace, dummyOTPID))
+	d = poll()
+	assert.True(t, res.Data.Closed)
+	assert.Less(t, d, testApp.constants.LongPollTimeout, "closed otp was held")
+	assert.Empty(t, testApp.closeWaiters.waiters, "waiters not cleaned up")
+}
+
+func TestOTPEvents(t *testing.T) {
+	rdis.FlushDB()
+	t.Cleanup(func() {
+		testApp.closeWaiters = nil
+		testApp.constants.StatusEvents = false
+		testApp.constants.StatusEventsLifetime = 0
+		testApp.stopping = nil
+	})
+
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", dummyProvider)
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode, "otp registration failed")
+
+	open := func(id string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/otp/"+dummyNamespace+"/"+id+"/events", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// Disabled.
+	resp := open(dummyOTPID)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	testApp.closeWaiters = newCloseWaiters()
+	testApp.constants.StatusEvents = true
+	testApp.constants.StatusEventsLifetime = time.Second * 5
+
+	resp = open("unknownotp")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// A close is streamed and ends the stream.
+	resp = open(dummyOTPID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	rd := bufio.NewReader(resp.Body)
+	l, err := rd.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, ": ok\n", l)
+
+	testApp.closeWaiters.notify(dummyNamespace, dummyOTPID)
+	b, err := io.ReadAll(rd)
+	assert.NoError(t, err)
+	assert.Equal(t, "\nevent: closed\ndata: {}\n\n", string(b))
+
+	// Streams end after their lifetime.
+	testApp.constants.StatusEventsLifetime = time.Millisecond * 100
+	resp = open(dummyOTPID)
+	b, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, ": ok\n\n", string(b))
+	assert.Empty(t, testApp.closeWaiters.waiters, "waiters not cleaned up")
+
+	// Streams end when the server shuts down.
+	testApp.constants.StatusEventsLifetime = time.Second * 5
+	testApp.stopping = make(chan struct{})
+	resp = open(dummyOTPID)
+	rd = bufio.NewReader(resp.Body)
+	l, err = rd.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, ": ok\n", l)
+
+	close(testApp.stopping)
+	b, err = io.ReadAll(rd)
+	assert.NoError(t, err)
+	assert.Equal(t, "\n", string(b))
+
+	// Closed OTPs get the event right away.
+	assert.NoError(t, testApp.store.Close(context.Background(), dummyNamespace, dummyOTPID))
+	resp = open(dummyOTPID)
+	b, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "event: closed\ndata: {}\n\n", string(b))
+}
+
+func TestExtraSchema(t *testing.T) {
+	rdis.FlushDB()
+
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource("extra.json", strings.NewReader(`{
+		"type": "object",
+		"required": ["user_id"],
+		"properties": {"user_id": {"type": "integer"}}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+	testApp.namespaces[dummyNamespace] = nsConf{ExtraSchema: c.MustCompile("extra.json")}
+	t.Cleanup(func() {
+		testApp.namespaces[dummyNamespace] = nsConf{}
+	})
+
+	for _, c := range []struct {
+		name   string
+		extra  string
+		status int
+	}{
+		{"no extra", "", http.StatusBadRequest},
+		{"missing field", `{"name": "john"}`, http.StatusBadRequest},
+		{"wrong type", `{"user_id": "john"}`, http.StatusBadRequest},
+		{"valid", `{"user_id": 123, "name": "john"}`, http.StatusOK},
+	} {
+		p := url.Values{}
+		p.Set("to", dummyToAddress)
+		p.Set("provider", dummyProvider)
+		p.Set("extra", c.extra)
+
+		var out httpResp
+		r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+		assert.Equal(t, c.status, r.StatusCode, "%s: status mismatch", c.name)
+		if c.status != http.StatusOK {
+			assert.Equal(t, errCodeInvalidParam, out.ErrorCode, "%s: error code mismatch", c.name)
+			assert.Contains(t, out.Message, "doesn't match the schema", "%s: message mismatch", c.name)
+		}
+	}
+}
+
+func TestConfigParser(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"config.toml": "[app]\nttl = \"5m\"",
+		"config.yaml": "app:\n  ttl: 5m",
+		"config.yml":  "app:\n  ttl: 5m",
+		"config.json": `{"app": {"ttl": "5m"}}`,
+		"config.conf": "[app]\nttl = \"5m\"",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		k := koanf.New(".")
+		assert.NoError(t, k.Load(file.Provider(path), configParser(path)), "%s: error loading", name)
+		assert.Equal(t, time.Minute*5, k.Duration("app.ttl"), "%s: value mismatch", name)
+	}
+}
+
+func TestDisabledProvider(t *testing.T) {
+	rdis.FlushDB()
+	testApp.disabledProviders = map[string]bool{"off": true}
+	t.Cleanup(func() {
+		testApp.disabledProviders = nil
+	})
+
+	p := url.Values{}
+	p.Set("to", dummyToAddress)
+	p.Set("provider", "off")
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode, "disabled provider not rejected")
+	assert.Equal(t, errCodeProviderDisabled, out.ErrorCode)
+	assert.Equal(t, "Provider temporarily disabled.", out.Message)
+
+	out = httpResp{}
+	r = testRequest(t, http.MethodGet, "/api/providers/off", nil, &out)
+	assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode)
+	assert.Equal(t, errCodeProviderDisabled, out.ErrorCode)
+
+	// Other providers are unaffected.
+	p.Set("provider", dummyProvider)
+	r = testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, p, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+}
+
+func TestProviderConf(t *testing.T) {
+	k := koanf.New(".")
+	assert.NoError(t, k.Load(rawConf(`{"providers": {"sns": {"region": "ap-south-1", "timeout": "7s"}}}`), kjson.Parser()))
+
+	var cfg struct {
+		ID      string        `json:"id"`
+		Region  string        `json:"region"`
+		Timeout time.Duration `json:"timeout"`
+	}
+	b := providerConf(k, "providers.sns", map[string]interface{}{"id": "named"})
+	assert.NoError(t, unmarshalProviderConf(b, &cfg))
+	assert.Equal(t, "named", cfg.ID)
+	assert.Equal(t, "ap-south-1", cfg.Region)
+	assert.Equal(t, time.Second*7, cfg.Timeout)
+}
+
+func TestErrorCodes(t *testing.T) {
+	rdis.FlushDB()
+	testApp.namespaces[dummyNamespace] = nsConf{}
+
+	reg := url.Values{}
+	reg.Set("otp", dummyOTP)
+	reg.Set("to", dummyToAddress)
+	reg.Set("provider", dummyProvider)
+	reg.Set("max_attempts", "2")
+
+	vals := func(kv ...string) url.Values {
+		v := url.Values{}
+		for i := 0; i < len(kv); i += 2 {
+			v.Set(kv[i], kv[i+1])
+		}
+		return v
+	}
+
+	for _, c := range []struct {
+		name   string
+		method string
+		path   string
+		params url.Values
+		status int
+		code   string
+	}{
+		{"route not found", http.MethodGet, "/api/unknown", nil, http.StatusNotFound, errCodeNotFound},
+		{"method not allowed", http.MethodPatch, "/api/providers", nil, http.StatusMethodNotAllowed, errCodeMethodNotAllowed},
+		{"unknown provider info", http.MethodGet, "/api/providers/unknown", nil, http.StatusNotFound, errCodeInvalidProvider},
+		{"unknown provider", http.MethodPut, "/api/otp/" + dummyOTPID, vals("provider", "unknown"), http.StatusBadRequest, errCodeInvalidProvider},
+		{"invalid address", http.MethodPut, "/api/otp/" + dummyOTPID, vals("provider", dummyProvider, "to", "xxx"), http.StatusBadRequest, errCodeInvalidAddress},
+		{"invalid ttl", http.MethodPut, "/api/otp/" + dummyOTPID, vals("provider", dummyProvider, "ttl", "x"), http.StatusBadRequest, errCodeInvalidParam},
+		{"invalid extra", http.MethodPut, "/api/otp/" + dummyOTPID, vals("provider", dummyProvider, "extra", "{"), http.StatusBadRequest, errCodeInvalidParam},
+		{"verify unknown otp", http.MethodPost, "/api/otp/" + dummyOTPID, vals("otp", dummyOTP), http.StatusBadRequest, errCodeOTPNotFound},
+		{"status unknown otp", http.MethodDelete, "/api/otp/" + dummyOTPID + "/status", nil, http.StatusBadRequest, errCodeOTPNotFound},
+		{"register", http.MethodPut, "/api/otp/" + dummyOTPID, reg, http.StatusOK, ""},
+		{"short id", http.MethodPost, "/api/otp/abc", vals("otp", dummyOTP), http.StatusBadRequest, errCodeInvalidParam},
+		{"empty otp", http.MethodPost, "/api/otp/" + dummyOTPID, nil, http.StatusBadRequest, errCodeInvalidParam},
+		{"invalid otp hash", http.MethodPost, "/api/otp/" + dummyOTPID, vals("otp_hash", "xx"), http.StatusBadRequest, errCodeInvalidParam},
+		{"not verified", http.MethodDelete, "/api/otp/" + dummyOTPID + "/status", nil, http.StatusBadRequest, errCodeOTPNotVerified},
+		{"close not allowed", http.MethodPost, "/api/otp/" + dummyOTPID + "/close", nil, http.StatusForbidden, errCodeForbidden},
+		{"reset not allowed", http.MethodPost, "/api/otp/" + dummyOTPID + "/reset", nil, http.StatusForbidden, errCodeForbidden},
+		{"mismatch", http.MethodPost, "/api/otp/" + dummyOTPID, vals("otp", "000000"), http.StatusBadRequest, errCodeOTPMismatch},
+		{"second mismatch", http.MethodPost, "/api/otp/" + dummyOTPID, vals("otp", "000000"), http.StatusBadRequest, errCodeOTPMismatch},
+		{"locked", http.MethodPost, "/api/otp/" + dummyOTPID, vals("otp", "000000"), http.StatusBadRequest, errCodeOTPLocked},
+		{"set locked", http.MethodPut, "/api/otp/" + dummyOTPID, reg, http.StatusTooManyRequests, errCodeOTPLocked},
+	} {
+		var out httpResp
+		r := testRequest(t, c.method, c.path, c.params, &out)
+		assert.Equal(t, c.status, r.StatusCode, "%s: status mismatch", c.name)
+		assert.Equal(t, c.code, out.ErrorCode, "%s: error code mismatch", c.name)
+	}
+
+	// Unauthorized.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/providers", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out httpResp
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "non 401 response")
+	assert.Equal(t, errCodeUnauthorized, out.ErrorCode, "error code mismatch")
+}
+
+func testRequest(t *testing.T, method, path string, p url.Values, out interface{}) *http.Response {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(p.Encode()))
+	if err != nil {
+		t.Fatal(err)
+		return nil
+	}
+	req.SetBasicAuth(dummyNamespace, dummySecret)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	// HTTP client.
+	c := &http.Client{}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+		return nil
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestUnixListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "otpgateway.sock")
+
+	ln, err := initListener("unix:"+path, "0600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	s := &http.Server{Handler: http.HandlerFunc(handleLiveCheck)}
+	go s.Serve(ln)
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := c.Get("http://otpgateway/api/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The socket file is removed on shutdown.
+	assert.NoError(t, s.Shutdown(context.Background()))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "socket file not removed")
+
+	_, err = initListener("unix:"+path, "abc")
+	assert.Error(t, err, "invalid perms not rejected")
+}
+
+func TestRootURL(t *testing.T) {
+	t.Cleanup(func() {
+		ko.Delete("app.root_url")
+		ko.Delete("app.force_https_links")
+	})
+
+	ko.Set("app.root_url", "https://otp.example.com/")
+	assert.Equal(t, "https://otp.example.com", initRootURL())
+
+	// http:// is allowed (with a warning) unless it's rewritten.
+	ko.Set("app.root_url", "http://otp.example.com/")
+	assert.Equal(t, "http://otp.example.com", initRootURL())
+
+	ko.Set("app.force_https_links", true)
+	assert.Equal(t, "https://otp.example.com", initRootURL())
+}
+
+func TestCheckProviders(t *testing.T) {
+	providers := map[string]*provider{
+		"ok":      {name: "ok", provider: &dummyCheckProv{}},
+		"fail":    {name: "fail", provider: &dummyCheckProv{err: errors.New("auth failed")}},
+		"slow":    {name: "slow", provider: &dummyCheckProv{err: errCheckTimeout}},
+		"nocheck": {name: "nocheck", provider: &dummyProv{}},
+	}
+
+	start := time.Now()
+	errs := checkProviders(providers, time.Millisecond*100)
+	assert.Less(t, time.Since(start), time.Second, "checks not timed out")
+
+	assert.Len(t, errs, 2)
+	assert.EqualError(t, errs["fail"], "auth failed")
+	assert.ErrorIs(t, errs["slow"], context.DeadlineExceeded)
+}
+
+func TestEventsWebhook(t *testing.T) {
+	rdis.FlushDB()
+
+	events := make(chan store.Event, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		assert.Equal(t, signEvent([]byte("hooksecret"), r.Header.Get("X-OTPGateway-Timestamp"), b),
+			r.Header.Get("X-OTPGateway-Signature"), "invalid signature")
+
+		var e store.Event
+		assert.NoError(t, json.Unmarshal(b, &e))
+		events <- e
+	}))
+	defer hook.Close()
+
+	testApp.events = newEventHooks(map[string]nsConf{
+		dummyNamespace: {EventsWebhookURL: hook.URL, EventsWebhookSecret: "hooksecret"},
+	}, testApp.lo)
+	t.Cleanup(func() { testApp.events = nil })
+
+	wait := func() store.Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second * 2):
+			t.Fatal("event not posted")
+		}
+		return store.Event{}
+	}
+
+	var out httpResp
+	r := testRequest(t, http.MethodPut, "/api/otp/"+dummyOTPID, url.Values{
+		"otp": {dummyOTP}, "to": {dummyToAddress}, "provider": {dummyProvider}}, &out)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	e := wait()
+	assert.Equal(t, eventSet, e.Type)
+	assert.Equal(t, dummyNamespace, e.Namespace)
+	assert.Equal(t, dummyOTPID, e.ID)
+
+	var o models.OTP
+	assert.NoError(t, json.Unmarshal(e.Data, &o))
+	assert.Equal(t, dummyToAddress, o.To)
+	assert.Empty(t, o.OTP, "OTP value posted")
+
+	testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {"000000"}}, &out)
+	assert.Equal(t, eventFailed, wait().Type)
+
+	testRequest(t, http.MethodPost, "/api/otp/"+dummyOTPID, url.Values{"otp": {dummyOTP}}, &out)
+	assert.Equal(t, eventVerified, wait().Type)
+
+	// Other namespaces' events aren't posted.
+	testApp.events.push(eventExpired, "otherapp", dummyOTPID, nil)
+	testApp.events.push(eventExpired, dummyNamespace, dummyOTPID, nil)
+	e = wait()
+	assert.Equal(t, eventExpired, e.Type)
+	assert.Equal(t, dummyNamespace, e.Namespace)
+	assert.Equal(t, "null", string(e.Data))
+
+	// Queued events are posted on close and later ones are ignored.
+	testApp.events.push(eventExpired, dummyNamespace, "closeotp", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	assert.Zero(t, testApp.events.close(ctx), "queued events not posted")
+	assert.Equal(t, "closeotp", wait().ID)
+
+	testApp.events.push(eventExpired, dummyNamespace, dummyOTPID, nil)
+	assert.Empty(t, events, "event posted after close")
 }
@@ -1,24 +1,37 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	stdjson "encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Masterminds/sprig"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/knadh/koanf/parsers/json"
 	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/knadh/koanf/v2"
-	"github.com/knadh/otpgateway/v3/internal/providers/kaleyra"
-	"github.com/knadh/otpgateway/v3/internal/providers/pinpoint"
-	"github.com/knadh/otpgateway/v3/internal/providers/smtp"
 	"github.com/knadh/otpgateway/v3/internal/providers/webhook"
 	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/zerodha/logf"
 
 	"github.com/knadh/stuffbin"
@@ -39,6 +52,92 @@ type constants struct {
 	OtpMaxAttempts int
 	OtpMaxGenerate int
 
+	// Minimum interval between consecutive verification attempts on an OTP.
+	VerifyMinInterval time.Duration
+
+	// Failed verifications with incorrect OTPs are delayed by this
+	// duration plus a random jitter of up to VerifyFailJitter.
+	VerifyFailDelay  time.Duration
+	VerifyFailJitter time.Duration
+
+	// Trim whitespace around OTPs entered by users, and optionally, within
+	// them (eg: "123 456"), before comparison.
+	TrimOTPInput   bool
+	StripOTPSpaces bool
+
+	// Respond to verifications of non-existent OTPs as incorrect OTPs.
+	ObscureNotFound bool
+
+	// Verified OTPs are only closed and never deleted.
+	RetainVerified bool
+
+	// Verified OTPs that are to be deleted are kept (closed) for this
+	// duration so that repeat verifications succeed.
+	VerifyGrace time.Duration
+
+	// If set, status checks extend the expiry of OTPs to at least this.
+	SlidingExpiry time.Duration
+
+	// If set, addresses of OTPs locked by failed verification attempts
+	// are locked for this duration, during which new OTPs can't be set.
+	AddressLockout time.Duration
+
+	// Respond to newly created OTPs with 201 instead of 200.
+	StatusCreated bool
+
+	// Respond to invalid OTP requests with all the field errors instead
+	// of only the first one.
+	FieldErrors bool
+
+	// Reject messages whose bodies are longer than the provider's
+	// MaxBodyLen() instead of only warning.
+	StrictBodyLen bool
+
+	// Identical sends within this window are suppressed.
+	DupSendWindow time.Duration
+
+	// Length and charset of auto-generated OTP IDs. If the charset is
+	// idCharsetUUID, IDs are UUIDs.
+	IDLength  int
+	IDCharset string
+
+	// Generate a human-friendly reference code (eg: ABC-123) for new OTPs
+	// that can be used to look them up.
+	RefCodes bool
+
+	// Max active OTPs per namespace beyond which new IDs are rejected.
+	// 0 = no limit.
+	MaxActiveOTPs int
+
+	// Time of the day (after midnight UTC) at which provider quotas reset.
+	QuotaResetTime time.Duration
+
+	// Max items in an OTP batch and the number of concurrent pushes.
+	BatchMaxSize     int
+	BatchConcurrency int
+
+	// Max verification attempts per client IP on the web view per window.
+	WebVerifyRateLimit  int
+	WebVerifyRateWindow time.Duration
+
+	// Proxies whose X-Forwarded-For headers are trusted for resolving
+	// client IPs.
+	TrustedProxies []netip.Prefix
+
+	// If set, web view status requests of open OTPs are held for up to
+	// this long, and are responded to as soon as the OTP is closed.
+	LongPollTimeout time.Duration
+
+	// Stream the status of OTPs to the web view as Server-Sent Events
+	// (/otp/{namespace}/{id}/events). Streams are ended after the lifetime,
+	// after which clients reconnect.
+	StatusEvents         bool
+	StatusEventsLifetime time.Duration
+
+	// If set, requests to / are redirected here instead of getting
+	// the JSON info response.
+	RootRedirect string
+
 	// Exported to templates.
 	RootURL    string
 	LogoURL    string
@@ -51,8 +150,26 @@ type providerTpl struct {
 }
 
 type provider struct {
+	// Name of the provider in the config (providers.*, smtps.*, webhooks.*).
+	name string
+
 	provider models.Provider
 	tpl      *providerTpl
+
+	// Names of providers to try in order if pushing to this provider fails.
+	fallbacks []string
+
+	// If set, an empty subject is replaced with a default subject.
+	requireSubject bool
+
+	// If set, messages whose body renders empty aren't sent.
+	requireBody bool
+
+	// Subjects longer than this are truncated. 0 = no limit.
+	maxSubjectLen int
+
+	// Max number of messages that can be sent per day. 0 = no limit.
+	dailyQuota int
 }
 
 func initConfig() {
@@ -63,7 +180,7 @@ func initConfig() {
 		os.Exit(0)
 	}
 	f.StringSlice("config", []string{"config.toml"},
-		"Path to one or more TOML config files to load in order")
+		"Path to one or more config files (TOML, YAML, or JSON) to load in order")
 	f.Bool("version", false, "Show build version")
 	f.Parse(os.Args[1:])
 
@@ -77,7 +194,7 @@ func initConfig() {
 	cFiles, _ := f.GetStringSlice("config")
 	for _, f := range cFiles {
 		lo.Printf("reading config: %s", f)
-		if err := ko.Load(file.Provider(f), toml.Parser()); err != nil {
+		if err := ko.Load(file.Provider(f), configParser(f)); err != nil {
 			lo.Printf("error reading config: %v", err)
 		}
 	}
@@ -92,91 +209,125 @@ func initConfig() {
 	ko.Load(posflag.Provider(f, ".", ko), nil)
 }
 
-// initProviders loads models.Provider plugins from the list of given filenames.
-func initProviders(ko *koanf.Koanf) map[string]*provider {
-	// Reserved names for in-built providers.
-	bundled := map[string]bool{
-		"smtp":             true,
-		"pinpoint_sms":     true,
-		"kaleyra_sms":      true,
-		"kaleyra_whatsapp": true,
+// configParser returns the koanf parser for a config file based on its
+// extension. TOML is the default.
+func configParser(path string) koanf.Parser {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yaml.Parser()
+	case ".json":
+		return json.Parser()
 	}
+	return toml.Parser()
+}
 
-	out := make(map[string]*provider)
+// initDisabledProviders returns the set of provider names in
+// app.disabled_providers.
+func initDisabledProviders() map[string]bool {
+	out := make(map[string]bool)
+	for _, name := range ko.Strings("app.disabled_providers") {
+		out[name] = true
+	}
+	return out
+}
 
-	// Initialized the in-built providers.
-	// SMTP.
-	if ko.Bool("providers.smtp.enabled") {
-		var cfg smtp.Config
-		if err := ko.UnmarshalWithConf("providers.smtp", &cfg, koanf.UnmarshalConf{Tag: "json"}); err != nil {
-			lo.Fatalf("error unmarshalling providers.smtp config: %v", err)
+// initCIDRs returns the IP ranges in a list of CIDRs in the config. Bare IPs
+// are single address ranges.
+func initCIDRs(key string) []netip.Prefix {
+	var out []netip.Prefix
+	for _, c := range ko.Strings(key) {
+		p, err := parseCIDR(c)
+		if err != nil {
+			lo.Fatalf("invalid CIDR in %s: %v", key, err)
 		}
+		out = append(out, p)
+	}
+	return out
+}
 
-		p, err := smtp.New(cfg)
+// parseCIDR parses a CIDR (eg: 10.0.0.0/8) or a bare IP.
+func parseCIDR(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		a, err := netip.ParseAddr(s)
 		if err != nil {
-			lo.Fatalf("error initializing smtp provider: %v", err)
+			return netip.Prefix{}, err
 		}
+		a = a.Unmap()
+		return netip.PrefixFrom(a, a.BitLen()), nil
+	}
 
-		out["smtp"] = &provider{
-			provider: p,
-			tpl:      initProviderTpl(ko.String("providers.smtp.subject"), ko.String("providers.smtp.template")),
-		}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
 	}
+	return p.Masked(), nil
+}
 
-	// Pinpoint SMS.
-	if ko.Bool("providers.pinpoint_sms.enabled") {
-		var cfg pinpoint.Config
-		if err := ko.UnmarshalWithConf("providers.pinpoint_sms", &cfg, koanf.UnmarshalConf{Tag: "json"}); err != nil {
-			lo.Fatalf("error unmarshalling providers.pinpoint_sms config: %v", err)
-		}
+// initProviders initializes the providers enabled in the config from the
+// provider registry. Providers in disabled aren't loaded regardless of
+// their enabled flag. log is passed to providers that support debug logging.
+func initProviders(ko *koanf.Koanf, disabled map[string]bool, log *logf.Logger) map[string]*provider {
+	providerLog = log
 
-		p, err := pinpoint.NewSMS(cfg)
-		if err != nil {
-			lo.Fatalf("error initializing pinpoint provider: %v", err)
-		}
+	// Registered provider IDs are reserved and can't be used as names of
+	// smtps.* or webhooks.*.
+	factories := models.ProviderFactories()
 
-		out["pinpoint_sms"] = &provider{
-			provider: p,
-			tpl:      initProviderTpl(ko.String("providers.pinpoint_sms.subject"), ko.String("providers.pinpoint_sms.template")),
-		}
+	out := make(map[string]*provider)
+
+	ids := make([]string, 0, len(factories))
+	for id := range factories {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
 
-	// Kaleyra.
-	for _, k := range []string{"kaleyra_sms", "kaleyra_whatsapp"} {
-		if !ko.Bool(fmt.Sprintf("providers.%s.enabled", k)) {
+	for _, id := range ids {
+		key := "providers." + id
+		if !ko.Bool(key+".enabled") || disabled[id] {
 			continue
 		}
 
-		var cfg kaleyra.Config
-		if err := ko.UnmarshalWithConf(fmt.Sprintf("providers.%s", k), &cfg, koanf.UnmarshalConf{Tag: "json"}); err != nil {
-			lo.Fatalf("error unmarshalling providers.%s config: %v", k, err)
+		p, err := factories[id](providerConf(ko, key, nil))
+		if err != nil {
+			lo.Fatalf("error initializing %s provider: %v", key, err)
 		}
 
-		typ := kaleyra.ChannelSMS
-		if k == "kaleyra_whatsapp" {
-			typ = kaleyra.ChannelWhatsapp
+		out[id] = newProvider(p, id, key)
+	}
+
+	// Apart from the default providers.smtp, any number of named
+	// SMTP providers can be defined under smtps.*.
+	for _, name := range ko.MapKeys("smtps") {
+		if _, ok := factories[name]; ok {
+			lo.Fatalf("smtp name '%s' is reserved in providers.'%s'", name, name)
 		}
 
-		p, err := kaleyra.New(typ, cfg)
-		if err != nil {
-			lo.Fatalf("error initializing %s provider: %v", k, err)
+		key := fmt.Sprintf("smtps.%s", name)
+		if !ko.Bool(fmt.Sprintf("%s.enabled", key)) || disabled[name] {
+			continue
 		}
 
-		out[k] = &provider{
-			provider: p,
-			tpl:      initProviderTpl(ko.String(fmt.Sprintf("providers.%s.subject", k)), ko.String(fmt.Sprintf("providers.%s.template", k))),
+		p, err := factories["smtp"](providerConf(ko, key, map[string]interface{}{"id": name}))
+		if err != nil {
+			lo.Fatalf("error initializing %s provider: %v", key, err)
 		}
+
+		out[name] = newProvider(p, name, key)
 	}
 
 	// Load custom webhook providers.
 	for _, name := range ko.MapKeys("webhooks") {
-		if _, ok := bundled[name]; ok {
+		if _, ok := factories[name]; ok {
 			lo.Fatalf("webhook name '%s' is reserved in providers.'%s'", name, name)
 		}
+		if _, ok := out[name]; ok {
+			lo.Fatalf("webhook name '%s' is already used by another provider", name)
+		}
 
 		key := fmt.Sprintf("webhooks.%s", name)
 
-		if !ko.Bool(fmt.Sprintf("%s.enabled", key)) {
+		if !ko.Bool(fmt.Sprintf("%s.enabled", key)) || disabled[name] {
 			continue
 		}
 
@@ -184,34 +335,120 @@ func initProviders(ko *koanf.Koanf) map[string]*provider {
 		if err := ko.UnmarshalWithConf(key, &cfg, koanf.UnmarshalConf{Tag: "json"}); err != nil {
 			lo.Fatalf("error unmarshalling %s config: %v", key, err)
 		}
+		if cfg.ID == "" {
+			cfg.ID = name
+		}
+		cfg.Logger = log
+
+		// Failed posts are handed to the fallbacks instead of being queued,
+		// which would deliver the OTP twice.
+		if cfg.RetryMaxAttempts > 0 && len(ko.Strings(key+".fallback_providers")) > 0 {
+			lo.Printf("%s: retries disabled as it has fallback providers", key)
+			cfg.RetryMaxAttempts = 0
+		}
 
 		p, err := webhook.New(cfg)
 		if err != nil {
 			lo.Fatalf("error initializing %s: %v", key, err)
 		}
-		out[name] = &provider{
-			provider: p,
-			tpl:      initProviderTpl(ko.String(fmt.Sprintf("%s.subject", key)), ko.String(fmt.Sprintf("%s.template", key))),
-		}
+		out[name] = newProvider(p, name, key)
 	}
 
 	if len(out) == 0 {
 		lo.Fatal("no providers or webhooks enabled")
 	}
 
+	// Validate the fallback chains. Disabled providers are dropped from them.
+	for name, p := range out {
+		fallbacks := make([]string, 0, len(p.fallbacks))
+		for _, f := range p.fallbacks {
+			if f == name {
+				lo.Fatalf("provider '%s' can't be its own fallback", name)
+			}
+			if disabled[f] {
+				continue
+			}
+			if _, ok := out[f]; !ok {
+				lo.Fatalf("unknown fallback provider '%s' in '%s'", f, name)
+			}
+			fallbacks = append(fallbacks, f)
+		}
+		p.fallbacks = fallbacks
+	}
+
 	names := []string{}
 	for name := range out {
 		names = append(names, name)
 	}
 
 	lo.Printf("enabled providers: %s", strings.Join(names, ", "))
+	if len(disabled) > 0 {
+		lo.Printf("disabled providers: %s", strings.Join(ko.Strings("app.disabled_providers"), ", "))
+	}
 
 	return out
 }
 
-// initAuth loads the namespace:token authorisation maps.
-func initAuth() map[string]string {
-	out := make(map[string]string)
+// providerConf returns the config block at key as JSON for a provider
+// factory with the given overrides applied.
+func providerConf(ko *koanf.Koanf, key string, override map[string]interface{}) stdjson.RawMessage {
+	cfg := ko.Cut(key).Raw()
+	for k, v := range override {
+		cfg[k] = v
+	}
+
+	b, err := stdjson.Marshal(cfg)
+	if err != nil {
+		lo.Fatalf("error reading %s config: %v", key, err)
+	}
+	return b
+}
+
+// initOTPGenerator returns the OTP generator registered as app.otp_generator
+// initialized with the otp_generators.<id> config, or the default random
+// generator if it isn't set.
+func initOTPGenerator() models.OTPGenerator {
+	id := ko.String("app.otp_generator")
+	if id == "" {
+		return randomOTPGenerator{}
+	}
+
+	f, ok := models.OTPGeneratorFactories()[id]
+	if !ok {
+		lo.Fatalf("unknown app.otp_generator: %s", id)
+	}
+
+	key := "otp_generators." + id
+	g, err := f(providerConf(ko, key, nil))
+	if err != nil {
+		lo.Fatalf("error initializing %s OTP generator: %v", key, err)
+	}
+	return g
+}
+
+// authConf contains the API authentication config.
+type authConf struct {
+	// namespace: secret map.
+	creds map[string]string
+
+	// Optional JWT Bearer auth.
+	jwt *jwtAuth
+}
+
+// jwtAuth contains the key and options for validating JWT Bearer tokens.
+type jwtAuth struct {
+	key   interface{}
+	algo  string
+	claim string
+
+	// Allowed clock skew in validating the exp and iat claims.
+	leeway time.Duration
+}
+
+// initAuth loads the namespace:token authorisation maps and the optional
+// JWT auth config.
+func initAuth() *authConf {
+	out := &authConf{creds: make(map[string]string)}
 	for _, a := range ko.MapKeys("auth") {
 		k := ko.StringMap("auth." + a)
 		var (
@@ -222,12 +459,518 @@ func initAuth() map[string]string {
 		if namespace == "" || secret == "" {
 			lo.Fatalf("namespace or secret keys not found in auth.%s", a)
 		}
-		out[k["namespace"]] = k["secret"]
+		out.creds[k["namespace"]] = k["secret"]
+	}
+
+	if ko.Bool("jwt.enabled") {
+		out.jwt = initJWT()
 	}
 
 	return out
 }
 
+// initJWT loads the JWT auth config.
+func initJWT() *jwtAuth {
+	out := &jwtAuth{
+		algo:   ko.String("jwt.algorithm"),
+		claim:  ko.String("jwt.namespace_claim"),
+		leeway: ko.Duration("jwt.leeway"),
+	}
+	if out.claim == "" {
+		out.claim = "namespace"
+	}
+
+	switch out.algo {
+	case "HS256", "HS384", "HS512":
+		secret := ko.String("jwt.secret")
+		if secret == "" {
+			lo.Fatal("jwt.secret is required for HMAC algorithms")
+		}
+		out.key = []byte(secret)
+
+	case "RS256", "RS384", "RS512":
+		b, err := os.ReadFile(ko.String("jwt.public_key_file"))
+		if err != nil {
+			lo.Fatalf("error reading jwt.public_key_file: %v", err)
+		}
+
+		key, err := jwt.ParseRSAPublicKeyFromPEM(b)
+		if err != nil {
+			lo.Fatalf("error parsing jwt.public_key_file: %v", err)
+		}
+		out.key = key
+
+	default:
+		lo.Fatalf("unknown jwt.algorithm '%s'", out.algo)
+	}
+
+	return out
+}
+
+// verifyTokenConf contains the key for signing verification tokens.
+type verifyTokenConf struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// initVerifyToken loads the verification token config.
+func initVerifyToken() *verifyTokenConf {
+	secret := ko.String("verify_token.secret")
+	if secret == "" {
+		lo.Fatal("verify_token.secret is required")
+	}
+
+	return &verifyTokenConf{
+		secret: []byte(secret),
+		ttl:    ko.MustDuration("verify_token.ttl"),
+	}
+}
+
+// initRootURL returns the root URL used in generated links. If it isn't
+// https://, it's either rewritten to https:// (app.force_https_links),
+// rejected (app.require_https_links), or a warning is logged.
+func initRootURL() string {
+	root := strings.TrimRight(ko.String("app.root_url"), "/")
+
+	u, err := url.Parse(root)
+	if err != nil {
+		lo.Fatalf("invalid app.root_url: %v", err)
+	}
+	if u.Scheme == "https" {
+		return root
+	}
+
+	if ko.Bool("app.force_https_links") {
+		if u.Scheme != "http" {
+			lo.Fatalf("app.root_url should be an http:// or https:// URL: %s", root)
+		}
+		u.Scheme = "https"
+		return u.String()
+	}
+
+	if ko.Bool("app.require_https_links") {
+		lo.Fatalf("app.root_url isn't https:// but require_https_links is enabled: %s", root)
+	}
+	lo.Printf("WARNING: app.root_url isn't https://. Links sent to users will be insecure: %s", root)
+
+	return root
+}
+
+// initLongPollTimeout returns the validated app.long_poll_timeout. Held
+// requests have to be responded to before the server times them out.
+func initLongPollTimeout() time.Duration {
+	d := ko.Duration("app.long_poll_timeout")
+	if d <= 0 {
+		return 0
+	}
+
+	for _, k := range []string{"app.server_timeout", "app.handler_timeout"} {
+		if t := ko.Duration(k); t > 0 && d >= t {
+			lo.Fatalf("app.long_poll_timeout (%v) should be less than %s (%v)", d, k, t)
+		}
+	}
+
+	return d
+}
+
+// initBatchConf returns the max size and the concurrency of OTP batches,
+// defaulting the ones that aren't set. A concurrency of 0 would block
+// batches forever.
+func initBatchConf() (int, int) {
+	var (
+		size        = ko.Int("app.batch_max_size")
+		concurrency = ko.Int("app.batch_concurrency")
+	)
+	if size < 1 {
+		size = defaultBatchMaxSize
+	}
+	if concurrency < 1 {
+		concurrency = defaultBatchConcurrency
+	}
+
+	return size, concurrency
+}
+
+// initIDConf returns the validated length and charset of auto-generated
+// OTP IDs.
+func initIDConf() (int, string) {
+	var (
+		length  = ko.Int("app.id_length")
+		charset = ko.String("app.id_charset")
+	)
+	if charset == idCharsetUUID {
+		return 0, charset
+	}
+
+	if length == 0 {
+		length = defaultIDLen
+	}
+	if length < minIDLen {
+		lo.Fatalf("app.id_length should be min %d", minIDLen)
+	}
+
+	if charset == "" {
+		return length, alphaNumChars
+	}
+	if len(charset) < 2 {
+		lo.Fatal("app.id_charset should be min 2 chars")
+	}
+
+	// IDs go into URLs, so only unreserved URL chars (RFC 3986) are allowed.
+	seen := make(map[rune]bool)
+	for _, c := range charset {
+		if !strings.ContainsRune(alphaNumChars+"-._~", c) {
+			lo.Fatalf("app.id_charset has an invalid char '%c'. Only A-Z, a-z, 0-9, and -._~ are allowed", c)
+		}
+		if seen[c] {
+			lo.Fatalf("app.id_charset has a duplicate char '%c'", c)
+		}
+		seen[c] = true
+	}
+
+	return length, charset
+}
+
+// initListener returns a listener on the given address. Addresses of the
+// form unix:/path/to/sock are Unix domain sockets whose file gets the given
+// permissions (octal, eg: 0660). Other addresses are TCP host:port.
+func initListener(addr, perms string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("invalid unix socket address: %s", addr)
+	}
+
+	var mode os.FileMode
+	if perms != "" {
+		m, err := strconv.ParseUint(perms, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socket_perms: %s", perms)
+		}
+		mode = os.FileMode(m)
+	}
+
+	// Remove a stale socket file left over from an unclean shutdown.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+// newProvider wraps a models.Provider with its templates and options loaded
+// from the given config key.
+func newProvider(p models.Provider, name, key string) *provider {
+	if v, ok := p.(models.Validator); ok {
+		if err := v.Validate(); err != nil {
+			lo.Fatalf("invalid %s config: %v", key, err)
+		}
+	}
+
+	out := &provider{
+		name:           name,
+		provider:       p,
+		tpl:            initProviderTpl(ko.String(key+".subject"), ko.String(key+".template")),
+		fallbacks:      ko.Strings(key + ".fallback_providers"),
+		requireSubject: ko.Bool(key + ".require_subject"),
+		requireBody:    ko.Bool(key + ".require_body"),
+		maxSubjectLen:  ko.Int(key + ".max_subject_len"),
+		dailyQuota:     ko.Int(key + ".daily_quota"),
+	}
+	validateSubject(out, key)
+	validateBody(out, key)
+
+	return out
+}
+
+// initProviderChecks checks the connectivity of the providers at startup
+// (app.verify_providers_on_start). Failed checks are fatal if
+// app.verify_providers_strict is set and are logged as warnings otherwise.
+func initProviderChecks(providers map[string]*provider) {
+	timeout := ko.Duration("app.verify_providers_timeout")
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+
+	errs := checkProviders(providers, timeout)
+	if len(errs) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		lo.Printf("WARNING: provider %s failed the connectivity check: %v", name, errs[name])
+	}
+	if ko.Bool("app.verify_providers_strict") {
+		lo.Fatalf("%d provider(s) failed the connectivity check: %s", len(names), strings.Join(names, ", "))
+	}
+}
+
+// checkProviders concurrently runs the checks of the providers that
+// implement models.Checker and returns the errors of the failed ones
+// by provider name.
+func checkProviders(providers map[string]*provider, timeout time.Duration) map[string]error {
+	var (
+		out = make(map[string]error)
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+	)
+	for name, p := range providers {
+		c, ok := p.provider.(models.Checker)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(name string, c models.Checker) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			if err := c.Check(ctx); err != nil {
+				mu.Lock()
+				out[name] = err
+				mu.Unlock()
+			}
+		}(name, c)
+	}
+	wg.Wait()
+
+	return out
+}
+
+// samplePushTpl returns sample template data for validating a
+// provider's templates.
+func samplePushTpl(p *provider) pushTpl {
+	return pushTpl{
+		To:        "sample-address",
+		Namespace: "sample-namespace",
+		Channel:   p.provider.ChannelName(),
+		OTP:       strings.Repeat("0", p.provider.MaxOTPLen()),
+		OTPURL:    "http://localhost/otp/sample-namespace/sample-id",
+		OTPTTL:    time.Minute * 5,
+		Extra:     map[string]interface{}{},
+	}
+}
+
+// validateSubject renders a provider's subject template against sample data
+// to catch misconfigured subjects at startup.
+func validateSubject(p *provider, key string) {
+	if p.tpl.subject == nil {
+		if p.requireSubject {
+			lo.Fatalf("%s.subject is empty but require_subject is enabled", key)
+		}
+		return
+	}
+
+	b := &bytes.Buffer{}
+	if err := p.tpl.subject.Execute(b, samplePushTpl(p)); err != nil {
+		lo.Fatalf("error rendering %s.subject: %v", key, err)
+	}
+
+	subj := strings.TrimSpace(b.String())
+	if subj == "" {
+		if p.requireSubject {
+			lo.Fatalf("%s.subject renders empty but require_subject is enabled", key)
+		}
+		lo.Printf("WARNING: %s.subject renders empty", key)
+	}
+
+	if p.maxSubjectLen > 0 && utf8.RuneCountInString(subj) > p.maxSubjectLen {
+		lo.Fatalf("%s.subject exceeds max_subject_len (%d): %s", key, p.maxSubjectLen, subj)
+	}
+}
+
+// validateBody renders a provider's body template against sample data to
+// catch templates that render empty, for instance, webhooks whose receivers
+// would otherwise silently get an empty body.
+func validateBody(p *provider, key string) {
+	if p.tpl.body == nil {
+		if p.requireBody {
+			lo.Fatalf("%s.template is empty but require_body is enabled", key)
+		}
+		return
+	}
+
+	// Templates may rely on fields (eg: in extra) that the sample data
+	// doesn't have, so rendering errors aren't fatal.
+	b := &bytes.Buffer{}
+	if err := p.tpl.body.Execute(b, samplePushTpl(p)); err != nil {
+		lo.Printf("WARNING: error rendering %s.template with sample data: %v", key, err)
+		return
+	}
+
+	if len(bytes.TrimSpace(b.Bytes())) == 0 {
+		if p.requireBody {
+			lo.Fatalf("%s.template renders empty but require_body is enabled", key)
+		}
+		lo.Printf("WARNING: %s.template renders empty", key)
+	}
+}
+
+// nsConf contains the optional per-namespace options defined in auth.*.
+type nsConf struct {
+	// Allow OTPs to be closed via the API without verification.
+	AllowAdminClose bool
+
+	// Allow OTP attempts to be reset via the API.
+	AllowAdminReset bool
+
+	// Compare alphanumeric OTPs case-insensitively.
+	CaseInsensitive bool
+
+	// Reject verification until the OTP is marked delivered via the
+	// delivery callback, or DeliveryWait has passed since it was sent.
+	RequireDelivery bool
+	DeliveryWait    time.Duration
+
+	// Optional JSON schema that the extra payload of OTPs has to match.
+	ExtraSchema *jsonschema.Schema
+
+	// Providers tried in order to pick one that accepts the address
+	// when an OTP is set without a provider.
+	AutoProviders []string
+
+	// Default phone code for addresses without one that overrides
+	// the providers' default_phone_code.
+	DefaultPhoneCode string
+
+	// Optional text around OTPs in messages (eg: "ACME-"). They're
+	// stripped from the input on verification.
+	OTPPrefix string
+	OTPSuffix string
+
+	// Store the web view URL of OTPs on them to be re-shared.
+	StoreURL bool
+
+	// Return existing open OTPs instead of setting and sending new ones.
+	ReuseExisting bool
+
+	// Origins (scheme://host[:port]) that can frame the embedded web
+	// views (?embed=1).
+	EmbedOrigins []string
+
+	// Webhook that the namespace's OTP lifecycle events are posted to
+	// and the secret their signatures are made with.
+	EventsWebhookURL    string
+	EventsWebhookSecret string
+}
+
+// initNamespaces loads the per-namespace options.
+func initNamespaces(providers map[string]*provider, disabled map[string]bool) map[string]nsConf {
+	out := make(map[string]nsConf)
+	for _, a := range ko.MapKeys("auth") {
+		key := "auth." + a
+		ns := nsConf{
+			AllowAdminClose: ko.Bool(key + ".allow_admin_close"),
+			AllowAdminReset: ko.Bool(key + ".allow_admin_reset"),
+			CaseInsensitive: ko.Bool(key + ".case_insensitive"),
+			RequireDelivery: ko.Bool(key + ".require_delivery"),
+			DeliveryWait:    ko.Duration(key + ".delivery_wait"),
+			AutoProviders:   ko.Strings(key + ".auto_providers"),
+
+			DefaultPhoneCode: ko.String(key + ".default_phone_code"),
+			OTPPrefix:        ko.String(key + ".otp_prefix"),
+			OTPSuffix:        ko.String(key + ".otp_suffix"),
+			StoreURL:         ko.Bool(key + ".store_url"),
+			ReuseExisting:    ko.Bool(key + ".reuse_existing"),
+
+			EventsWebhookURL:    ko.String(key + ".events_webhook_url"),
+			EventsWebhookSecret: ko.String(key + ".events_webhook_secret"),
+		}
+
+		// Without a wait, unconfirmed OTPs would be verifiable right away.
+		if ns.RequireDelivery && ns.DeliveryWait <= 0 {
+			lo.Fatalf("%s.delivery_wait should be > 0 with require_delivery", key)
+		}
+
+		if ns.EventsWebhookURL != "" {
+			if u, err := url.Parse(ns.EventsWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				lo.Fatalf("invalid %s.events_webhook_url: %s", key, ns.EventsWebhookURL)
+			}
+
+			// Events are signed with the namespace's API secret by default.
+			if ns.EventsWebhookSecret == "" {
+				ns.EventsWebhookSecret = ko.String(key + ".secret")
+			}
+		}
+
+		// The affixed OTP has to fit in the messages of all providers.
+		if n := len(ns.OTPPrefix) + len(ns.OTPSuffix); n > 0 {
+			for name, p := range providers {
+				if l := p.provider.MaxBodyLen(); l > 0 && n+p.provider.MaxOTPLen() > l {
+					lo.Fatalf("%s.otp_prefix and otp_suffix exceed the max message length (%d) of provider '%s'", key, l, name)
+				}
+			}
+		}
+
+		for _, p := range ns.AutoProviders {
+			if _, ok := providers[p]; !ok && !disabled[p] {
+				lo.Fatalf("unknown provider '%s' in %s.auto_providers", p, key)
+			}
+		}
+
+		for _, o := range ko.Strings(key + ".embed_origins") {
+			origin, err := parseOrigin(o)
+			if err != nil {
+				lo.Fatalf("invalid origin '%s' in %s.embed_origins: %v", o, key, err)
+			}
+			ns.EmbedOrigins = append(ns.EmbedOrigins, origin)
+		}
+
+		if f := ko.String(key + ".extra_schema"); f != "" {
+			sc, err := jsonschema.Compile(f)
+			if err != nil {
+				lo.Fatalf("error loading %s.extra_schema: %v", key, err)
+			}
+			ns.ExtraSchema = sc
+		}
+
+		out[ko.String(key+".namespace")] = ns
+	}
+
+	return out
+}
+
+// parseOrigin validates and normalizes a web origin, eg:
+// https://app.example.com:8443.
+func parseOrigin(o string) (string, error) {
+	u, err := url.Parse(o)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("should be an http:// or https:// origin")
+	}
+	if u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("should only have a scheme and a host, eg: https://app.example.com")
+	}
+
+	return u.Scheme + "://" + strings.ToLower(u.Host), nil
+}
+
 // initProviderTpl loads a provider's optional templates.
 func initProviderTpl(subj, tplFile string) *providerTpl {
 	out := &providerTpl{}
@@ -237,7 +980,7 @@ func initProviderTpl(subj, tplFile string) *providerTpl {
 		// Parse the template file.
 		// tpl, err := template.ParseFiles(tplFile)
 
-		tpl, err := template.New(filepath.Base(tplFile)).Funcs(sprig.FuncMap()).ParseFiles(tplFile)
+		tpl, err := template.New(filepath.Base(tplFile)).Funcs(tplFuncs()).ParseFiles(tplFile)
 
 		if err != nil {
 			lo.Fatalf("error parsing template file: %s: %v", tplFile, err)
@@ -247,7 +990,7 @@ func initProviderTpl(subj, tplFile string) *providerTpl {
 
 	// Subject template string.
 	if subj != "" {
-		tpl, err := template.New("subject").Parse(subj)
+		tpl, err := template.New("subject").Funcs(tplFuncs()).Parse(subj)
 		if err != nil {
 			lo.Fatalf("error parsing template subject: %s: %v", tplFile, err)
 		}
@@ -258,6 +1001,62 @@ func initProviderTpl(subj, tplFile string) *providerTpl {
 	return out
 }
 
+// tplFuncs returns the functions available in provider templates: sprig's
+// functions and helpers for rendering the OTP TTL.
+func tplFuncs() template.FuncMap {
+	f := sprig.FuncMap()
+
+	// {{ ttlMinutes .OTPTTL }} = 5. Partial minutes are rounded up.
+	f["ttlMinutes"] = func(d time.Duration) int {
+		return int(math.Ceil(d.Minutes()))
+	}
+
+	// {{ ttlSeconds .OTPTTL }} = 300.
+	f["ttlSeconds"] = func(d time.Duration) int {
+		return int(d.Seconds())
+	}
+
+	// {{ ttlHuman .OTPTTL }} = "5 minutes", "1 hour 30 minutes", "45 seconds".
+	f["ttlHuman"] = ttlHuman
+
+	return f
+}
+
+// ttlHuman returns a human readable representation of a TTL.
+func ttlHuman(d time.Duration) string {
+	d = d.Round(time.Second)
+
+	var (
+		parts = []string{}
+		units = []struct {
+			d    time.Duration
+			name string
+		}{
+			{time.Hour, "hour"},
+			{time.Minute, "minute"},
+			{time.Second, "second"},
+		}
+	)
+	for _, u := range units {
+		n := int(d / u.d)
+		if n == 0 {
+			continue
+		}
+		d -= time.Duration(n) * u.d
+
+		if n == 1 {
+			parts = append(parts, "1 "+u.name)
+		} else {
+			parts = append(parts, fmt.Sprintf("%d %ss", n, u.name))
+		}
+	}
+
+	if len(parts) == 0 {
+		return "0 seconds"
+	}
+	return strings.Join(parts, " ")
+}
+
 func initFS(exe string) stuffbin.FileSystem {
 	// Read stuffed data from self.
 	fs, err := stuffbin.UnStuff(exe)
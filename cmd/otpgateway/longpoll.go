@@ -0,0 +1,59 @@
+package main
+
+import "sync"
+
+// closeWaiters lets long-polling web view status requests wait for their
+// OTPs to be closed. It's notified of the close events that the store
+// publishes (store.redis.publish_key), so that OTPs closed on any instance
+// wake up the requests waiting on every instance.
+type closeWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+}
+
+func newCloseWaiters() *closeWaiters {
+	return &closeWaiters{waiters: make(map[string]map[chan struct{}]struct{})}
+}
+
+// wait returns a channel that's closed when the OTP is closed, and a
+// function that has to be called once the caller is done waiting.
+func (c *closeWaiters) wait(namespace, id string) (<-chan struct{}, func()) {
+	var (
+		key = namespace + ":" + id
+		ch  = make(chan struct{})
+	)
+
+	c.mu.Lock()
+	if c.waiters[key] == nil {
+		c.waiters[key] = make(map[chan struct{}]struct{})
+	}
+	c.waiters[key][ch] = struct{}{}
+	c.mu.Unlock()
+
+	return ch, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// The waiter may have already been notified and removed.
+		if w, ok := c.waiters[key]; ok {
+			delete(w, ch)
+			if len(w) == 0 {
+				delete(c.waiters, key)
+			}
+		}
+	}
+}
+
+// notify wakes up all the requests waiting on an OTP.
+func (c *closeWaiters) notify(namespace, id string) {
+	key := namespace + ":" + id
+
+	c.mu.Lock()
+	w := c.waiters[key]
+	delete(c.waiters, key)
+	c.mu.Unlock()
+
+	for ch := range w {
+		close(ch)
+	}
+}
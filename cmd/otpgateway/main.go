@@ -1,31 +1,49 @@
 package main
 
 import (
+	"context"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/knadh/koanf/v2"
 	"github.com/knadh/otpgateway/v3/internal/store"
 	"github.com/knadh/otpgateway/v3/internal/store/redis"
+	"github.com/knadh/otpgateway/v3/pkg/models"
 	"github.com/knadh/stuffbin"
 	"github.com/zerodha/logf"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 // App is the global app context that groups the necessary
 // controls (db, config etc.) to be injected into the HTTP handlers.
 type App struct {
 	store        store.Store
+	breaker      *breakerStore
+	verifyToken  *verifyTokenConf
 	providers    map[string]*provider
 	providerTpls map[string]*providerTpl
+	namespaces   map[string]nsConf
+	events       *eventHooks
+	otpGen       models.OTPGenerator
+	closeWaiters *closeWaiters
 	lo           logf.Logger
 	tpl          *template.Template
 	fs           stuffbin.FileSystem
 	constants    constants
+
+	// Providers turned off with app.disabled_providers. Requests
+	// naming them are rejected as temporarily unavailable.
+	disabledProviders map[string]bool
+
+	// Closed when the server starts shutting down to end long-lived
+	// requests such as status event streams.
+	stopping chan struct{}
 }
 
 var (
@@ -39,28 +57,142 @@ var (
 func main() {
 	initConfig()
 
+	logger := initLogger(ko.Bool("app.enable_debug_logs"))
+	disabled := initDisabledProviders()
+	providers := initProviders(ko, disabled, &logger)
+	if ko.Bool("app.verify_providers_on_start") {
+		initProviderChecks(providers)
+	}
 	app := &App{
-		fs:        initFS(os.Args[0]),
-		providers: initProviders(ko),
-		lo:        initLogger(ko.Bool("app.enable_debug_logs")),
+		fs:                initFS(os.Args[0]),
+		providers:         providers,
+		disabledProviders: disabled,
+		namespaces:        initNamespaces(providers, disabled),
+		otpGen:            initOTPGenerator(),
+		lo:                logger,
+		stopping:          make(chan struct{}),
 
 		constants: constants{
 			OtpTTL:         ko.MustDuration("app.otp_ttl") * time.Second,
 			OtpMaxAttempts: ko.MustInt("app.otp_max_attempts"),
 			OtpMaxGenerate: ko.MustInt("app.otp_max_generate"),
-			RootURL:        strings.TrimRight(ko.String("app.root_url"), "/"),
-			LogoURL:        ko.String("app.logo_url"),
-			FaviconURL:     ko.String("app.favicon_url"),
+
+			VerifyMinInterval: ko.Duration("app.verify_min_interval"),
+			VerifyFailDelay:   ko.Duration("app.verify_fail_delay"),
+			VerifyFailJitter:  ko.Duration("app.verify_fail_jitter"),
+			TrimOTPInput:      !ko.Exists("app.trim_otp_input") || ko.Bool("app.trim_otp_input"),
+			StripOTPSpaces:    ko.Bool("app.strip_otp_spaces"),
+			ObscureNotFound:   ko.Bool("app.obscure_not_found"),
+			RetainVerified:    ko.Bool("app.retain_verified"),
+			VerifyGrace:       ko.Duration("app.verify_grace"),
+			SlidingExpiry:     ko.Duration("app.sliding_expiry"),
+			AddressLockout:    ko.Duration("app.address_lockout"),
+			DupSendWindow:     ko.Duration("app.dup_send_window"),
+			StrictBodyLen:     ko.Bool("app.strict_body_len"),
+			StatusCreated:     ko.Bool("app.status_created"),
+			FieldErrors:       ko.Bool("app.field_errors"),
+			RefCodes:          ko.Bool("app.enable_ref_codes"),
+			MaxActiveOTPs:     ko.Int("app.max_active_otps_per_namespace"),
+			QuotaResetTime:    ko.Duration("app.quota_reset_time"),
+
+			WebVerifyRateLimit:  ko.Int("app.web_verify_rate_limit"),
+			WebVerifyRateWindow: ko.Duration("app.web_verify_rate_window"),
+			TrustedProxies:      initCIDRs("app.trusted_proxies"),
+			LongPollTimeout:     initLongPollTimeout(),
+			StatusEvents:        ko.Bool("app.enable_status_events"),
+
+			RootRedirect: ko.String("app.root_redirect"),
+
+			RootURL:    initRootURL(),
+			LogoURL:    ko.String("app.logo_url"),
+			FaviconURL: ko.String("app.favicon_url"),
 		},
 	}
 
+	app.constants.IDLength, app.constants.IDCharset = initIDConf()
+	app.constants.BatchMaxSize, app.constants.BatchConcurrency = initBatchConf()
+	app.events = newEventHooks(app.namespaces, app.lo)
+
+	if ko.Bool("verify_token.enabled") {
+		app.verifyToken = initVerifyToken()
+	}
+
 	// Initialize the Redis store.
 	var rc redis.Conf
 	ko.UnmarshalWithConf("store.redis", &rc, koanf.UnmarshalConf{Tag: "json"})
-	app.store = redis.New(rc)
+	rs, err := redis.New(rc)
+	if err != nil {
+		lo.Fatalf("error initializing redis: %v", err)
+	}
+	app.store = rs
+
+	// Log OTPs that expire unverified (and publish them as events).
+	if rc.ExpiryEvents {
+		go func() {
+			err := rs.WatchExpiry(context.Background(), func(namespace, id string) {
+				app.lo.Info("OTP expired unverified", "namespace", namespace, "id", id)
+				app.events.push(eventExpired, namespace, id, nil)
+			}, func(err error) {
+				app.lo.Error("error handling OTP expiry", "error", err)
+			})
+			if err != nil {
+				app.lo.Error("error watching OTP expiry", "error", err)
+			}
+		}()
+	}
+
+	if app.constants.StatusEvents {
+		app.constants.StatusEventsLifetime = ko.MustDuration("app.status_events_max_lifetime")
+	}
+
+	// Hold web view status requests until their OTPs are closed, or stream
+	// their closes. Closes are learnt from the events published to Redis.
+	if app.constants.LongPollTimeout > 0 || app.constants.StatusEvents {
+		if rc.PublishKey == "" {
+			lo.Printf("WARNING: app.long_poll_timeout and app.enable_status_events require store.redis.publish_key. Disabling them")
+			app.constants.LongPollTimeout = 0
+			app.constants.StatusEvents = false
+		} else {
+			app.closeWaiters = newCloseWaiters()
+			go func() {
+				err := rs.WatchEvents(context.Background(), func(e store.Event) {
+					if e.Type == "close" {
+						app.closeWaiters.notify(e.Namespace, e.ID)
+					}
+				})
+				if err != nil {
+					app.lo.Error("error watching store events", "error", err)
+				}
+			}()
+		}
+	}
+
+	// Wrap the store in a circuit breaker that fails fast when it's down.
+	if n := ko.Int("app.store_breaker_failures"); n > 0 {
+		app.breaker = newBreakerStore(app.store, n, ko.MustDuration("app.store_breaker_cooldown"))
+		app.store = app.breaker
+	}
+
+	// Initialize OpenTelemetry tracing.
+	var tp *sdktrace.TracerProvider
+	if ko.Bool("app.enable_tracing") {
+		t, err := initTracing(ko.MustString("app.tracing_endpoint"), ko.Bool("app.tracing_insecure"))
+		if err != nil {
+			lo.Fatalf("error initializing tracing: %v", err)
+		}
+		tp = t
+		app.store = newTracedStore(app.store)
+	}
+
+	// Start retrying failed pushes of providers that support retries.
+	for _, p := range app.providers {
+		if s, ok := p.provider.(models.Starter); ok {
+			s.StartRetries(rs)
+		}
+	}
 
 	// Check if the Redis server is available by sending a Ping.
-	if err := app.store.Ping(); err != nil {
+	if err := app.store.Ping(context.Background()); err != nil {
 		log.Fatalf("failed to connect to redis: %v", err)
 	}
 
@@ -71,25 +203,53 @@ func main() {
 	}
 	app.tpl = tpl
 
-	authCreds := initAuth()
-	if len(authCreds) == 0 {
+	authCfg := initAuth()
+	if len(authCfg.creds) == 0 {
 		app.lo.Fatal("no auth entries found in config")
 	}
 
 	// Register HTTP handlers.
 	r := chi.NewRouter()
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("otpgateway"))
-	})
-	r.Get("/api/providers", auth(authCreds, wrap(app, handleGetProviders)))
+	if n := ko.Int("app.max_concurrent_requests"); n > 0 {
+		r.Use(withConcurrencyLimit(n, app.constants.LongPollTimeout > 0))
+	}
+	if ko.Bool("app.enable_tracing") {
+		r.Use(withTracing)
+	}
+	if cidrs := initCIDRs("app.api_allowed_cidrs"); len(cidrs) > 0 {
+		r.Use(withAPIAllowList(cidrs, app.constants.TrustedProxies))
+	}
+	if d := ko.Duration("app.handler_timeout"); d > 0 {
+		r.Use(withTimeout(d))
+	}
+	if ko.Bool("app.enable_compression") {
+		r.Use(withCompression(ko.Int("app.compression_min_size")))
+	}
+	r.Use(withNegotiation(ko.Bool("app.enable_xml_responses")))
+	r.NotFound(handleNotFound)
+	r.MethodNotAllowed(handleMethodNotAllowed)
+	r.Get("/", wrap(app, handleRoot))
+	r.Get("/api/providers", auth(authCfg, wrap(app, handleGetProviders)))
+	r.Get("/api/providers/{id}", auth(authCfg, wrap(app, handleGetProvider)))
+	r.Get("/api/stats", auth(authCfg, wrap(app, handleGetStats)))
+	r.Get("/api/live", handleLiveCheck)
+	r.Get("/api/ready", wrap(app, handleHealthCheck))
 	r.Get("/api/health", wrap(app, handleHealthCheck))
-	r.Put("/api/otp/{id}", auth(authCreds, wrap(app, handleSetOTP)))
-	r.Post("/api/otp/{id}/status", auth(authCreds, wrap(app, handleCheckOTPStatus)))
-	r.Delete("/api/otp/{id}/status", auth(authCreds, wrap(app, handleCheckOTPStatus)))
-	r.Post("/api/otp/{id}", auth(authCreds, wrap(app, handleVerifyOTP)))
+	r.Put("/api/otp/batch", auth(authCfg, wrap(app, handleSetOTPBatch)))
+	r.Put("/api/otp/{id}", auth(authCfg, wrap(app, handleSetOTP)))
+	r.Get("/api/otp/ref/{ref}", auth(authCfg, wrap(app, handleGetOTPByRef)))
+	r.Get("/api/otp/{id}", auth(authCfg, wrap(app, handleGetOTP)))
+	r.Post("/api/otp/{id}/status", auth(authCfg, wrap(app, handleCheckOTPStatus)))
+	r.Delete("/api/otp/{id}/status", auth(authCfg, wrap(app, handleCheckOTPStatus)))
+	r.Post("/api/otp/{id}/close", auth(authCfg, wrap(app, handleCloseOTP)))
+	r.Post("/api/otp/{id}/reset", auth(authCfg, wrap(app, handleResetOTPAttempts)))
+	r.Post("/api/otp/{id}/delivered", auth(authCfg, wrap(app, handleSetOTPDelivered)))
+	r.Post("/api/otp/{id}", auth(authCfg, wrap(app, handleVerifyOTP)))
 
 	r.Get("/otp/{namespace}/{id}", wrap(app, handleOTPView))
 	r.Get("/otp/{namespace}/{id}/status", wrap(app, handleGetOTPClosed))
+	r.Get("/otp/{namespace}/{id}/events", wrap(app, handleOTPEvents))
+	r.Get("/otp/{namespace}/{id}/qr", wrap(app, handleOTPQR))
 	r.Get("/otp/{namespace}/{id}/address", wrap(app, handleAddressView))
 	r.Post("/otp/{namespace}/{id}/address", wrap(app, handleAddressView))
 	r.Post("/otp/{namespace}/{id}", wrap(app, handleOTPView))
@@ -99,15 +259,77 @@ func main() {
 
 	// HTTP Server.
 
+	// Zero values of the optional limits fall back to net/http's defaults.
 	srv := &http.Server{
-		Addr:         ko.MustString("app.address"),
-		ReadTimeout:  ko.MustDuration("app.server_timeout"),
-		WriteTimeout: ko.MustDuration("app.server_timeout"),
-		Handler:      r,
+		Addr:              ko.MustString("app.address"),
+		ReadTimeout:       ko.MustDuration("app.server_timeout"),
+		WriteTimeout:      ko.MustDuration("app.server_timeout"),
+		ReadHeaderTimeout: ko.Duration("app.read_header_timeout"),
+		IdleTimeout:       ko.Duration("app.idle_timeout"),
+		MaxHeaderBytes:    ko.Int("app.max_header_bytes"),
+		Handler:           r,
 	}
+	srv.RegisterOnShutdown(func() { close(app.stopping) })
+
+	ln, err := initListener(srv.Addr, ko.String("app.socket_perms"))
+	if err != nil {
+		app.lo.Fatal("couldn't start server", "error", err)
+	}
+
+	// Shut down gracefully on signals. Closing a Unix socket listener
+	// removes its socket file.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		<-ctx.Done()
+
+		app.lo.Info("shutting down server")
+		c, cancel := context.WithTimeout(context.Background(), srv.WriteTimeout)
+		defer cancel()
+		if err := srv.Shutdown(c); err != nil {
+			app.lo.Error("error shutting down server", "error", err)
+		}
+
+		c, cancel = context.WithTimeout(context.Background(), srv.WriteTimeout)
+		defer cancel()
+		shutdown(c, app, rs, tp)
+	}()
 
 	app.lo.Info("starting server", "address", srv.Addr)
-	if err := srv.ListenAndServe(); err != nil {
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
 		app.lo.Fatal("couldn't start server", "error", err)
 	}
+	<-closed
+}
+
+// shutdown stops the background workers once the server has stopped taking
+// requests. Queued e-mails and events are sent until ctx is done, webhook
+// retries are stopped (pending ones stay queued in the store), SMPP sessions
+// are unbound, the store's connections are closed, and finally, the buffered
+// trace spans are exported.
+func shutdown(ctx context.Context, app *App, rs *redis.Redis, tp *sdktrace.TracerProvider) {
+	for _, p := range app.providers {
+		if c, ok := p.provider.(models.Closer); ok {
+			if err := c.Close(ctx); err != nil {
+				app.lo.Error("error closing provider", "provider", p.name, "error", err)
+			}
+		}
+	}
+
+	if n := app.events.close(ctx); n > 0 {
+		app.lo.Error("dropped unposted events webhook events", "count", n)
+	}
+
+	if err := rs.Disconnect(); err != nil {
+		app.lo.Error("error closing store connections", "error", err)
+	}
+
+	if tp != nil {
+		if err := tp.Shutdown(ctx); err != nil {
+			app.lo.Error("error shutting down tracing", "error", err)
+		}
+	}
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Response formats negotiated with the Accept header.
+const (
+	formatJSON = "json"
+	formatText = "text"
+	formatXML  = "xml"
+)
+
+// withNegotiation is a middleware that picks the format of API responses
+// (JSON, plain text, or optionally XML) from the Accept header. JSON is
+// the default if the client doesn't accept any of the other formats.
+func withNegotiation(enableXML bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept")
+
+			f := acceptedFormat(r.Header.Get("Accept"), enableXML)
+			if f == formatJSON {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(&formatWriter{ResponseWriter: w, format: f}, r)
+		})
+	}
+}
+
+// acceptedFormat returns the response format with the highest q-value in
+// an Accept header. Of equally preferred types, the first one is picked.
+func acceptedFormat(h string, enableXML bool) string {
+	var (
+		out   = formatJSON
+		bestQ = 0.0
+	)
+	for _, t := range strings.Split(h, ",") {
+		t, params, _ := strings.Cut(strings.TrimSpace(t), ";")
+
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if k == "q" {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+
+		var f string
+		switch strings.ToLower(t) {
+		case "application/json", "application/*", "*/*":
+			f = formatJSON
+		case "text/plain":
+			f = formatText
+		case "application/xml", "text/xml":
+			if !enableXML {
+				continue
+			}
+			f = formatXML
+		default:
+			continue
+		}
+
+		out, bestQ = f, q
+	}
+
+	return out
+}
+
+// formatWriter carries the negotiated response format to sendResponse()
+// and sendErrorResponse().
+type formatWriter struct {
+	http.ResponseWriter
+	format string
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (f *formatWriter) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+// responseFormat returns the negotiated response format of a response.
+func responseFormat(w http.ResponseWriter) string {
+	if f, ok := w.(*formatWriter); ok {
+		return f.format
+	}
+	return formatJSON
+}
+
+// writeResponse writes an envelope in the negotiated format. Plain text
+// responses only have "OK" or the error message.
+func writeResponse(w http.ResponseWriter, code int, resp httpResp) error {
+	var (
+		out []byte
+		err error
+	)
+	switch responseFormat(w) {
+	case formatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		out = []byte("OK")
+		if resp.Status != "success" {
+			out = []byte(resp.Message)
+		}
+	case formatXML:
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		out, err = marshalXML(resp)
+	default:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		out, err = json.Marshal(resp)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set(hdrAPIVersion, apiVersion)
+	w.WriteHeader(code)
+	w.Write(out)
+	return nil
+}
+
+// marshalXML encodes an envelope as a <response> XML document. The data is
+// encoded via its JSON form so that the element names match the JSON
+// fields. Array items are <item> elements.
+func marshalXML(resp httpResp) ([]byte, error) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(xml.Header)
+	e := xml.NewEncoder(buf)
+	if err := encodeXML(e, "response", v); err != nil {
+		return nil, err
+	}
+	if err := e.Flush(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeXML encodes a decoded JSON value as an XML element. Keys that
+// aren't valid element names (eg: in extra) are encoded as
+// <field name="key">.
+func encodeXML(e *xml.Encoder, name string, v interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !isXMLName(name) {
+		start = xml.StartElement{Name: xml.Name{Local: "field"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: name}}}
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if err := encodeXML(e, k, v[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, i := range v {
+			if err := encodeXML(e, "item", i); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case json.Number:
+			s = v.String()
+		case bool:
+			s = strconv.FormatBool(v)
+		}
+		if err := e.EncodeToken(xml.CharData(s)); err != nil {
+			return err
+		}
+	}
+
+	return e.EncodeToken(start.End())
+}
+
+// isXMLName tells if a string is a simple (ASCII) XML element name.
+func isXMLName(s string) bool {
+	if s == "" || strings.HasPrefix(strings.ToLower(s), "xml") {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
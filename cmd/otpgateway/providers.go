@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	kjson "github.com/knadh/koanf/parsers/json"
+	"github.com/knadh/koanf/v2"
+	"github.com/knadh/otpgateway/v3/internal/providers/infobip"
+	"github.com/knadh/otpgateway/v3/internal/providers/kaleyra"
+	"github.com/knadh/otpgateway/v3/internal/providers/pinpoint"
+	"github.com/knadh/otpgateway/v3/internal/providers/smpp"
+	"github.com/knadh/otpgateway/v3/internal/providers/smtp"
+	"github.com/knadh/otpgateway/v3/internal/providers/sns"
+	"github.com/knadh/otpgateway/v3/internal/providers/whatsapp_cloud"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/zerodha/logf"
+)
+
+// providerLog is passed to providers that support debug logging. It's set
+// by initProviders before any of the factories are invoked.
+var providerLog *logf.Logger
+
+// Register the bundled providers in the provider registry alongside any
+// third-party providers that register themselves from their init().
+func init() {
+	models.RegisterProvider("smtp", func(b json.RawMessage) (models.Provider, error) {
+		var cfg smtp.Config
+		if err := unmarshalProviderConf(b, &cfg); err != nil {
+			return nil, err
+		}
+		cfg.Logger = providerLog
+		return smtp.New(cfg)
+	})
+
+	models.RegisterProvider("pinpoint_sms", func(b json.RawMessage) (models.Provider, error) {
+		var cfg pinpoint.Config
+		if err := unmarshalProviderConf(b, &cfg); err != nil {
+			return nil, err
+		}
+		return pinpoint.NewSMS(cfg)
+	})
+
+	models.RegisterProvider("sns", func(b json.RawMessage) (models.Provider, error) {
+		var cfg sns.Config
+		if err := unmarshalProviderConf(b, &cfg); err != nil {
+			return nil, err
+		}
+		return sns.New(cfg)
+	})
+
+	for id, typ := range map[string]string{
+		"kaleyra_sms":      kaleyra.ChannelSMS,
+		"kaleyra_whatsapp": kaleyra.ChannelWhatsapp,
+	} {
+		typ := typ
+		models.RegisterProvider(id, func(b json.RawMessage) (models.Provider, error) {
+			var cfg kaleyra.Config
+			if err := unmarshalProviderConf(b, &cfg); err != nil {
+				return nil, err
+			}
+			cfg.Logger = providerLog
+			return kaleyra.New(typ, cfg)
+		})
+	}
+
+	models.RegisterProvider("whatsapp_cloud", func(b json.RawMessage) (models.Provider, error) {
+		var cfg whatsapp_cloud.Config
+		if err := unmarshalProviderConf(b, &cfg); err != nil {
+			return nil, err
+		}
+		cfg.Logger = providerLog
+		return whatsapp_cloud.New(cfg)
+	})
+
+	models.RegisterProvider("infobip", func(b json.RawMessage) (models.Provider, error) {
+		var cfg infobip.Config
+		if err := unmarshalProviderConf(b, &cfg); err != nil {
+			return nil, err
+		}
+		cfg.Logger = providerLog
+		return infobip.New(cfg)
+	})
+
+	models.RegisterProvider("smpp", func(b json.RawMessage) (models.Provider, error) {
+		var cfg smpp.Config
+		if err := unmarshalProviderConf(b, &cfg); err != nil {
+			return nil, err
+		}
+		cfg.Logger = providerLog
+		return smpp.New(cfg)
+	})
+}
+
+// unmarshalProviderConf unmarshals a JSON provider config into the given
+// config struct with koanf so that values like durations ("5s") are decoded
+// the same way as the rest of the config.
+func unmarshalProviderConf(b json.RawMessage, out interface{}) error {
+	k := koanf.New(".")
+	if err := k.Load(rawConf(b), kjson.Parser()); err != nil {
+		return fmt.Errorf("error loading config: %v", err)
+	}
+	if err := k.UnmarshalWithConf("", out, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+		return fmt.Errorf("error unmarshalling config: %v", err)
+	}
+	return nil
+}
+
+// rawConf is a koanf.Provider for a raw config blob.
+type rawConf []byte
+
+func (r rawConf) ReadBytes() ([]byte, error) {
+	return r, nil
+}
+
+func (r rawConf) Read() (map[string]interface{}, error) {
+	return nil, errors.New("rawConf provider does not support this method")
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/knadh/otpgateway/v3/internal/store"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is the tracer used for all spans. Until a tracer provider is
+// registered with initTracing, it is a no-op.
+var tracer = otel.Tracer("github.com/knadh/otpgateway")
+
+// initTracing registers a global OpenTelemetry tracer provider that
+// exports spans to the given OTLP/HTTP endpoint (host:port).
+func initTracing(endpoint string, insecure bool) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName("otpgateway"),
+			semconv.ServiceVersion(buildString),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp, nil
+}
+
+// withTracing is a middleware that starts a span for every HTTP request.
+// Incoming trace context headers are honoured so that the span nests
+// under the caller's trace.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		// The route pattern is only known after chi has routed the request.
+		if rc := chi.RouteContext(ctx); rc != nil {
+			if p := rc.RoutePattern(); p != "" {
+				span.SetName(r.Method + " " + p)
+				span.SetAttributes(semconv.HTTPRoute(p))
+			}
+		}
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(ww.Status()))
+		if ww.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(ww.Status()))
+		}
+	})
+}
+
+// setSpanAttrs adds attributes to the request's span, if there's one.
+func setSpanAttrs(ctx context.Context, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+// endSpan records err (if any) on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedStore wraps a store.Store and records a span for every operation.
+type tracedStore struct {
+	store store.Store
+}
+
+func newTracedStore(s store.Store) store.Store {
+	return &tracedStore{store: s}
+}
+
+func (t *tracedStore) start(ctx context.Context, op, namespace, id string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "store."+op, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("otp.namespace", namespace),
+			attribute.String("otp.id", id),
+		))
+}
+
+func (t *tracedStore) Set(ctx context.Context, namespace, id string, otp models.OTP) (models.OTP, error) {
+	ctx, span := t.start(ctx, "Set", namespace, id)
+	out, err := t.store.Set(ctx, namespace, id, otp)
+	endSpan(span, err)
+	return out, err
+}
+
+func (t *tracedStore) SetBatch(ctx context.Context, namespace string, otps []models.OTP) ([]models.OTP, error) {
+	ctx, span := t.start(ctx, "SetBatch", namespace, "")
+	out, err := t.store.SetBatch(ctx, namespace, otps)
+	endSpan(span, err)
+	return out, err
+}
+
+func (t *tracedStore) SetAddress(ctx context.Context, namespace, id, address string) error {
+	ctx, span := t.start(ctx, "SetAddress", namespace, id)
+	err := t.store.SetAddress(ctx, namespace, id, address)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) Check(ctx context.Context, namespace, id string, counterKey string) (models.OTP, error) {
+	ctx, span := t.start(ctx, "Check", namespace, id)
+	out, err := t.store.Check(ctx, namespace, id, counterKey)
+	endSpan(span, err)
+	return out, err
+}
+
+func (t *tracedStore) Peek(ctx context.Context, namespace, id string) (models.OTP, error) {
+	ctx, span := t.start(ctx, "Peek", namespace, id)
+	out, err := t.store.Peek(ctx, namespace, id)
+	endSpan(span, err)
+	return out, err
+}
+
+func (t *tracedStore) Verify(ctx context.Context, namespace, id, otp string, lastSet int64, minInterval, grace time.Duration) (models.OTP, error) {
+	ctx, span := t.start(ctx, "Verify", namespace, id)
+	out, err := t.store.Verify(ctx, namespace, id, otp, lastSet, minInterval, grace)
+	endSpan(span, err)
+	return out, err
+}
+
+func (t *tracedStore) SetNonce(ctx context.Context, namespace, id, nonce string) error {
+	ctx, span := t.start(ctx, "SetNonce", namespace, id)
+	err := t.store.SetNonce(ctx, namespace, id, nonce)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) ConsumeNonce(ctx context.Context, namespace, id, nonce string) error {
+	ctx, span := t.start(ctx, "ConsumeNonce", namespace, id)
+	err := t.store.ConsumeNonce(ctx, namespace, id, nonce)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) SetDelivered(ctx context.Context, namespace, id string) error {
+	ctx, span := t.start(ctx, "SetDelivered", namespace, id)
+	err := t.store.SetDelivered(ctx, namespace, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) SetSent(ctx context.Context, namespace, id string) error {
+	ctx, span := t.start(ctx, "SetSent", namespace, id)
+	err := t.store.SetSent(ctx, namespace, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) ClaimSend(ctx context.Context, namespace, id, key string, ttl time.Duration) error {
+	ctx, span := t.start(ctx, "ClaimSend", namespace, id)
+	err := t.store.ClaimSend(ctx, namespace, id, key, ttl)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) ReleaseSend(ctx context.Context, namespace, id, key string) error {
+	ctx, span := t.start(ctx, "ReleaseSend", namespace, id)
+	err := t.store.ReleaseSend(ctx, namespace, id, key)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) Touch(ctx context.Context, namespace, id string, extend time.Duration) error {
+	ctx, span := t.start(ctx, "Touch", namespace, id)
+	err := t.store.Touch(ctx, namespace, id, extend)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) ResetAttempts(ctx context.Context, namespace, id string) error {
+	ctx, span := t.start(ctx, "ResetAttempts", namespace, id)
+	err := t.store.ResetAttempts(ctx, namespace, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) Close(ctx context.Context, namespace, id string) error {
+	ctx, span := t.start(ctx, "Close", namespace, id)
+	err := t.store.Close(ctx, namespace, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) Delete(ctx context.Context, namespace, id string) error {
+	ctx, span := t.start(ctx, "Delete", namespace, id)
+	err := t.store.Delete(ctx, namespace, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) Expire(ctx context.Context, namespace, id string, ttl time.Duration) error {
+	ctx, span := t.start(ctx, "Expire", namespace, id)
+	err := t.store.Expire(ctx, namespace, id, ttl)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) SetRef(ctx context.Context, namespace, ref, id string, ttl time.Duration) error {
+	ctx, span := t.start(ctx, "SetRef", namespace, id)
+	err := t.store.SetRef(ctx, namespace, ref, id, ttl)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) GetRef(ctx context.Context, namespace, ref string) (string, error) {
+	ctx, span := t.start(ctx, "GetRef", namespace, "")
+	id, err := t.store.GetRef(ctx, namespace, ref)
+	endSpan(span, err)
+	return id, err
+}
+
+func (t *tracedStore) DeleteRef(ctx context.Context, namespace, ref, id string) error {
+	ctx, span := t.start(ctx, "DeleteRef", namespace, id)
+	err := t.store.DeleteRef(ctx, namespace, ref, id)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) LockAddress(ctx context.Context, namespace, address string, ttl time.Duration) error {
+	ctx, span := t.start(ctx, "LockAddress", namespace, "")
+	err := t.store.LockAddress(ctx, namespace, address, ttl)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) GetAddressLock(ctx context.Context, namespace, address string) (time.Duration, error) {
+	ctx, span := t.start(ctx, "GetAddressLock", namespace, "")
+	ttl, err := t.store.GetAddressLock(ctx, namespace, address)
+	endSpan(span, err)
+	return ttl, err
+}
+
+func (t *tracedStore) ConsumeQuota(ctx context.Context, key, period string, limit int, ttl time.Duration) (int, error) {
+	ctx, span := tracer.Start(ctx, "store.ConsumeQuota", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("quota.key", key)))
+	n, err := t.store.ConsumeQuota(ctx, key, period, limit, ttl)
+	endSpan(span, err)
+	return n, err
+}
+
+func (t *tracedStore) RefundQuota(ctx context.Context, key, period string) error {
+	ctx, span := tracer.Start(ctx, "store.RefundQuota", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("quota.key", key)))
+	err := t.store.RefundQuota(ctx, key, period)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) GetQuota(ctx context.Context, key, period string) (int, error) {
+	ctx, span := tracer.Start(ctx, "store.GetQuota", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("quota.key", key)))
+	n, err := t.store.GetQuota(ctx, key, period)
+	endSpan(span, err)
+	return n, err
+}
+
+func (t *tracedStore) IncrStat(ctx context.Context, namespace, stat, day string) error {
+	ctx, span := tracer.Start(ctx, "store.IncrStat", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("otp.namespace", namespace), attribute.String("stat", stat)))
+	err := t.store.IncrStat(ctx, namespace, stat, day)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedStore) GetStats(ctx context.Context, namespace, day string) (store.Stats, error) {
+	ctx, span := tracer.Start(ctx, "store.GetStats", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("otp.namespace", namespace)))
+	out, err := t.store.GetStats(ctx, namespace, day)
+	endSpan(span, err)
+	return out, err
+}
+
+func (t *tracedStore) CountActive(ctx context.Context, namespace string) (int, error) {
+	ctx, span := tracer.Start(ctx, "store.CountActive", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("otp.namespace", namespace)))
+	out, err := t.store.CountActive(ctx, namespace)
+	endSpan(span, err)
+	return out, err
+}
+
+func (t *tracedStore) Ping(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "store.Ping", trace.WithSpanKind(trace.SpanKindClient))
+	err := t.store.Ping(ctx)
+	endSpan(span, err)
+	return err
+}
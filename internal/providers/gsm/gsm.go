@@ -0,0 +1,118 @@
+// gsm helps SMS providers with the encoding of messages. Messages that only
+// have characters from the GSM 03.38 (GSM-7) alphabet fit 160 characters in
+// an SMS. Others have to be sent as UCS-2 that only fits 70 characters.
+package gsm
+
+import (
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	MaxGSM7Len = 160
+	MaxUCS2Len = 70
+)
+
+const (
+	// GSM 03.38 default alphabet in the order of its codes, without the
+	// escape character (0x1B) to the extension table.
+	basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+		"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+	// Extension table characters that take two GSM-7 characters, and their
+	// codes after the escape character.
+	extended      = "\f^{}\\[~]|€"
+	extendedCodes = "\x0A\x14\x28\x29\x2F\x3C\x3D\x3E\x40\x65"
+
+	escape = 0x1B
+)
+
+var (
+	basicCodes = make(map[rune]byte)
+	extCodes   = make(map[rune]byte)
+)
+
+func init() {
+	for i, c := range []rune(basic) {
+		// Codes after the escape character are shifted by one.
+		if i >= escape {
+			i++
+		}
+		basicCodes[c] = byte(i)
+	}
+	for i, c := range []rune(extended) {
+		extCodes[c] = extendedCodes[i]
+	}
+}
+
+// IsGSM7 tells if s can be encoded in the GSM-7 alphabet.
+func IsGSM7(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune(basic, c) && !strings.ContainsRune(extended, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeGSM7 encodes s in the GSM 03.38 alphabet with one (unpacked) septet
+// per byte. Characters from the extension table are encoded as the escape
+// character followed by their code. It returns false if s has characters
+// outside the GSM-7 alphabet.
+func EncodeGSM7(s string) ([]byte, bool) {
+	b := make([]byte, 0, len(s))
+	for _, c := range s {
+		if code, ok := basicCodes[c]; ok {
+			b = append(b, code)
+			continue
+		}
+		if code, ok := extCodes[c]; ok {
+			b = append(b, escape, code)
+			continue
+		}
+		return nil, false
+	}
+	return b, true
+}
+
+// MaxLen returns the max number of characters of s that fit in a message
+// whose max length in GSM-7 characters is max. Characters from the extension
+// table take two GSM-7 characters. If s has characters outside the GSM-7
+// alphabet, it's sent as UCS-2 and max is the number of 16-bit characters
+// that fit in the octets of max (packed) GSM-7 characters, less one for
+// every character that's encoded as a surrogate pair.
+func MaxLen(s string, max int) int {
+	var (
+		ext   = 0
+		pairs = 0
+		ucs2  = false
+	)
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune(basic, c):
+		case strings.ContainsRune(extended, c):
+			ext++
+		default:
+			ucs2 = true
+			if c > 0xFFFF {
+				pairs++
+			}
+		}
+	}
+	if ucs2 {
+		octets := (max*7 + 7) / 8
+		return octets/2 - pairs
+	}
+	return max - ext
+}
+
+// EncodeUCS2 encodes s as UCS-2 (UTF-16BE). Characters outside the BMP
+// are encoded as surrogate pairs.
+func EncodeUCS2(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 0, len(u)*2)
+	for _, c := range u {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return b
+}
@@ -0,0 +1,40 @@
+package gsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsGSM7(t *testing.T) {
+	assert.True(t, IsGSM7("Your OTP is 123456. Don't share it! @£$ äöü {€}"))
+	assert.False(t, IsGSM7("आपका OTP 123456 है"))
+	assert.False(t, IsGSM7("Your OTP is 123456 ✅"))
+}
+
+func TestMaxLen(t *testing.T) {
+	assert.Equal(t, 160, MaxLen("Your OTP is 123456", 160))
+	assert.Equal(t, 158, MaxLen("Your OTP is {123456}", 160), "extension chars not counted twice")
+	assert.Equal(t, 70, MaxLen("आपका OTP 123456 है", 160))
+	assert.Equal(t, 61, MaxLen("आपका OTP 123456 है", 140))
+	assert.Equal(t, 67, MaxLen("आपका OTP 123456 है", 153), "concatenated segment")
+	assert.Equal(t, 68, MaxLen("Your OTP is 123456 😀😀", 160), "surrogate pairs not counted twice")
+}
+
+func TestEncodeGSM7(t *testing.T) {
+	b, ok := EncodeGSM7("A@£é\nÉ¡ü")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x41, 0x00, 0x01, 0x05, 0x0A, 0x1F, 0x40, 0x7E}, b)
+
+	b, ok = EncodeGSM7("{€}^")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x1B, 0x28, 0x1B, 0x65, 0x1B, 0x29, 0x1B, 0x14}, b)
+
+	_, ok = EncodeGSM7("Your OTP is 123456 ✅")
+	assert.False(t, ok)
+}
+
+func TestEncodeUCS2(t *testing.T) {
+	assert.Equal(t, []byte{0x00, 0x41, 0x09, 0x06}, EncodeUCS2("Aआ"))
+	assert.Equal(t, []byte{0xD8, 0x3D, 0xDE, 0x00}, EncodeUCS2("😀"))
+}
@@ -0,0 +1,73 @@
+// httplog logs the raw requests made to and responses received from
+// HTTP based providers for debugging, with credentials and OTPs redacted.
+package httplog
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/zerodha/logf"
+)
+
+const redacted = "*****"
+
+// Headers that carry credentials and are never logged.
+var sensitiveHeaders = map[string]bool{
+	"Authorization": true,
+	"Api-Key":       true,
+	"X-Api-Key":     true,
+}
+
+// Log logs a provider's request and response at the debug level.
+// Occurrences of the given secrets (eg: the OTP) in the request and
+// response bodies are redacted.
+func Log(lo *logf.Logger, provider string, req *http.Request, reqBody []byte, status int, respBody []byte, secrets ...string) {
+	if lo == nil {
+		return
+	}
+
+	lo.Debug("provider request",
+		"provider", provider,
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"headers", Headers(req.Header),
+		"body", Redact(string(reqBody), secrets...),
+		"status", status,
+		"response", Redact(string(respBody), secrets...))
+}
+
+// Headers returns the headers as a string with credentials redacted.
+func Headers(h http.Header) string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		v := h[k]
+		if b.Len() > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(k)
+		b.WriteString(": ")
+		if sensitiveHeaders[http.CanonicalHeaderKey(k)] {
+			b.WriteString(redacted)
+		} else {
+			b.WriteString(strings.Join(v, ", "))
+		}
+	}
+	return b.String()
+}
+
+// Redact replaces all occurrences of the given non-empty secrets in s.
+func Redact(s string, secrets ...string) string {
+	for _, sec := range secrets {
+		if sec != "" {
+			s = strings.ReplaceAll(s, sec, redacted)
+		}
+	}
+	return s
+}
@@ -0,0 +1,29 @@
+package httplog
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	out := Redact(`{"otp": "123456", "url": "/otp?otp=123456&nonce=abc"}`, "123456", "abc", "")
+	assert.Equal(t, `{"otp": "*****", "url": "/otp?otp=*****&nonce=*****"}`, out)
+}
+
+func TestHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secret")
+	out := Headers(h)
+	assert.Equal(t, "Authorization: *****", out)
+	assert.NotContains(t, out, "secret")
+
+	h = http.Header{}
+	h.Add("api-key", "secret")
+	assert.Equal(t, "Api-Key: *****", Headers(h))
+
+	h = http.Header{}
+	h.Set("Content-Type", "application/json")
+	assert.Equal(t, "Content-Type: application/json", Headers(h))
+}
@@ -0,0 +1,33 @@
+// httpproxy resolves the outbound proxy of HTTP based providers.
+package httpproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Func returns the proxy function for an http.Transport. If proxyURL is
+// empty, the proxy is picked from the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY
+// environment variables.
+func Func(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_url: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy_url scheme '%s'. Should be http, https, or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy_url: no host in %s", u.Redacted())
+	}
+
+	return http.ProxyURL(u), nil
+}
@@ -0,0 +1,129 @@
+package infobip
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPush(t *testing.T) {
+	var (
+		req    payload
+		status = http.StatusOK
+		resp   = `{"messages": [{"to": "919876543210", "status": {"groupName": "PENDING", "name": "PENDING_ACCEPTED"}}]}`
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, apiPath, r.URL.Path)
+		assert.Equal(t, "App mykey", r.Header.Get("Authorization"))
+
+		b, _ := io.ReadAll(r.Body)
+		req = payload{}
+		assert.NoError(t, json.Unmarshal(b, &req))
+
+		w.WriteHeader(status)
+		w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+
+	p, err := New(Config{BaseURL: srv.URL, APIKey: "mykey", Sender: "OTPGW", DefaultPhoneCode: "+91"})
+	require.NoError(t, err)
+
+	assert.NoError(t, p.Push(context.Background(), models.OTP{To: "9876543210"}, "", []byte("123456")))
+	require.Len(t, req.Messages, 1)
+	assert.Equal(t, "OTPGW", req.Messages[0].From)
+	assert.Equal(t, "919876543210", req.Messages[0].Destinations[0].To, "phone number not sanitized")
+	assert.Equal(t, "123456", req.Messages[0].Text)
+
+	// Rejected messages are failures.
+	resp = `{"messages": [{"to": "919876543210", "status": {"groupName": "REJECTED", "name": "REJECTED_DESTINATION", "description": "Invalid destination"}}]}`
+	err = p.Push(context.Background(), models.OTP{To: "+14155550100"}, "", []byte("123456"))
+	assert.ErrorContains(t, err, "REJECTED_DESTINATION")
+	assert.Equal(t, "14155550100", req.Messages[0].Destinations[0].To)
+
+	// Request errors.
+	status = http.StatusUnauthorized
+	resp = `{"requestError": {"serviceException": {"messageId": "UNAUTHORIZED", "text": "Invalid login details"}}}`
+	err = p.Push(context.Background(), models.OTP{To: "0014155550100"}, "", []byte("123456"))
+	assert.ErrorContains(t, err, "Invalid login details")
+	assert.Equal(t, "14155550100", req.Messages[0].Destinations[0].To)
+}
+
+func TestBulkPush(t *testing.T) {
+	var (
+		req    payload
+		status = http.StatusOK
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		req = payload{}
+		assert.NoError(t, json.Unmarshal(b, &req))
+
+		w.WriteHeader(status)
+		w.Write([]byte(`{"messages": [
+			{"to": "919876543210", "status": {"groupName": "PENDING", "name": "PENDING_ACCEPTED"}},
+			{"to": "14155550100", "status": {"groupName": "REJECTED", "name": "REJECTED_DESTINATION"}}
+		]}`))
+	}))
+	defer srv.Close()
+
+	p, err := New(Config{BaseURL: srv.URL, APIKey: "mykey", DefaultPhoneCode: "+91"})
+	require.NoError(t, err)
+
+	msgs := []models.Message{
+		{OTP: models.OTP{To: "9876543210"}, Body: []byte("111111")},
+		{OTP: models.OTP{To: "+14155550100"}, Body: []byte("222222")},
+	}
+	errs := p.BulkPush(context.Background(), msgs)
+	require.Len(t, errs, 2)
+	assert.NoError(t, errs[0])
+	assert.ErrorContains(t, errs[1], "REJECTED_DESTINATION")
+
+	// The messages are sent in one request.
+	require.Len(t, req.Messages, 2)
+	assert.Equal(t, "919876543210", req.Messages[0].Destinations[0].To)
+	assert.Equal(t, "222222", req.Messages[1].Text)
+
+	// A failed request fails all the messages.
+	status = http.StatusInternalServerError
+	errs = p.BulkPush(context.Background(), msgs)
+	require.Len(t, errs, 2)
+	assert.Error(t, errs[0])
+	assert.Error(t, errs[1])
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{APIKey: "mykey"})
+	assert.Error(t, err, "missing base_url not rejected")
+
+	p, err := New(Config{BaseURL: "xxxxx.api.infobip.com/", APIKey: "mykey"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://xxxxx.api.infobip.com/sms/2/text/advanced", p.apiURL)
+}
+
+func TestCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, balancePath, r.URL.Path)
+		if r.Header.Get("Authorization") != "App mykey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"requestError": {"serviceException": {"messageId": "UNAUTHORIZED", "text": "Invalid login details"}}}`))
+			return
+		}
+		w.Write([]byte(`{"balance": 10.5, "currency": "EUR"}`))
+	}))
+	defer srv.Close()
+
+	p, err := New(Config{BaseURL: srv.URL, APIKey: "mykey"})
+	require.NoError(t, err)
+	assert.NoError(t, p.Check(context.Background()))
+
+	p, err = New(Config{BaseURL: srv.URL, APIKey: "badkey"})
+	require.NoError(t, err)
+	assert.ErrorContains(t, p.Check(context.Background()), "Invalid login details")
+}
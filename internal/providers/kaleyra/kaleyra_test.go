@@ -0,0 +1,29 @@
+package kaleyra
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		channel string
+		cfg     Config
+		ok      bool
+	}{
+		{ChannelSMS, Config{SID: "HXIN1", Sender: "OTPGW"}, true},
+		{ChannelSMS, Config{SID: "HXIN1", Sender: "+14155550100"}, true},
+		{ChannelSMS, Config{Sender: "OTPGW"}, false},
+		{ChannelSMS, Config{SID: "HXIN1", Sender: "OTP GW"}, false},
+		{ChannelWhatsapp, Config{SID: "HXIN1", Sender: "+14155550100", TemplateName: "otp"}, true},
+		{ChannelWhatsapp, Config{SID: "HXIN1", Sender: "+14155550100"}, false},
+	} {
+		c.cfg.APIKey = "key"
+		k, err := New(c.channel, c.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, c.ok, k.Validate() == nil, "%s %+v", c.channel, c.cfg)
+	}
+}
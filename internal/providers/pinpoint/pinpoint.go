@@ -13,6 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/pinpoint"
 	"github.com/aws/aws-sdk-go-v2/service/pinpoint/types"
+	"github.com/knadh/otpgateway/v3/internal/providers/gsm"
 	"github.com/knadh/otpgateway/v3/pkg/models"
 )
 
@@ -24,7 +25,11 @@ const (
 	maxOTPlen     = 6
 )
 
-var reNum = regexp.MustCompile(`\+?([0-9]){8,15}`)
+var (
+	reNum      = regexp.MustCompile(`\+?([0-9]){8,15}`)
+	rePhoneSep = regexp.MustCompile(`[\s().-]`)
+	reSenderID = regexp.MustCompile(`^[a-zA-Z0-9]{1,11}$`)
+)
 
 // PinpointSMS implements the AWS PinpointSMS SMS provider.
 type PinpointSMS struct {
@@ -130,12 +135,12 @@ func (p *PinpointSMS) ValidateAddress(to string) error {
 	return nil
 }
 
-func (p *PinpointSMS) Push(otp models.OTP, subject string, body []byte) error {
+func (p *PinpointSMS) Push(ctx context.Context, otp models.OTP, subject string, body []byte) error {
 	input := &pinpoint.SendMessagesInput{
 		ApplicationId: aws.String(p.cfg.ApplicationID),
 		MessageRequest: &types.MessageRequest{
 			Addresses: map[string]types.AddressConfiguration{
-				p.sanitizePhone(otp.To): {
+				p.sanitizePhone(otp.To, otp.PhoneCode): {
 					ChannelType: types.ChannelTypeSms,
 				},
 			},
@@ -154,7 +159,14 @@ func (p *PinpointSMS) Push(otp models.OTP, subject string, body []byte) error {
 		},
 	}
 
-	_, err := p.p.SendMessages(context.TODO(), input)
+	_, err := p.p.SendMessages(ctx, input)
+	return err
+}
+
+// Check fetches the Pinpoint application to verify that the credentials
+// are valid and that the application exists.
+func (p *PinpointSMS) Check(ctx context.Context) error {
+	_, err := p.p.GetApp(ctx, &pinpoint.GetAppInput{ApplicationId: aws.String(p.cfg.ApplicationID)})
 	return err
 }
 
@@ -173,7 +185,32 @@ func (p *PinpointSMS) MaxBodyLen() int {
 	return 140
 }
 
-func (p *PinpointSMS) sanitizePhone(phone string) string {
+// MaxBodyLenFor returns the max permitted size of a body, accounting for
+// Unicode encoding of bodies that aren't GSM-7.
+func (p *PinpointSMS) MaxBodyLenFor(body []byte) int {
+	return gsm.MaxLen(string(body), p.MaxBodyLen())
+}
+
+// UsesSubject returns whether the provider sends a message subject.
+func (p *PinpointSMS) UsesSubject() bool {
+	return false
+}
+
+// Validate validates the SMS sender ID.
+func (p *PinpointSMS) Validate() error {
+	if id := p.cfg.SMSSenderID; id != "" && !reSenderID.MatchString(id) {
+		return fmt.Errorf("invalid sms_sender_id '%s': should be 1-11 alphanumeric characters", id)
+	}
+	return nil
+}
+
+// NormalizeAddress returns a phone number without separators in the
+// international form that it's sent in.
+func (p *PinpointSMS) NormalizeAddress(to, phoneCode string) string {
+	return p.sanitizePhone(rePhoneSep.ReplaceAllString(to, ""), phoneCode)
+}
+
+func (p *PinpointSMS) sanitizePhone(phone, code string) string {
 	phone = strings.TrimSpace(phone)
 
 	if strings.HasPrefix(phone, "+") {
@@ -182,5 +219,8 @@ func (p *PinpointSMS) sanitizePhone(phone string) string {
 		return "+" + phone[2:]
 	}
 
-	return p.cfg.DefaultPhoneCode + phone
+	if code == "" {
+		code = p.cfg.DefaultPhoneCode
+	}
+	return code + phone
 }
@@ -0,0 +1,175 @@
+package smpp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The provider only binds as a transmitter and sends submit_sm and
+// enquire_link, so this implements just that subset of SMPP v3.4 instead of
+// pulling in a full client library.
+
+// SMPP v3.4 command IDs.
+const (
+	cmdGenericNack        uint32 = 0x80000000
+	cmdBindTransmitter    uint32 = 0x00000002
+	cmdBindTransmitterRes uint32 = 0x80000002
+	cmdSubmitSM           uint32 = 0x00000004
+	cmdSubmitSMResp       uint32 = 0x80000004
+	cmdUnbind             uint32 = 0x00000006
+	cmdUnbindResp         uint32 = 0x80000006
+	cmdEnquireLink        uint32 = 0x00000015
+	cmdEnquireLinkResp    uint32 = 0x80000015
+
+	// Response command IDs have this bit set.
+	respBit uint32 = 0x80000000
+
+	interfaceVersion = 0x34
+	headerLen        = 16
+	maxPDULen        = 64 * 1024
+)
+
+// pdu is an SMPP protocol data unit.
+type pdu struct {
+	cmd    uint32
+	status uint32
+	seq    uint32
+	body   []byte
+}
+
+// isResp tells if the PDU is a response to a request.
+func (p pdu) isResp() bool {
+	return p.cmd&respBit != 0
+}
+
+// marshal encodes the PDU along with its header.
+func (p pdu) marshal() []byte {
+	b := make([]byte, headerLen, headerLen+len(p.body))
+	binary.BigEndian.PutUint32(b[0:], uint32(headerLen+len(p.body)))
+	binary.BigEndian.PutUint32(b[4:], p.cmd)
+	binary.BigEndian.PutUint32(b[8:], p.status)
+	binary.BigEndian.PutUint32(b[12:], p.seq)
+	return append(b, p.body...)
+}
+
+// readPDU reads a PDU from r.
+func readPDU(r io.Reader) (pdu, error) {
+	var h [headerLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return pdu{}, err
+	}
+
+	n := binary.BigEndian.Uint32(h[0:])
+	if n < headerLen || n > maxPDULen {
+		return pdu{}, fmt.Errorf("invalid PDU length %d", n)
+	}
+
+	p := pdu{
+		cmd:    binary.BigEndian.Uint32(h[4:]),
+		status: binary.BigEndian.Uint32(h[8:]),
+		seq:    binary.BigEndian.Uint32(h[12:]),
+		body:   make([]byte, n-headerLen),
+	}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return pdu{}, err
+	}
+
+	return p, nil
+}
+
+// pduWriter builds a PDU body of C-strings and integers.
+type pduWriter struct {
+	bytes.Buffer
+}
+
+func (w *pduWriter) cstring(s string) {
+	w.WriteString(s)
+	w.WriteByte(0)
+}
+
+func (w *pduWriter) uint8(v int) {
+	w.WriteByte(byte(v))
+}
+
+// bindBody returns the body of a bind_transmitter PDU.
+func bindBody(cfg Config) []byte {
+	var w pduWriter
+	w.cstring(cfg.SystemID)
+	w.cstring(cfg.Password)
+	w.cstring(cfg.SystemType)
+	w.uint8(interfaceVersion)
+	w.uint8(cfg.SourceAddrTON)
+	w.uint8(cfg.SourceAddrNPI)
+	w.cstring("") // address_range
+	return w.Bytes()
+}
+
+// submitBody returns the body of a submit_sm PDU with the message
+// encoded in the given data_coding.
+func submitBody(cfg Config, to string, coding int, msg []byte) []byte {
+	var w pduWriter
+	w.cstring("") // service_type
+	w.uint8(cfg.SourceAddrTON)
+	w.uint8(cfg.SourceAddrNPI)
+	w.cstring(cfg.SourceAddr)
+	w.uint8(cfg.DestAddrTON)
+	w.uint8(cfg.DestAddrNPI)
+	w.cstring(to)
+	w.uint8(0)      // esm_class
+	w.uint8(0)      // protocol_id
+	w.uint8(0)      // priority_flag
+	w.cstring("")   // schedule_delivery_time
+	w.cstring("")   // validity_period
+	w.uint8(0)      // registered_delivery
+	w.uint8(0)      // replace_if_present_flag
+	w.uint8(coding) // data_coding
+	w.uint8(0)      // sm_default_msg_id
+	w.uint8(len(msg))
+	w.Write(msg)
+	return w.Bytes()
+}
+
+// parseSubmit parses the destination address, the data_coding, and the
+// message from the body of a submit_sm PDU.
+func parseSubmit(b []byte) (string, int, []byte, error) {
+	r := bytes.NewReader(b)
+	cstring := func() string {
+		var s []byte
+		for {
+			c, err := r.ReadByte()
+			if err != nil || c == 0 {
+				return string(s)
+			}
+			s = append(s, c)
+		}
+	}
+	skip := func(n int) {
+		r.Seek(int64(n), io.SeekCurrent)
+	}
+
+	cstring() // service_type
+	skip(2)   // source_addr_ton, source_addr_npi
+	cstring() // source_addr
+	skip(2)   // dest_addr_ton, dest_addr_npi
+	to := cstring()
+	skip(3)                   // esm_class, protocol_id, priority_flag
+	cstring()                 // schedule_delivery_time
+	cstring()                 // validity_period
+	skip(2)                   // registered_delivery, replace_if_present_flag
+	coding, _ := r.ReadByte() // data_coding
+	skip(1)                   // sm_default_msg_id
+
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", 0, nil, errors.New("truncated submit_sm")
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", 0, nil, errors.New("truncated submit_sm")
+	}
+
+	return to, int(coding), msg, nil
+}
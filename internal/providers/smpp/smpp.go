@@ -0,0 +1,492 @@
+package smpp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/knadh/otpgateway/v3/internal/providers/gsm"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/zerodha/logf"
+)
+
+const (
+	providerID    = "smpp"
+	channelName   = "SMS"
+	addressName   = "Mobile number"
+	maxAddresslen = 15
+	maxOTPlen     = 6
+
+	// sm_length is a single octet and the spec caps short_message at 254.
+	maxMsgLen = 254
+
+	// data_coding of messages in the SMSC's default alphabet (GSM-7)
+	// and in UCS-2.
+	codingDefault = 0x00
+	codingUCS2    = 0x08
+
+	minBackoff = time.Second
+	maxBackoff = time.Second * 30
+)
+
+var (
+	reNum      = regexp.MustCompile(`\+?([0-9]){8,15}`)
+	rePhoneSep = regexp.MustCompile(`[\s().-]`)
+)
+
+// errNotBound is returned by Push when there's no bound session with the server.
+var errNotBound = errors.New("not bound to the SMPP server")
+
+// Config is the SMPP provider config.
+type Config struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	SystemID   string `json:"system_id"`
+	Password   string `json:"password"`
+	SystemType string `json:"system_type"`
+
+	// Sender address and its type of number (TON) and numbering plan
+	// indicator (NPI). For alphanumeric sender IDs, TON is 5 and NPI is 0.
+	SourceAddr    string `json:"source_addr"`
+	SourceAddrTON int    `json:"source_addr_ton"`
+	SourceAddrNPI int    `json:"source_addr_npi"`
+	DestAddrTON   int    `json:"dest_addr_ton"`
+	DestAddrNPI   int    `json:"dest_addr_npi"`
+
+	// Country code for numbers without one (not starting with + or 00).
+	DefaultPhoneCode string `json:"default_phone_code"`
+
+	// Interval at which enquire_link is sent to keep the bind alive.
+	EnquireLinkInterval time.Duration `json:"enquire_link_interval"`
+	Timeout             time.Duration `json:"timeout"`
+
+	Logger *logf.Logger `json:"-"`
+}
+
+// SMPP is an SMS provider that submits messages to an SMSC over an SMPP v3.4
+// transmitter bind. The bind is maintained in the background and is
+// re-established whenever the connection drops.
+type SMPP struct {
+	cfg  Config
+	addr string
+
+	seq uint32
+
+	// conn is nil when there's no bound session.
+	mu      sync.Mutex
+	conn    net.Conn
+	pending map[uint32]chan pdu
+
+	// Serializes PDU writes on conn.
+	wMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns an SMPP provider and starts binding to the server in the background.
+func New(cfg Config) (*SMPP, error) {
+	if cfg.Host == "" || cfg.Port == 0 {
+		return nil, errors.New("invalid host or port")
+	}
+	if cfg.SystemID == "" {
+		return nil, errors.New("invalid system_id")
+	}
+
+	if cfg.Timeout.Seconds() < 1 {
+		cfg.Timeout = time.Second * 5
+	}
+	if cfg.EnquireLinkInterval.Seconds() < 1 {
+		cfg.EnquireLinkInterval = time.Second * 30
+	}
+
+	s := &SMPP{
+		cfg:     cfg,
+		addr:    net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		pending: make(map[uint32]chan pdu),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+
+	return s, nil
+}
+
+// ID returns the Provider's ID.
+func (s *SMPP) ID() string {
+	return providerID
+}
+
+// ChannelName returns the Provider's name.
+func (s *SMPP) ChannelName() string {
+	return channelName
+}
+
+// AddressName returns the Provider's address name.
+func (s *SMPP) AddressName() string {
+	return addressName
+}
+
+// ChannelDesc returns help text for the SMS verification Provider.
+func (s *SMPP) ChannelDesc() string {
+	return fmt.Sprintf(`
+		A %d digit code has been sent as an SMS to your mobile.
+		Enter it here to verify your mobile number.`, maxOTPlen)
+}
+
+// AddressDesc returns help text for the phone number.
+func (s *SMPP) AddressDesc() string {
+	return "Please enter your mobile number"
+}
+
+// ValidateAddress "validates" a phone number.
+func (s *SMPP) ValidateAddress(to string) error {
+	if !reNum.MatchString(to) {
+		return errors.New("invalid mobile number")
+	}
+	return nil
+}
+
+// Push submits the OTP message to the SMSC with submit_sm.
+func (s *SMPP) Push(ctx context.Context, otp models.OTP, subject string, body []byte) error {
+	// Bodies are sent in the SMSC's default alphabet (GSM-7), or as UCS-2
+	// if they have characters outside it.
+	msg, ok := gsm.EncodeGSM7(string(body))
+	coding := codingDefault
+	if !ok {
+		msg, coding = gsm.EncodeUCS2(string(body)), codingUCS2
+	}
+	if len(msg) > maxMsgLen {
+		return fmt.Errorf("message is longer than %d bytes", maxMsgLen)
+	}
+
+	// Destination addresses are in the international format without the +.
+	to := strings.TrimPrefix(s.sanitizePhone(otp.To, otp.PhoneCode), "+")
+	resp, err := s.request(ctx, cmdSubmitSM, submitBody(s.cfg, to, coding, msg))
+	if err != nil {
+		return err
+	}
+	if resp.status != 0 {
+		return fmt.Errorf("submit_sm failed with status 0x%08X", resp.status)
+	}
+
+	return nil
+}
+
+// MaxAddressLen returns the maximum allowed length for the mobile number.
+func (s *SMPP) MaxAddressLen() int {
+	return maxAddresslen
+}
+
+// MaxOTPLen returns the maximum allowed length of the OTP value.
+func (s *SMPP) MaxOTPLen() int {
+	return maxOTPlen
+}
+
+// MaxBodyLen returns the max permitted body size.
+func (s *SMPP) MaxBodyLen() int {
+	return 160
+}
+
+// MaxBodyLenFor returns the max permitted size of a body, which is shorter
+// for bodies that are sent as UCS-2.
+func (s *SMPP) MaxBodyLenFor(body []byte) int {
+	return gsm.MaxLen(string(body), s.MaxBodyLen())
+}
+
+// UsesSubject returns whether the provider sends a message subject.
+func (s *SMPP) UsesSubject() bool {
+	return false
+}
+
+// NormalizeAddress returns a phone number without separators in the
+// international form that it's sent in.
+func (s *SMPP) NormalizeAddress(to, phoneCode string) string {
+	return s.sanitizePhone(rePhoneSep.ReplaceAllString(to, ""), phoneCode)
+}
+
+func (s *SMPP) sanitizePhone(phone, code string) string {
+	phone = strings.TrimSpace(phone)
+
+	if strings.HasPrefix(phone, "+") {
+		return phone
+	} else if strings.HasPrefix(phone, "00") {
+		return "+" + phone[2:]
+	}
+
+	if code == "" {
+		code = s.cfg.DefaultPhoneCode
+	}
+	return code + phone
+}
+
+// Check waits for the background bind to the server (until ctx is done)
+// and sends an enquire_link to verify that the session is alive. As the
+// bind authenticates with the system_id and password, a failed bind
+// points to bad credentials or an unreachable server.
+func (s *SMPP) Check(ctx context.Context) error {
+	t := time.NewTicker(time.Millisecond * 100)
+	defer t.Stop()
+
+	for s.getConn() == nil {
+		select {
+		case <-ctx.Done():
+			return errNotBound
+		case <-t.C:
+		}
+	}
+
+	_, err := s.request(ctx, cmdEnquireLink, nil)
+	return err
+}
+
+// Close unbinds from the server and stops reconnecting. It waits for the
+// session to end until ctx is done.
+func (s *SMPP) Close(ctx context.Context) error {
+	close(s.stop)
+
+	if conn := s.getConn(); conn != nil {
+		c, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+		s.request(c, cmdUnbind, nil)
+		cancel()
+		conn.Close()
+	}
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run keeps a session bound to the server until the provider is closed.
+func (s *SMPP) run() {
+	defer close(s.done)
+
+	wait := minBackoff
+	for {
+		bound, err := s.session()
+		if err != nil && s.cfg.Logger != nil {
+			s.cfg.Logger.Error("smpp session error", "addr", s.addr, "error", err)
+		}
+
+		// Rebind immediately if the previous session was healthy and back
+		// off exponentially on consecutive bind failures.
+		if bound {
+			wait = minBackoff
+			continue
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+}
+
+// session connects and binds to the server and blocks until the connection
+// drops. It returns true if the bind was successful.
+func (s *SMPP) session() (bool, error) {
+	select {
+	case <-s.stop:
+		return false, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", s.addr, s.cfg.Timeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := s.bind(conn); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	// Send enquire_link periodically and drop the connection if the
+	// server doesn't respond.
+	quit := make(chan struct{})
+	go s.keepAlive(conn, quit)
+
+	err = s.readLoop(conn)
+	close(quit)
+
+	// Fail all requests waiting on this connection.
+	s.mu.Lock()
+	s.conn = nil
+	for seq, ch := range s.pending {
+		close(ch)
+		delete(s.pending, seq)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.stop:
+		return true, nil
+	default:
+	}
+
+	return true, err
+}
+
+// bind sends bind_transmitter on a new connection and waits for the response.
+func (s *SMPP) bind(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(s.cfg.Timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	seq := atomic.AddUint32(&s.seq, 1)
+	if _, err := conn.Write(pdu{cmd: cmdBindTransmitter, seq: seq, body: bindBody(s.cfg)}.marshal()); err != nil {
+		return err
+	}
+
+	resp, err := readPDU(conn)
+	if err != nil {
+		return err
+	}
+	if resp.cmd != cmdBindTransmitterRes || resp.seq != seq {
+		return fmt.Errorf("unexpected bind response 0x%08X", resp.cmd)
+	}
+	if resp.status != 0 {
+		return fmt.Errorf("bind failed with status 0x%08X", resp.status)
+	}
+
+	return nil
+}
+
+// readLoop reads PDUs from the connection, dispatches responses to the
+// pending requests and responds to requests from the server.
+func (s *SMPP) readLoop(conn net.Conn) error {
+	for {
+		p, err := readPDU(conn)
+		if err != nil {
+			return err
+		}
+
+		if p.isResp() {
+			s.mu.Lock()
+			ch, ok := s.pending[p.seq]
+			delete(s.pending, p.seq)
+			s.mu.Unlock()
+
+			if ok {
+				ch <- p
+			}
+			continue
+		}
+
+		switch p.cmd {
+		case cmdEnquireLink:
+			s.write(conn, pdu{cmd: cmdEnquireLinkResp, seq: p.seq})
+		case cmdUnbind:
+			s.write(conn, pdu{cmd: cmdUnbindResp, seq: p.seq})
+			return errors.New("unbound by server")
+		default:
+			// ESME_RINVCMDID.
+			s.write(conn, pdu{cmd: cmdGenericNack, status: 0x03, seq: p.seq})
+		}
+	}
+}
+
+// keepAlive sends enquire_link at every interval and closes the connection
+// if it fails.
+func (s *SMPP) keepAlive(conn net.Conn, quit chan struct{}) {
+	t := time.NewTicker(s.cfg.EnquireLinkInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+		_, err := s.request(ctx, cmdEnquireLink, nil)
+		cancel()
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// request sends a PDU on the bound connection and waits for its response.
+func (s *SMPP) request(ctx context.Context, cmd uint32, body []byte) (pdu, error) {
+	var (
+		seq = atomic.AddUint32(&s.seq, 1)
+		ch  = make(chan pdu, 1)
+	)
+
+	s.mu.Lock()
+	conn := s.conn
+	if conn == nil {
+		s.mu.Unlock()
+		return pdu{}, errNotBound
+	}
+	s.pending[seq] = ch
+	s.mu.Unlock()
+
+	if err := s.write(conn, pdu{cmd: cmd, seq: seq, body: body}); err != nil {
+		s.forget(seq)
+		return pdu{}, err
+	}
+
+	t := time.NewTimer(s.cfg.Timeout)
+	defer t.Stop()
+
+	select {
+	case p, ok := <-ch:
+		if !ok {
+			return pdu{}, errors.New("SMPP connection closed")
+		}
+		if p.cmd == cmdGenericNack {
+			return pdu{}, fmt.Errorf("request rejected with status 0x%08X", p.status)
+		}
+		return p, nil
+	case <-t.C:
+		s.forget(seq)
+		return pdu{}, errors.New("timed out waiting for SMPP response")
+	case <-ctx.Done():
+		s.forget(seq)
+		return pdu{}, ctx.Err()
+	}
+}
+
+func (s *SMPP) write(conn net.Conn, p pdu) error {
+	s.wMu.Lock()
+	defer s.wMu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(s.cfg.Timeout))
+	_, err := conn.Write(p.marshal())
+	return err
+}
+
+func (s *SMPP) forget(seq uint32) {
+	s.mu.Lock()
+	delete(s.pending, seq)
+	s.mu.Unlock()
+}
+
+func (s *SMPP) getConn() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
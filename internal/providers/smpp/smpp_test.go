@@ -0,0 +1,339 @@
+package smpp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/otpgateway/v3/internal/providers/gsm"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMSC is a minimal SMPP server that accepts binds and records submit_sm.
+type fakeSMSC struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	binds    int
+	messages map[string]string
+	codings  map[string]int
+	conns    []net.Conn
+
+	// If set, submit_sm is rejected with generic_nack.
+	nack bool
+}
+
+func newFakeSMSC(t *testing.T) *fakeSMSC {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	f := &fakeSMSC{ln: ln, messages: make(map[string]string), codings: make(map[string]int)}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeSMSC) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := readPDU(conn)
+		if err != nil {
+			return
+		}
+
+		resp := pdu{cmd: p.cmd | respBit, seq: p.seq}
+		switch p.cmd {
+		case cmdBindTransmitter:
+			f.mu.Lock()
+			f.binds++
+			f.mu.Unlock()
+			resp.body = []byte("fake\x00")
+		case cmdSubmitSM:
+			f.mu.Lock()
+			nack := f.nack
+			f.mu.Unlock()
+			if nack {
+				// ESME_RSYSERR.
+				resp = pdu{cmd: cmdGenericNack, status: 0x08, seq: p.seq}
+				break
+			}
+
+			to, coding, msg, err := parseSubmit(p.body)
+			if err != nil {
+				resp.status = 0x01
+				break
+			}
+			f.mu.Lock()
+			f.messages[to] = string(msg)
+			f.codings[to] = coding
+			f.mu.Unlock()
+			resp.body = []byte("msgid\x00")
+		}
+		conn.Write(resp.marshal())
+	}
+}
+
+// dropAll closes all client connections.
+func (f *fakeSMSC) dropAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeSMSC) numBinds() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.binds
+}
+
+func newTestSMPP(t *testing.T, f *fakeSMSC) *SMPP {
+	addr := f.ln.Addr().(*net.TCPAddr)
+	s, err := New(Config{
+		Host:        addr.IP.String(),
+		Port:        addr.Port,
+		SystemID:    "test",
+		Password:    "test",
+		SourceAddr:  "OTPGW",
+		DestAddrTON: 1,
+		DestAddrNPI: 1,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close(context.Background()) })
+
+	return s
+}
+
+func waitBound(t *testing.T, s *SMPP) {
+	require.Eventually(t, func() bool { return s.getConn() != nil }, time.Second*3, time.Millisecond*10)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{SystemID: "test"})
+	assert.Error(t, err)
+
+	_, err = New(Config{Host: "localhost", Port: 2775})
+	assert.Error(t, err)
+}
+
+func TestPush(t *testing.T) {
+	f := newFakeSMSC(t)
+	s := newTestSMPP(t, f)
+	waitBound(t, s)
+
+	err := s.Push(context.Background(), models.OTP{To: "+919876543210"}, "", []byte("Your OTP is 123456"))
+	require.NoError(t, err)
+
+	f.mu.Lock()
+	assert.Equal(t, "Your OTP is 123456", f.messages["919876543210"])
+	assert.Equal(t, codingDefault, f.codings["919876543210"])
+	f.mu.Unlock()
+
+	// Bodies with characters outside GSM-7 are sent as UCS-2.
+	err = s.Push(context.Background(), models.OTP{To: "919876543211"}, "", []byte("आपका OTP 123456 है"))
+	require.NoError(t, err)
+
+	f.mu.Lock()
+	assert.Equal(t, string(gsm.EncodeUCS2("आपका OTP 123456 है")), f.messages["919876543211"])
+	assert.Equal(t, codingUCS2, f.codings["919876543211"])
+	f.mu.Unlock()
+	assert.Equal(t, 70, s.MaxBodyLenFor([]byte("आपका OTP 123456 है")))
+
+	// Non-ASCII GSM-7 characters are sent in the GSM 03.38 alphabet and
+	// extension table characters are escaped.
+	err = s.Push(context.Background(), models.OTP{To: "919876543213"}, "", []byte("Code: é{1}€"))
+	require.NoError(t, err)
+
+	f.mu.Lock()
+	assert.Equal(t, "Code: \x05\x1B\x281\x1B\x29\x1B\x65", f.messages["919876543213"])
+	assert.Equal(t, codingDefault, f.codings["919876543213"])
+	f.mu.Unlock()
+
+	// Numbers without a country code get the OTP's or the default one.
+	s.cfg.DefaultPhoneCode = "+91"
+	require.NoError(t, s.Push(context.Background(), models.OTP{To: "9876543212"}, "", []byte("123456")))
+	require.NoError(t, s.Push(context.Background(), models.OTP{To: "4155550100", PhoneCode: "+1"}, "", []byte("123456")))
+	require.NoError(t, s.Push(context.Background(), models.OTP{To: "00447700900123"}, "", []byte("123456")))
+
+	f.mu.Lock()
+	assert.Contains(t, f.messages, "919876543212", "default phone code not applied")
+	assert.Contains(t, f.messages, "14155550100", "OTP phone code not applied")
+	assert.Contains(t, f.messages, "447700900123", "00 prefix not converted")
+	f.mu.Unlock()
+
+	// Messages that don't fit in a single submit_sm are rejected.
+	long := make([]byte, maxMsgLen+1)
+	assert.Error(t, s.Push(context.Background(), models.OTP{To: "919876543210"}, "", long))
+}
+
+func TestRebind(t *testing.T) {
+	f := newFakeSMSC(t)
+	s := newTestSMPP(t, f)
+	waitBound(t, s)
+	assert.Equal(t, 1, f.numBinds())
+
+	// Dropping the connection should trigger a rebind.
+	f.dropAll()
+	require.Eventually(t, func() bool { return f.numBinds() == 2 && s.getConn() != nil }, time.Second*3, time.Millisecond*10)
+
+	err := s.Push(context.Background(), models.OTP{To: "919876543210"}, "", []byte("123456"))
+	assert.NoError(t, err)
+}
+
+func TestNotBound(t *testing.T) {
+	// Nothing listens on this port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	s, err := New(Config{Host: "127.0.0.1", Port: port, SystemID: "test"})
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	err = s.Push(context.Background(), models.OTP{To: "919876543210"}, "", []byte("123456"))
+	assert.ErrorIs(t, err, errNotBound)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	assert.ErrorIs(t, s.Check(ctx), errNotBound)
+}
+
+func TestCheck(t *testing.T) {
+	f := newFakeSMSC(t)
+	s := newTestSMPP(t, f)
+
+	// Check waits for the bind.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	assert.NoError(t, s.Check(ctx))
+}
+
+func TestReadPDU(t *testing.T) {
+	p := pdu{cmd: cmdSubmitSM, status: 0x01, seq: 7, body: []byte("body")}
+	b := p.marshal()
+	assert.Len(t, b, headerLen+4)
+
+	out, err := readPDU(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Equal(t, p, out)
+	assert.False(t, out.isResp())
+	assert.True(t, pdu{cmd: cmdGenericNack}.isResp(), "generic_nack not a response")
+
+	// Short headers and bodies.
+	_, err = readPDU(bytes.NewReader(b[:headerLen-1]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = readPDU(bytes.NewReader(b[:len(b)-1]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, err = readPDU(bytes.NewReader(nil))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Lengths that are shorter than the header or too long.
+	for _, n := range []uint32{0, headerLen - 1, maxPDULen + 1} {
+		h := append([]byte{}, b...)
+		binary.BigEndian.PutUint32(h, n)
+		_, err = readPDU(bytes.NewReader(h))
+		assert.ErrorContains(t, err, "invalid PDU length", "length %d", n)
+	}
+
+	// A header-only PDU has an empty body.
+	out, err = readPDU(bytes.NewReader(pdu{cmd: cmdEnquireLink, seq: 1}.marshal()))
+	require.NoError(t, err)
+	assert.Empty(t, out.body)
+}
+
+func TestParseSubmit(t *testing.T) {
+	b := submitBody(Config{SourceAddr: "OTPGW"}, "919876543210", codingUCS2, []byte("123456"))
+
+	to, coding, msg, err := parseSubmit(b)
+	require.NoError(t, err)
+	assert.Equal(t, "919876543210", to)
+	assert.Equal(t, codingUCS2, coding)
+	assert.Equal(t, []byte("123456"), msg)
+
+	// Bodies cut short anywhere are rejected.
+	for n := 0; n < len(b); n++ {
+		_, _, _, err := parseSubmit(b[:n])
+		assert.Error(t, err, "truncated submit_sm at %d parsed", n)
+	}
+}
+
+func TestGenericNack(t *testing.T) {
+	f := newFakeSMSC(t)
+	s := newTestSMPP(t, f)
+	waitBound(t, s)
+
+	// Requests rejected with generic_nack fail with its status.
+	f.mu.Lock()
+	f.nack = true
+	f.mu.Unlock()
+	err := s.Push(context.Background(), models.OTP{To: "919876543210"}, "", []byte("123456"))
+	assert.ErrorContains(t, err, "0x00000008")
+
+	// The session survives it.
+	f.mu.Lock()
+	f.nack = false
+	f.mu.Unlock()
+	assert.NoError(t, s.Push(context.Background(), models.OTP{To: "919876543210"}, "", []byte("123456")))
+	assert.Equal(t, 1, f.numBinds())
+}
+
+func TestUnknownCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	s := &SMPP{cfg: Config{Timeout: time.Second}, pending: make(map[uint32]chan pdu)}
+	done := make(chan error, 1)
+	go func() { done <- s.readLoop(client) }()
+
+	// Requests the client doesn't support are rejected with generic_nack
+	// (ESME_RINVCMDID) without ending the session.
+	_, err := server.Write(pdu{cmd: 0x00000103, seq: 9}.marshal()) // data_sm
+	require.NoError(t, err)
+	p, err := readPDU(server)
+	require.NoError(t, err)
+	assert.Equal(t, pdu{cmd: cmdGenericNack, status: 0x03, seq: 9, body: []byte{}}, p)
+
+	// Responses to requests that aren't pending are ignored.
+	_, err = server.Write(pdu{cmd: cmdGenericNack, status: 0x01}.marshal())
+	require.NoError(t, err)
+
+	_, err = server.Write(pdu{cmd: cmdEnquireLink, seq: 10}.marshal())
+	require.NoError(t, err)
+	p, err = readPDU(server)
+	require.NoError(t, err)
+	assert.Equal(t, cmdEnquireLinkResp, p.cmd)
+	assert.Equal(t, uint32(10), p.seq)
+
+	// Malformed PDUs end the session.
+	_, err = server.Write([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
+	select {
+	case err := <-done:
+		assert.ErrorContains(t, err, "invalid PDU length")
+	case <-time.After(time.Second * 3):
+		t.Fatal("read loop didn't end on a malformed PDU")
+	}
+}
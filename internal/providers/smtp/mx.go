@@ -0,0 +1,100 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMXTimeout  = time.Second * 2
+	defaultMXCacheTTL = time.Hour
+
+	// Max number of domains in the cache after which it's reset.
+	maxMXCacheSize = 10000
+)
+
+var errNoMX = errors.New("e-mail domain has no mail servers")
+
+// mxChecker checks if e-mail domains have mail servers (MX records) and
+// caches the results of the lookups.
+type mxChecker struct {
+	timeout time.Duration
+	ttl     time.Duration
+	lookup  func(ctx context.Context, domain string) ([]*net.MX, error)
+
+	mu    sync.Mutex
+	cache map[string]mxResult
+}
+
+type mxResult struct {
+	ok  bool
+	exp time.Time
+}
+
+func newMXChecker(timeout, ttl time.Duration) *mxChecker {
+	if timeout <= 0 {
+		timeout = defaultMXTimeout
+	}
+	if ttl <= 0 {
+		ttl = defaultMXCacheTTL
+	}
+
+	return &mxChecker{
+		timeout: timeout,
+		ttl:     ttl,
+		lookup:  net.DefaultResolver.LookupMX,
+		cache:   make(map[string]mxResult),
+	}
+}
+
+// check returns an error if the domain has no mail servers. Domains that
+// don't exist, have no MX records, or have a null MX (RFC 7505) are
+// rejected. Lookups that fail otherwise (eg: timeouts) don't reject the
+// domain and aren't cached.
+func (m *mxChecker) check(domain string) error {
+	now := time.Now()
+
+	m.mu.Lock()
+	r, ok := m.cache[domain]
+	m.mu.Unlock()
+	if ok && now.Before(r.exp) {
+		if !r.ok {
+			return errNoMX
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	mx, err := m.lookup(ctx, domain)
+	if err != nil {
+		var dErr *net.DNSError
+		if !errors.As(err, &dErr) || !dErr.IsNotFound {
+			return nil
+		}
+	}
+
+	hasMX := false
+	for _, r := range mx {
+		if r.Host != "." && r.Host != "" {
+			hasMX = true
+			break
+		}
+	}
+
+	m.mu.Lock()
+	if len(m.cache) >= maxMXCacheSize {
+		m.cache = make(map[string]mxResult)
+	}
+	m.cache[domain] = mxResult{ok: hasMX, exp: now.Add(m.ttl)}
+	m.mu.Unlock()
+
+	if !hasMX {
+		return errNoMX
+	}
+	return nil
+}
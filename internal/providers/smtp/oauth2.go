@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Access tokens are refreshed this long before they expire so that
+	// they don't expire in the middle of an SMTP handshake.
+	oauth2ExpiryMargin = time.Minute
+
+	defaultOAuth2Timeout = time.Second * 10
+)
+
+// xoauth2Auth implements the XOAUTH2 SASL mechanism used by Gmail and
+// Office 365 (https://developers.google.com/gmail/imap/xoauth2-protocol).
+type xoauth2Auth struct {
+	username string
+	host     string
+	token    func() (string, error)
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like net/smtp's PLAIN, refuse to send the token in the clear
+	// to anything but localhost.
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	tok, err := a.token()
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting OAuth2 access token: %v", err)
+	}
+
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + tok + "\x01\x01"), nil
+}
+
+// Next responds to the JSON error challenge that the server sends when
+// authentication fails with an empty response, to which the server
+// replies with the actual error.
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// oauth2Token gets OAuth2 access tokens from a token endpoint with a
+// refresh token (RFC 6749, section 6) and caches them until they're
+// about to expire.
+type oauth2Token struct {
+	url          string
+	clientID     string
+	clientSecret string
+	refreshToken string
+	h            *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newOAuth2Token(cfg Config) *oauth2Token {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultOAuth2Timeout
+	}
+
+	return &oauth2Token{
+		url:          cfg.OAuth2TokenURL,
+		clientID:     cfg.OAuth2ClientID,
+		clientSecret: cfg.OAuth2ClientSecret,
+		refreshToken: cfg.OAuth2RefreshToken,
+		h:            &http.Client{Timeout: timeout},
+	}
+}
+
+// get returns the cached access token, or a new one if it has expired.
+func (o *oauth2Token) get() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token != "" && time.Now().Before(o.expiry) {
+		return o.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {o.refreshToken},
+	}
+	if o.clientID != "" {
+		form.Set("client_id", o.clientID)
+	}
+	if o.clientSecret != "" {
+		form.Set("client_secret", o.clientSecret)
+	}
+
+	resp, err := o.h.PostForm(o.url, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+		ErrorDesc    string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&out); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("error parsing token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint responded with %d: %s %s", resp.StatusCode, out.Error, out.ErrorDesc)
+	}
+	if out.AccessToken == "" {
+		return "", errors.New("token endpoint returned no access token")
+	}
+
+	// Tokens without an expiry aren't cached.
+	o.token = out.AccessToken
+	o.expiry = time.Now().Add(time.Duration(out.ExpiresIn)*time.Second - oauth2ExpiryMargin)
+
+	// Some endpoints rotate refresh tokens on every use.
+	if out.RefreshToken != "" {
+		o.refreshToken = out.RefreshToken
+	}
+
+	return o.token, nil
+}
@@ -1,15 +1,23 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/knadh/otpgateway/v3/pkg/models"
 	"github.com/knadh/smtppool"
+	"github.com/zerodha/logf"
 )
 
 const (
@@ -19,6 +27,9 @@ const (
 	maxOTPlen     = 6
 	maxAddressLen = 100
 	maxBodyLen    = 100 * 1024
+
+	// Default size of the outgoing queue when rate limiting is enabled.
+	defaultQueueSize = 1000
 )
 
 // http://www.golangprograms.com/regular-expression-to-validate-email-address.html
@@ -26,6 +37,9 @@ var reMail = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?
 
 // Config represents an SMTP server's credentials.
 type Config struct {
+	// ID is the unique ID of the provider. Defaults to "smtp".
+	ID string `json:"id"`
+
 	Host         string        `json:"host"`
 	Port         int           `json:"port"`
 	AuthProtocol string        `json:"auth_protocol"`
@@ -35,19 +49,69 @@ type Config struct {
 	Timeout      time.Duration `json:"timeout"`
 	MaxConns     int           `json:"max_conns"`
 
+	// OAuth2 settings for the XOAUTH2 auth protocol ("oauth2"), which
+	// authenticates Username with an access token instead of a password.
+	// If OAuth2TokenURL is set, access tokens are fetched from it with the
+	// refresh token and refreshed before they expire. Otherwise,
+	// OAuth2AccessToken is used as is.
+	OAuth2AccessToken  string `json:"oauth2_access_token"`
+	OAuth2TokenURL     string `json:"oauth2_token_url"`
+	OAuth2ClientID     string `json:"oauth2_client_id"`
+	OAuth2ClientSecret string `json:"oauth2_client_secret"`
+	OAuth2RefreshToken string `json:"oauth2_refresh_token"`
+
 	// STARTTLS or TLS.
 	TLSType       string `json:"tls_type"`
 	TLSSkipVerify bool   `json:"tls_skip_verify"`
+
+	// HighPriority sets the X-Priority and Importance headers on e-mails.
+	HighPriority bool `json:"high_priority"`
+
+	// Headers is an optional map of static headers set on all e-mails.
+	Headers map[string]string `json:"headers"`
+
+	// RatePerMinute, if set, queues outgoing e-mails and sends them at
+	// most at this rate. Push returns as soon as an e-mail is queued.
+	RatePerMinute int `json:"rate_per_minute"`
+
+	// QueueSize is the max number of e-mails that can be queued when
+	// RatePerMinute is set. Push fails once the queue is full.
+	QueueSize int `json:"queue_size"`
+
+	// VerifyMX, if set, rejects addresses whose domains have no mail
+	// servers (MX records) in ValidateAddress. Lookups time out after
+	// MXTimeout and their results are cached for MXCacheTTL.
+	VerifyMX   bool          `json:"verify_mx"`
+	MXTimeout  time.Duration `json:"mx_timeout"`
+	MXCacheTTL time.Duration `json:"mx_cache_ttl"`
+
+	// Logger is used to log errors of queued e-mails.
+	Logger *logf.Logger `json:"-"`
 }
 
 // SMTP is a generic SMTP e-mail provider.
 type SMTP struct {
-	cfg Config
-	p   *smtppool.Pool
+	cfg     Config
+	opt     smtppool.Opt
+	headers textproto.MIMEHeader
+	p       *smtppool.Pool
+	send    func(smtppool.Email) error
+	mx      *mxChecker
+
+	// Outgoing queue when rate limiting is enabled. Its worker returns
+	// early when stop is closed and closes done when it returns.
+	queue  chan smtppool.Email
+	mu     sync.RWMutex
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
 }
 
 // New creates and returns an e-mail Provider backend.
 func New(cfg Config) (*SMTP, error) {
+	if cfg.ID == "" {
+		cfg.ID = providerID
+	}
 	if cfg.FromEmail == "" {
 		cfg.FromEmail = "otp@localhost"
 	}
@@ -61,6 +125,20 @@ func New(cfg Config) (*SMTP, error) {
 		auth = smtp.CRAMMD5Auth(cfg.Username, cfg.Password)
 	case "plain":
 		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	case "oauth2":
+		a := &xoauth2Auth{username: cfg.Username, host: cfg.Host}
+		switch {
+		case cfg.OAuth2TokenURL != "":
+			if cfg.OAuth2RefreshToken == "" {
+				return nil, errors.New("oauth2_refresh_token is required with oauth2_token_url")
+			}
+			a.token = newOAuth2Token(cfg).get
+		case cfg.OAuth2AccessToken != "":
+			a.token = func() (string, error) { return cfg.OAuth2AccessToken, nil }
+		default:
+			return nil, errors.New("oauth2 auth requires oauth2_access_token or oauth2_token_url")
+		}
+		auth = a
 	case "", "none":
 	default:
 		return nil, fmt.Errorf("unknown SMTP auth type '%s'", cfg.AuthProtocol)
@@ -95,15 +173,34 @@ func New(cfg Config) (*SMTP, error) {
 		return nil, err
 	}
 
-	return &SMTP{
-		p:   pool,
-		cfg: cfg,
-	}, nil
+	s := &SMTP{
+		p:       pool,
+		cfg:     cfg,
+		opt:     opt,
+		headers: makeHeaders(cfg),
+		send:    pool.Send,
+	}
+
+	if cfg.VerifyMX {
+		s.mx = newMXChecker(cfg.MXTimeout, cfg.MXCacheTTL)
+	}
+
+	if cfg.RatePerMinute > 0 {
+		if cfg.QueueSize < 1 {
+			cfg.QueueSize = defaultQueueSize
+		}
+		s.queue = make(chan smtppool.Email, cfg.QueueSize)
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.runQueue(time.Minute / time.Duration(cfg.RatePerMinute))
+	}
+
+	return s, nil
 }
 
 // ID returns the Provider's ID.
 func (s *SMTP) ID() string {
-	return providerID
+	return s.cfg.ID
 }
 
 // ChannelName returns the e-mail Provider's name.
@@ -131,22 +228,74 @@ func (s *SMTP) AddressDesc() string {
 	return `Please enter the e-mail ID you want to verify`
 }
 
-// ValidateAddress "validates" an e-mail address.
+// ValidateAddress "validates" an e-mail address, and if VerifyMX is set,
+// checks that its domain has mail servers.
 func (s *SMTP) ValidateAddress(to string) error {
 	if !reMail.MatchString(to) {
 		return errors.New("invalid e-mail address")
 	}
+
+	if s.mx != nil {
+		return s.mx.check(strings.ToLower(to[strings.LastIndexByte(to, '@')+1:]))
+	}
 	return nil
 }
 
-// Push pushes an e-mail to the SMTP server.
-func (s *SMTP) Push(otp models.OTP, subject string, m []byte) error {
-	return s.p.Send(smtppool.Email{
-		From:    s.cfg.FromEmail,
-		To:      []string{otp.To},
-		Subject: subject,
-		HTML:    m,
-	})
+// NormalizeAddress returns an e-mail address in lowercase. While the local
+// part is case-sensitive in theory, mail servers treat it as insensitive.
+func (s *SMTP) NormalizeAddress(to, phoneCode string) string {
+	return strings.ToLower(strings.TrimSpace(to))
+}
+
+// Push pushes an e-mail to the SMTP server. The SMTP pool has its own
+// timeouts and doesn't accept a context. If rate limiting is enabled,
+// the e-mail is queued and Push returns immediately.
+func (s *SMTP) Push(ctx context.Context, otp models.OTP, subject string, m []byte) error {
+	e := s.makeEmail(otp, subject, m)
+	if s.queue == nil {
+		return s.send(e)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errors.New("e-mail queue is closed")
+	}
+
+	select {
+	case s.queue <- e:
+		return nil
+	default:
+		return errors.New("e-mail queue is full")
+	}
+}
+
+// Close stops accepting e-mails and waits for the queued ones to be sent
+// until ctx is done, after which the rest are dropped. It then closes the
+// SMTP connections.
+func (s *SMTP) Close(ctx context.Context) error {
+	var err error
+	if s.queue != nil {
+		s.mu.Lock()
+		s.closed = true
+		close(s.queue)
+		s.mu.Unlock()
+
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			close(s.stop)
+			<-s.done
+			if n := len(s.queue); n > 0 {
+				err = fmt.Errorf("dropped %d queued e-mails", n)
+			}
+		}
+	}
+
+	if s.p != nil {
+		s.p.Close()
+	}
+	return err
 }
 
 // MaxAddressLen returns the maximum allowed length of the e-mail address.
@@ -163,3 +312,115 @@ func (s *SMTP) MaxOTPLen() int {
 func (s *SMTP) MaxBodyLen() int {
 	return maxBodyLen
 }
+
+// UsesSubject returns whether the provider sends a message subject.
+func (s *SMTP) UsesSubject() bool {
+	return true
+}
+
+// Validate validates the from e-mail.
+func (s *SMTP) Validate() error {
+	if _, err := mail.ParseAddress(s.cfg.FromEmail); err != nil {
+		return fmt.Errorf("invalid from_email '%s': %v", s.cfg.FromEmail, err)
+	}
+	return nil
+}
+
+// Check connects to the SMTP server and goes through the TLS and auth
+// handshakes to verify that the server is reachable and that the
+// credentials are valid. No e-mail is sent.
+func (s *SMTP) Check(ctx context.Context) error {
+	var (
+		addr = net.JoinHostPort(s.opt.Host, strconv.Itoa(s.opt.Port))
+		d    = &net.Dialer{Timeout: s.cfg.Timeout}
+
+		conn net.Conn
+		err  error
+	)
+	if s.opt.TLSConfig != nil && s.opt.SSL {
+		conn, err = (&tls.Dialer{NetDialer: d, Config: s.opt.TLSConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+
+	c, err := smtp.NewClient(conn, s.opt.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.opt.TLSConfig != nil && !s.opt.SSL {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP STARTTLS extension not found")
+		}
+		if err := c.StartTLS(s.opt.TLSConfig); err != nil {
+			return err
+		}
+	}
+
+	if s.opt.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("SMTP AUTH extension not found")
+		}
+		if err := c.Auth(s.opt.Auth); err != nil {
+			return err
+		}
+	}
+
+	return c.Quit()
+}
+
+// runQueue sends queued e-mails one at a time, at most one per interval.
+// As Push has already returned by then, errors are only logged.
+func (s *SMTP) runQueue(interval time.Duration) {
+	defer close(s.done)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for e := range s.queue {
+		if err := s.send(e); err != nil && s.cfg.Logger != nil {
+			s.cfg.Logger.Error("error sending queued e-mail", "provider", s.cfg.ID, "error", err)
+		}
+
+		select {
+		case <-t.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// makeEmail prepares the e-mail message for an OTP.
+func (s *SMTP) makeEmail(otp models.OTP, subject string, m []byte) smtppool.Email {
+	return smtppool.Email{
+		From:    s.cfg.FromEmail,
+		To:      []string{otp.To},
+		Subject: subject,
+		HTML:    m,
+		Headers: s.headers,
+	}
+}
+
+// makeHeaders prepares the static headers to set on e-mails.
+func makeHeaders(cfg Config) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	for k, v := range cfg.Headers {
+		h.Set(k, v)
+	}
+
+	if cfg.HighPriority {
+		h.Set("X-Priority", "1")
+		h.Set("X-MSMail-Priority", "High")
+		h.Set("Importance", "High")
+	}
+
+	return h
+}
@@ -0,0 +1,349 @@
+package smtp
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/knadh/smtppool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaders(t *testing.T) {
+	s := &SMTP{
+		cfg: Config{FromEmail: "otp@localhost"},
+		headers: makeHeaders(Config{
+			HighPriority: true,
+			Headers:      map[string]string{"x-custom": "yes"},
+		}),
+	}
+
+	e := s.makeEmail(models.OTP{To: "to@localhost"}, "subject", []byte("body"))
+	assert.Equal(t, "1", e.Headers.Get("X-Priority"), "X-Priority header not set")
+	assert.Equal(t, "High", e.Headers.Get("Importance"), "Importance header not set")
+	assert.Equal(t, "yes", e.Headers.Get("X-Custom"), "custom header not set")
+
+	// No priority headers by default.
+	s.headers = makeHeaders(Config{})
+	e = s.makeEmail(models.OTP{To: "to@localhost"}, "subject", []byte("body"))
+	assert.Equal(t, "", e.Headers.Get("X-Priority"), "X-Priority header set")
+}
+
+func TestValidate(t *testing.T) {
+	for from, ok := range map[string]bool{"otp@localhost": true, "OTP <otp@example.com>": true, "otp": false, "": false} {
+		s := &SMTP{cfg: Config{FromEmail: from}}
+		assert.Equal(t, ok, s.Validate() == nil, "from_email %q", from)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	sent := make(chan time.Time, 3)
+	s := &SMTP{
+		cfg:   Config{FromEmail: "otp@localhost"},
+		queue: make(chan smtppool.Email, 2),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		send: func(smtppool.Email) error {
+			sent <- time.Now()
+			return nil
+		},
+	}
+
+	// The queue worker isn't running yet, so the queue fills up.
+	interval := time.Millisecond * 50
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, s.Push(context.Background(), models.OTP{To: "to@localhost"}, "subject", []byte("body")))
+	}
+	assert.Error(t, s.Push(context.Background(), models.OTP{To: "to@localhost"}, "subject", []byte("body")), "full queue not rejected")
+	assert.Less(t, time.Since(start), interval, "push blocked")
+
+	go s.runQueue(interval)
+	t1, t2 := <-sent, <-sent
+	assert.GreaterOrEqual(t, t2.Sub(t1), interval-time.Millisecond*5, "e-mails not paced")
+}
+
+func TestClose(t *testing.T) {
+	var sent int
+	newSMTP := func() *SMTP {
+		sent = 0
+		return &SMTP{
+			cfg:   Config{FromEmail: "otp@localhost"},
+			queue: make(chan smtppool.Email, 3),
+			stop:  make(chan struct{}),
+			done:  make(chan struct{}),
+			send: func(smtppool.Email) error {
+				sent++
+				return nil
+			},
+		}
+	}
+	push := func(s *SMTP) error {
+		return s.Push(context.Background(), models.OTP{To: "to@localhost"}, "subject", []byte("body"))
+	}
+
+	// Queued e-mails are sent before Close returns and new ones are rejected.
+	s := newSMTP()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, push(s))
+	}
+	go s.runQueue(time.Millisecond)
+	assert.NoError(t, s.Close(context.Background()))
+	assert.Equal(t, 3, sent, "queued e-mails not sent")
+	assert.Error(t, push(s), "e-mail queued after close")
+
+	// E-mails that can't be sent in time are dropped.
+	s = newSMTP()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, push(s))
+	}
+	go s.runQueue(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.Error(t, s.Close(ctx), "dropped e-mails not reported")
+	assert.Equal(t, 1, sent)
+}
+
+func TestVerifyMX(t *testing.T) {
+	lookups := 0
+	mx := newMXChecker(0, time.Minute)
+	mx.lookup = func(ctx context.Context, domain string) ([]*net.MX, error) {
+		lookups++
+		switch domain {
+		case "example.com":
+			return []*net.MX{{Host: "mx.example.com.", Pref: 10}}, nil
+		case "null.com":
+			return []*net.MX{{Host: ".", Pref: 0}}, nil
+		case "timeout.com":
+			return nil, &net.DNSError{Err: "i/o timeout", Name: domain, IsTimeout: true}
+		case "broken.com":
+			return nil, errors.New("lookup failed")
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	s := &SMTP{mx: mx}
+
+	assert.NoError(t, s.ValidateAddress("user@Example.com"))
+	assert.Error(t, s.ValidateAddress("user@exmaple.com"), "domain without mx not rejected")
+	assert.Error(t, s.ValidateAddress("user@null.com"), "null mx not rejected")
+
+	// Failed lookups don't reject addresses and aren't cached.
+	assert.NoError(t, s.ValidateAddress("user@timeout.com"))
+	assert.NoError(t, s.ValidateAddress("user@broken.com"))
+
+	// Results are cached.
+	n := lookups
+	assert.NoError(t, s.ValidateAddress("other@example.com"))
+	assert.Error(t, s.ValidateAddress("other@exmaple.com"))
+	assert.Equal(t, n, lookups, "lookup not cached")
+
+	assert.NoError(t, s.ValidateAddress("user@timeout.com"))
+	assert.Equal(t, n+1, lookups, "failed lookup cached")
+
+	// Expired results are looked up again.
+	mx.cache["example.com"] = mxResult{ok: true, exp: time.Now().Add(-time.Second)}
+	assert.NoError(t, s.ValidateAddress("user@example.com"))
+	assert.Equal(t, n+2, lookups, "expired result not looked up")
+
+	// MX isn't checked by default.
+	assert.NoError(t, (&SMTP{}).ValidateAddress("user@exmaple.com"))
+}
+
+func TestCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A minimal SMTP server that accepts the password "secret".
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				tp := textproto.NewConn(c)
+				tp.PrintfLine("220 localhost ESMTP")
+				for {
+					l, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					switch {
+					case strings.HasPrefix(l, "EHLO"):
+						tp.PrintfLine("250-localhost")
+						tp.PrintfLine("250 AUTH PLAIN")
+					case strings.HasPrefix(l, "AUTH PLAIN"):
+						b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(l, "AUTH PLAIN "))
+						if strings.HasSuffix(string(b), "\x00secret") {
+							tp.PrintfLine("235 OK")
+						} else {
+							tp.PrintfLine("535 Authentication failed")
+						}
+					case l == "QUIT":
+						tp.PrintfLine("221 Bye")
+						return
+					default:
+						tp.PrintfLine("502 Not implemented")
+					}
+				}
+			}(c)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	newSMTP := func(password string) *SMTP {
+		s, err := New(Config{Host: "127.0.0.1", Port: addr.Port, AuthProtocol: "plain",
+			Username: "user", Password: password, TLSType: "none", Timeout: time.Second, MaxConns: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	assert.NoError(t, newSMTP("secret").Check(ctx))
+	assert.ErrorContains(t, newSMTP("wrong").Check(ctx), "Authentication failed")
+
+	// Unreachable servers.
+	ln.Close()
+	assert.Error(t, newSMTP("secret").Check(ctx))
+}
+
+func TestXOAUTH2(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A minimal SMTP server that accepts the access token "token2".
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				tp := textproto.NewConn(c)
+				tp.PrintfLine("220 localhost ESMTP")
+				for {
+					l, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					switch {
+					case strings.HasPrefix(l, "EHLO"):
+						tp.PrintfLine("250-localhost")
+						tp.PrintfLine("250 AUTH XOAUTH2")
+					case strings.HasPrefix(l, "AUTH XOAUTH2"):
+						b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(l, "AUTH XOAUTH2 "))
+						if string(b) == "user=user\x01auth=Bearer token2\x01\x01" {
+							tp.PrintfLine("235 OK")
+							continue
+						}
+						// Send the error challenge and fail on the empty response.
+						tp.PrintfLine("334 eyJzdGF0dXMiOiI0MDEifQ==")
+						if l, _ := tp.ReadLine(); l == "" {
+							tp.PrintfLine("535 Authentication failed")
+						}
+					case l == "QUIT":
+						tp.PrintfLine("221 Bye")
+						return
+					default:
+						tp.PrintfLine("502 Not implemented")
+					}
+				}
+			}(c)
+		}
+	}()
+
+	// Token endpoint that hands out token1, token2 ... on every refresh.
+	var refreshes int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" ||
+			r.PostForm.Get("client_id") != "id" || r.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		refreshes++
+		fmt.Fprintf(w, `{"access_token": "token%d", "expires_in": 0}`, refreshes)
+	}))
+	defer ts.Close()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	newSMTP := func(cfg Config) *SMTP {
+		cfg.Host, cfg.Port, cfg.AuthProtocol, cfg.Username = "127.0.0.1", addr.Port, "oauth2", "user"
+		cfg.TLSType, cfg.Timeout, cfg.MaxConns = "none", time.Second, 1
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	// Static access tokens.
+	assert.NoError(t, newSMTP(Config{OAuth2AccessToken: "token2"}).Check(ctx))
+	assert.ErrorContains(t, newSMTP(Config{OAuth2AccessToken: "wrong"}).Check(ctx), "Authentication failed")
+
+	// Refreshed access tokens. Tokens without an expiry are refreshed on
+	// every use, so the first attempt gets token1 and the second, token2.
+	s := newSMTP(Config{OAuth2TokenURL: ts.URL, OAuth2RefreshToken: "refresh",
+		OAuth2ClientID: "id", OAuth2ClientSecret: "secret"})
+	assert.ErrorContains(t, s.Check(ctx), "Authentication failed")
+	assert.NoError(t, s.Check(ctx))
+
+	// Token endpoint errors.
+	s = newSMTP(Config{OAuth2TokenURL: ts.URL, OAuth2RefreshToken: "wrong"})
+	assert.ErrorContains(t, s.Check(ctx), "invalid_grant")
+
+	// Missing settings.
+	_, err = New(Config{AuthProtocol: "oauth2"})
+	assert.Error(t, err)
+	_, err = New(Config{AuthProtocol: "oauth2", OAuth2TokenURL: ts.URL})
+	assert.Error(t, err)
+}
+
+func TestOAuth2TokenCache(t *testing.T) {
+	var refreshes int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes++
+		fmt.Fprintf(w, `{"access_token": "token%d", "expires_in": 3600, "refresh_token": "rotated"}`, refreshes)
+	}))
+	defer ts.Close()
+
+	o := newOAuth2Token(Config{OAuth2TokenURL: ts.URL, OAuth2RefreshToken: "refresh"})
+	for i := 0; i < 3; i++ {
+		tok, err := o.get()
+		assert.NoError(t, err)
+		assert.Equal(t, "token1", tok)
+	}
+	assert.Equal(t, 1, refreshes)
+	assert.Equal(t, "rotated", o.refreshToken)
+
+	// Expired tokens are refreshed.
+	o.expiry = time.Now().Add(-time.Second)
+	tok, err := o.get()
+	assert.NoError(t, err)
+	assert.Equal(t, "token2", tok)
+}
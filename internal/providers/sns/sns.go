@@ -0,0 +1,215 @@
+package sns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/knadh/otpgateway/v3/internal/providers/gsm"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+)
+
+const (
+	providerID    = "sns"
+	channelName   = "SMS"
+	addressName   = "Mobile number"
+	maxAddresslen = 10
+	maxOTPlen     = 6
+
+	smsTransactional = "Transactional"
+	smsPromotional   = "Promotional"
+)
+
+var (
+	reNum      = regexp.MustCompile(`\+?([0-9]){8,15}`)
+	rePhoneSep = regexp.MustCompile(`[\s().-]`)
+	reSenderID = regexp.MustCompile(`^[a-zA-Z0-9]{1,11}$`)
+)
+
+// SNS implements the AWS SNS SMS provider.
+type SNS struct {
+	cfg Config
+	c   *sns.Client
+}
+
+type Config struct {
+	AccessKey        string        `json:"access_key"`
+	SecretKey        string        `json:"secret_key"`
+	Region           string        `json:"region"`
+	SMSSenderID      string        `json:"sms_sender_id"`
+	SMSType          string        `json:"sms_type"`
+	DefaultPhoneCode string        `json:"default_phone_code"`
+	Timeout          time.Duration `json:"timeout"`
+}
+
+// New returns an instance of the SNS SMS provider that sends messages
+// directly to phone numbers with SNS Publish.
+func New(cfg Config) (*SNS, error) {
+	if cfg.Region == "" {
+		return nil, errors.New("invalid region")
+	}
+	if cfg.AccessKey == "" {
+		return nil, errors.New("invalid access_key")
+	}
+	if cfg.SecretKey == "" {
+		return nil, errors.New("invalid secret_key")
+	}
+
+	if cfg.Timeout.Seconds() < 1 {
+		cfg.Timeout = time.Second * 3
+	}
+
+	if cfg.SMSType == "" {
+		cfg.SMSType = smsTransactional
+	}
+	if cfg.SMSType != smsTransactional && cfg.SMSType != smsPromotional {
+		return nil, errors.New("invalid sms_type: must be Transactional or Promotional")
+	}
+
+	cfgAws, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(cfg.Region),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, "")),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SNS{cfg: cfg, c: sns.NewFromConfig(cfgAws)}, nil
+}
+
+// ID returns the Provider's ID.
+func (s *SNS) ID() string {
+	return providerID
+}
+
+// ChannelName returns the Provider's name.
+func (s *SNS) ChannelName() string {
+	return channelName
+}
+
+// AddressName returns the Provider's address name.
+func (s *SNS) AddressName() string {
+	return addressName
+}
+
+// ChannelDesc returns help text for the SMS verification Provider.
+func (s *SNS) ChannelDesc() string {
+	return fmt.Sprintf(`
+		A %d digit code has been sent as an SMS to your mobile.
+		Enter it here to verify your mobile number.`, maxOTPlen)
+}
+
+// AddressDesc returns help text for the phone number.
+func (s *SNS) AddressDesc() string {
+	return "Please enter your mobile number"
+}
+
+// ValidateAddress "validates" a phone number.
+func (s *SNS) ValidateAddress(to string) error {
+	if !reNum.MatchString(to) {
+		return errors.New("invalid mobile number")
+	}
+	return nil
+}
+
+// Push sends the OTP as an SMS.
+func (s *SNS) Push(ctx context.Context, otp models.OTP, subject string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	_, err := s.c.Publish(ctx, s.makeInput(otp, body))
+	return err
+}
+
+// Check fetches the account's SMS attributes, which is a cheap API call, to
+// verify that the credentials are valid.
+func (s *SNS) Check(ctx context.Context) error {
+	_, err := s.c.GetSMSAttributes(ctx, &sns.GetSMSAttributesInput{})
+	return err
+}
+
+// MaxAddressLen returns the maximum allowed length for the mobile number.
+func (s *SNS) MaxAddressLen() int {
+	return maxAddresslen
+}
+
+// MaxOTPLen returns the maximum allowed length of the OTP value.
+func (s *SNS) MaxOTPLen() int {
+	return maxOTPlen
+}
+
+// MaxBodyLen returns the max permitted body size.
+func (s *SNS) MaxBodyLen() int {
+	return 140
+}
+
+// MaxBodyLenFor returns the max permitted size of a body. SNS picks the
+// encoding of messages, but bodies with characters outside GSM-7 are sent
+// as Unicode, which fits fewer characters.
+func (s *SNS) MaxBodyLenFor(body []byte) int {
+	return gsm.MaxLen(string(body), s.MaxBodyLen())
+}
+
+// UsesSubject returns whether the provider sends a message subject.
+func (s *SNS) UsesSubject() bool {
+	return false
+}
+
+// Validate validates the SMS sender ID.
+func (s *SNS) Validate() error {
+	if id := s.cfg.SMSSenderID; id != "" && !reSenderID.MatchString(id) {
+		return fmt.Errorf("invalid sms_sender_id '%s': should be 1-11 alphanumeric characters", id)
+	}
+	return nil
+}
+
+// makeInput prepares the SNS Publish input for an OTP message.
+func (s *SNS) makeInput(otp models.OTP, body []byte) *sns.PublishInput {
+	attrs := map[string]types.MessageAttributeValue{
+		"AWS.SNS.SMS.SMSType": {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(s.cfg.SMSType),
+		},
+	}
+	if s.cfg.SMSSenderID != "" {
+		attrs["AWS.SNS.SMS.SenderID"] = types.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(s.cfg.SMSSenderID),
+		}
+	}
+
+	return &sns.PublishInput{
+		PhoneNumber:       aws.String(s.sanitizePhone(otp.To, otp.PhoneCode)),
+		Message:           aws.String(string(body)),
+		MessageAttributes: attrs,
+	}
+}
+
+// NormalizeAddress returns a phone number without separators in the
+// international form that it's sent in.
+func (s *SNS) NormalizeAddress(to, phoneCode string) string {
+	return s.sanitizePhone(rePhoneSep.ReplaceAllString(to, ""), phoneCode)
+}
+
+func (s *SNS) sanitizePhone(phone, code string) string {
+	phone = strings.TrimSpace(phone)
+
+	if strings.HasPrefix(phone, "+") {
+		return phone
+	} else if strings.HasPrefix(phone, "00") {
+		return "+" + phone[2:]
+	}
+
+	if code == "" {
+		code = s.cfg.DefaultPhoneCode
+	}
+	return code + phone
+}
@@ -0,0 +1,54 @@
+package sns
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeInput(t *testing.T) {
+	s := &SNS{cfg: Config{SMSType: smsTransactional, SMSSenderID: "OTPGW", DefaultPhoneCode: "+91"}}
+
+	in := s.makeInput(models.OTP{To: "9876543210"}, []byte("123456"))
+	assert.Equal(t, "+919876543210", aws.ToString(in.PhoneNumber), "default phone code not applied")
+	assert.Equal(t, "123456", aws.ToString(in.Message))
+	assert.Equal(t, "Transactional", aws.ToString(in.MessageAttributes["AWS.SNS.SMS.SMSType"].StringValue))
+	assert.Equal(t, "OTPGW", aws.ToString(in.MessageAttributes["AWS.SNS.SMS.SenderID"].StringValue))
+
+	in = s.makeInput(models.OTP{To: "0014155550100"}, nil)
+	assert.Equal(t, "+14155550100", aws.ToString(in.PhoneNumber), "00 prefix not converted")
+
+	// The OTP's phone code overrides the default.
+	in = s.makeInput(models.OTP{To: "4155550100", PhoneCode: "+1"}, nil)
+	assert.Equal(t, "+14155550100", aws.ToString(in.PhoneNumber), "OTP phone code not applied")
+
+	// No sender ID attribute if it's not set.
+	s.cfg.SMSSenderID = ""
+	in = s.makeInput(models.OTP{To: "+14155550100"}, nil)
+	assert.NotContains(t, in.MessageAttributes, "AWS.SNS.SMS.SenderID")
+}
+
+func TestNewValidation(t *testing.T) {
+	_, err := New(Config{AccessKey: "a", SecretKey: "b"})
+	assert.Error(t, err, "missing region not rejected")
+
+	_, err = New(Config{Region: "us-east-1", AccessKey: "a", SecretKey: "b", SMSType: "Bulk"})
+	assert.Error(t, err, "invalid sms_type not rejected")
+}
+
+func TestValidate(t *testing.T) {
+	for id, ok := range map[string]bool{"": true, "OTPGW": true, "OTPGATEWAY1": true, "OTPGATEWAY12": false, "OTP GW": false} {
+		s := &SNS{cfg: Config{SMSSenderID: id}}
+		assert.Equal(t, ok, s.Validate() == nil, "sender ID %q", id)
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	s := &SNS{cfg: Config{DefaultPhoneCode: "+91"}}
+	for _, to := range []string{"+919876543210", "0091 98765 43210", "98765-43210", "(98765) 43210"} {
+		assert.Equal(t, "+919876543210", s.NormalizeAddress(to, ""), "address %q", to)
+	}
+	assert.Equal(t, "+14155550100", s.NormalizeAddress("4155550100", "+1"), "phone code not applied")
+}
@@ -0,0 +1,167 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/knadh/otpgateway/v3/internal/providers/httplog"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+)
+
+const (
+	retryPollInterval = time.Second
+	retryBatchSize    = 100
+)
+
+// errGiveUp is returned by enqueue for posts that aren't retried anymore.
+var errGiveUp = errors.New("giving up")
+
+// retryJob is a failed webhook post in the retry queue.
+type retryJob struct {
+	Payload  Payload `json:"payload"`
+	Attempts int     `json:"attempts"` // Number of retries made.
+	Created  int64   `json:"created"`  // Unix timestamp (ms) of the original post.
+	Expiry   int64   `json:"expiry"`   // Unix timestamp (ms) at which the OTP expires. 0 if unknown.
+}
+
+// StartRetries enables queueing failed posts on q and starts a background
+// worker that retries them until Close is called. It does nothing if retries
+// aren't enabled.
+func (w *Webhook) StartRetries(q models.RetryQueue) {
+	if w.cfg.RetryMaxAttempts < 1 {
+		return
+	}
+	w.queue = q
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.stop = cancel
+	w.stopped = make(chan struct{})
+
+	go func() {
+		defer close(w.stopped)
+
+		t := time.NewTicker(retryPollInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				w.processRetries(ctx, time.Now())
+			}
+		}
+	}()
+}
+
+// Close stops the retry worker and waits for it to finish until ctx is done.
+// Jobs that it had dequeued but not processed are dequeued again after their
+// lease.
+func (w *Webhook) Close(ctx context.Context) error {
+	if w.stop == nil {
+		return nil
+	}
+	w.stop()
+
+	select {
+	case <-w.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// processRetries retries the posts that are due at now.
+func (w *Webhook) processRetries(ctx context.Context, now time.Time) {
+	// The lease is long enough for the whole batch to be posted so that the
+	// jobs aren't picked up again while they're still being retried.
+	lease := w.cfg.Timeout * retryBatchSize
+
+	jobs, err := w.queue.Dequeue(ctx, w.cfg.ID, now, lease, retryBatchSize)
+	if err != nil {
+		w.logError("error fetching webhook retries", err)
+		return
+	}
+
+	for _, b := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		var j retryJob
+		if err := json.Unmarshal(b, &j); err != nil {
+			w.logError("error decoding webhook retry", err)
+			w.ack(ctx, b)
+			continue
+		}
+
+		j.Attempts++
+		pctx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+		err := w.post(pctx, j.Payload)
+		cancel()
+		if err != nil {
+			// The post was interrupted by Close. Leave the job to be
+			// dequeued again after its lease.
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err := w.enqueue(ctx, j, err); err != nil {
+				if !errors.Is(err, errGiveUp) {
+					w.logError("error queueing webhook retry", err, j.Payload.OTP.OTP, j.Payload.OTP.Nonce)
+					continue
+				}
+				w.logError("dropping webhook post", err, j.Payload.OTP.OTP, j.Payload.OTP.Nonce)
+			}
+		}
+
+		// The job is removed only once it's been posted, re-queued, or given
+		// up on. If the process dies before this, it's retried after its lease.
+		w.ack(ctx, b)
+	}
+}
+
+// enqueue queues a failed post to be retried after a backoff. It returns an
+// errGiveUp error if the post has exhausted its retries.
+func (w *Webhook) enqueue(ctx context.Context, j retryJob, postErr error) error {
+	if j.Attempts >= w.cfg.RetryMaxAttempts {
+		return fmt.Errorf("%w after %d retries: %v", errGiveUp, j.Attempts, postErr)
+	}
+
+	// Double the wait on every retry.
+	wait := w.cfg.RetryInterval
+	for i := 0; i < j.Attempts && wait < w.cfg.RetryMaxAge; i++ {
+		wait *= 2
+	}
+
+	next := time.Now().Add(wait)
+	if next.Sub(time.UnixMilli(j.Created)) > w.cfg.RetryMaxAge {
+		return fmt.Errorf("%w after %d retries as the next one exceeds retry_max_age: %v", errGiveUp, j.Attempts, postErr)
+	}
+	if j.Expiry > 0 && next.UnixMilli() >= j.Expiry {
+		return fmt.Errorf("%w after %d retries as the OTP expires before the next one: %v", errGiveUp, j.Attempts, postErr)
+	}
+
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return w.queue.Enqueue(ctx, w.cfg.ID, b, next)
+}
+
+// ack removes a dequeued job from the retry queue.
+func (w *Webhook) ack(ctx context.Context, job []byte) {
+	if err := w.queue.Ack(ctx, w.cfg.ID, job); err != nil {
+		w.logError("error removing webhook retry", err)
+	}
+}
+
+// logError logs an error with the given secrets (eg: the OTP) redacted.
+func (w *Webhook) logError(msg string, err error, secrets ...string) {
+	if w.cfg.Logger != nil {
+		w.cfg.Logger.Error(msg, "provider", w.cfg.ID, "error", httplog.Redact(err.Error(), secrets...))
+	}
+}
@@ -0,0 +1,227 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memQueue is an in-memory Queue.
+type memQueue struct {
+	mu   sync.Mutex
+	jobs []memJob
+}
+
+type memJob struct {
+	job []byte
+	at  time.Time
+}
+
+func (q *memQueue) Enqueue(ctx context.Context, queue string, job []byte, at time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, memJob{job: job, at: at})
+	q.sort()
+	return nil
+}
+
+func (q *memQueue) Dequeue(ctx context.Context, queue string, until time.Time, lease time.Duration, limit int) ([][]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var out [][]byte
+	for i := 0; i < len(q.jobs) && len(out) < limit && !q.jobs[i].at.After(until); i++ {
+		out = append(out, q.jobs[i].job)
+		q.jobs[i].at = until.Add(lease)
+	}
+	q.sort()
+	return out, nil
+}
+
+func (q *memQueue) Ack(ctx context.Context, queue string, job []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, j := range q.jobs {
+		if bytes.Equal(j.job, job) {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (q *memQueue) sort() {
+	sort.SliceStable(q.jobs, func(i, j int) bool { return q.jobs[i].at.Before(q.jobs[j].at) })
+}
+
+func (q *memQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+func TestPushStatus(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	w, err := New(Config{ID: "hook", URL: srv.URL})
+	require.NoError(t, err)
+
+	assert.NoError(t, w.Push(context.Background(), models.OTP{}, "", nil))
+
+	// Non 2xx responses are failures.
+	status = http.StatusInternalServerError
+	assert.Error(t, w.Push(context.Background(), models.OTP{}, "", nil))
+}
+
+func TestRetry(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		posts int
+		fail  = true
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		posts++
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	w, err := New(Config{ID: "hook", URL: srv.URL, RetryMaxAttempts: 2, RetryInterval: time.Second, RetryMaxAge: time.Minute})
+	require.NoError(t, err)
+
+	// Without a queue, failures are returned.
+	assert.Error(t, w.Push(context.Background(), models.OTP{ID: "abc"}, "", nil))
+
+	// With a queue, the failed post is queued.
+	q := &memQueue{}
+	w.queue = q
+	assert.ErrorIs(t, w.Push(context.Background(), models.OTP{ID: "abc"}, "", nil), models.ErrQueued)
+	assert.Equal(t, 1, q.len(), "failed post not queued")
+
+	// Retries aren't picked up before they're due.
+	now := time.Now()
+	w.processRetries(context.Background(), now)
+	assert.Equal(t, 1, q.len(), "retry picked up before backoff")
+
+	// The first retry fails and is queued again with a longer backoff.
+	w.processRetries(context.Background(), now.Add(time.Second*2))
+	assert.Equal(t, 1, q.len(), "failed retry not queued")
+	w.processRetries(context.Background(), now.Add(time.Second*2))
+	assert.Equal(t, 3, posts, "retry attempted before backoff")
+
+	// The second retry is the last one and is dropped on failure.
+	w.processRetries(context.Background(), now.Add(time.Second*5))
+	assert.Equal(t, 4, posts)
+	assert.Equal(t, 0, q.len(), "exhausted retry not dropped")
+
+	// A successful retry is removed from the queue.
+	assert.ErrorIs(t, w.Push(context.Background(), models.OTP{ID: "abc"}, "", nil), models.ErrQueued)
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	w.processRetries(context.Background(), time.Now().Add(time.Second*2))
+	assert.Equal(t, 6, posts)
+	assert.Equal(t, 0, q.len())
+}
+
+func TestRetryLease(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		posts int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		posts++
+		if posts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	w, err := New(Config{ID: "hook", URL: srv.URL, Timeout: time.Second, RetryMaxAttempts: 2, RetryInterval: time.Second, RetryMaxAge: time.Hour})
+	require.NoError(t, err)
+
+	q := &memQueue{}
+	w.queue = q
+	assert.ErrorIs(t, w.Push(context.Background(), models.OTP{ID: "abc"}, "", nil), models.ErrQueued)
+
+	// A job dequeued by a worker that dies before finishing it stays in the
+	// queue and is picked up again once its lease runs out.
+	now := time.Now().Add(time.Second * 2)
+	lease := w.cfg.Timeout * retryBatchSize
+	jobs, err := q.Dequeue(context.Background(), "hook", now, lease, retryBatchSize)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+
+	w.processRetries(context.Background(), now)
+	assert.Equal(t, 1, posts, "leased job retried")
+	assert.Equal(t, 1, q.len(), "leased job removed")
+
+	w.processRetries(context.Background(), now.Add(lease))
+	assert.Equal(t, 2, posts, "job not retried after its lease")
+	assert.Equal(t, 0, q.len(), "posted job not removed")
+}
+
+func TestRetryExpiry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	w, err := New(Config{ID: "hook", URL: srv.URL, RetryMaxAttempts: 5, RetryInterval: time.Second * 10, RetryMaxAge: time.Hour})
+	require.NoError(t, err)
+
+	q := &memQueue{}
+	w.queue = q
+
+	// Posts of OTPs that expire before the first retry aren't queued.
+	err = w.Push(context.Background(), models.OTP{ID: "abc", TTL: time.Second * 5}, "", nil)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, models.ErrQueued)
+	assert.Equal(t, 0, q.len(), "post of an expiring OTP queued")
+
+	// Retries stop once the next one is after the OTP's expiry.
+	assert.ErrorIs(t, w.Push(context.Background(), models.OTP{ID: "abc", TTL: time.Second * 15}, "", nil), models.ErrQueued)
+	assert.Equal(t, 1, q.len(), "failed post not queued")
+
+	w.processRetries(context.Background(), time.Now().Add(time.Second*10))
+	assert.Equal(t, 0, q.len(), "retry queued past the OTP's expiry")
+}
+
+func TestRetryClose(t *testing.T) {
+	w, err := New(Config{ID: "hook", URL: "http://localhost", RetryMaxAttempts: 1})
+	require.NoError(t, err)
+
+	// Close is a no-op without retries and stops the worker with them.
+	assert.NoError(t, w.Close(context.Background()))
+	w.StartRetries(&memQueue{})
+
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, w.Close(context.Background()))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("retry worker didn't stop")
+	}
+}
@@ -0,0 +1,27 @@
+package whatsapp_cloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		cfg Config
+		ok  bool
+	}{
+		{Config{PhoneNumberID: "1234567890", TemplateName: "otp_code"}, true},
+		{Config{PhoneNumberID: "1234567890", TemplateName: "otp_code", TemplateLang: "pt_BR"}, true},
+		{Config{PhoneNumberID: "+1 415 555", TemplateName: "otp_code"}, false},
+		{Config{PhoneNumberID: "1234567890", TemplateName: "OTP Code"}, false},
+		{Config{PhoneNumberID: "1234567890", TemplateName: "otp_code", TemplateLang: "english"}, false},
+	} {
+		c.cfg.AccessToken = "token"
+		w, err := New(c.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, c.ok, w.Validate() == nil, "%+v", c.cfg)
+	}
+}
@@ -2,8 +2,12 @@ package redis
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/knadh/otpgateway/v3/internal/store"
@@ -13,16 +17,284 @@ import (
 
 // Redis implements a Redis Store.
 type Redis struct {
-	client *redis.Client
+	client redis.UniversalClient
 	conf   Conf
+
+	// Optional read replica for reads that can tolerate replication lag.
+	replica redis.UniversalClient
 }
 
+// migrateCounters is a Lua snippet that moves the counters of OTPs set by
+// older versions (attempts, which counted sets too, and generate) to
+// verify_attempts and deliveries. KEYS[1] = OTP key.
+const migrateCounters = `
+	if redis.call("HEXISTS", KEYS[1], "generate") == 1 then
+		local generate = tonumber(redis.call("HGET", KEYS[1], "generate")) or 0
+		local attempts = tonumber(redis.call("HGET", KEYS[1], "attempts")) or 0
+		redis.call("HSETNX", KEYS[1], "deliveries", generate)
+		redis.call("HSETNX", KEYS[1], "verify_attempts", math.max(attempts - generate, 0))
+		redis.call("HDEL", KEYS[1], "attempts", "generate")
+	end
+`
+
+// migrateCountersScript runs migrateCounters before the counters are
+// incremented outside of scripts.
+var migrateCountersScript = redis.NewScript(migrateCounters + `return 1`)
+
 var (
-	ctx = context.Background()
+	// verifyScript atomically checks the attempt limits, increments the
+	// verify_attempts counter, compares the OTP and closes it (recording
+	// the time of verification) if it matches. Repeat verifications of a
+	// closed OTP with the correct OTP within the grace period since it was
+	// verified aren't counted.
+	// KEYS[1] = OTP key, ARGV[1] = OTP value to compare,
+	// ARGV[2] = current time (ms), ARGV[3] = min interval between attempts (ms),
+	// ARGV[4] = last_set the OTP must have to match (0 to skip the check),
+	// ARGV[5] = grace period for repeat verifications (ms, 0 to disable).
+	verifyScript = redis.NewScript(migrateCounters + `
+		if redis.call("HEXISTS", KEYS[1], "otp") == 0 then
+			return -1
+		end
+
+		-- The OTP was replaced after the caller read it.
+		local otp = ARGV[1]
+		if ARGV[4] ~= "0" and redis.call("HGET", KEYS[1], "last_set") ~= ARGV[4] then
+			otp = ""
+		end
+
+		local grace = tonumber(ARGV[5])
+		if grace > 0 and redis.call("HGET", KEYS[1], "closed") == "1" and redis.call("HGET", KEYS[1], "otp") == otp then
+			local verifiedAt = tonumber(redis.call("HGET", KEYS[1], "verified_at")) or 0
+			if tonumber(ARGV[2]) - verifiedAt <= grace then
+				return 4
+			end
+		end
+
+		local now = tonumber(ARGV[2])
+		local interval = tonumber(ARGV[3])
+		if interval > 0 then
+			local last = tonumber(redis.call("HGET", KEYS[1], "last_verify")) or 0
+			if now - last < interval then
+				return 3
+			end
+		end
+		redis.call("HSET", KEYS[1], "last_verify", ARGV[2])
+
+		local attempts = tonumber(redis.call("HGET", KEYS[1], "verify_attempts")) or 0
+		local maxAttempts = tonumber(redis.call("HGET", KEYS[1], "max_attempts")) or 0
+		local deliveries = tonumber(redis.call("HGET", KEYS[1], "deliveries")) or 0
+		local maxGenerate = tonumber(redis.call("HGET", KEYS[1], "max_generate")) or 0
+		if attempts >= maxAttempts or deliveries > maxGenerate then
+			return 2
+		end
+		redis.call("HINCRBY", KEYS[1], "verify_attempts", 1)
+
+		if otp == "" or redis.call("HGET", KEYS[1], "otp") ~= otp then
+			return 0
+		end
+
+		redis.call("HMSET", KEYS[1], "closed", "1", "verified_at", ARGV[2])
+		return 1
+	`)
+)
+
+// consumeNonceScript clears the nonce on an OTP if it matches the given nonce.
+// KEYS[1] = OTP key, ARGV[1] = nonce.
+var consumeNonceScript = redis.NewScript(`
+	if ARGV[1] == "" or redis.call("HGET", KEYS[1], "nonce") ~= ARGV[1] then
+		return 0
+	end
+
+	redis.call("HSET", KEYS[1], "nonce", "")
+	return 1
+`)
+
+// setRefScript maps a reference code to an ID unless it's mapped to
+// another ID. KEYS[1] = ref key, ARGV[1] = ID, ARGV[2] = TTL (ms).
+var setRefScript = redis.NewScript(`
+	local id = redis.call("GET", KEYS[1])
+	if id and id ~= ARGV[1] then
+		return 0
+	end
+
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+`)
+
+// claimSendScript claims a send unless it's already claimed with the same
+// key. KEYS[1] = send key, ARGV[1] = key, ARGV[2] = TTL (ms).
+var claimSendScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return 0
+	end
+
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+`)
+
+// deleteRefScript deletes a reference code if it's mapped to an ID. It's
+// also used to release send claims held with a key.
+// KEYS[1] = ref key, ARGV[1] = ID.
+var deleteRefScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		redis.call("DEL", KEYS[1])
+	end
+	return 1
+`)
+
+// resetAttemptsScript resets the attempts and deliveries counters on an
+// existing OTP.
+// KEYS[1] = OTP key.
+var resetAttemptsScript = redis.NewScript(`
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		return 0
+	end
+
+	redis.call("HMSET", KEYS[1], "verify_attempts", 0, "deliveries", 0, "last_verify", 0)
+	return 1
+`)
+
+// setDeliveredScript marks an existing OTP as delivered.
+// KEYS[1] = OTP key.
+var setDeliveredScript = redis.NewScript(`
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		return 0
+	end
+
+	redis.call("HSET", KEYS[1], "delivered", "1")
+	return 1
+`)
+
+// setNonceScript sets the nonce on an existing OTP.
+// KEYS[1] = OTP key, ARGV[1] = nonce.
+var setNonceScript = redis.NewScript(`
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		return 0
+	end
+
+	redis.call("HSET", KEYS[1], "nonce", ARGV[1])
+	return 1
+`)
+
+// setSentScript records the time of the last successful push on an
+// existing OTP. KEYS[1] = OTP key, ARGV[1] = current time (ms).
+var setSentScript = redis.NewScript(`
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		return 0
+	end
+
+	redis.call("HSET", KEYS[1], "last_sent", ARGV[1])
+	return 1
+`)
+
+// touchScript records the last access time on an existing OTP and
+// optionally extends its expiry. It returns 2 if the expiry was extended.
+// KEYS[1] = OTP key, ARGV[1] = current time (ms), ARGV[2] = min TTL (ms).
+var touchScript = redis.NewScript(`
+	if redis.call("EXISTS", KEYS[1]) == 0 then
+		return 0
+	end
+
+	redis.call("HSET", KEYS[1], "last_accessed", ARGV[1])
+
+	-- The TTL is passed to PEXPIRE as the original argument as Lua numbers
+	-- may be converted to strings in the exponent notation (eg: 3.6e+06),
+	-- which it rejects. gopher-lua (used by miniredis) does so for TTLs of
+	-- an hour and Redis' Lua for very large values.
+	local ttl = tonumber(ARGV[2])
+	if ttl > 0 and redis.call("PTTL", KEYS[1]) < ttl then
+		redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		return 2
+	end
+	return 1
+`)
+
+// expireScript shortens the expiry of an existing OTP to ARGV[1] (ms).
+// KEYS[1] = OTP key.
+var expireScript = redis.NewScript(`
+	local ttl = redis.call("PTTL", KEYS[1])
+	if ttl == -2 then
+		return 0
+	end
+
+	if ttl < 0 or ttl > tonumber(ARGV[1]) then
+		redis.call("PEXPIRE", KEYS[1], ARGV[1])
+	end
+	return 1
+`)
+
+// consumeQuotaScript increments a quota counter if it's below the limit.
+// KEYS[1] = quota key, ARGV[1] = limit, ARGV[2] = TTL (ms).
+var consumeQuotaScript = redis.NewScript(`
+	local n = tonumber(redis.call("GET", KEYS[1]) or "0")
+	if n >= tonumber(ARGV[1]) then
+		return -1
+	end
+
+	n = redis.call("INCR", KEYS[1])
+	if n == 1 then
+		redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	end
+	return n
+`)
+
+// refundQuotaScript decrements a quota counter if it's above 0.
+// KEYS[1] = quota key.
+var refundQuotaScript = redis.NewScript(`
+	local n = tonumber(redis.call("GET", KEYS[1]) or "0")
+	if n > 0 then
+		redis.call("DECR", KEYS[1])
+	end
+	return 1
+`)
+
+// dequeueScript returns up to ARGV[2] jobs from a queue (sorted set) that
+// are due at or before ARGV[1] (unix ms) and reschedules them to ARGV[3]
+// (unix ms) so that they're dequeued again unless they're removed (acked)
+// before then. KEYS[1] = queue key.
+var dequeueScript = redis.NewScript(`
+	local jobs = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+	for _, j in ipairs(jobs) do
+		redis.call("ZADD", KEYS[1], ARGV[3], j)
+	end
+	return jobs
+`)
+
+// Results returned by verifyScript.
+const (
+	verifyNotExist  = -1
+	verifyMismatch  = 0
+	verifyOK        = 1
+	verifyLocked    = 2
+	verifyThrottled = 3
+	verifyRepeat    = 4
+)
+
+// With expiry events, OTPs are removed from the active set when Redis
+// notifies their expiry, which it does lazily, ie, after their expiry. Only
+// entries that have been expired for longer than this are pruned so that
+// expire() still finds them, and those whose expiries weren't handled (eg:
+// when no instance was watching) don't pile up.
+const expiryEventsLag = time.Hour
+
+// Redis deployment modes.
+const (
+	ModeSingle   = "single"
+	ModeSentinel = "sentinel"
+	ModeCluster  = "cluster"
 )
 
 // Conf contains Redis configuration fields.
 type Conf struct {
+	// Mode is one of single (default), sentinel, or cluster.
+	Mode string `json:"mode"`
+
+	// Sentinel mode: the name of the master and the addresses (host:port)
+	// of the sentinels. Cluster mode: the addresses of the cluster nodes.
+	MasterName       string   `json:"master_name"`
+	Addrs            []string `json:"addrs"`
+	SentinelPassword string   `json:"sentinel_password"`
+
 	Host      string        `json:"host"`
 	Port      int           `json:"port"`
 	Username  string        `json:"username"`
@@ -32,50 +304,150 @@ type Conf struct {
 	MaxIdle   int           `json:"max_idle"`
 	Timeout   time.Duration `json:"timeout"`
 	KeyPrefix string        `json:"key_prefix"`
+
+	// Optional segments (eg: ["prod", "otpgateway"]) that are prepended
+	// to KeyPrefix so that multiple deployments can share a Redis instance.
+	KeySegments []string `json:"key_segments"`
+
 	// If this is set, 'check' and 'close' events will be PUBLISHed to
 	// to this Redis key (Redis PubSub).
 	PublishKey string `json:"publish_key"`
+
+	// If set, WatchExpiry() listens to Redis keyspace notifications for
+	// OTPs that expire unverified. Requires notify-keyspace-events to
+	// have "Ex" on the Redis server.
+	ExpiryEvents bool `json:"expiry_events"`
+
+	// Optional read replica that OTP reads without counter increments
+	// (eg: status polls) are served from to offload the primary.
+	Replica ReplicaConf `json:"replica"`
 }
 
-type event struct {
-	Type      string          `json:"type"`
-	Namespace string          `json:"namespace"`
-	ID        string          `json:"id"`
-	Data      json.RawMessage `json:"data"`
+// ReplicaConf contains the config of a read replica. The DB and the
+// timeouts are the same as the primary's.
+type ReplicaConf struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 // New returns a Redis implementation of store.
-func New(c Conf) *Redis {
+func New(c Conf) (*Redis, error) {
 	if c.KeyPrefix == "" {
 		c.KeyPrefix = "OTP"
 	}
+	if len(c.KeySegments) > 0 {
+		segs := append([]string{}, c.KeySegments...)
+		c.KeyPrefix = strings.Join(append(segs, c.KeyPrefix), ":")
+	}
 
-	client := redis.NewClient(&redis.Options{
-		Addr:         fmt.Sprintf("%s:%d", c.Host, c.Port),
-		Username:     c.Username,
-		Password:     c.Password,
-		DB:           c.DB,
-		DialTimeout:  c.Timeout,
-		WriteTimeout: c.Timeout,
-		ReadTimeout:  c.Timeout,
-	})
+	var client redis.UniversalClient
+	switch c.Mode {
+	case "", ModeSingle:
+		client = redis.NewClient(&redis.Options{
+			Addr:         fmt.Sprintf("%s:%d", c.Host, c.Port),
+			Username:     c.Username,
+			Password:     c.Password,
+			DB:           c.DB,
+			DialTimeout:  c.Timeout,
+			WriteTimeout: c.Timeout,
+			ReadTimeout:  c.Timeout,
+		})
 
-	return &Redis{
-		conf:   c,
-		client: client,
+	case ModeSentinel:
+		if c.MasterName == "" || len(c.Addrs) == 0 {
+			return nil, errors.New("master_name and addrs are required in sentinel mode")
+		}
+
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       c.MasterName,
+			SentinelAddrs:    c.Addrs,
+			SentinelPassword: c.SentinelPassword,
+			Username:         c.Username,
+			Password:         c.Password,
+			DB:               c.DB,
+			DialTimeout:      c.Timeout,
+			WriteTimeout:     c.Timeout,
+			ReadTimeout:      c.Timeout,
+		})
+
+	case ModeCluster:
+		if len(c.Addrs) == 0 {
+			return nil, errors.New("addrs are required in cluster mode")
+		}
+
+		// All operations are on single keys, so they work across slots.
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        c.Addrs,
+			Username:     c.Username,
+			Password:     c.Password,
+			DialTimeout:  c.Timeout,
+			WriteTimeout: c.Timeout,
+			ReadTimeout:  c.Timeout,
+		})
+
+	default:
+		return nil, fmt.Errorf("unknown mode '%s'", c.Mode)
 	}
+
+	var replica redis.UniversalClient
+	if c.Replica.Host != "" {
+		if c.Mode == ModeCluster {
+			return nil, errors.New("replica isn't supported in cluster mode")
+		}
+
+		replica = redis.NewClient(&redis.Options{
+			Addr:         fmt.Sprintf("%s:%d", c.Replica.Host, c.Replica.Port),
+			Username:     c.Replica.Username,
+			Password:     c.Replica.Password,
+			DB:           c.DB,
+			DialTimeout:  c.Timeout,
+			WriteTimeout: c.Timeout,
+			ReadTimeout:  c.Timeout,
+		})
+	}
+
+	return &Redis{
+		conf:    c,
+		client:  client,
+		replica: replica,
+	}, nil
 }
 
 // Ping checks if Redis server is reachable
-func (r *Redis) Ping() error {
+func (r *Redis) Ping(ctx context.Context) error {
 	return r.client.Ping(ctx).Err()
 }
 
+// Disconnect closes the connections to the primary and the replica.
+func (r *Redis) Disconnect() error {
+	if r.replica != nil {
+		if err := r.replica.Close(); err != nil {
+			return err
+		}
+	}
+	return r.client.Close()
+}
+
+// Peek retrieves an OTP without incrementing any counters. It's read from
+// the replica, if there's one. If the OTP hasn't been replicated yet, or the
+// replica is unavailable, it's read from the primary.
+func (r *Redis) Peek(ctx context.Context, namespace, id string) (models.OTP, error) {
+	if r.replica != nil {
+		if out, err := r.get(ctx, r.replica, namespace, id); err == nil {
+			return out, nil
+		}
+	}
+	return r.get(ctx, r.client, namespace, id)
+}
+
 // Check checks the attempt count and TTL duration against an ID.
-// Passing counterKey increments the attempt counter.
-func (r *Redis) Check(namespace, id string, counterKey string) (models.OTP, error) {
+// Passing counterKey increments the attempt counter. It always reads
+// from the primary.
+func (r *Redis) Check(ctx context.Context, namespace, id string, counterKey string) (models.OTP, error) {
 	// Retrieve the OTP information.
-	out, err := r.get(namespace, id)
+	out, err := r.get(ctx, r.client, namespace, id)
 	if err != nil {
 		return out, err
 	}
@@ -88,6 +460,7 @@ func (r *Redis) Check(namespace, id string, counterKey string) (models.OTP, erro
 
 	// Increment attempts and get TTL.
 	pipe := r.client.TxPipeline()
+	migrateCountersScript.Eval(ctx, pipe, []string{key})
 	attempts := pipe.HIncrBy(ctx, key, counterKey, 1)
 	ttl := pipe.TTL(ctx, key)
 	_, err = pipe.Exec(ctx)
@@ -97,53 +470,89 @@ func (r *Redis) Check(namespace, id string, counterKey string) (models.OTP, erro
 
 	switch counterKey {
 	case store.CounterAttempts:
-		out.Attempts = int(attempts.Val())
+		out.VerifyAttempts = int(attempts.Val())
 	case store.CounterGenerate:
-		out.Generate = int(attempts.Val())
+		out.Deliveries = int(attempts.Val())
 	default:
 		return out, store.ErrNotExist
 	}
-	// out.Attempts = int(attempts.Val())
+	// out.VerifyAttempts = int(attempts.Val())
 	out.TTL = ttl.Val()
 
 	// If there's a configured PublishKey, publish the event.
-	if r.conf.PublishKey != "" {
-		b, _ := json.Marshal(out)
-		e, _ := json.Marshal(event{
-			Type:      "check",
-			Namespace: namespace,
-			ID:        id,
-			Data:      json.RawMessage(b),
-		})
-		err := r.client.Publish(ctx, r.conf.PublishKey, e).Err()
-		if err != nil {
-			return out, err
-		}
+	if err := r.publish(ctx, "check", namespace, id, out); err != nil {
+		return out, err
 	}
 
 	return out, nil
 }
 
-func (r *Redis) Set(namespace, id string, otp models.OTP) (models.OTP, error) {
+// Verify atomically increments the attempts counter, compares the given
+// otp against the stored OTP and closes it if it matches.
+func (r *Redis) Verify(ctx context.Context, namespace, id, otp string, lastSet int64, minInterval, grace time.Duration) (models.OTP, error) {
+	out := models.OTP{
+		Namespace: namespace,
+		ID:        id,
+	}
+
+	now := time.Now().UnixMilli()
+	res, err := verifyScript.Run(ctx, r.client, []string{r.makeKey(namespace, id)},
+		otp, now, minInterval.Milliseconds(), lastSet, grace.Milliseconds()).Int()
+	if err != nil {
+		return out, err
+	}
+	if res == verifyNotExist {
+		return out, store.ErrNotExist
+	}
+
+	// Retrieve the updated OTP.
+	out, err = r.get(ctx, r.client, namespace, id)
+	if err != nil {
+		return out, err
+	}
+
+	// The attempt was not counted.
+	switch res {
+	case verifyThrottled:
+		out.RetryAfter = minInterval - time.Duration(now-out.LastVerify)*time.Millisecond
+		return out, store.ErrThrottled
+	case verifyRepeat:
+		return out, store.ErrAlreadyVerified
+	}
+
+	if err := r.publish(ctx, "check", namespace, id, out); err != nil {
+		return out, err
+	}
+
+	switch res {
+	case verifyLocked:
+		return out, store.ErrLocked
+	case verifyMismatch:
+		return out, store.ErrMismatch
+	}
+
+	if err := r.client.ZRem(ctx, r.makeActiveKey(namespace), id).Err(); err != nil {
+		return out, err
+	}
+
+	if err := r.publish(ctx, "close", namespace, id, nil); err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
+func (r *Redis) Set(ctx context.Context, namespace, id string, otp models.OTP) (models.OTP, error) {
 	// Set the OTP value.
 	key := r.makeKey(namespace, id)
 	exp := otp.TTL.Milliseconds()
+	now := time.Now().UnixMilli()
 
 	// Create a transaction to execute commands atomically.
 	txf := func(tx *redis.Tx) error {
 		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.HMSet(ctx, key,
-				"otp", otp.OTP,
-				"to", otp.To,
-				"channel_description", otp.ChannelDesc,
-				"address_description", otp.AddressDesc,
-				"extra", string(otp.Extra),
-				"provider", otp.Provider,
-				"closed", false,
-				"max_attempts", otp.MaxAttempts,
-				"max_generate", otp.MaxGenerate)
-
-			pipe.HIncrBy(ctx, key, store.CounterAttempts, 1)
+			pipe.HMSet(ctx, key, otpFields(otp, now)...)
+			migrateCountersScript.Eval(ctx, pipe, []string{key})
 			pipe.HIncrBy(ctx, key, store.CounterGenerate, 1)
 			pipe.PExpire(ctx, key, time.Duration(exp)*time.Millisecond)
 			return nil
@@ -158,19 +567,33 @@ func (r *Redis) Set(namespace, id string, otp models.OTP) (models.OTP, error) {
 		return otp, err
 	}
 
-	// Retrieve the updated attempts count to update the OTP struct.
+	// Prune expired OTPs from the active set as it's added to so that it
+	// doesn't grow unbounded when it isn't counted.
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		akey := r.makeActiveKey(namespace)
+		r.pruneActive(ctx, pipe, akey, now)
+		pipe.ZAdd(ctx, akey, redis.Z{Score: float64(now + exp), Member: id})
+		return nil
+	})
+	if err != nil {
+		return otp, err
+	}
+
+	// Retrieve the updated counters to update the OTP struct. The
+	// verification attempts counter only exists after an attempt.
 	generate, err := r.client.HGet(ctx, key, store.CounterGenerate).Int()
 	if err != nil {
 		return otp, err
 	}
 
 	attempts, err := r.client.HGet(ctx, key, store.CounterAttempts).Int()
-	if err != nil {
+	if err != nil && err != redis.Nil {
 		return otp, err
 	}
 
-	otp.Attempts = attempts
-	otp.Generate = generate
+	otp.VerifyAttempts = attempts
+	otp.Deliveries = generate
+	otp.LastSet = now
 	otp.TTLSeconds = otp.TTL.Seconds()
 	otp.Namespace = namespace
 	otp.ID = id
@@ -178,8 +601,56 @@ func (r *Redis) Set(namespace, id string, otp models.OTP) (models.OTP, error) {
 	return otp, nil
 }
 
+// SetBatch sets multiple OTPs in a single pipeline.
+func (r *Redis) SetBatch(ctx context.Context, namespace string, otps []models.OTP) ([]models.OTP, error) {
+	var (
+		now = time.Now().UnixMilli()
+
+		generate = make([]*redis.IntCmd, len(otps))
+		attempts = make([]*redis.StringCmd, len(otps))
+	)
+
+	// The pipeline isn't transactional as the keys can be on different
+	// nodes in cluster mode.
+	cmds, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		r.pruneActive(ctx, pipe, r.makeActiveKey(namespace), now)
+		for i, otp := range otps {
+			key := r.makeKey(namespace, otp.ID)
+			pipe.HMSet(ctx, key, otpFields(otp, now)...)
+			migrateCountersScript.Eval(ctx, pipe, []string{key})
+			generate[i] = pipe.HIncrBy(ctx, key, store.CounterGenerate, 1)
+			attempts[i] = pipe.HGet(ctx, key, store.CounterAttempts)
+			pipe.PExpire(ctx, key, otp.TTL)
+			pipe.ZAdd(ctx, r.makeActiveKey(namespace), redis.Z{Score: float64(now + otp.TTL.Milliseconds()), Member: otp.ID})
+		}
+		return nil
+	})
+	if err != nil {
+		// The verification attempts counter only exists after an attempt.
+		for _, c := range cmds {
+			if err := c.Err(); err != nil && err != redis.Nil {
+				return nil, err
+			}
+		}
+	}
+
+	out := make([]models.OTP, len(otps))
+	for i, otp := range otps {
+		n, _ := attempts[i].Int()
+
+		otp.VerifyAttempts = n
+		otp.Deliveries = int(generate[i].Val())
+		otp.LastSet = now
+		otp.TTLSeconds = otp.TTL.Seconds()
+		otp.Namespace = namespace
+		out[i] = otp
+	}
+
+	return out, nil
+}
+
 // SetAddress sets (updates) the address on an existing OTP.
-func (r *Redis) SetAddress(namespace, id, address string) error {
+func (r *Redis) SetAddress(ctx context.Context, namespace, id, address string) error {
 	// Set the OTP value.
 	key := r.makeKey(namespace, id)
 
@@ -190,36 +661,507 @@ func (r *Redis) SetAddress(namespace, id, address string) error {
 	return nil
 }
 
+// SetNonce sets a one-time nonce on an existing OTP. It returns ErrNotExist
+// if the OTP doesn't exist (eg: it expired) instead of creating it.
+func (r *Redis) SetNonce(ctx context.Context, namespace, id, nonce string) error {
+	ok, err := setNonceScript.Run(ctx, r.client, []string{r.makeKey(namespace, id)}, nonce).Int()
+	if err != nil {
+		return err
+	}
+	if ok != 1 {
+		return store.ErrNotExist
+	}
+
+	return nil
+}
+
+// ConsumeNonce atomically checks and clears the nonce on an OTP.
+func (r *Redis) ConsumeNonce(ctx context.Context, namespace, id, nonce string) error {
+	ok, err := consumeNonceScript.Run(ctx, r.client, []string{r.makeKey(namespace, id)}, nonce).Int()
+	if err != nil {
+		return err
+	}
+	if ok != 1 {
+		return store.ErrNotExist
+	}
+
+	return nil
+}
+
+// SetDelivered marks an existing OTP as delivered.
+func (r *Redis) SetDelivered(ctx context.Context, namespace, id string) error {
+	ok, err := setDeliveredScript.Run(ctx, r.client, []string{r.makeKey(namespace, id)}).Int()
+	if err != nil {
+		return err
+	}
+	if ok != 1 {
+		return store.ErrNotExist
+	}
+
+	return nil
+}
+
+// SetSent records the time of the last successful push on an existing OTP.
+func (r *Redis) SetSent(ctx context.Context, namespace, id string) error {
+	ok, err := setSentScript.Run(ctx, r.client, []string{r.makeKey(namespace, id)}, time.Now().UnixMilli()).Int()
+	if err != nil {
+		return err
+	}
+	if ok != 1 {
+		return store.ErrNotExist
+	}
+
+	return nil
+}
+
+// Touch records the last access time on an existing OTP and optionally
+// extends its expiry.
+func (r *Redis) Touch(ctx context.Context, namespace, id string, extend time.Duration) error {
+	var (
+		now = time.Now()
+		key = r.makeKey(namespace, id)
+	)
+	res, err := touchScript.Run(ctx, r.client, []string{key}, now.UnixMilli(), extend.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if res == 0 {
+		return store.ErrNotExist
+	}
+	if res != 2 {
+		return nil
+	}
+
+	// Extend the OTP's expiry in the active set and its reference code's too.
+	ref, err := r.client.HGet(ctx, key, "ref").Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAddXX(ctx, r.makeActiveKey(namespace), redis.Z{Score: float64(now.Add(extend).UnixMilli()), Member: id})
+		if ref != "" {
+			setRefScript.Eval(ctx, pipe, []string{r.makeRefKey(namespace, ref)}, id, extend.Milliseconds())
+		}
+		return nil
+	})
+	return err
+}
+
+// Expire sets an existing OTP to expire after ttl if it'd otherwise
+// expire later.
+func (r *Redis) Expire(ctx context.Context, namespace, id string, ttl time.Duration) error {
+	key := r.makeKey(namespace, id)
+	ok, err := expireScript.Run(ctx, r.client, []string{key}, ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if ok != 1 {
+		return store.ErrNotExist
+	}
+
+	// Shorten the expiry of the OTP's reference code too.
+	ref, err := r.client.HGet(ctx, key, "ref").Result()
+	if err == redis.Nil || ref == "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return expireScript.Run(ctx, r.client, []string{r.makeRefKey(namespace, ref)}, ttl.Milliseconds()).Err()
+}
+
+// ResetAttempts resets the attempts counter on an existing OTP.
+func (r *Redis) ResetAttempts(ctx context.Context, namespace, id string) error {
+	ok, err := resetAttemptsScript.Run(ctx, r.client, []string{r.makeKey(namespace, id)}).Int()
+	if err != nil {
+		return err
+	}
+	if ok != 1 {
+		return store.ErrNotExist
+	}
+
+	return nil
+}
+
+// LockAddress locks an address for ttl, or removes the lock if ttl is 0.
+func (r *Redis) LockAddress(ctx context.Context, namespace, address string, ttl time.Duration) error {
+	key := r.makeLockKey(namespace, address)
+	if ttl <= 0 {
+		return r.client.Del(ctx, key).Err()
+	}
+
+	return r.client.SetNX(ctx, key, 1, ttl).Err()
+}
+
+// GetAddressLock returns the remaining duration of the lock on an address.
+func (r *Redis) GetAddressLock(ctx context.Context, namespace, address string) (time.Duration, error) {
+	ttl, err := r.client.PTTL(ctx, r.makeLockKey(namespace, address)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// The key doesn't exist (-2) or has no expiry (-1).
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// ConsumeQuota increments the usage counter of a quota if it's below limit.
+func (r *Redis) ConsumeQuota(ctx context.Context, key, period string, limit int, ttl time.Duration) (int, error) {
+	n, err := consumeQuotaScript.Run(ctx, r.client, []string{r.makeQuotaKey(key, period)},
+		limit, ttl.Milliseconds()).Int()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return limit, store.ErrQuotaExceeded
+	}
+
+	return n, nil
+}
+
+// RefundQuota decrements the usage counter of a quota if it's above 0.
+func (r *Redis) RefundQuota(ctx context.Context, key, period string) error {
+	return refundQuotaScript.Run(ctx, r.client, []string{r.makeQuotaKey(key, period)}).Err()
+}
+
+// GetQuota returns the usage counter of a quota.
+func (r *Redis) GetQuota(ctx context.Context, key, period string) (int, error) {
+	n, err := r.client.Get(ctx, r.makeQuotaKey(key, period)).Int()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// IncrStat increments a namespace's counter of a stat for a day. The
+// counters are kept for two days.
+func (r *Redis) IncrStat(ctx context.Context, namespace, stat, day string) error {
+	key := r.makeStatsKey(namespace, day)
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, key, stat, 1)
+		pipe.Expire(ctx, key, time.Hour*48)
+		return nil
+	})
+	return err
+}
+
+// GetStats returns the number of active OTPs in a namespace and its
+// stat counters for a day.
+func (r *Redis) GetStats(ctx context.Context, namespace, day string) (store.Stats, error) {
+	var (
+		out    store.Stats
+		key    = r.makeActiveKey(namespace)
+		now    = time.Now().UnixMilli()
+		active *redis.IntCmd
+		stats  *redis.MapStringStringCmd
+	)
+
+	// Expired OTPs are pruned from the active set lazily.
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		r.pruneActive(ctx, pipe, key, now)
+		active = countActive(ctx, pipe, key, now)
+		stats = pipe.HGetAll(ctx, r.makeStatsKey(namespace, day))
+		return nil
+	})
+	if err != nil {
+		return out, err
+	}
+
+	if err := stats.Scan(&out); err != nil {
+		return out, err
+	}
+	out.Active = int(active.Val())
+
+	return out, nil
+}
+
+// CountActive returns the number of active OTPs in a namespace from the
+// active set, pruning expired OTPs from it.
+func (r *Redis) CountActive(ctx context.Context, namespace string) (int, error) {
+	var (
+		key    = r.makeActiveKey(namespace)
+		now    = time.Now().UnixMilli()
+		active *redis.IntCmd
+	)
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		r.pruneActive(ctx, pipe, key, now)
+		active = countActive(ctx, pipe, key, now)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(active.Val()), nil
+}
+
+// Enqueue adds a job to the named queue to be dequeued at or after the given time.
+func (r *Redis) Enqueue(ctx context.Context, queue string, job []byte, at time.Time) error {
+	return r.client.ZAdd(ctx, r.makeQueueKey(queue), redis.Z{Score: float64(at.UnixMilli()), Member: job}).Err()
+}
+
+// Dequeue atomically returns up to limit jobs from the named queue that are
+// due at or before the given time and hides them for the lease duration,
+// after which they're dequeued again unless they've been removed with Ack.
+func (r *Redis) Dequeue(ctx context.Context, queue string, until time.Time, lease time.Duration, limit int) ([][]byte, error) {
+	res, err := dequeueScript.Run(ctx, r.client, []string{r.makeQueueKey(queue)}, until.UnixMilli(), limit, until.Add(lease).UnixMilli()).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]byte, len(res))
+	for i, j := range res {
+		out[i] = []byte(j)
+	}
+	return out, nil
+}
+
+// Ack removes a dequeued job from the named queue.
+func (r *Redis) Ack(ctx context.Context, queue string, job []byte) error {
+	return r.client.ZRem(ctx, r.makeQueueKey(queue), job).Err()
+}
+
 // Close closes an OTP and marks it as done (verified).
 // After this, the OTP has to expire after a TTL or be deleted.
-func (r *Redis) Close(namespace, id string) error {
+func (r *Redis) Close(ctx context.Context, namespace, id string) error {
 	// Set the OTP as closed.
-	if err := r.client.HSet(ctx, r.makeKey(namespace, id), "closed", true).Err(); err != nil {
+	if err := r.client.HMSet(ctx, r.makeKey(namespace, id), "closed", true, "verified_at", time.Now().UnixMilli()).Err(); err != nil {
+		return err
+	}
+	if err := r.client.ZRem(ctx, r.makeActiveKey(namespace), id).Err(); err != nil {
 		return err
 	}
 
 	// Publish?
-	if r.conf.PublishKey != "" {
-		e, _ := json.Marshal(event{
-			Type:      "close",
-			Namespace: namespace,
-			ID:        id,
-			Data:      json.RawMessage([]byte(`null`)),
-		})
-		if err := r.client.Publish(ctx, r.conf.PublishKey, e).Err(); err != nil {
-			return err
-		}
+	if err := r.publish(ctx, "close", namespace, id, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetRef maps a reference code to an OTP's ID in a namespace for ttl.
+func (r *Redis) SetRef(ctx context.Context, namespace, ref, id string, ttl time.Duration) error {
+	ok, err := setRefScript.Run(ctx, r.client, []string{r.makeRefKey(namespace, ref)}, id, ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return store.ErrRefExists
 	}
+	return nil
+}
 
+// GetRef returns the ID of the OTP a reference code is mapped to.
+func (r *Redis) GetRef(ctx context.Context, namespace, ref string) (string, error) {
+	id, err := r.client.Get(ctx, r.makeRefKey(namespace, ref)).Result()
+	if err == redis.Nil {
+		return "", store.ErrNotExist
+	}
+	return id, err
+}
+
+// DeleteRef removes a reference code if it's mapped to the given ID.
+func (r *Redis) DeleteRef(ctx context.Context, namespace, ref, id string) error {
+	return deleteRefScript.Run(ctx, r.client, []string{r.makeRefKey(namespace, ref)}, id).Err()
+}
+
+// ClaimSend atomically claims the send of an OTP for ttl unless it's already
+// claimed with the same key.
+func (r *Redis) ClaimSend(ctx context.Context, namespace, id, key string, ttl time.Duration) error {
+	ok, err := claimSendScript.Run(ctx, r.client, []string{r.makeSendKey(namespace, id)}, key, ttl.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return store.ErrSendClaimed
+	}
 	return nil
 }
 
+// ReleaseSend removes a send claim if it's held with the given key.
+func (r *Redis) ReleaseSend(ctx context.Context, namespace, id, key string) error {
+	return deleteRefScript.Run(ctx, r.client, []string{r.makeSendKey(namespace, id)}, key).Err()
+}
+
 // Delete deletes the OTP saved against a given ID.
-func (r *Redis) Delete(namespace, id string) error {
+func (r *Redis) Delete(ctx context.Context, namespace, id string) error {
 	if err := r.client.Del(ctx, r.makeKey(namespace, id)).Err(); err != nil {
 		return err
 	}
-	return nil
+	return r.client.ZRem(ctx, r.makeActiveKey(namespace), id).Err()
+}
+
+// WatchExpiry subscribes to Redis keyspace notifications of expired keys
+// until ctx is cancelled. For every OTP that expires unverified, an 'expired'
+// event is PUBLISHed to PublishKey (if it's set) and cb is called. If
+// multiple instances are watching, only one of them handles an expiry.
+// Errors handling an expiry are passed to errCb and don't stop the watch.
+func (r *Redis) WatchExpiry(ctx context.Context, cb func(namespace, id string), errCb func(error)) error {
+	if r.conf.Mode == ModeCluster {
+		return errors.New("expiry events aren't supported in cluster mode")
+	}
+
+	ps := r.client.Subscribe(ctx, fmt.Sprintf("__keyevent@%d__:expired", r.conf.DB))
+	defer ps.Close()
+
+	// Wait for the subscription to be confirmed.
+	if _, err := ps.Receive(ctx); err != nil {
+		return err
+	}
+
+	ch := ps.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			namespace, id, ok, err := r.expire(ctx, m.Payload)
+			if err != nil {
+				if errCb != nil {
+					errCb(err)
+				}
+				continue
+			}
+			if ok && cb != nil {
+				cb(namespace, id)
+			}
+		}
+	}
+}
+
+// WatchEvents subscribes to the events PUBLISHed to PublishKey (by any
+// instance) and calls cb for every event until ctx is cancelled.
+func (r *Redis) WatchEvents(ctx context.Context, cb func(store.Event)) error {
+	if r.conf.PublishKey == "" {
+		return errors.New("publish_key isn't set")
+	}
+
+	ps := r.client.Subscribe(ctx, r.conf.PublishKey)
+	defer ps.Close()
+
+	if _, err := ps.Receive(ctx); err != nil {
+		return err
+	}
+
+	ch := ps.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			var e store.Event
+			if err := json.Unmarshal([]byte(m.Payload), &e); err != nil {
+				continue
+			}
+			cb(e)
+		}
+	}
+}
+
+// pruneActive removes the OTPs that have expired by now from the active set
+// key. With expiry events, only those that expired expiryEventsLag ago are.
+func (r *Redis) pruneActive(ctx context.Context, pipe redis.Pipeliner, key string, now int64) {
+	if r.conf.ExpiryEvents {
+		now -= expiryEventsLag.Milliseconds()
+	}
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now, 10))
+}
+
+// countActive counts the OTPs in the active set key that haven't expired by
+// now, which includes ones whose expiries are yet to be notified.
+func countActive(ctx context.Context, pipe redis.Pipeliner, key string, now int64) *redis.IntCmd {
+	return pipe.ZCount(ctx, key, "("+strconv.FormatInt(now, 10), "+inf")
+}
+
+// expire handles the expiry of a key. If it's an OTP that's still in its
+// namespace's active set, ie: it wasn't verified or deleted, it's removed
+// from the set and an 'expired' event is published.
+func (r *Redis) expire(ctx context.Context, key string) (string, string, bool, error) {
+	rest, ok := strings.CutPrefix(key, r.conf.KeyPrefix+":")
+	if !ok {
+		return "", "", false, nil
+	}
+
+	namespace, id, ok := strings.Cut(rest, ":")
+	if !ok || reservedKeys[namespace] {
+		return "", "", false, nil
+	}
+
+	n, err := r.client.ZRem(ctx, r.makeActiveKey(namespace), id).Result()
+	if err != nil || n == 0 {
+		return "", "", false, err
+	}
+
+	if err := r.publish(ctx, "expired", namespace, id, nil); err != nil {
+		return "", "", false, err
+	}
+
+	return namespace, id, true, nil
+}
+
+// publish PUBLISHes an event to the configured PublishKey, if there's one.
+func (r *Redis) publish(ctx context.Context, typ, namespace, id string, data interface{}) error {
+	if r.conf.PublishKey == "" {
+		return nil
+	}
+
+	b, _ := json.Marshal(data)
+	e, _ := json.Marshal(store.Event{
+		Type:      typ,
+		Namespace: namespace,
+		ID:        id,
+		Data:      json.RawMessage(b),
+	})
+	return r.client.Publish(ctx, r.conf.PublishKey, e).Err()
+}
+
+// otpFields returns the hash fields of a newly set OTP.
+func otpFields(otp models.OTP, now int64) []interface{} {
+	return []interface{}{
+		"otp", otp.OTP,
+		"to", otp.To,
+		"channel_description", otp.ChannelDesc,
+		"address_description", otp.AddressDesc,
+		"extra", string(otp.Extra),
+		"provider", otp.Provider,
+		"channel", otp.Channel,
+		"view_url", otp.ViewURL,
+		"ref", otp.Ref,
+		"closed", false,
+		"delivered", false,
+		"verified_at", 0,
+		"case_insensitive", otp.CaseInsens,
+		"last_verify", 0,
+		"nonce", "",
+		"last_set", now,
+		"last_sent", 0,
+		"max_attempts", otp.MaxAttempts,
+		"max_generate", otp.MaxGenerate,
+	}
+}
+
+// reservedKeys are the segments after KeyPrefix of keys that aren't OTPs.
+var reservedKeys = map[string]bool{
+	"lock":   true,
+	"quota":  true,
+	"active": true,
+	"stats":  true,
+	"queue":  true,
+	"ref":    true,
 }
 
 // makeKey makes the Redis key for the OTP.
@@ -227,8 +1169,43 @@ func (r *Redis) makeKey(namespace, id string) string {
 	return fmt.Sprintf("%s:%s:%s", r.conf.KeyPrefix, namespace, id)
 }
 
-// get retrieves the OTP information from Redis based on the namespace and ID.
-func (r *Redis) get(namespace, id string) (models.OTP, error) {
+// makeLockKey makes the Redis key for an address lock. The address is
+// hashed so that it isn't stored in the clear.
+func (r *Redis) makeLockKey(namespace, address string) string {
+	return fmt.Sprintf("%s:lock:%s:%x", r.conf.KeyPrefix, namespace, sha256.Sum256([]byte(address)))
+}
+
+func (r *Redis) makeQuotaKey(key, period string) string {
+	return fmt.Sprintf("%s:quota:%s:%s", r.conf.KeyPrefix, key, period)
+}
+
+// makeActiveKey makes the Redis key for the set of a namespace's active
+// OTP IDs scored by their expiry.
+func (r *Redis) makeActiveKey(namespace string) string {
+	return fmt.Sprintf("%s:active:%s", r.conf.KeyPrefix, namespace)
+}
+
+// makeRefKey makes the Redis key that maps a reference code to an OTP ID.
+func (r *Redis) makeRefKey(namespace, ref string) string {
+	return fmt.Sprintf("%s:ref:%s:%s", r.conf.KeyPrefix, namespace, ref)
+}
+
+// makeSendKey makes the Redis key for the send claim of an OTP.
+func (r *Redis) makeSendKey(namespace, id string) string {
+	return fmt.Sprintf("%s:sending:%s:%s", r.conf.KeyPrefix, namespace, id)
+}
+
+func (r *Redis) makeStatsKey(namespace, day string) string {
+	return fmt.Sprintf("%s:stats:%s:%s", r.conf.KeyPrefix, namespace, day)
+}
+
+func (r *Redis) makeQueueKey(queue string) string {
+	return fmt.Sprintf("%s:queue:%s", r.conf.KeyPrefix, queue)
+}
+
+// get retrieves the OTP information from Redis (the primary or the replica)
+// based on the namespace and ID.
+func (r *Redis) get(ctx context.Context, c redis.UniversalClient, namespace, id string) (models.OTP, error) {
 	key := r.makeKey(namespace, id)
 	out := models.OTP{
 		Namespace: namespace,
@@ -236,7 +1213,8 @@ func (r *Redis) get(namespace, id string) (models.OTP, error) {
 	}
 
 	// Retrieve all fields of the hash.
-	if err := r.client.HGetAll(ctx, key).Scan(&out); err != nil {
+	res := c.HGetAll(ctx, key)
+	if err := res.Scan(&out); err != nil {
 		return out, err
 	}
 
@@ -245,8 +1223,22 @@ func (r *Redis) get(namespace, id string) (models.OTP, error) {
 		return out, store.ErrNotExist
 	}
 
+	// OTPs set by older versions that haven't been migrated (migrateCounters)
+	// have the counters under their old names.
+	var old struct {
+		Attempts int `redis:"attempts"`
+		Generate int `redis:"generate"`
+	}
+	if err := res.Scan(&old); err != nil {
+		return out, err
+	}
+	if old.Generate > 0 && out.Deliveries == 0 {
+		out.Deliveries = old.Generate
+		out.VerifyAttempts = max(old.Attempts-old.Generate, 0)
+	}
+
 	// Retrieve TTL.
-	ttl, err := r.client.TTL(ctx, key).Result()
+	ttl, err := c.TTL(ctx, key).Result()
 	if err != nil {
 		return out, err
 	}
@@ -1,19 +1,25 @@
 package redis
 
 import (
+	"context"
 	"log"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis"
 	"github.com/knadh/otpgateway/v3/internal/store"
+	"github.com/knadh/otpgateway/v3/internal/store/storetest"
 	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 var (
+	ctx = context.Background()
+
 	rStore  *Redis
 	rdis    *miniredis.Miniredis
 	mockOTP = models.OTP{
@@ -21,6 +27,7 @@ var (
 		ID:          "myotpid",
 		OTP:         "myotp",
 		MaxAttempts: 3,
+		MaxGenerate: 3,
 		ChannelDesc: "channeldesc",
 		AddressDesc: "addressdesc",
 		Provider:    "smtp",
@@ -38,15 +45,128 @@ func init() {
 	rdis = rd
 
 	port, _ := strconv.Atoi(rd.Port())
-	rStore = New(Conf{
+	rStore, err = New(Conf{
 		Host: rd.Host(),
 		Port: port,
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestNewModes(t *testing.T) {
+	r, err := New(Conf{Mode: ModeSentinel, MasterName: "mymaster", Addrs: []string{"localhost:26379"}})
+	require.NoError(t, err)
+	assert.IsType(t, &redis.Client{}, r.client, "sentinel mode should use a failover client")
+
+	r, err = New(Conf{Mode: ModeCluster, Addrs: []string{"localhost:7000", "localhost:7001"}})
+	require.NoError(t, err)
+	assert.IsType(t, &redis.ClusterClient{}, r.client, "cluster mode should use a cluster client")
+
+	_, err = New(Conf{Mode: ModeSentinel})
+	assert.Error(t, err, "sentinel mode without master_name should fail")
+
+	_, err = New(Conf{Mode: ModeCluster})
+	assert.Error(t, err, "cluster mode without addrs should fail")
+
+	_, err = New(Conf{Mode: "unknown"})
+	assert.Error(t, err, "unknown mode should fail")
+}
+
+func TestKeySegments(t *testing.T) {
+	rdis.FlushDB()
+	t.Cleanup(func() {
+		rdis.FlushDB()
+	})
+
+	port, _ := strconv.Atoi(rdis.Port())
+	r, err := New(Conf{
+		Host:        rdis.Host(),
+		Port:        port,
+		KeySegments: []string{"prod", "otpgateway"},
+	})
+	require.NoError(t, err)
+
+	_, err = r.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
+	require.NoError(t, err)
+	assert.True(t, rdis.Exists("prod:otpgateway:OTP:mynamespace:myotpid"), "key not segmented")
+
+	_, err = r.ConsumeQuota(ctx, "smtp", "2024-01-01", 10, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, rdis.Exists("prod:otpgateway:OTP:quota:smtp:2024-01-01"), "quota key not segmented")
+
+	// The default store doesn't see the OTP.
+	_, err = rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assert.Equal(t, store.ErrNotExist, err)
+}
+
+func TestReplica(t *testing.T) {
+	setup(t)
+
+	rep, err := miniredis.Run()
+	require.NoError(t, err)
+	defer rep.Close()
+
+	var (
+		port, _    = strconv.Atoi(rdis.Port())
+		repPort, _ = strconv.Atoi(rep.Port())
+	)
+	r, err := New(Conf{
+		Host:    rdis.Host(),
+		Port:    port,
+		Replica: ReplicaConf{Host: rep.Host(), Port: repPort},
+	})
+	require.NoError(t, err)
+
+	// Not replicated yet. Reads fall back to the primary.
+	o, err := r.Peek(ctx, mockOTP.Namespace, mockOTP.ID)
+	require.NoError(t, err)
+	assert.Equal(t, mockOTP.OTP, o.OTP)
+
+	// Replicate a copy of the OTP, which then lags behind the primary.
+	rs, err := New(Conf{Host: rep.Host(), Port: repPort})
+	require.NoError(t, err)
+	_, err = rs.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
+	require.NoError(t, err)
+	require.NoError(t, r.Close(ctx, mockOTP.Namespace, mockOTP.ID))
+
+	o, err = r.Peek(ctx, mockOTP.Namespace, mockOTP.ID)
+	require.NoError(t, err)
+	assert.False(t, o.Closed, "read wasn't served from the replica")
+
+	// Checks, even without increments, go to the primary.
+	o, err = r.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.True(t, o.Closed, "check was served from the replica")
+
+	// Increments and writes go to the primary.
+	o, err = r.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterAttempts)
+	require.NoError(t, err)
+	assert.True(t, o.Closed, "increment was served from the replica")
+	assert.Equal(t, 1, o.VerifyAttempts)
+	o, err = rs.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, o.VerifyAttempts, "replica was written to")
+
+	// An unavailable replica falls back to the primary.
+	rep.Close()
+	o, err = r.Peek(ctx, mockOTP.Namespace, mockOTP.ID)
+	require.NoError(t, err)
+	assert.True(t, o.Closed)
+
+	// Disconnecting closes both clients.
+	require.NoError(t, r.Disconnect())
+	assert.Error(t, r.Ping(ctx), "primary client not closed")
+	assert.Error(t, r.replica.Ping(ctx).Err(), "replica client not closed")
+	require.NoError(t, rs.Disconnect())
+
+	_, err = New(Conf{Mode: ModeCluster, Addrs: []string{"localhost:7000"}, Replica: ReplicaConf{Host: "localhost", Port: 6380}})
+	assert.Error(t, err, "replica in cluster mode should fail")
 }
 
 func setup(t *testing.T) *Redis {
 	rdis.FlushDB()
-	_, err := rStore.Set(mockOTP.Namespace, mockOTP.ID, mockOTP)
+	_, err := rStore.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
 	require.NoError(t, err, "Failed to set up test OTP")
 
 	t.Cleanup(func() {
@@ -56,53 +176,147 @@ func setup(t *testing.T) *Redis {
 	return rStore
 }
 
+func TestStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		rdis.FlushDB()
+		t.Cleanup(func() { rdis.FlushDB() })
+		return rStore
+	})
+}
+
 func TestStoreSet(t *testing.T) {
 	rStore := setup(t)
 
-	resp, err := rStore.Set(mockOTP.Namespace, mockOTP.ID, mockOTP)
+	resp, err := rStore.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
 	assert.NoError(t, err, "Error setting OTP")
 
 	cmp := mockOTP
 	// Override dynamic values.
-	cmp.Attempts = resp.Attempts
-	cmp.Generate = resp.Generate
+	cmp.VerifyAttempts = resp.VerifyAttempts
+	cmp.Deliveries = resp.Deliveries
 	cmp.TTL = resp.TTL
 	cmp.TTLSeconds = resp.TTLSeconds
+	cmp.LastSet = resp.LastSet
 	assert.Equal(t, cmp, resp, "Returned OTP doesn't match expected OTP")
+	assert.NotZero(t, resp.LastSet, "last set time not recorded")
+}
+
+func TestStoreSetBatch(t *testing.T) {
+	rStore := setup(t)
+
+	o1, o2 := mockOTP, mockOTP
+	o2.ID = "myotpid2"
+	o2.OTP = "myotp2"
+
+	out, err := rStore.SetBatch(ctx, mockOTP.Namespace, []models.OTP{o1, o2})
+	assert.NoError(t, err, "Error setting OTP batch")
+	if !assert.Len(t, out, 2) {
+		return
+	}
+
+	// The existing OTP's counter is incremented.
+	assert.Equal(t, 2, out[0].Deliveries, "Deliveries mismatch")
+	assert.Equal(t, 1, out[1].Deliveries, "Deliveries mismatch")
+	assert.NotZero(t, out[1].LastSet, "last set time not recorded")
+
+	o, err := rStore.Check(ctx, mockOTP.Namespace, o2.ID, store.CounterNil)
+	assert.NoError(t, err, "Batch OTP wasn't set")
+	assert.Equal(t, o2.OTP, o.OTP, "OTP mismatch")
+	assert.Equal(t, o2.TTL, o.TTL, "TTL mismatch")
+}
+
+func TestStoreSetPrunesActive(t *testing.T) {
+	rStore := setup(t)
+
+	// Expired OTPs are pruned from the active set on Set and SetBatch.
+	key := rStore.makeActiveKey(mockOTP.Namespace)
+	stale := func() {
+		assert.NoError(t, rStore.client.ZAdd(ctx, key, redis.Z{Score: float64(time.Now().Add(-time.Minute).UnixMilli()), Member: "stale"}).Err())
+	}
+
+	stale()
+	_, err := rStore.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
+	assert.NoError(t, err)
+	assert.Equal(t, redis.Nil, rStore.client.ZScore(ctx, key, "stale").Err(), "expired OTP not pruned on Set")
+
+	stale()
+	_, err = rStore.SetBatch(ctx, mockOTP.Namespace, []models.OTP{mockOTP})
+	assert.NoError(t, err)
+	assert.Equal(t, redis.Nil, rStore.client.ZScore(ctx, key, "stale").Err(), "expired OTP not pruned on SetBatch")
+
+	n, err := rStore.client.ZCard(ctx, key).Result()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n, "active OTP pruned")
 }
 
 func TestStoreCheck(t *testing.T) {
 	rStore := setup(t)
 
 	t.Run("no increment", func(t *testing.T) {
-		o, err := rStore.Check(mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+		o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
 		assert.NoError(t, err, "Error checking OTP without increment")
-		assert.Equal(t, 1, o.Attempts, "Unexpected attempt count")
+		assert.Equal(t, 0, o.VerifyAttempts, "Unexpected attempt count")
 	})
 
 	t.Run("with increment", func(t *testing.T) {
-		o, err := rStore.Check(mockOTP.Namespace, mockOTP.ID, store.CounterAttempts)
+		o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterAttempts)
 		assert.NoError(t, err, "Error checking OTP with increment")
-		assert.Equal(t, 2, o.Attempts, "Unexpected attempt count after first increment")
+		assert.Equal(t, 1, o.VerifyAttempts, "Unexpected attempt count after first increment")
 
-		o, err = rStore.Check(mockOTP.Namespace, mockOTP.ID, store.CounterAttempts)
+		o, err = rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterAttempts)
 		assert.NoError(t, err, "Error checking OTP with second increment")
-		assert.Equal(t, 3, o.Attempts, "Unexpected attempt count after second increment")
+		assert.Equal(t, 2, o.VerifyAttempts, "Unexpected attempt count after second increment")
 
-		o, err = rStore.Check(mockOTP.Namespace, mockOTP.ID, store.CounterGenerate)
+		o, err = rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterGenerate)
 		assert.NoError(t, err, "Error checking generate OTP with increment")
-		assert.Equal(t, 2, o.Generate, "Unexpected generate count after first increment")
+		assert.Equal(t, 2, o.Deliveries, "Unexpected generate count after first increment")
 
-		o, err = rStore.Check(mockOTP.Namespace, mockOTP.ID, store.CounterGenerate)
+		o, err = rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterGenerate)
 		assert.NoError(t, err, "Error checking generate OTP with second increment")
-		assert.Equal(t, 3, o.Generate, "Unexpected generate count after second increment")
+		assert.Equal(t, 3, o.Deliveries, "Unexpected generate count after second increment")
 	})
 }
 
+func TestStoreLegacyCounters(t *testing.T) {
+	rStore := setup(t)
+
+	// An OTP set by an older version with 2 sets and 1 verification attempt.
+	legacy := func() {
+		key := rStore.makeKey(mockOTP.Namespace, mockOTP.ID)
+		rdis.HDel(key, "verify_attempts")
+		rdis.HDel(key, "deliveries")
+		rdis.HSet(key, "attempts", "3")
+		rdis.HSet(key, "generate", "2")
+	}
+
+	legacy()
+	o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err, "Error checking OTP")
+	assert.Equal(t, 1, o.VerifyAttempts, "Unexpected attempt count")
+	assert.Equal(t, 2, o.Deliveries, "Unexpected deliveries count")
+
+	o, err = rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, 0, 0)
+	assert.Equal(t, store.ErrMismatch, err)
+	assert.Equal(t, 2, o.VerifyAttempts, "Unexpected attempt count")
+	assert.Equal(t, 2, o.Deliveries, "Unexpected deliveries count")
+
+	legacy()
+	o, err = rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterGenerate)
+	require.NoError(t, err, "Error checking OTP")
+	assert.Equal(t, 3, o.Deliveries, "Unexpected deliveries count")
+
+	legacy()
+	o, err = rStore.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
+	require.NoError(t, err, "Error setting OTP")
+	assert.Equal(t, 1, o.VerifyAttempts, "Unexpected attempt count")
+	assert.Equal(t, 3, o.Deliveries, "Unexpected deliveries count")
+	assert.Empty(t, rdis.HGet(rStore.makeKey(mockOTP.Namespace, mockOTP.ID), "generate"), "Old counter wasn't removed")
+}
+
 func TestStoreTTL(t *testing.T) {
 	rStore := setup(t)
 
-	o, err := rStore.Check(mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
 	assert.NoError(t, err, "Error checking OTP")
 	assert.Equal(t, mockOTP.TTL, o.TTL, "Returned OTP TTL doesn't match expected TTL")
 }
@@ -110,20 +324,440 @@ func TestStoreTTL(t *testing.T) {
 func TestStoreClose(t *testing.T) {
 	rStore := setup(t)
 
-	err := rStore.Close(mockOTP.Namespace, mockOTP.ID)
+	err := rStore.Close(ctx, mockOTP.Namespace, mockOTP.ID)
 	assert.NoError(t, err, "Error closing OTP")
 
-	o, err := rStore.Check(mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
 	assert.NoError(t, err, "Error checking closed OTP")
 	assert.True(t, o.Closed, "OTP should be closed but isn't")
+	assert.NotZero(t, o.VerifiedAt, "verified_at should be set on close")
 }
 
 func TestStoreDelete(t *testing.T) {
 	rStore := setup(t)
 
-	err := rStore.Delete(mockOTP.Namespace, mockOTP.ID)
+	err := rStore.Delete(ctx, mockOTP.Namespace, mockOTP.ID)
 	assert.NoError(t, err, "Error deleting OTP")
 
-	_, err = rStore.Check(mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	_, err = rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
 	assert.Equal(t, store.ErrNotExist, err, "OTP should not exist but it does")
 }
+
+func TestStoreVerify(t *testing.T) {
+	rStore := setup(t)
+
+	o, err := rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, 0, 0)
+	assert.Equal(t, store.ErrMismatch, err, "Bad OTP didn't fail verification")
+	assert.Equal(t, 1, o.VerifyAttempts, "Unexpected attempt count")
+	assert.False(t, o.Closed, "OTP shouldn't be closed")
+	assert.Zero(t, o.VerifiedAt, "verified_at shouldn't be set")
+
+	o, err = rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, 0, 0)
+	assert.NoError(t, err, "Error verifying OTP")
+	assert.True(t, o.Closed, "OTP should be closed but isn't")
+	assert.NotZero(t, o.VerifiedAt, "verified_at should be set on verification")
+
+	_, err = rStore.Verify(ctx, mockOTP.Namespace, "unknown", mockOTP.OTP, 0, 0, 0)
+	assert.Equal(t, store.ErrNotExist, err, "OTP should not exist but it does")
+}
+
+func TestStoreVerifyConcurrent(t *testing.T) {
+	rStore := setup(t)
+
+	const n = 20
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+
+		errs = map[error]int{}
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, 0, 0)
+
+			mu.Lock()
+			errs[err]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Only MaxAttempts verifications should've been evaluated and the
+	// rest locked without being counted.
+	assert.Equal(t, mockOTP.MaxAttempts, errs[store.ErrMismatch], "Unexpected mismatch count")
+	assert.Equal(t, n-mockOTP.MaxAttempts, errs[store.ErrLocked], "Unexpected locked count")
+
+	o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assert.NoError(t, err, "Error checking OTP")
+	assert.Equal(t, mockOTP.MaxAttempts, o.VerifyAttempts, "Attempts weren't incremented atomically")
+	assert.False(t, o.Closed, "OTP shouldn't be closed")
+}
+
+func TestStoreVerifyThrottle(t *testing.T) {
+	rStore := setup(t)
+
+	_, err := rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, time.Minute, 0)
+	assert.Equal(t, store.ErrMismatch, err, "First attempt shouldn't be throttled")
+
+	o, err := rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, time.Minute, 0)
+	assert.Equal(t, store.ErrThrottled, err, "Second attempt should be throttled")
+	assert.Equal(t, 1, o.VerifyAttempts, "Throttled attempt shouldn't be counted")
+	assert.False(t, o.Closed, "OTP shouldn't be closed")
+}
+
+func TestStoreResetAttempts(t *testing.T) {
+	rStore := setup(t)
+
+	err := rStore.ResetAttempts(ctx, mockOTP.Namespace, "unknown")
+	assert.Equal(t, store.ErrNotExist, err, "Non-existent OTP was reset")
+	assert.False(t, rdis.Exists(rStore.makeKey(mockOTP.Namespace, "unknown")), "Reset created a key")
+
+	_, err = rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, 0, 0)
+	assert.Equal(t, store.ErrMismatch, err)
+
+	err = rStore.ResetAttempts(ctx, mockOTP.Namespace, mockOTP.ID)
+	assert.NoError(t, err, "Error resetting attempts")
+
+	o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, o.VerifyAttempts, "Attempts weren't reset")
+	assert.Equal(t, mockOTP.OTP, o.OTP, "OTP changed on reset")
+}
+
+func TestStoreSetDelivered(t *testing.T) {
+	rStore := setup(t)
+
+	err := rStore.SetDelivered(ctx, mockOTP.Namespace, "unknown")
+	assert.Equal(t, store.ErrNotExist, err, "Non-existent OTP was marked delivered")
+	assert.False(t, rdis.Exists(rStore.makeKey(mockOTP.Namespace, "unknown")), "SetDelivered created a key")
+
+	err = rStore.SetDelivered(ctx, mockOTP.Namespace, mockOTP.ID)
+	assert.NoError(t, err, "Error marking OTP delivered")
+
+	o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.True(t, o.Delivered, "OTP wasn't marked delivered")
+
+	// Resending resets the flag.
+	_, err = rStore.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
+	assert.NoError(t, err)
+	o, err = rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.False(t, o.Delivered, "Delivered flag wasn't reset on Set")
+}
+
+func TestStoreTouch(t *testing.T) {
+	rStore := setup(t)
+
+	err := rStore.Touch(ctx, mockOTP.Namespace, "unknown", 0)
+	assert.Equal(t, store.ErrNotExist, err, "Non-existent OTP was touched")
+	assert.False(t, rdis.Exists(rStore.makeKey(mockOTP.Namespace, "unknown")), "Touch created a key")
+
+	err = rStore.Touch(ctx, mockOTP.Namespace, mockOTP.ID, 0)
+	assert.NoError(t, err, "Error touching OTP")
+
+	o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assert.NoError(t, err)
+	assert.NotZero(t, o.LastAccessed, "last access time not recorded")
+	assert.Equal(t, 0, o.VerifyAttempts, "Touch incremented attempts")
+	assert.Equal(t, mockOTP.TTL, o.TTL, "Touch changed the TTL")
+
+	// Sliding expiry extends, but never shortens the TTL.
+	assert.NoError(t, rStore.Touch(ctx, mockOTP.Namespace, mockOTP.ID, time.Minute))
+	o, _ = rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assert.Equal(t, time.Minute, o.TTL, "TTL wasn't extended")
+
+	assert.NoError(t, rStore.Touch(ctx, mockOTP.Namespace, mockOTP.ID, time.Second))
+	o, _ = rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assert.Equal(t, time.Minute, o.TTL, "TTL was shortened")
+}
+
+func TestStoreTouchLongTTL(t *testing.T) {
+	rStore := setup(t)
+
+	// gopher-lua formats numbers as large as these in the exponent notation
+	// (eg: 3.6e+06), which PEXPIRE rejects, if they're passed to it instead
+	// of the TTL argument itself.
+	for _, ttl := range []time.Duration{time.Hour, time.Hour * 24 * 30} {
+		assert.NoError(t, rStore.Touch(ctx, mockOTP.Namespace, mockOTP.ID, ttl), "error extending TTL to %v", ttl)
+		o, err := rStore.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+		assert.NoError(t, err)
+		assert.Equal(t, ttl, o.TTL, "TTL wasn't extended to %v", ttl)
+	}
+}
+
+func TestStoreAddressLock(t *testing.T) {
+	rStore := setup(t)
+
+	ttl, err := rStore.GetAddressLock(ctx, mockOTP.Namespace, "to@localhost")
+	assert.NoError(t, err)
+	assert.Zero(t, ttl, "Unlocked address has a lock")
+
+	assert.NoError(t, rStore.LockAddress(ctx, mockOTP.Namespace, "to@localhost", time.Minute))
+	ttl, err = rStore.GetAddressLock(ctx, mockOTP.Namespace, "to@localhost")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl, "Lock TTL mismatch")
+
+	// An existing lock isn't extended.
+	assert.NoError(t, rStore.LockAddress(ctx, mockOTP.Namespace, "to@localhost", time.Hour))
+	ttl, _ = rStore.GetAddressLock(ctx, mockOTP.Namespace, "to@localhost")
+	assert.Equal(t, time.Minute, ttl, "Lock was extended")
+
+	// Locks are per namespace.
+	ttl, _ = rStore.GetAddressLock(ctx, "othernamespace", "to@localhost")
+	assert.Zero(t, ttl, "Lock leaked across namespaces")
+
+	assert.NoError(t, rStore.LockAddress(ctx, mockOTP.Namespace, "to@localhost", 0))
+	ttl, _ = rStore.GetAddressLock(ctx, mockOTP.Namespace, "to@localhost")
+	assert.Zero(t, ttl, "Lock wasn't removed")
+}
+
+func TestStoreQueue(t *testing.T) {
+	rStore := setup(t)
+
+	now := time.Now()
+	assert.NoError(t, rStore.Enqueue(ctx, "hook", []byte("a"), now.Add(-time.Second)))
+	assert.NoError(t, rStore.Enqueue(ctx, "hook", []byte("b"), now))
+	assert.NoError(t, rStore.Enqueue(ctx, "hook", []byte("c"), now.Add(time.Minute)))
+
+	// Only due jobs are dequeued, oldest first, and up to the limit.
+	jobs, err := rStore.Dequeue(ctx, "hook", now, time.Minute, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, jobs)
+
+	jobs, err = rStore.Dequeue(ctx, "hook", now, time.Minute, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b")}, jobs)
+
+	// Dequeued jobs are hidden for their lease.
+	jobs, err = rStore.Dequeue(ctx, "hook", now, time.Minute, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	// Acked jobs are removed and the rest are dequeued again after their lease.
+	assert.NoError(t, rStore.Ack(ctx, "hook", []byte("a")))
+	jobs, err = rStore.Dequeue(ctx, "hook", now.Add(time.Minute), time.Minute, 10)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, [][]byte{[]byte("b"), []byte("c")}, jobs)
+}
+
+func TestStoreQuota(t *testing.T) {
+	rStore := setup(t)
+
+	n, err := rStore.GetQuota(ctx, "smtp", "2024-01-01")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "Unused quota isn't 0")
+
+	for i := 1; i <= 2; i++ {
+		n, err = rStore.ConsumeQuota(ctx, "smtp", "2024-01-01", 2, time.Hour)
+		assert.NoError(t, err, "Error consuming quota")
+		assert.Equal(t, i, n, "Quota usage mismatch")
+	}
+
+	_, err = rStore.ConsumeQuota(ctx, "smtp", "2024-01-01", 2, time.Hour)
+	assert.Equal(t, store.ErrQuotaExceeded, err, "Exhausted quota was consumed")
+
+	n, err = rStore.GetQuota(ctx, "smtp", "2024-01-01")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n, "Quota usage mismatch")
+
+	// A new period has a fresh quota.
+	_, err = rStore.ConsumeQuota(ctx, "smtp", "2024-01-02", 2, time.Hour)
+	assert.NoError(t, err, "New period quota wasn't consumable")
+	assert.True(t, rdis.TTL(rStore.makeQuotaKey("smtp", "2024-01-02")) > 0, "Quota key has no expiry")
+}
+
+func TestStoreNonce(t *testing.T) {
+	rStore := setup(t)
+
+	err := rStore.ConsumeNonce(ctx, mockOTP.Namespace, mockOTP.ID, "")
+	assert.Equal(t, store.ErrNotExist, err, "Empty nonce shouldn't be consumable")
+
+	err = rStore.SetNonce(ctx, mockOTP.Namespace, mockOTP.ID, "mynonce")
+	assert.NoError(t, err, "Error setting nonce")
+
+	err = rStore.ConsumeNonce(ctx, mockOTP.Namespace, mockOTP.ID, "badnonce")
+	assert.Equal(t, store.ErrNotExist, err, "Bad nonce shouldn't be consumable")
+
+	err = rStore.ConsumeNonce(ctx, mockOTP.Namespace, mockOTP.ID, "mynonce")
+	assert.NoError(t, err, "Error consuming nonce")
+
+	err = rStore.ConsumeNonce(ctx, mockOTP.Namespace, mockOTP.ID, "mynonce")
+	assert.Equal(t, store.ErrNotExist, err, "Nonce was consumed twice")
+}
+
+func TestStoreStats(t *testing.T) {
+	rStore := setup(t)
+	ns := "statsns"
+
+	s, err := rStore.GetStats(ctx, ns, "2024-01-01")
+	assert.NoError(t, err)
+	assert.Equal(t, store.Stats{}, s, "Empty stats aren't zero")
+
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := rStore.Set(ctx, ns, id, mockOTP)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, rStore.Close(ctx, ns, "a"))
+	assert.NoError(t, rStore.Delete(ctx, ns, "b"))
+
+	assert.NoError(t, rStore.IncrStat(ctx, ns, store.StatVerified, "2024-01-01"))
+	assert.NoError(t, rStore.IncrStat(ctx, ns, store.StatFailed, "2024-01-01"))
+	assert.NoError(t, rStore.IncrStat(ctx, ns, store.StatFailed, "2024-01-01"))
+	assert.NoError(t, rStore.IncrStat(ctx, ns, store.StatLocked, "2024-01-01"))
+	assert.NoError(t, rStore.IncrStat(ctx, ns, store.StatVerified, "2024-01-02"))
+
+	s, err = rStore.GetStats(ctx, ns, "2024-01-01")
+	assert.NoError(t, err)
+	assert.Equal(t, store.Stats{Active: 1, Verified: 1, Failed: 2, Locked: 1}, s)
+	assert.True(t, rdis.TTL(rStore.makeStatsKey(ns, "2024-01-01")) > 0, "Stats key has no expiry")
+
+	n, err := rStore.CountActive(ctx, ns)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Other namespaces are unaffected.
+	s, err = rStore.GetStats(ctx, "other", "2024-01-01")
+	assert.NoError(t, err)
+	assert.Equal(t, store.Stats{}, s)
+}
+
+func TestWatchEvents(t *testing.T) {
+	// The miniredis version in use doesn't support PubSub, so only the
+	// config is tested here.
+	err := rStore.WatchEvents(ctx, func(store.Event) {})
+	assert.Error(t, err, "watching without publish_key should fail")
+}
+
+func TestStoreExpire(t *testing.T) {
+	rStore := setup(t)
+	key := rStore.makeKey(mockOTP.Namespace, mockOTP.ID)
+
+	// An unverified OTP is expired only once.
+	ns, id, ok, err := rStore.expire(ctx, key)
+	assert.NoError(t, err)
+	assert.True(t, ok, "OTP not expired")
+	assert.Equal(t, mockOTP.Namespace, ns)
+	assert.Equal(t, mockOTP.ID, id)
+
+	_, _, ok, err = rStore.expire(ctx, key)
+	assert.NoError(t, err)
+	assert.False(t, ok, "OTP expired twice")
+
+	// Verified OTPs and other keys aren't OTP expiries.
+	_, err = rStore.Set(ctx, mockOTP.Namespace, "verified", mockOTP)
+	assert.NoError(t, err)
+	_, err = rStore.Verify(ctx, mockOTP.Namespace, "verified", mockOTP.OTP, 0, 0, 0)
+	assert.NoError(t, err)
+
+	for _, k := range []string{
+		rStore.makeKey(mockOTP.Namespace, "verified"),
+		rStore.makeLockKey(mockOTP.Namespace, "addr"),
+		rStore.makeActiveKey(mockOTP.Namespace),
+		"other:" + mockOTP.Namespace + ":" + mockOTP.ID,
+	} {
+		_, _, ok, err = rStore.expire(ctx, k)
+		assert.NoError(t, err)
+		assert.False(t, ok, k)
+	}
+}
+
+func TestStoreExpireAfterPrune(t *testing.T) {
+	setup(t)
+
+	port, _ := strconv.Atoi(rdis.Port())
+	r, err := New(Conf{Host: rdis.Host(), Port: port, ExpiryEvents: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Disconnect() })
+
+	// The expiry of an OTP is notified after other OTPs are set and the
+	// active OTPs are counted, which prune the active set.
+	otp := mockOTP
+	otp.TTL = time.Millisecond * 50
+	_, err = r.Set(ctx, mockOTP.Namespace, "expiring", otp)
+	require.NoError(t, err)
+	time.Sleep(otp.TTL * 2)
+
+	_, err = r.Set(ctx, mockOTP.Namespace, "other", mockOTP)
+	require.NoError(t, err)
+	n, err := r.CountActive(ctx, mockOTP.Namespace)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n, "expired OTP counted as active")
+
+	_, id, ok, err := r.expire(ctx, r.makeKey(mockOTP.Namespace, "expiring"))
+	assert.NoError(t, err)
+	assert.True(t, ok, "pruned OTP not expired")
+	assert.Equal(t, "expiring", id)
+}
+
+func TestStoreVerifyRepeat(t *testing.T) {
+	rStore := setup(t)
+
+	_, err := rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, 0, 0)
+	assert.NoError(t, err)
+
+	// Repeat verifications of the closed OTP within the grace period aren't counted.
+	o, err := rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, time.Hour, time.Minute)
+	assert.Equal(t, store.ErrAlreadyVerified, err)
+	assert.True(t, o.Closed)
+	assert.Equal(t, 1, o.VerifyAttempts, "repeat verification counted")
+
+	_, err = rStore.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, 0, 0)
+	assert.Equal(t, store.ErrMismatch, err)
+}
+
+func TestStoreSetExpiry(t *testing.T) {
+	rStore := setup(t)
+	key := rStore.makeKey(mockOTP.Namespace, mockOTP.ID)
+
+	assert.NoError(t, rStore.Expire(ctx, mockOTP.Namespace, mockOTP.ID, time.Second))
+	assert.Equal(t, time.Second, rdis.TTL(key))
+
+	// Expiries aren't extended.
+	assert.NoError(t, rStore.Expire(ctx, mockOTP.Namespace, mockOTP.ID, time.Hour))
+	assert.Equal(t, time.Second, rdis.TTL(key))
+
+	assert.Equal(t, store.ErrNotExist, rStore.Expire(ctx, mockOTP.Namespace, "unknown", time.Second))
+}
+
+func TestStoreRef(t *testing.T) {
+	rStore := setup(t)
+	ns := mockOTP.Namespace
+
+	_, err := rStore.GetRef(ctx, ns, "ABC-123")
+	assert.Equal(t, store.ErrNotExist, err)
+
+	assert.NoError(t, rStore.SetRef(ctx, ns, "ABC-123", mockOTP.ID, time.Minute))
+	id, err := rStore.GetRef(ctx, ns, "ABC-123")
+	assert.NoError(t, err)
+	assert.Equal(t, mockOTP.ID, id)
+
+	// The same ID extends the mapping. Another ID can't take it.
+	assert.NoError(t, rStore.SetRef(ctx, ns, "ABC-123", mockOTP.ID, time.Hour))
+	assert.Equal(t, time.Hour, rdis.TTL(rStore.makeRefKey(ns, "ABC-123")))
+	assert.Equal(t, store.ErrRefExists, rStore.SetRef(ctx, ns, "ABC-123", "another", time.Minute))
+
+	// Codes are per namespace.
+	assert.NoError(t, rStore.SetRef(ctx, "another", "ABC-123", "another", time.Minute))
+}
+
+func TestStoreRefTTL(t *testing.T) {
+	rStore := setup(t)
+	ns := mockOTP.Namespace
+
+	o := mockOTP
+	o.Ref = "ABC-123"
+	_, err := rStore.Set(ctx, ns, o.ID, o)
+	require.NoError(t, err)
+	require.NoError(t, rStore.SetRef(ctx, ns, o.Ref, o.ID, o.TTL))
+	refKey := rStore.makeRefKey(ns, o.Ref)
+
+	// The code's expiry follows the OTP's when it's extended or shortened.
+	require.NoError(t, rStore.Touch(ctx, ns, o.ID, time.Hour))
+	assert.Equal(t, time.Hour, rdis.TTL(refKey), "code not extended with the OTP")
+
+	require.NoError(t, rStore.Expire(ctx, ns, o.ID, time.Minute))
+	assert.Equal(t, time.Minute, rdis.TTL(refKey), "code not shortened with the OTP")
+}
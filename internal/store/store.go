@@ -1,7 +1,10 @@
 package store
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/knadh/otpgateway/v3/pkg/models"
 )
@@ -10,32 +13,207 @@ import (
 // does not exist.
 var ErrNotExist = errors.New("the OTP does not exist")
 
+var (
+	// ErrMismatch is thrown by Verify() when the given OTP doesn't match
+	// the stored OTP.
+	ErrMismatch = errors.New("the OTP does not match")
+
+	// ErrLocked is thrown by Verify() when the OTP's attempts have been exceeded.
+	ErrLocked = errors.New("the OTP is locked")
+
+	// ErrThrottled is thrown by Verify() when a verification is attempted
+	// before the minimum interval since the last attempt has elapsed.
+	ErrThrottled = errors.New("the OTP verification is throttled")
+
+	// ErrAlreadyVerified is thrown by Verify() (along with the OTP) when an
+	// already verified (closed) OTP is verified again with the correct OTP
+	// within the grace period. The attempt is not counted.
+	ErrAlreadyVerified = errors.New("the OTP is already verified")
+
+	// ErrRefExists is thrown by SetRef() when the reference code is
+	// mapped to another OTP.
+	ErrRefExists = errors.New("the reference code is in use")
+
+	// ErrSendClaimed is thrown by ClaimSend() when an identical send of the
+	// OTP has already been claimed.
+	ErrSendClaimed = errors.New("the OTP send is already claimed")
+
+	// ErrQuotaExceeded is thrown by ConsumeQuota() when a quota is exhausted.
+	ErrQuotaExceeded = errors.New("the quota is exceeded")
+
+	// ErrUnavailable is thrown when the store is known to be unreachable
+	// and the operation was not attempted.
+	ErrUnavailable = errors.New("the store is unavailable")
+)
+
 const (
-	CounterAttempts = "attempts"
-	CounterGenerate = "generate"
+	CounterAttempts = "verify_attempts"
+	CounterGenerate = "deliveries"
 	CounterNil      = ""
 )
 
-// Store represents a storage backend where OTP data is stored.
+// Daily stats of a namespace that are incremented with IncrStat().
+const (
+	StatVerified = "verified"
+	StatFailed   = "failed"
+	StatLocked   = "locked"
+)
+
+// Event is an OTP lifecycle event (eg: check, close) that's published by
+// stores (eg: Redis PubSub) and posted to namespaces' events webhooks.
+type Event struct {
+	Type      string          `json:"type"`
+	Namespace string          `json:"namespace"`
+	ID        string          `json:"id"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Stats contains the aggregate stats of a namespace.
+type Stats struct {
+	// Number of OTPs that are neither expired nor closed.
+	Active int `json:"active"`
+
+	// Daily counters.
+	Verified int `redis:"verified" json:"verified"`
+	Failed   int `redis:"failed" json:"failed"`
+	Locked   int `redis:"locked" json:"locked"`
+}
+
+// Store represents a storage backend where OTP data is stored. All methods
+// accept a context that carries the deadline and cancellation of the request.
 type Store interface {
-	// Set sets an OTP against an ID. Every Set() increments the attempts
+	// Set sets an OTP against an ID. Every Set() increments the deliveries
 	// count against the ID that was initially set.
-	Set(namespace, id string, otp models.OTP) (models.OTP, error)
+	Set(ctx context.Context, namespace, id string, otp models.OTP) (models.OTP, error)
+
+	// SetBatch sets multiple OTPs (against their IDs) in one go, like Set().
+	// It returns the OTPs in the same order.
+	SetBatch(ctx context.Context, namespace string, otps []models.OTP) ([]models.OTP, error)
 
 	// SetAddress sets (updates) the address on an existing OTP.
-	SetAddress(namespace, id, address string) error
+	SetAddress(ctx context.Context, namespace, id, address string) error
 
 	// Check checks the attempt count and TTL duration against an ID.
 	// Passing counter=true increments the attempt counter.
-	Check(namespace, id string, counterKey string) (models.OTP, error)
+	Check(ctx context.Context, namespace, id string, counterKey string) (models.OTP, error)
+
+	// Peek returns an OTP without incrementing any counters, like Check()
+	// without a counter, but it may be read from a replica that lags behind
+	// recent changes. It's only for reads that can tolerate that, such as
+	// status polls, and not for checks that gate changes to the OTP.
+	Peek(ctx context.Context, namespace, id string) (models.OTP, error)
+
+	// Verify atomically increments the attempts counter, compares the given
+	// otp against the stored OTP and closes it if it matches. It returns
+	// ErrMismatch or ErrLocked (along with the OTP) if verification fails,
+	// and ErrAlreadyVerified if a closed OTP is verified again within grace
+	// (if set) of its verification. Otherwise, the attempt is counted.
+	// If minInterval is set and the previous attempt was made within it,
+	// ErrThrottled is returned without counting the attempt, along with the
+	// OTP with its RetryAfter set to the time left until the next attempt.
+	// If lastSet is set, the OTP only matches if it's still the one that was
+	// set at lastSet (models.OTP.LastSet), ie, it hasn't been replaced since
+	// it was read for checks made before verifying it.
+	Verify(ctx context.Context, namespace, id, otp string, lastSet int64, minInterval, grace time.Duration) (models.OTP, error)
 
-	// Close closes an OTP and marks it as done (verified).
-	// After this, the OTP has to expire after a TTL or be deleted.
-	Close(namespace, id string) error
+	// SetNonce sets a one-time nonce on an existing OTP that's embedded
+	// in verification URLs. It returns ErrNotExist if the OTP doesn't exist.
+	SetNonce(ctx context.Context, namespace, id, nonce string) error
+
+	// ConsumeNonce atomically checks and clears the nonce on an OTP. It returns
+	// ErrNotExist if the nonce doesn't match or has already been consumed.
+	ConsumeNonce(ctx context.Context, namespace, id, nonce string) error
+
+	// SetDelivered marks an existing OTP as delivered, for instance, on
+	// a delivery callback from the provider. It returns ErrNotExist if the
+	// OTP doesn't exist. Set() resets the flag.
+	SetDelivered(ctx context.Context, namespace, id string) error
+
+	// SetSent records the current time as the time of the last successful
+	// push of an existing OTP. It returns ErrNotExist if the OTP doesn't
+	// exist. Set() resets it.
+	SetSent(ctx context.Context, namespace, id string) error
+
+	// ClaimSend atomically claims the send of an OTP for ttl so that only
+	// one of concurrent identical sends (eg: double clicks) is pushed. key
+	// identifies the send (eg: a hash of its provider, address, and OTP).
+	// It returns ErrSendClaimed if a claim with the same key is held. A
+	// claim with a different key is replaced. The OTP needn't exist.
+	ClaimSend(ctx context.Context, namespace, id, key string, ttl time.Duration) error
+
+	// ReleaseSend removes a send claim if it's held with the given key, ie,
+	// once the OTP has been pushed or has failed to be.
+	ReleaseSend(ctx context.Context, namespace, id, key string) error
+
+	// Touch records the current time as the last access time of an
+	// existing OTP without incrementing any counters. If extend is set,
+	// the OTP's expiry is extended to at least extend from now (sliding
+	// expiration) along with its reference code's. It returns ErrNotExist
+	// if the OTP doesn't exist.
+	Touch(ctx context.Context, namespace, id string, extend time.Duration) error
+
+	// ResetAttempts resets the verification attempts and deliveries counters
+	// (and any throttle) on an existing OTP without deleting it, unlocking
+	// an OTP that exhausted either of them.
+	ResetAttempts(ctx context.Context, namespace, id string) error
+
+	// Close closes an OTP and marks it as done (verified), recording the
+	// time of verification. After this, the OTP has to expire after a TTL or be deleted.
+	Close(ctx context.Context, namespace, id string) error
+
+	// Expire sets an existing OTP and its reference code to expire after ttl
+	// if they'd otherwise expire later. It returns ErrNotExist if the OTP
+	// doesn't exist.
+	Expire(ctx context.Context, namespace, id string, ttl time.Duration) error
+
+	// SetRef maps a human-friendly reference code to an OTP's ID in a
+	// namespace for ttl. Mapping a code to the same ID again extends it.
+	// It returns ErrRefExists if the code is mapped to another ID.
+	SetRef(ctx context.Context, namespace, ref, id string, ttl time.Duration) error
+
+	// GetRef returns the ID of the OTP a reference code is mapped to.
+	// It returns ErrNotExist if the code isn't mapped.
+	GetRef(ctx context.Context, namespace, ref string) (string, error)
+
+	// DeleteRef removes a reference code if it's mapped to the given ID.
+	DeleteRef(ctx context.Context, namespace, ref, id string) error
 
 	// Delete deletes the OTP saved against a given ID.
-	Delete(namespace, id string) error
+	Delete(ctx context.Context, namespace, id string) error
+
+	// LockAddress locks an address (eg: after too many failed verification
+	// attempts) in a namespace for ttl. An existing lock isn't extended.
+	// A ttl of 0 removes the lock.
+	LockAddress(ctx context.Context, namespace, address string, ttl time.Duration) error
+
+	// GetAddressLock returns the remaining duration of the lock on an
+	// address, or 0 if it's not locked.
+	GetAddressLock(ctx context.Context, namespace, address string) (time.Duration, error)
+
+	// ConsumeQuota atomically increments the usage counter of a quota (eg: a
+	// provider) for a period if it's below limit, and returns the new usage.
+	// ErrQuotaExceeded is returned if the limit has been reached. The counter
+	// expires after ttl.
+	ConsumeQuota(ctx context.Context, key, period string, limit int, ttl time.Duration) (int, error)
+
+	// RefundQuota decrements the usage counter of a quota for a period, for
+	// instance, to give back a consumed quota when the message wasn't sent.
+	// The counter never goes below 0.
+	RefundQuota(ctx context.Context, key, period string) error
+
+	// GetQuota returns the usage counter of a quota for a period.
+	GetQuota(ctx context.Context, key, period string) (int, error)
+
+	// IncrStat increments a namespace's counter of a stat (Stat*) for a day.
+	IncrStat(ctx context.Context, namespace, stat, day string) error
+
+	// GetStats returns the number of active OTPs in a namespace and its
+	// stat counters for a day.
+	GetStats(ctx context.Context, namespace, day string) (Stats, error)
+
+	// CountActive returns the number of active (unexpired) OTPs in a namespace.
+	CountActive(ctx context.Context, namespace string) (int, error)
 
 	// Ping checks if store is reachable
-	Ping() error
+	Ping(ctx context.Context) error
 }
@@ -0,0 +1,601 @@
+// Package storetest is a test suite of the store.Store contract that can be
+// run against any implementation so that all the backends behave the same.
+// A backend's tests only have to call Run with a function that returns an
+// empty instance of the store.
+package storetest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/otpgateway/v3/internal/store"
+	"github.com/knadh/otpgateway/v3/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ttlSlack is the tolerance in TTL comparisons for backends whose TTLs
+// count down in real time.
+const ttlSlack = time.Second * 2
+
+var (
+	ctx = context.Background()
+
+	mockOTP = models.OTP{
+		Namespace:   "mynamespace",
+		ID:          "myotpid",
+		To:          "to@localhost",
+		OTP:         "myotp",
+		MaxAttempts: 3,
+		MaxGenerate: 3,
+		ChannelDesc: "channeldesc",
+		AddressDesc: "addressdesc",
+		Provider:    "smtp",
+		Extra:       []byte(`{"some": "json", "extra": true}`),
+		TTL:         time.Minute,
+		TTLSeconds:  60,
+	}
+)
+
+// Run runs the store.Store contract tests as subtests of t. newStore is
+// called for every test and should return an empty store. Any cleanup can
+// be registered with t.Cleanup().
+func Run(t *testing.T, newStore func(t *testing.T) store.Store) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, store.Store)
+	}{
+		{"Set", testSet},
+		{"SetBatch", testSetBatch},
+		{"SetAddress", testSetAddress},
+		{"Check", testCheck},
+		{"Peek", testPeek},
+		{"TTL", testTTL},
+		{"NotExist", testNotExist},
+		{"Verify", testVerify},
+		{"VerifyLastSet", testVerifyLastSet},
+		{"VerifyLocked", testVerifyLocked},
+		{"VerifyConcurrent", testVerifyConcurrent},
+		{"VerifyThrottle", testVerifyThrottle},
+		{"VerifyRepeat", testVerifyRepeat},
+		{"Close", testClose},
+		{"Delete", testDelete},
+		{"Expire", testExpire},
+		{"ResetAttempts", testResetAttempts},
+		{"SetDelivered", testSetDelivered},
+		{"SetSent", testSetSent},
+		{"SendClaim", testSendClaim},
+		{"Touch", testTouch},
+		{"Nonce", testNonce},
+		{"Ref", testRef},
+		{"AddressLock", testAddressLock},
+		{"Quota", testQuota},
+		{"Stats", testStats},
+		{"Ping", testPing},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newStore(t)
+			_, err := s.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
+			require.NoError(t, err, "Failed to set up test OTP")
+
+			tc.fn(t, s)
+		})
+	}
+}
+
+// assertTTL asserts that a TTL is exp, give or take the time it's been
+// counting down.
+func assertTTL(t *testing.T, exp, ttl time.Duration, msg string) {
+	t.Helper()
+	assert.LessOrEqual(t, ttl, exp, msg)
+	assert.Greater(t, ttl, exp-ttlSlack, msg)
+}
+
+func testSet(t *testing.T, s store.Store) {
+	// Setting an existing ID again counts as a delivery.
+	o, err := s.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
+	require.NoError(t, err, "Error setting OTP")
+	assert.Equal(t, 2, o.Deliveries, "Deliveries not incremented")
+	assert.Equal(t, 0, o.VerifyAttempts, "Unexpected attempt count")
+	assert.NotZero(t, o.LastSet, "Last set time not recorded")
+
+	o, err = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.Equal(t, mockOTP.Namespace, o.Namespace)
+	assert.Equal(t, mockOTP.ID, o.ID)
+	assert.Equal(t, mockOTP.To, o.To)
+	assert.Equal(t, mockOTP.OTP, o.OTP)
+	assert.Equal(t, mockOTP.Provider, o.Provider)
+	assert.Equal(t, mockOTP.MaxAttempts, o.MaxAttempts)
+	assert.Equal(t, mockOTP.ChannelDesc, o.ChannelDesc)
+	assert.Equal(t, mockOTP.AddressDesc, o.AddressDesc)
+	assert.JSONEq(t, string(mockOTP.Extra), string(o.Extra))
+	assert.False(t, o.Closed)
+
+	// A new ID starts over.
+	o, err = s.Set(ctx, mockOTP.Namespace, "newid", mockOTP)
+	require.NoError(t, err)
+	assert.Equal(t, 1, o.Deliveries)
+}
+
+func testSetBatch(t *testing.T, s store.Store) {
+	o1, o2 := mockOTP, mockOTP
+	o2.ID = "myotpid2"
+	o2.OTP = "myotp2"
+
+	out, err := s.SetBatch(ctx, mockOTP.Namespace, []models.OTP{o1, o2})
+	require.NoError(t, err, "Error setting OTP batch")
+	require.Len(t, out, 2)
+
+	// The OTPs are in the same order and the existing OTP's counter
+	// is incremented.
+	assert.Equal(t, o1.ID, out[0].ID)
+	assert.Equal(t, 2, out[0].Deliveries, "Deliveries mismatch")
+	assert.Equal(t, o2.ID, out[1].ID)
+	assert.Equal(t, 1, out[1].Deliveries, "Deliveries mismatch")
+
+	o, err := s.Check(ctx, mockOTP.Namespace, o2.ID, store.CounterNil)
+	require.NoError(t, err, "Batch OTP wasn't set")
+	assert.Equal(t, o2.OTP, o.OTP, "OTP mismatch")
+	assertTTL(t, o2.TTL, o.TTL, "TTL mismatch")
+}
+
+func testSetAddress(t *testing.T, s store.Store) {
+	require.NoError(t, s.SetAddress(ctx, mockOTP.Namespace, mockOTP.ID, "new@localhost"))
+
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.Equal(t, "new@localhost", o.To, "Address wasn't updated")
+	assert.Equal(t, mockOTP.OTP, o.OTP, "OTP changed")
+}
+
+func testCheck(t *testing.T, s store.Store) {
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err, "Error checking OTP without increment")
+	assert.Equal(t, 0, o.VerifyAttempts, "Check without a counter incremented attempts")
+	assert.Equal(t, 1, o.Deliveries, "Check without a counter incremented deliveries")
+
+	for i := 1; i <= 2; i++ {
+		o, err = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterAttempts)
+		require.NoError(t, err, "Error checking OTP with increment")
+		assert.Equal(t, i, o.VerifyAttempts, "Unexpected attempt count")
+	}
+
+	for i := 2; i <= 3; i++ {
+		o, err = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterGenerate)
+		require.NoError(t, err, "Error checking OTP with generate increment")
+		assert.Equal(t, i, o.Deliveries, "Unexpected generate count")
+	}
+	assert.Equal(t, 2, o.VerifyAttempts, "Generate increment changed attempts")
+}
+
+func testPeek(t *testing.T, s store.Store) {
+	_, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterAttempts)
+	require.NoError(t, err)
+
+	o, err := s.Peek(ctx, mockOTP.Namespace, mockOTP.ID)
+	require.NoError(t, err, "Error peeking OTP")
+	assert.Equal(t, mockOTP.OTP, o.OTP)
+	assert.Equal(t, 1, o.VerifyAttempts, "Unexpected attempt count")
+
+	o, err = s.Peek(ctx, mockOTP.Namespace, mockOTP.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, o.VerifyAttempts, "Peek incremented attempts")
+	assert.Equal(t, 1, o.Deliveries, "Peek incremented deliveries")
+	assertTTL(t, mockOTP.TTL, o.TTL, "Peek returned the wrong TTL")
+}
+
+func testTTL(t *testing.T, s store.Store) {
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err, "Error checking OTP")
+	assertTTL(t, mockOTP.TTL, o.TTL, "Returned OTP TTL doesn't match expected TTL")
+}
+
+func testNotExist(t *testing.T, s store.Store) {
+	const ns, id = "othernamespace", "unknown"
+
+	for _, c := range []string{store.CounterNil, store.CounterAttempts, store.CounterGenerate} {
+		_, err := s.Check(ctx, mockOTP.Namespace, id, c)
+		assert.Equal(t, store.ErrNotExist, err, "Check of a non-existent OTP (counter %q)", c)
+	}
+
+	_, err := s.Peek(ctx, mockOTP.Namespace, id)
+	assert.Equal(t, store.ErrNotExist, err, "Peek")
+
+	// IDs are per namespace.
+	_, err = s.Check(ctx, ns, mockOTP.ID, store.CounterNil)
+	assert.Equal(t, store.ErrNotExist, err, "OTP leaked across namespaces")
+
+	_, err = s.Verify(ctx, mockOTP.Namespace, id, mockOTP.OTP, 0, 0, 0)
+	assert.Equal(t, store.ErrNotExist, err, "Verify")
+	assert.Equal(t, store.ErrNotExist, s.SetDelivered(ctx, mockOTP.Namespace, id), "SetDelivered")
+	assert.Equal(t, store.ErrNotExist, s.SetSent(ctx, mockOTP.Namespace, id), "SetSent")
+	assert.Equal(t, store.ErrNotExist, s.SetNonce(ctx, mockOTP.Namespace, id, "mynonce"), "SetNonce")
+	assert.Equal(t, store.ErrNotExist, s.Touch(ctx, mockOTP.Namespace, id, 0), "Touch")
+	assert.Equal(t, store.ErrNotExist, s.ResetAttempts(ctx, mockOTP.Namespace, id), "ResetAttempts")
+	assert.Equal(t, store.ErrNotExist, s.Expire(ctx, mockOTP.Namespace, id, time.Second), "Expire")
+
+	// None of them should've created the OTP.
+	_, err = s.Check(ctx, mockOTP.Namespace, id, store.CounterNil)
+	assert.Equal(t, store.ErrNotExist, err, "OTP was created")
+}
+
+func testVerify(t *testing.T, s store.Store) {
+	o, err := s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, 0, 0)
+	assert.Equal(t, store.ErrMismatch, err, "Bad OTP didn't fail verification")
+	assert.Equal(t, 1, o.VerifyAttempts, "Unexpected attempt count")
+	assert.False(t, o.Closed, "OTP shouldn't be closed")
+	assert.Zero(t, o.VerifiedAt, "verified_at shouldn't be set")
+
+	o, err = s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, 0, 0)
+	require.NoError(t, err, "Error verifying OTP")
+	assert.Equal(t, 2, o.VerifyAttempts, "Unexpected attempt count")
+	assert.True(t, o.Closed, "OTP should be closed but isn't")
+	assert.NotZero(t, o.VerifiedAt, "verified_at should be set on verification")
+}
+
+func testVerifyLastSet(t *testing.T, s store.Store) {
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err, "Error checking OTP")
+
+	// An OTP that was replaced after it was read doesn't match.
+	o, err = s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, o.LastSet-1, 0, 0)
+	assert.Equal(t, store.ErrMismatch, err, "Replaced OTP was verified")
+	assert.Equal(t, 1, o.VerifyAttempts, "Unexpected attempt count")
+	assert.False(t, o.Closed, "OTP shouldn't be closed")
+
+	o, err = s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, o.LastSet, 0, 0)
+	require.NoError(t, err, "Error verifying OTP")
+	assert.True(t, o.Closed, "OTP should be closed but isn't")
+}
+
+func testVerifyLocked(t *testing.T, s store.Store) {
+	for i := 0; i < mockOTP.MaxAttempts; i++ {
+		_, err := s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, 0, 0)
+		assert.Equal(t, store.ErrMismatch, err)
+	}
+
+	// Even the correct OTP is rejected once the attempts are exhausted.
+	o, err := s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, 0, 0)
+	assert.Equal(t, store.ErrLocked, err, "Exhausted OTP wasn't locked")
+	assert.Equal(t, mockOTP.MaxAttempts, o.VerifyAttempts, "Locked attempt was counted")
+	assert.False(t, o.Closed, "Locked OTP was closed")
+}
+
+func testVerifyConcurrent(t *testing.T, s store.Store) {
+	const n = 20
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+
+		errs = map[error]int{}
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, 0, 0)
+
+			mu.Lock()
+			errs[err]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// Only MaxAttempts verifications should've been evaluated and the
+	// rest locked without being counted.
+	assert.Equal(t, mockOTP.MaxAttempts, errs[store.ErrMismatch], "Unexpected mismatch count")
+	assert.Equal(t, n-mockOTP.MaxAttempts, errs[store.ErrLocked], "Unexpected locked count")
+
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err, "Error checking OTP")
+	assert.Equal(t, mockOTP.MaxAttempts, o.VerifyAttempts, "Attempts weren't incremented atomically")
+}
+
+func testVerifyThrottle(t *testing.T, s store.Store) {
+	_, err := s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, time.Minute, 0)
+	assert.Equal(t, store.ErrMismatch, err, "First attempt shouldn't be throttled")
+
+	o, err := s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, time.Minute, 0)
+	assert.Equal(t, store.ErrThrottled, err, "Second attempt should be throttled")
+	assert.Equal(t, 1, o.VerifyAttempts, "Throttled attempt shouldn't be counted")
+	assert.False(t, o.Closed, "OTP shouldn't be closed")
+	assert.True(t, o.RetryAfter > 0 && o.RetryAfter <= time.Minute, "Throttled attempt's RetryAfter out of range: %v", o.RetryAfter)
+}
+
+func testVerifyRepeat(t *testing.T, s store.Store) {
+	_, err := s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, 0, 0)
+	require.NoError(t, err)
+
+	// Repeat verifications of the closed OTP within the grace period aren't
+	// counted or throttled.
+	o, err := s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, time.Hour, time.Minute)
+	assert.Equal(t, store.ErrAlreadyVerified, err)
+	assert.True(t, o.Closed)
+	assert.Equal(t, 1, o.VerifyAttempts, "Repeat verification was counted")
+
+	_, err = s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, 0, time.Minute)
+	assert.Equal(t, store.ErrMismatch, err)
+
+	// Without a grace period or after it, they're counted.
+	require.NoError(t, s.ResetAttempts(ctx, mockOTP.Namespace, mockOTP.ID))
+	o, err = s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, o.VerifyAttempts, "Repeat verification without grace wasn't counted")
+
+	time.Sleep(time.Millisecond * 5)
+	o, err = s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, 0, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 2, o.VerifyAttempts, "Repeat verification after grace wasn't counted")
+}
+
+func testClose(t *testing.T, s store.Store) {
+	require.NoError(t, s.Close(ctx, mockOTP.Namespace, mockOTP.ID), "Error closing OTP")
+
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err, "Error checking closed OTP")
+	assert.True(t, o.Closed, "OTP should be closed but isn't")
+	assert.NotZero(t, o.VerifiedAt, "verified_at should be set on close")
+}
+
+func testDelete(t *testing.T, s store.Store) {
+	require.NoError(t, s.Delete(ctx, mockOTP.Namespace, mockOTP.ID), "Error deleting OTP")
+
+	_, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assert.Equal(t, store.ErrNotExist, err, "OTP should not exist but it does")
+
+	// Deleting a non-existent OTP isn't an error.
+	assert.NoError(t, s.Delete(ctx, mockOTP.Namespace, mockOTP.ID))
+}
+
+func testExpire(t *testing.T, s store.Store) {
+	require.NoError(t, s.Expire(ctx, mockOTP.Namespace, mockOTP.ID, time.Second*30))
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assertTTL(t, time.Second*30, o.TTL, "Expiry wasn't shortened")
+
+	// Expiries aren't extended.
+	require.NoError(t, s.Expire(ctx, mockOTP.Namespace, mockOTP.ID, time.Hour))
+	o, err = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assertTTL(t, time.Second*30, o.TTL, "Expiry was extended")
+}
+
+func testResetAttempts(t *testing.T, s store.Store) {
+	_, err := s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, "wrong", 0, time.Hour, 0)
+	assert.Equal(t, store.ErrMismatch, err)
+
+	// Exceed the deliveries so that the OTP is locked.
+	for i := 0; i <= mockOTP.MaxGenerate; i++ {
+		_, err = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterGenerate)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.ResetAttempts(ctx, mockOTP.Namespace, mockOTP.ID), "Error resetting attempts")
+
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, o.VerifyAttempts, "Attempts weren't reset")
+	assert.Equal(t, 0, o.Deliveries, "Deliveries weren't reset")
+	assert.Equal(t, mockOTP.OTP, o.OTP, "OTP changed on reset")
+
+	// The throttle is reset too.
+	_, err = s.Verify(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP.OTP, 0, time.Hour, 0)
+	assert.NoError(t, err, "Throttle wasn't reset")
+}
+
+func testSetDelivered(t *testing.T, s store.Store) {
+	require.NoError(t, s.SetDelivered(ctx, mockOTP.Namespace, mockOTP.ID), "Error marking OTP delivered")
+
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.True(t, o.Delivered, "OTP wasn't marked delivered")
+
+	// Resending resets the flag.
+	_, err = s.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
+	require.NoError(t, err)
+	o, err = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.False(t, o.Delivered, "Delivered flag wasn't reset on Set")
+}
+
+func testSendClaim(t *testing.T, s store.Store) {
+	require.NoError(t, s.ClaimSend(ctx, mockOTP.Namespace, mockOTP.ID, "a", time.Minute), "Error claiming send")
+	assert.Equal(t, store.ErrSendClaimed, s.ClaimSend(ctx, mockOTP.Namespace, mockOTP.ID, "a", time.Minute), "Claimed send claimed again")
+
+	// Claims are per ID.
+	assert.NoError(t, s.ClaimSend(ctx, mockOTP.Namespace, "other", "a", time.Minute), "Claim leaked across IDs")
+
+	// A different send replaces the claim.
+	require.NoError(t, s.ClaimSend(ctx, mockOTP.Namespace, mockOTP.ID, "b", time.Minute), "Error claiming a different send")
+	assert.Equal(t, store.ErrSendClaimed, s.ClaimSend(ctx, mockOTP.Namespace, mockOTP.ID, "b", time.Minute))
+
+	// Claims are only released with their key.
+	require.NoError(t, s.ReleaseSend(ctx, mockOTP.Namespace, mockOTP.ID, "a"))
+	assert.Equal(t, store.ErrSendClaimed, s.ClaimSend(ctx, mockOTP.Namespace, mockOTP.ID, "b", time.Minute), "Claim released with another key")
+	require.NoError(t, s.ReleaseSend(ctx, mockOTP.Namespace, mockOTP.ID, "b"))
+	assert.NoError(t, s.ClaimSend(ctx, mockOTP.Namespace, mockOTP.ID, "b", time.Minute), "Released send couldn't be claimed")
+}
+
+func testSetSent(t *testing.T, s store.Store) {
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.Zero(t, o.LastSent, "new OTP has a send time")
+
+	require.NoError(t, s.SetSent(ctx, mockOTP.Namespace, mockOTP.ID), "Error recording send")
+	o, err = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().UnixMilli(), o.LastSent, float64(ttlSlack.Milliseconds()), "send time wasn't recorded")
+
+	// Setting the OTP again resets it.
+	_, err = s.Set(ctx, mockOTP.Namespace, mockOTP.ID, mockOTP)
+	require.NoError(t, err)
+	o, err = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.Zero(t, o.LastSent, "send time wasn't reset on Set")
+}
+
+func testTouch(t *testing.T, s store.Store) {
+	require.NoError(t, s.Touch(ctx, mockOTP.Namespace, mockOTP.ID, 0), "Error touching OTP")
+
+	o, err := s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	require.NoError(t, err)
+	assert.NotZero(t, o.LastAccessed, "Last access time not recorded")
+	assert.Equal(t, 0, o.VerifyAttempts, "Touch incremented attempts")
+	assertTTL(t, mockOTP.TTL, o.TTL, "Touch changed the TTL")
+
+	// Sliding expiry extends, but never shortens the TTL.
+	require.NoError(t, s.Touch(ctx, mockOTP.Namespace, mockOTP.ID, time.Hour))
+	o, _ = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assertTTL(t, time.Hour, o.TTL, "TTL wasn't extended")
+
+	require.NoError(t, s.Touch(ctx, mockOTP.Namespace, mockOTP.ID, time.Second))
+	o, _ = s.Check(ctx, mockOTP.Namespace, mockOTP.ID, store.CounterNil)
+	assertTTL(t, time.Hour, o.TTL, "TTL was shortened")
+}
+
+func testNonce(t *testing.T, s store.Store) {
+	err := s.ConsumeNonce(ctx, mockOTP.Namespace, mockOTP.ID, "")
+	assert.Equal(t, store.ErrNotExist, err, "Empty nonce shouldn't be consumable")
+
+	require.NoError(t, s.SetNonce(ctx, mockOTP.Namespace, mockOTP.ID, "mynonce"), "Error setting nonce")
+
+	err = s.ConsumeNonce(ctx, mockOTP.Namespace, mockOTP.ID, "badnonce")
+	assert.Equal(t, store.ErrNotExist, err, "Bad nonce shouldn't be consumable")
+
+	assert.NoError(t, s.ConsumeNonce(ctx, mockOTP.Namespace, mockOTP.ID, "mynonce"), "Error consuming nonce")
+
+	err = s.ConsumeNonce(ctx, mockOTP.Namespace, mockOTP.ID, "mynonce")
+	assert.Equal(t, store.ErrNotExist, err, "Nonce was consumed twice")
+}
+
+func testRef(t *testing.T, s store.Store) {
+	ns := mockOTP.Namespace
+
+	_, err := s.GetRef(ctx, ns, "ABC-123")
+	assert.Equal(t, store.ErrNotExist, err)
+
+	require.NoError(t, s.SetRef(ctx, ns, "ABC-123", mockOTP.ID, time.Minute))
+	id, err := s.GetRef(ctx, ns, "ABC-123")
+	require.NoError(t, err)
+	assert.Equal(t, mockOTP.ID, id)
+
+	// The same ID can map it again. Another ID can't take it.
+	assert.NoError(t, s.SetRef(ctx, ns, "ABC-123", mockOTP.ID, time.Hour))
+	assert.Equal(t, store.ErrRefExists, s.SetRef(ctx, ns, "ABC-123", "another", time.Minute))
+
+	// Codes are per namespace.
+	assert.NoError(t, s.SetRef(ctx, "another", "ABC-123", "another", time.Minute))
+
+	// Codes are only deleted by the ID they're mapped to.
+	require.NoError(t, s.DeleteRef(ctx, ns, "ABC-123", "another"))
+	_, err = s.GetRef(ctx, ns, "ABC-123")
+	assert.NoError(t, err, "Code deleted by another ID")
+
+	require.NoError(t, s.DeleteRef(ctx, ns, "ABC-123", mockOTP.ID))
+	_, err = s.GetRef(ctx, ns, "ABC-123")
+	assert.Equal(t, store.ErrNotExist, err, "Code wasn't deleted")
+}
+
+func testAddressLock(t *testing.T, s store.Store) {
+	ttl, err := s.GetAddressLock(ctx, mockOTP.Namespace, "to@localhost")
+	require.NoError(t, err)
+	assert.Zero(t, ttl, "Unlocked address has a lock")
+
+	require.NoError(t, s.LockAddress(ctx, mockOTP.Namespace, "to@localhost", time.Minute))
+	ttl, err = s.GetAddressLock(ctx, mockOTP.Namespace, "to@localhost")
+	require.NoError(t, err)
+	assertTTL(t, time.Minute, ttl, "Lock TTL mismatch")
+
+	// An existing lock isn't extended.
+	require.NoError(t, s.LockAddress(ctx, mockOTP.Namespace, "to@localhost", time.Hour))
+	ttl, _ = s.GetAddressLock(ctx, mockOTP.Namespace, "to@localhost")
+	assertTTL(t, time.Minute, ttl, "Lock was extended")
+
+	// Locks are per namespace.
+	ttl, _ = s.GetAddressLock(ctx, "othernamespace", "to@localhost")
+	assert.Zero(t, ttl, "Lock leaked across namespaces")
+
+	require.NoError(t, s.LockAddress(ctx, mockOTP.Namespace, "to@localhost", 0))
+	ttl, _ = s.GetAddressLock(ctx, mockOTP.Namespace, "to@localhost")
+	assert.Zero(t, ttl, "Lock wasn't removed")
+}
+
+func testQuota(t *testing.T, s store.Store) {
+	n, err := s.GetQuota(ctx, "smtp", "2024-01-01")
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "Unused quota isn't 0")
+
+	for i := 1; i <= 2; i++ {
+		n, err = s.ConsumeQuota(ctx, "smtp", "2024-01-01", 2, time.Hour)
+		require.NoError(t, err, "Error consuming quota")
+		assert.Equal(t, i, n, "Quota usage mismatch")
+	}
+
+	_, err = s.ConsumeQuota(ctx, "smtp", "2024-01-01", 2, time.Hour)
+	assert.Equal(t, store.ErrQuotaExceeded, err, "Exhausted quota was consumed")
+
+	n, err = s.GetQuota(ctx, "smtp", "2024-01-01")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n, "Quota usage mismatch")
+
+	// A refunded quota can be consumed again.
+	require.NoError(t, s.RefundQuota(ctx, "smtp", "2024-01-01"), "Error refunding quota")
+	n, err = s.ConsumeQuota(ctx, "smtp", "2024-01-01", 2, time.Hour)
+	assert.NoError(t, err, "Refunded quota wasn't consumable")
+	assert.Equal(t, 2, n, "Quota usage mismatch")
+
+	// Refunds never take the usage below 0.
+	require.NoError(t, s.RefundQuota(ctx, "smtp", "2023-12-31"), "Error refunding quota")
+	n, err = s.GetQuota(ctx, "smtp", "2023-12-31")
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "Unused quota isn't 0")
+
+	// A new period has a fresh quota.
+	n, err = s.ConsumeQuota(ctx, "smtp", "2024-01-02", 2, time.Hour)
+	assert.NoError(t, err, "New period quota wasn't consumable")
+	assert.Equal(t, 1, n)
+}
+
+func testStats(t *testing.T, s store.Store) {
+	const ns = "statsns"
+
+	st, err := s.GetStats(ctx, ns, "2024-01-01")
+	require.NoError(t, err)
+	assert.Equal(t, store.Stats{}, st, "Empty stats aren't zero")
+
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := s.Set(ctx, ns, id, mockOTP)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close(ctx, ns, "a"))
+	require.NoError(t, s.Delete(ctx, ns, "b"))
+
+	require.NoError(t, s.IncrStat(ctx, ns, store.StatVerified, "2024-01-01"))
+	require.NoError(t, s.IncrStat(ctx, ns, store.StatFailed, "2024-01-01"))
+	require.NoError(t, s.IncrStat(ctx, ns, store.StatFailed, "2024-01-01"))
+	require.NoError(t, s.IncrStat(ctx, ns, store.StatLocked, "2024-01-01"))
+	require.NoError(t, s.IncrStat(ctx, ns, store.StatVerified, "2024-01-02"))
+
+	st, err = s.GetStats(ctx, ns, "2024-01-01")
+	require.NoError(t, err)
+	assert.Equal(t, store.Stats{Active: 1, Verified: 1, Failed: 2, Locked: 1}, st)
+
+	n, err := s.CountActive(ctx, ns)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Other namespaces are unaffected.
+	st, err = s.GetStats(ctx, "other", "2024-01-01")
+	require.NoError(t, err)
+	assert.Equal(t, store.Stats{}, st)
+}
+
+func testPing(t *testing.T, s store.Store) {
+	assert.NoError(t, s.Ping(ctx))
+}
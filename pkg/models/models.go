@@ -1,27 +1,122 @@
 package models
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"time"
 )
 
+// ErrQueued is returned (wrapped) by Push when a message couldn't be sent
+// right away and has been queued to be retried in the background. Nothing
+// has been delivered yet.
+var ErrQueued = errors.New("queued for retry")
+
 // OTP contains the information about an OTP.
 type OTP struct {
-	Namespace   string          `redis:"namespace" json:"namespace"`
-	ID          string          `redis:"id" json:"id"`
-	To          string          `redis:"to" json:"to"`
-	ChannelDesc string          `redis:"channel_description" json:"channel_description"`
-	AddressDesc string          `redis:"address_description" json:"address_description"`
-	Extra       json.RawMessage `redis:"extra" json:"extra"`
-	Provider    string          `redis:"provider" json:"provider"`
-	OTP         string          `redis:"otp" json:"otp"`
-	MaxAttempts int             `redis:"max_attempts" json:"max_attempts"`
-	Attempts    int             `redis:"attempts" json:"attempts"`
-	Generate    int             `redis:"generate" json:"generate"`
-	MaxGenerate int             `redis:"max_generate" json:"max_generate"`
-	Closed      bool            `redis:"closed" json:"closed"`
-	TTL         time.Duration   `redis:"-" json:"-"`
-	TTLSeconds  float64         `redis:"-" json:"ttl"`
+	Namespace      string          `redis:"namespace" json:"namespace"`
+	ID             string          `redis:"id" json:"id"`
+	To             string          `redis:"to" json:"to"`
+	ChannelDesc    string          `redis:"channel_description" json:"channel_description"`
+	AddressDesc    string          `redis:"address_description" json:"address_description"`
+	Extra          json.RawMessage `redis:"extra" json:"extra"`
+	Provider       string          `redis:"provider" json:"provider"`
+	Channel        string          `redis:"channel" json:"channel"` // Optional channel hint for the provider.
+	OTP            string          `redis:"otp" json:"otp"`
+	MaxAttempts    int             `redis:"max_attempts" json:"max_attempts"`
+	VerifyAttempts int             `redis:"verify_attempts" json:"attempts"`
+	Deliveries     int             `redis:"deliveries" json:"generate"` // Sets and resends.
+	MaxGenerate    int             `redis:"max_generate" json:"max_generate"`
+	Closed         bool            `redis:"closed" json:"closed"`
+	Delivered      bool            `redis:"delivered" json:"delivered"` // Confirmed via a delivery callback.
+	CaseInsens     bool            `redis:"case_insensitive" json:"case_insensitive"`
+	Nonce          string          `redis:"nonce" json:"-"`
+	LastSet        int64           `redis:"last_set" json:"-"`                            // Unix timestamp (ms) of the last Set().
+	LastSent       int64           `redis:"last_sent" json:"-"`                           // Unix timestamp (ms) of the last successful push since the last Set().
+	LastAccessed   int64           `redis:"last_accessed" json:"last_accessed,omitempty"` // Unix timestamp (ms) of the last Touch().
+	LastVerify     int64           `redis:"last_verify" json:"-"`                         // Unix timestamp (ms) of the last counted Verify() attempt.
+	VerifiedAt     int64           `redis:"verified_at" json:"verified_at,omitempty"`     // Unix timestamp (ms) of the verification / Close().
+	ViewURL        string          `redis:"view_url" json:"view_url,omitempty"`           // Stored URL of the web view (without the OTP) for re-sharing.
+	Ref            string          `redis:"ref" json:"ref,omitempty"`                     // Human-friendly reference code for support lookups.
+	PhoneCode      string          `redis:"-" json:"-"`                                   // Namespace's default phone code. Overrides the provider's.
+	TTL            time.Duration   `redis:"-" json:"-"`
+	RetryAfter     time.Duration   `redis:"-" json:"-"` // Time left until a throttled Verify() can be retried.
+	TTLSeconds     float64         `redis:"-" json:"ttl"`
+}
+
+// Validator is an optional interface that a Provider can implement to
+// validate its configuration (eg: sender IDs) at startup instead of
+// failing at send time.
+type Validator interface {
+	Validate() error
+}
+
+// AddressNormalizer is an optional interface that a Provider can implement
+// to return the canonical form of an address (eg: a lowercased e-mail or
+// a phone number with its country code) so that different spellings of an
+// address are treated as the same address, for instance, by address
+// lockouts. phoneCode is the default phone code of the OTP's namespace.
+type AddressNormalizer interface {
+	NormalizeAddress(to, phoneCode string) string
+}
+
+// Checker is an optional interface that a Provider can implement to check
+// that its backend is reachable and that its credentials are valid (eg: an
+// SMTP handshake or a cheap authenticated API call) without sending a
+// message.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// BodyLimiter is an optional interface that a Provider can implement when
+// the max length of a message body depends on its content, for instance,
+// SMS bodies with characters outside the GSM-7 alphabet that have to be sent
+// as UCS-2. If it's implemented, it's used instead of MaxBodyLen().
+type BodyLimiter interface {
+	MaxBodyLenFor(body []byte) int
+}
+
+// Closer is an optional interface that a Provider can implement to release
+// its resources (eg: connections and background workers) on shutdown. Close
+// should return once it's done or ctx is done.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// Starter is an optional interface that a Provider can implement to queue
+// failed pushes on q and retry them in the background until it's closed.
+type Starter interface {
+	StartRetries(q RetryQueue)
+}
+
+// RetryQueue is a durable queue of failed pushes to be retried.
+type RetryQueue interface {
+	// Enqueue adds a job to the named queue to be dequeued at or after the given time.
+	Enqueue(ctx context.Context, queue string, job []byte, at time.Time) error
+
+	// Dequeue returns up to limit jobs that are due at or before the given time
+	// and hides them for the lease duration, after which they're dequeued
+	// again unless they've been removed with Ack.
+	Dequeue(ctx context.Context, queue string, until time.Time, lease time.Duration, limit int) ([][]byte, error)
+
+	// Ack removes a dequeued job from the named queue.
+	Ack(ctx context.Context, queue string, job []byte) error
+}
+
+// Message is a compiled message of an OTP to be pushed.
+type Message struct {
+	OTP     OTP
+	Subject string
+	Body    []byte
+}
+
+// BulkPusher is an optional interface that a Provider can implement to
+// push multiple messages in one call (eg: a bulk send API). It's used when
+// OTPs are set in a batch.
+type BulkPusher interface {
+	// BulkPush pushes the messages and returns the error (or nil) of each
+	// message in the same order.
+	BulkPush(ctx context.Context, msgs []Message) []error
 }
 
 // ProviderConfig represents the common configuration types for a Provider.
@@ -70,7 +165,8 @@ type Provider interface {
 	// Push pushes a message. Depending on the the Provider,
 	// implementation, this can either cause the message to
 	// be sent immediately or be queued waiting for a Flush().
-	Push(otp OTP, subject string, body []byte) error
+	// ctx carries the deadline of the request that triggered the push.
+	Push(ctx context.Context, otp OTP, subject string, body []byte) error
 
 	// MaxAddressLen returns the maximum allowed length of the 'to' address.
 	MaxAddressLen() int
@@ -81,4 +177,17 @@ type Provider interface {
 	// MaxBodyLen returns the maximum permitted length of the text
 	// that can be sent by the Provider.
 	MaxBodyLen() int
+
+	// UsesSubject returns whether the Provider sends a subject along with
+	// the message (eg: e-mail). If it doesn't, the subject template isn't
+	// compiled and an empty subject is passed to Push().
+	UsesSubject() bool
+}
+
+// OTPGenerator generates the OTPs that aren't given in requests, for
+// instance, from an HSM or with a specific algorithm. The default generator
+// picks random characters with crypto/rand.
+type OTPGenerator interface {
+	// Generate returns an OTP of length characters from charset.
+	Generate(ctx context.Context, length int, charset string) (string, error)
 }
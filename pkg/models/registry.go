@@ -0,0 +1,80 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// ProviderFactory initializes a Provider from its JSON encoded
+// config block (providers.<id>.*).
+type ProviderFactory func(cfg json.RawMessage) (Provider, error)
+
+// OTPGeneratorFactory initializes an OTPGenerator from its JSON encoded
+// config block (otp_generators.<id>.*).
+type OTPGeneratorFactory func(cfg json.RawMessage) (OTPGenerator, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]ProviderFactory)
+	generators = make(map[string]OTPGeneratorFactory)
+)
+
+// RegisterProvider registers a Provider factory under the given ID. It is
+// meant to be called from the init() of a provider package. On startup,
+// the factory is invoked with the config of providers.<id> if
+// providers.<id>.enabled is set. It panics if the ID is already registered.
+func RegisterProvider(id string, factory ProviderFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic(fmt.Sprintf("provider factory for '%s' is nil", id))
+	}
+	if _, ok := registry[id]; ok {
+		panic(fmt.Sprintf("provider '%s' is already registered", id))
+	}
+	registry[id] = factory
+}
+
+// ProviderFactories returns a copy of the registered Provider factories.
+func ProviderFactories() map[string]ProviderFactory {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	out := make(map[string]ProviderFactory, len(registry))
+	for id, f := range registry {
+		out[id] = f
+	}
+	return out
+}
+
+// RegisterOTPGenerator registers an OTPGenerator factory under the given ID.
+// Like providers, it's meant to be called from the init() of a package. If
+// app.otp_generator is the ID, the factory is invoked with the config of
+// otp_generators.<id> on startup. It panics if the ID is already registered.
+func RegisterOTPGenerator(id string, factory OTPGeneratorFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic(fmt.Sprintf("OTP generator factory for '%s' is nil", id))
+	}
+	if _, ok := generators[id]; ok {
+		panic(fmt.Sprintf("OTP generator '%s' is already registered", id))
+	}
+	generators[id] = factory
+}
+
+// OTPGeneratorFactories returns a copy of the registered OTPGenerator
+// factories.
+func OTPGeneratorFactories() map[string]OTPGeneratorFactory {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	out := make(map[string]OTPGeneratorFactory, len(generators))
+	for id, f := range generators {
+		out[id] = f
+	}
+	return out
+}
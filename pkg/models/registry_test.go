@@ -0,0 +1,30 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterProvider(t *testing.T) {
+	f := func(cfg json.RawMessage) (Provider, error) { return nil, nil }
+
+	RegisterProvider("test_registry", f)
+	_, ok := ProviderFactories()["test_registry"]
+	assert.True(t, ok, "registered provider not found")
+
+	assert.Panics(t, func() { RegisterProvider("test_registry", f) }, "duplicate registration didn't panic")
+	assert.Panics(t, func() { RegisterProvider("test_nil", nil) }, "nil factory didn't panic")
+}
+
+func TestRegisterOTPGenerator(t *testing.T) {
+	f := func(cfg json.RawMessage) (OTPGenerator, error) { return nil, nil }
+
+	RegisterOTPGenerator("test_registry", f)
+	_, ok := OTPGeneratorFactories()["test_registry"]
+	assert.True(t, ok, "registered generator not found")
+
+	assert.Panics(t, func() { RegisterOTPGenerator("test_registry", f) }, "duplicate registration didn't panic")
+	assert.Panics(t, func() { RegisterOTPGenerator("test_nil", nil) }, "nil factory didn't panic")
+}